@@ -8,13 +8,17 @@ import (
 
 type Client interface {
 	Do(query interface{}) (interface{}, error)
-	//Pipeline() Pipeline
+	Pipeline() Pipeline
 }
 
-// Pipeline is a TBD interface for allowing MULTI transactions
+// Pipeline batches many queries and sends them to the server in a single round trip.
+// The queries are not applied atomically - use TX queries for that
 type Pipeline interface {
+	// Send adds a query to the pipeline without sending it
 	Send(query interface{}) error
+	// Abort discards the queries that were not executed yet
 	Abort() error
+	// Execute sends the queries and returns their responses, in the order the queries were added
 	Execute() ([]interface{}, error)
 }
 
@@ -67,9 +67,14 @@ func (c *Client) Do(query interface{}) (interface{}, error) {
 }
 
 func (c *Client) roundtrip(msg transport.Message) (transport.Message, error) {
+	return readReply(c.conn.Do(string(msg.Type), msg.Body))
+}
+
+// readReply converts a raw redis reply to a transport message
+func readReply(reply interface{}, err error) (transport.Message, error) {
 
 	var ret transport.Message
-	vals, err := redigo.Values(c.conn.Do(string(msg.Type), msg.Body))
+	vals, err := redigo.Values(reply, err)
 	if err != nil {
 		return ret, errors.NewError("Error receiving message: %s", err)
 	}
@@ -95,3 +100,81 @@ func (c *Client) roundtrip(msg transport.Message) (transport.Message, error) {
 
 	return ret, nil
 }
+
+// Pipeline creates a new pipeline of queries on the client's connection.
+// The client must not be used for other queries while the pipeline is executing
+func (c *Client) Pipeline() client.Pipeline {
+	return &Pipeline{
+		client: c,
+		msgs:   make([]transport.Message, 0),
+	}
+}
+
+// Pipeline batches queries and sends them to the server in a single round trip, reading all their responses at once.
+// Unlike TX queries, the queries are not atomic - each of them succeeds or fails on its own
+type Pipeline struct {
+	client *Client
+	msgs   []transport.Message
+}
+
+// Send serializes a query and adds it to the pipeline. Nothing is sent to the server until Execute is called
+func (p *Pipeline) Send(query interface{}) error {
+
+	msg, err := p.client.proto.WriteMessage(query)
+	if err != nil {
+		return errors.NewError("Could not send query: %s", err)
+	}
+
+	p.msgs = append(p.msgs, msg)
+	return nil
+}
+
+// Abort discards the queries of the pipeline. Since they were not sent yet, there is nothing to undo
+func (p *Pipeline) Abort() error {
+	p.msgs = p.msgs[:0]
+	return nil
+}
+
+// Execute sends all the queries to the server and returns their responses, in the order the queries were sent.
+//
+// All the responses are read even if some of them are invalid, so the connection can still be used, and the first
+// error is returned. The errors of the queries themselves are in their responses
+func (p *Pipeline) Execute() ([]interface{}, error) {
+
+	defer p.Abort()
+	conn := p.client.conn
+
+	for _, msg := range p.msgs {
+		if err := conn.Send(string(msg.Type), msg.Body); err != nil {
+			return nil, errors.NewError("Could not send query: %s", err)
+		}
+	}
+	if err := conn.Flush(); err != nil {
+		return nil, errors.NewError("Could not send queries: %s", err)
+	}
+
+	ret := make([]interface{}, len(p.msgs))
+	var firstErr error
+	for i := range p.msgs {
+
+		reply, err := conn.Receive()
+		if err != nil && conn.Err() != nil {
+			// the connection is broken, there is nothing more to read
+			return nil, errors.NewError("Error receiving message: %s", err)
+		}
+
+		msg, err := readReply(reply, err)
+		if err == nil {
+			ret[i], err = p.client.proto.ReadMessage(msg)
+		}
+		if err != nil && firstErr == nil {
+			logging.Error("Could not read pipelined response: %s", errors.Sprint(err))
+			firstErr = err
+		}
+	}
+
+	if firstErr != nil {
+		return nil, firstErr
+	}
+	return ret, nil
+}
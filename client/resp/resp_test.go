@@ -56,6 +56,70 @@ func TestClient(t *testing.T) {
 
 }
 
+func TestPipeline(t *testing.T) {
+
+	addr := "localhost:9966"
+	srv := resp.NewServer(mock.MockDriver{}, bson.BsonProtocol{})
+
+	go func() {
+		err := srv.Listen(addr)
+		if err != nil {
+			panic(err)
+		}
+
+	}()
+
+	time.Sleep(250 * time.Millisecond)
+	conn, err := redis.Dial("tcp", addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	cl := NewClient(bson.BsonProtocol{}, conn)
+	p := cl.Pipeline()
+
+	N := 100
+	for i := 0; i < N; i++ {
+		if err := p.Send(query.NewGetQuery("Users").FilterEq("id", fmt.Sprintf("user%d", i))); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := p.Send(query.NewCountQuery("Users").Where("id", query.All)); err != nil {
+		t.Fatal(err)
+	}
+
+	res, err := p.Execute()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(res) != N+1 {
+		t.Fatalf("Expected %d responses, got %d", N+1, len(res))
+	}
+	for i := 0; i < N; i++ {
+		if r, ok := res[i].(query.GetResponse); !ok {
+			t.Errorf("Wrong response for query %d: %v", i, res[i])
+		} else if r.Error != nil {
+			t.Errorf("Error in GET: %s", r.Error)
+		}
+	}
+	if _, ok := res[N].(query.CountResponse); !ok {
+		t.Errorf("Wrong response for COUNT: %v", res[N])
+	}
+
+	// aborted queries are never sent, and the client can still be used
+	p.Send(query.PingQuery{})
+	p.Abort()
+	if res, err = p.Execute(); err != nil || len(res) != 0 {
+		t.Errorf("Expected no responses after abort, got %v, %v", res, err)
+	}
+
+	if r, err := cl.Do(query.PingQuery{}); err != nil {
+		t.Errorf("Error pinging: %s", err)
+	} else if _, ok := r.(query.PingResponse); !ok {
+		t.Errorf("Wrong response :%v", r)
+	}
+}
+
 func TestBenchmark(t *testing.T) {
 	t.SkipNow()
 
@@ -13,14 +13,26 @@ type Driver interface {
 	Put(q query.PutQuery) *query.PutResponse
 	Delete(q query.DelQuery) *query.DelResponse
 
+	// Explain describes how the driver would select the entities matching a query's filters, without selecting them
+	Explain(q query.ExplainQuery) *query.ExplainResponse
+	// Count returns the number of entities matching a query's selection, without loading them
+	Count(q query.CountQuery) *query.CountResponse
+	// Transaction applies the PUT, UPDATE and DEL statements of a TX query atomically - either all of them or none
+	Transaction(q query.TxQuery) *query.TxResponse
+
+	// Duplicates returns the groups of entities of a table with the same values of the given columns, that would
+	// violate a unique index on them
+	Duplicates(table string, columns ...string) ([]Duplicate, error)
+
+	// Migrate brings the stored entities of a table in line with its columns, converting their values to the
+	// columns' types and moving the values of renamed columns. A dry run only reports what would be migrated
+	Migrate(table string, dryRun bool) (*MigrationReport, error)
+
 	Dump(table string) (<-chan schema.Entity, <-chan error, chan<- bool, error)
 
 	// Status asks the driver if it is up and running
 	Status() error
 	Stats() (*Stats, error)
-	//Transaction() Error
-	//Commit() Error
-	//Abort()
 }
 
 type Counter int
@@ -34,10 +46,41 @@ func (c ByteCounter) MarshalYAML() (interface{}, error) {
 	return humanize.Bytes(uint64(c)), nil
 }
 
+// IndexStats describes the size and value distribution of a single index, as sampled by the driver
+type IndexStats struct {
+	Type    string  `yaml:"type"`
+	Entries Counter `yaml:"entries"`
+	// The state of a secondary index, and the progress of its backfill while it is pending
+	State    string `yaml:"state,omitempty"`
+	Backfill string `yaml:"backfill,omitempty"`
+	// The estimated number of distinct values of each prefix of the index's properties
+	Distinct []Counter `yaml:"distinct,omitempty"`
+}
+
 type TableStats struct {
-	NumRows           Counter     `yaml:"num_rows"`
-	EstimatedDataSize ByteCounter `yaml:"data_size"`
-	EstimatedKeysSize ByteCounter `yaml:"keys_size"`
+	NumRows           Counter                `yaml:"num_rows"`
+	EstimatedDataSize ByteCounter            `yaml:"data_size"`
+	EstimatedKeysSize ByteCounter            `yaml:"keys_size"`
+	Indexes           map[string]*IndexStats `yaml:"indexes"`
+	// The progress of the table's running or last data migration
+	Migration string `yaml:"migration,omitempty"`
+}
+
+// Duplicate is a group of entities that have the same values of an index's columns
+type Duplicate struct {
+	Values schema.PropertyMap `yaml:"values"`
+	Ids    []schema.Key       `yaml:"ids"`
+}
+
+// MigrationReport describes the migration of a table's entities to its columns
+type MigrationReport struct {
+	Table    string  `yaml:"table"`
+	DryRun   bool    `yaml:"dry_run"`
+	Scanned  Counter `yaml:"scanned"`
+	Migrated Counter `yaml:"migrated"`
+	// Entities with values that could not be converted to their column's type, which are left as they are
+	Failed Counter  `yaml:"failed"`
+	Errors []string `yaml:"errors,omitempty"`
 }
 
 type Stats struct {
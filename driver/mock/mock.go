@@ -43,6 +43,26 @@ func (MockDriver) Update(q query.UpdateQuery) *query.UpdateResponse {
 	return query.NewUpdateResponse(nil, 0)
 }
 
+func (MockDriver) Explain(q query.ExplainQuery) *query.ExplainResponse {
+	return query.NewExplainResponse(nil)
+}
+
+func (MockDriver) Count(q query.CountQuery) *query.CountResponse {
+	return query.NewCountResponse(nil, 0)
+}
+
+func (MockDriver) Transaction(q query.TxQuery) *query.TxResponse {
+	return query.NewTxResponse(nil)
+}
+
+func (MockDriver) Duplicates(table string, columns ...string) ([]driver.Duplicate, error) {
+	return nil, nil
+}
+
+func (MockDriver) Migrate(table string, dryRun bool) (*driver.MigrationReport, error) {
+	return &driver.MigrationReport{Table: table, DryRun: dryRun}, nil
+}
+
 func (MockDriver) Status() error {
 	return nil
 }
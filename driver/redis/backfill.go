@@ -0,0 +1,409 @@
+package redis
+
+import (
+	"fmt"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/dvirsky/go-pylog/logging"
+	"github.com/garyburd/redigo/redis"
+	"github.com/EverythingMe/meduza/query"
+	"github.com/EverythingMe/meduza/schema"
+)
+
+// New secondary indexes are created in the pending state. Writes update them right away, but the planner does not
+// use them until the master has backfilled them - indexed all the entities that existed before the index was created,
+// by scanning the table's primary index in chunks. The progress of every backfill is persisted in redis, so it resumes
+// where it stopped if the master restarts, and all the servers see when the index becomes ready.
+//
+// Indexes that exist in redis from before backfills were tracked, and indexes of empty tables, are ready right away.
+//
+// Writes are not checked against unique indexes while they are pending, so when their backfill is done it scans them for
+// entities with the same values. If there are any, the index is marked failed instead of ready, and is not used until
+// the duplicates are resolved and the index is checked again, when the schema is reloaded
+
+// how often we check for pending indexes to backfill, and whether they have become ready
+const backfillCheckFrequency = time.Second
+
+// backfillProgress is the state of an index, and the progress of its backfill while it is pending
+type backfillProgress struct {
+	state schema.IndexState
+	// the last primary index entry backfilled
+	cursor  string
+	scanned int
+	total   int
+	// the number of groups of entities with the same values found in a failed unique index
+	duplicates int
+}
+
+// String returns a description of the progress for the driver stats
+func (p backfillProgress) String() string {
+	if p.state == schema.IndexFailed {
+		return fmt.Sprintf("%d duplicates", p.duplicates)
+	}
+	if p.total == 0 {
+		return fmt.Sprintf("%d", p.scanned)
+	}
+	return fmt.Sprintf("%d/%d (%d%%)", p.scanned, p.total, p.scanned*100/p.total)
+}
+
+// backfillKey returns the key of the hash the backfill progress of an index is persisted in, by the index's key
+func backfillKey(key string) string {
+	return fmt.Sprintf("__mdz_backfill__:%s", key)
+}
+
+// loadProgress reads the persisted progress of an index. It returns a zero state if none was persisted
+func loadProgress(conn redis.Conn, idx index) (backfillProgress, error) {
+
+	vals, err := redis.StringMap(conn.Do("HGETALL", backfillKey(idx.RedisKey())))
+	if err != nil {
+		return backfillProgress{}, redisError(err)
+	}
+
+	state, _ := strconv.Atoi(vals["state"])
+	scanned, _ := strconv.Atoi(vals["scanned"])
+	total, _ := strconv.Atoi(vals["total"])
+	duplicates, _ := strconv.Atoi(vals["duplicates"])
+
+	return backfillProgress{
+		state:      schema.IndexState(state),
+		cursor:     vals["cursor"],
+		scanned:    scanned,
+		total:      total,
+		duplicates: duplicates,
+	}, nil
+}
+
+// saveProgress persists the progress of an index
+func saveProgress(conn redis.Conn, idx index, p backfillProgress) error {
+
+	if _, err := conn.Do("HMSET", backfillKey(idx.RedisKey()), "state", int(p.state), "cursor", p.cursor,
+		"scanned", p.scanned, "total", p.total, "duplicates", p.duplicates); err != nil {
+		return redisError(err)
+	}
+	return nil
+}
+
+// indexStates holds the states and backfill progress of a table's secondary indexes, by index key.
+// Indexes missing from it are ready
+type indexStates struct {
+	lock     sync.RWMutex
+	progress map[string]backfillProgress
+}
+
+func newIndexStates() *indexStates {
+	return &indexStates{
+		progress: make(map[string]backfillProgress),
+	}
+}
+
+func (s *indexStates) get(idx index) backfillProgress {
+	s.lock.RLock()
+	defer s.lock.RUnlock()
+	return s.progress[idx.RedisKey()]
+}
+
+func (s *indexStates) set(idx index, p backfillProgress) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	s.progress[idx.RedisKey()] = p
+}
+
+// pending tells whether the index is still being backfilled
+func (s *indexStates) pending(idx index) bool {
+	return s.get(idx).state == schema.IndexPending
+}
+
+// ready tells whether the index is complete and may be used, that is neither pending nor failed
+func (s *indexStates) ready(idx index) bool {
+	state := s.get(idx).state
+	return state != schema.IndexPending && state != schema.IndexFailed
+}
+
+// loadIndexStates reads the states of the table's secondary indexes. Indexes without a persisted state are new,
+// unless they already have entries, and are marked pending if the table has entities to backfill them with
+func (t *table) loadIndexStates() error {
+
+	conn := pool.Get()
+	defer conn.Close()
+
+	size, err := redis.Int(conn.Do("ZCARD", t.primary.RedisKey()))
+	if err != nil {
+		return redisError(err)
+	}
+
+	for _, idx := range t.indexes {
+		p, err := loadProgress(conn, idx)
+		if err != nil {
+			return err
+		}
+
+		// the index was dropped and added back before its garbage was collected, so we build it again
+		if p.state == schema.IndexGarbage {
+			logging.Info("Index %s of table %s was added back, rebuilding it", idx, t)
+			if _, err := conn.Do("ZREM", garbageKey, indexGarbage(idx.RedisKey())); err != nil {
+				return redisError(err)
+			}
+
+			p = backfillProgress{state: schema.IndexPending}
+			if err := saveProgress(conn, idx, p); err != nil {
+				return err
+			}
+		}
+
+		// the duplicates of a failed unique index may have been resolved since it was checked, so we check it again
+		if p.state == schema.IndexFailed {
+			logging.Info("Unique index %s of table %s has failed, checking it for duplicates again", idx, t)
+			p.state = schema.IndexPending
+			if err := saveProgress(conn, idx, p); err != nil {
+				return err
+			}
+		}
+
+		if p.state == 0 {
+			exists, err := redis.Bool(conn.Do("EXISTS", idx.RedisKey()))
+			if err != nil {
+				return redisError(err)
+			}
+
+			p.state = schema.IndexReady
+			if !exists && size > 0 {
+				logging.Info("Index %s of table %s is new, marking it pending", idx, t)
+				p.state = schema.IndexPending
+			}
+
+			if err := saveProgress(conn, idx, p); err != nil {
+				return err
+			}
+		}
+
+		t.states.set(idx, p)
+	}
+
+	return nil
+}
+
+// readyIndexes returns the secondary indexes of the table the planner may use, that is all but the pending and
+// failed ones
+func (t table) readyIndexes() []index {
+
+	ret := make([]index, 0, len(t.indexes))
+	for _, idx := range t.indexes {
+		if t.states.ready(idx) {
+			ret = append(ret, idx)
+		}
+	}
+	return ret
+}
+
+// indexEntities loads entities and writes their entries in a single index, without touching the table's other
+// indexes. The entities are watched from before they are loaded, so if any of them is written before its entry,
+// nothing is written and errWatchConflict is returned
+func (t *table) indexEntities(idx index, ids []schema.Key) error {
+
+	tx := NewTransaction(pool.Get())
+	defer tx.Abort()
+
+	keys := make([]interface{}, len(ids))
+	for i, id := range ids {
+		keys[i] = t.idKey(id)
+	}
+	if _, err := tx.conn.Do("WATCH", keys...); err != nil {
+		return redisError(err)
+	}
+
+	// entities deleted since they were scanned will just not be loaded
+	entities, err := t.load(ids)
+	if err != nil {
+		return err
+	}
+
+	diffs := make([]*entityDiff, 0, len(entities))
+	for _, ent := range entities {
+
+		changes := make([]query.Change, 0, len(ent.Properties))
+		for k, p := range ent.Properties {
+			changes = append(changes, query.Change{Property: k, Value: p, Op: query.Noop})
+		}
+
+		res := changeResult{
+			properties: idx.Properties(),
+			change:     newEntityChange(t, ent.Id, changeReindex, changes...),
+		}
+		eDiff, err := res.getDiffs()
+		if err != nil {
+			return redisError(err)
+		}
+		diffs = append(diffs, eDiff)
+	}
+
+	pipe, errchan := idx.Pipeline(tx)
+	for _, eDiff := range diffs {
+		pipe <- eDiff
+	}
+	close(pipe)
+
+	if err := <-errchan; err != nil {
+		return err
+	}
+
+	if _, err := tx.Execute(); err == redis.ErrNil {
+		// EXEC returns nil if a watched entity was modified
+		return errWatchConflict
+	} else if err != nil {
+		return redisError(err)
+	}
+	return nil
+}
+
+// backfill indexes all the existing entities of the table in a pending index, and marks it ready when done, or
+// failed if it is a unique index and some entities have the same values in it.
+//
+// The primary index is scanned in chunks by id, after the last id backfilled, so entities added or removed during
+// the scan don't make it skip any others. Entities added during the scan are indexed by their own writes anyway.
+// Every chunk is indexed watching its entities, and indexed again if any of them is written in the meantime, so a
+// backfill never overwrites the entry of a write with the entity's older values
+func (t *table) backfill(idx index) error {
+
+	chunk := DefaultConfig.BackfillChunkSize
+	if chunk <= 0 {
+		chunk = 100
+	}
+
+	conn := pool.Get()
+	defer conn.Close()
+
+	p, err := loadProgress(conn, idx)
+	if err != nil {
+		return err
+	}
+	if p.state != schema.IndexPending {
+		return nil
+	}
+
+	logging.Info("Backfilling index %s of table %s from %d entities", idx, t, p.scanned)
+	for {
+
+		min := "-"
+		if p.cursor != "" {
+			min = "(" + p.cursor
+		}
+
+		entries, err := redis.Strings(conn.Do("ZRANGEBYLEX", t.primary.RedisKey(), min, "+", "LIMIT", 0, chunk))
+		if err != nil {
+			return redisError(err)
+		}
+		if p.total, err = redis.Int(conn.Do("ZCARD", t.primary.RedisKey())); err != nil {
+			return redisError(err)
+		}
+
+		ids := make([]schema.Key, len(entries))
+		for i, e := range entries {
+			ids[i] = t.primary.ExtractId(e)
+		}
+
+		// entities written while they are indexed may have been indexed with their old values, so we index them again
+		if len(ids) > 0 {
+			for retry := 0; ; retry++ {
+				err = t.indexEntities(idx, ids)
+				if err != errWatchConflict || retry == maxWatchRetries {
+					break
+				}
+				logging.Debug("Retrying backfill of index %s after concurrent modification (%d)", idx, retry+1)
+			}
+			if err != nil {
+				return err
+			}
+		}
+
+		if len(entries) > 0 {
+			p.cursor = entries[len(entries)-1]
+		}
+		p.scanned += len(entries)
+		if len(entries) < chunk {
+			p.state = schema.IndexReady
+
+			if ci, ok := idx.(*CompoundIndex); ok && ci.desc.Unique() {
+				dups, err := t.indexDuplicates(ci)
+				if err != nil {
+					return err
+				}
+				if p.duplicates = len(dups); p.duplicates > 0 {
+					logging.Error("Unique index %s of table %s has %d groups of entities with the same values, "+
+						"marking it failed", idx, t, p.duplicates)
+					p.state = schema.IndexFailed
+				}
+			}
+		}
+
+		if err := saveProgress(conn, idx, p); err != nil {
+			return err
+		}
+		t.states.set(idx, p)
+
+		if p.state != schema.IndexPending {
+			logging.Info("Finished backfilling index %s of table %s, %d entities scanned", idx, t, p.scanned)
+			return nil
+		}
+	}
+}
+
+// backfillLoop keeps the states of pending indexes up to date with their persisted progress. On the master it also
+// runs the backfills of pending indexes, one at a time per index
+func (r *Driver) backfillLoop(freq time.Duration) {
+
+	for range time.Tick(freq) {
+
+		r.tableLock.RLock()
+		tables := make([]*table, 0, len(r.tables))
+		for _, t := range r.tables {
+			tables = append(tables, t)
+		}
+		r.tableLock.RUnlock()
+
+		for _, t := range tables {
+			for _, idx := range t.indexes {
+				if !t.states.pending(idx) {
+					continue
+				}
+
+				if DefaultConfig.Master {
+					r.startBackfill(t, idx)
+				}
+
+				conn := pool.Get()
+				p, err := loadProgress(conn, idx)
+				conn.Close()
+				if err != nil {
+					logging.Error("Could not read the progress of index %s: %s", idx, err)
+					continue
+				}
+				t.states.set(idx, p)
+			}
+		}
+	}
+}
+
+// startBackfill starts backfilling an index in the background, unless it is already being backfilled. Tables are
+// replaced whenever their schema changes, so backfills are tracked by index key
+func (r *Driver) startBackfill(t *table, idx index) {
+
+	r.backfillLock.Lock()
+	defer r.backfillLock.Unlock()
+
+	if r.backfills[idx.RedisKey()] {
+		return
+	}
+	r.backfills[idx.RedisKey()] = true
+
+	go func() {
+		if err := t.backfill(idx); err != nil {
+			logging.Error("Error backfilling index %s: %s", idx, err)
+		}
+
+		r.backfillLock.Lock()
+		delete(r.backfills, idx.RedisKey())
+		r.backfillLock.Unlock()
+	}()
+}
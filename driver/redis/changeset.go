@@ -33,8 +33,26 @@ type entityChange struct {
 	objectId          schema.Key
 	changeType        changeType
 	table             *table
+	// conditions that the entity must meet for the change set to be executed
+	conditions []query.Condition
+	// existence the entity must have for the change to be applied. Changes of entities that don't have it are dropped
+	existence existence
+	// outcome, if not nil, receives the outcome of the change for PUT responses
+	outcome *query.PutOutcome
+	// defaults set the column defaults a strict table's entity is missing. They are applied only if the entity does
+	// not exist yet, so existing entities keep their stored values
+	defaults []query.Change
 }
 
+// existence is a requirement on whether an entity exists before it is changed
+type existence int
+
+const (
+	anyExistence existence = iota
+	mustExist
+	mustNotExist
+)
+
 func newEntityChange(t *table, objectId schema.Key, ct changeType, changes ...query.Change) entityChange {
 
 	changedProps := make(propertyList, len(changes))
@@ -51,6 +69,16 @@ func newEntityChange(t *table, objectId schema.Key, ct changeType, changes ...qu
 	}
 }
 
+// withDefaults returns the change with the changes of its defaults added before its own
+func (rc entityChange) withDefaults() entityChange {
+
+	changes := append(append(make([]query.Change, 0, len(rc.defaults)+len(rc.changes)), rc.defaults...), rc.changes...)
+
+	ret := newEntityChange(rc.table, rc.objectId, rc.changeType, changes...)
+	ret.conditions, ret.existence, ret.outcome = rc.conditions, rc.existence, rc.outcome
+	return ret
+}
+
 type redisCommand struct {
 	command string
 	args    redis.Args
@@ -81,6 +109,11 @@ func (r *redisCommand) valid() bool {
 
 func (rc entityChange) commands() ([]*redisCommand, error) {
 
+	// entities with collection changes are written entirely by collectionScript
+	if rc.hasCollectionOps() {
+		return rc.scriptCommands()
+	}
+
 	hmset := newRedisCommand("HMSET", rc.table.idKey(rc.objectId))
 
 	ret := []*redisCommand{hmset}
@@ -107,17 +140,9 @@ func (rc entityChange) commands() ([]*redisCommand, error) {
 		case query.OpPropDel:
 			ret = append(ret, newRedisCommand("HDEL", rc.table.idKey(rc.objectId), ch.Property))
 		case query.OpExpire:
-
-			var ttl int
-			switch v := ch.Value.(type) {
-			case time.Duration:
-				ttl = int(v / time.Millisecond)
-			case int64:
-				ttl = int(v / int64(time.Millisecond))
-			case int:
-				ttl = v / int(time.Millisecond)
-			default:
-				return nil, redisError(fmt.Errorf("Invalid value for TTL: %v", ch.Value))
+			ttl, err := expireMillis(ch.Value)
+			if err != nil {
+				return nil, redisError(err)
 			}
 			ret = append(ret, newRedisCommand("PEXPIRE", rc.table.idKey(rc.objectId), ttl))
 
@@ -132,21 +157,105 @@ func (rc entityChange) commands() ([]*redisCommand, error) {
 	}
 
 	if len(ret) > 0 {
+		// every write bumps the entity's version
+		if rc.changeType == changeUpdate || rc.changeType == changeInsert {
+			ret = append(ret, newRedisCommand("HINCRBY", rc.table.idKey(rc.objectId), schema.VersionKey, 1))
+		}
 		return ret, nil
 	}
 	return nil, nil
 }
 
+// hasCollectionOps tells whether any of the changes of the entity modifies the elements of a collection
+func (rc entityChange) hasCollectionOps() bool {
+	for _, ch := range rc.changes {
+		if isCollectionOp(ch.Op) {
+			return true
+		}
+	}
+	return false
+}
+
+// scriptCommands returns the call of collectionScript that writes all the changes of the entity in order, including
+// its version bump
+func (rc entityChange) scriptCommands() ([]*redisCommand, error) {
+
+	script := newRedisCommand("EVALSHA", collectionScriptHash, 1, rc.table.idKey(rc.objectId))
+
+	for _, ch := range rc.changes {
+		switch {
+		case ch.Op == query.Noop:
+			continue
+		case isCollectionOp(ch.Op):
+			args, err := collectionArgs(ch)
+			if err != nil {
+				return nil, redisError(err)
+			}
+			script.add(args...)
+		case ch.Op == query.OpSet:
+			val, err := encoder.Encode(ch.Value)
+			if err != nil {
+				return nil, redisError(fmt.Errorf("Could not encode changeset: %s", err))
+			}
+			script.add("SET", ch.Property, 1, val)
+		case ch.Op == query.OpIncrement:
+			script.add("INCR", ch.Property, 1, ch.Value)
+		case ch.Op == query.OpPropDel:
+			script.add("HDEL", ch.Property, 0)
+		case ch.Op == query.OpExpire:
+			ttl, err := expireMillis(ch.Value)
+			if err != nil {
+				return nil, redisError(err)
+			}
+			script.add("PEXPIRE", "", 1, ttl)
+		default:
+			logging.Error("Unsupported op: %s", ch.Op)
+			return nil, errors.OpNotSupported
+		}
+	}
+
+	if rc.changeType == changeUpdate || rc.changeType == changeInsert {
+		script.add("INCR", schema.VersionKey, 1, 1)
+	}
+	return []*redisCommand{script}, nil
+}
+
+// expireMillis converts the value of an expire change to milliseconds
+func expireMillis(v interface{}) (int, error) {
+
+	switch ttl := v.(type) {
+	case time.Duration:
+		return int(ttl / time.Millisecond), nil
+	case int64:
+		return int(ttl / int64(time.Millisecond)), nil
+	case int:
+		return ttl / int(time.Millisecond), nil
+	}
+	return 0, fmt.Errorf("Invalid value for TTL: %v", v)
+}
+
+// changeSet is a set of entity changes executed in a single transaction. The changes can be of entities of
+// different tables
 type changeSet struct {
-	table   *table
 	changes []entityChange
+
+	// atomic change sets write their index changes in the same transaction as the data, so either both are
+	// applied or neither is. Otherwise the indexes are updated in a separate transaction after the data.
+	// They also apply either all of their changes or none, so a rejected entity fails the whole change set
+	atomic bool
+
+	// returning tells the change set to load the changed entities in its transaction - after they are
+	// updated, or before they are deleted - limited to returnProperties if any are set
+	returning        bool
+	returnProperties []string
+	// returned are the entities loaded by an executed returning change set
+	returned []schema.Entity
 }
 
-// NewChangeSet creates a new changeset on table T. you can give it a capacity hint that is basically
+// NewChangeSet creates a new changeset. you can give it a capacity hint that is basically
 // the number of rows that's going to change
-func newChangeSet(t *table, capacityHint int) *changeSet {
+func newChangeSet(capacityHint int) *changeSet {
 	return &changeSet{
-		table:   t,
 		changes: make([]entityChange, 0, capacityHint),
 	}
 }
@@ -224,7 +333,11 @@ func (c *indexableCache) get(h uint64) ([]string, bool) {
 
 }
 
-var propCache = &indexableCache{map[uint64][]string{}, sync.RWMutex{}}
+// newIndexableCache creates the cache of a table's indexable properties. The indexable properties depend on the
+// table's indexes, so every table has its own cache, and tables rebuilt with different indexes start with an empty one
+func newIndexableCache() *indexableCache {
+	return &indexableCache{map[uint64][]string{}, sync.RWMutex{}}
+}
 
 // indexableProperties takes the properties of a rowChange and determines which properties should be loaded
 // when performing the update to match diffs
@@ -232,18 +345,18 @@ func (c *changeSet) indexableProperties(rc entityChange) []string {
 	//TODO: cache this - do it just once per change set or something
 
 	h := rc.changedProperties.hash()
-	if cached, found := propCache.get(h); found {
+	if cached, found := rc.table.props.get(h); found {
 		return cached
 	}
 
 	props := make(propertyList, 0, len(rc.changes))
 
 	// Add the primary index's properties always
-	props = append(props, c.table.primary.Properties()...)
+	props = append(props, rc.table.primary.Properties()...)
 
 	for _, ch := range rc.changes {
 
-		for _, idx := range c.table.indexes {
+		for _, idx := range rc.table.indexes {
 
 			// for DEL changes - we need all indexable properties
 			if rc.changeType == changeDelete {
@@ -271,7 +384,7 @@ func (c *changeSet) indexableProperties(rc entityChange) []string {
 		}
 	}
 
-	propCache.set(h, props)
+	rc.table.props.set(h, props)
 	return props
 
 }
@@ -283,11 +396,22 @@ func (c *changeSet) Add(rc entityChange) {
 	logging.Debug("Adding row change %s to change set. len now %d", rc, len(c.changes))
 }
 
+// outcomeResult holds the reply of an EXISTS check made inside a change set's transaction, and where to report it
+type outcomeResult struct {
+	outcome *query.PutOutcome
+	promise *Promise
+}
+
 // changeResult holds the pre and post
 type changeResult struct {
 	properties propertyList
 	oldPromise *Promise
 	change     entityChange
+	// script is the reply of the change's collection script, if it has one and it was executed
+	script *Promise
+	// prior holds the values earlier changes of the same atomic change set left in the entity's properties.
+	// They override the old values read before the transaction, which do not include these changes
+	prior map[string]interface{}
 }
 
 // entityDiff represents all the (indexable) changes an entity change caused
@@ -311,10 +435,58 @@ func (d entityDiff) vals(newVals bool) map[string]interface{} {
 	return ret
 }
 
+// rawVals is like vals, but returns the values as they were before being prepared for indexing.
+// It is used by indexes that need the actual typed values and not their lexical encoding
+func (d entityDiff) rawVals(newVals bool) map[string]interface{} {
+
+	ret := make(map[string]interface{})
+	for k, pd := range d.diffs {
+		if newVals {
+			ret[k] = pd.rawNew
+		} else {
+			ret[k] = pd.rawOld
+		}
+
+	}
+	return ret
+}
+
+// priorValues returns the values of the entity's indexable properties after the change, given those known from
+// before it. Deleted entities have no values left
+func (d entityDiff) priorValues(before map[string]interface{}) map[string]interface{} {
+
+	ret := make(map[string]interface{}, len(before)+len(d.diffs))
+	for k, v := range before {
+		ret[k] = v
+	}
+	for k, pd := range d.diffs {
+		ret[k] = pd.rawNew
+	}
+	return ret
+}
+
+// merge combines the diff of a later change of the same entity into the diff, keeping the old values from before
+// the earlier change and taking the new values and change type of the later one
+func (d *entityDiff) merge(later *entityDiff) {
+
+	d.changeType = later.changeType
+	for k, pd := range later.diffs {
+		if prev, found := d.diffs[k]; found {
+			prev.newVal, prev.rawNew = pd.newVal, pd.rawNew
+			prev.changed = prev.changed || pd.changed
+			prev.loadOnly = prev.loadOnly && pd.loadOnly
+		} else {
+			d.diffs[k] = pd
+		}
+	}
+}
+
 // propertyDiff represents the diff a change caused in one property
 type propertyDiff struct {
 	newVal   interface{}
 	oldVal   interface{}
+	rawNew   interface{}
+	rawOld   interface{}
 	op       query.ChangeOp
 	changed  bool
 	loadOnly bool
@@ -365,13 +537,45 @@ func (cr changeResult) getDiffs() (ret *entityDiff, err error) {
 				return nil, logging.Errorf("Invalid value to deocde: %v", olds[i])
 			}
 		}
+
+		if v, found := cr.prior[p]; found {
+			pd.oldVal = v
+		}
+	}
+
+	// a failed script leaves its entity unchanged
+	failed := false
+	if cr.script != nil {
+		_, failed = cr.script.Value.(redis.Error)
+	}
+	if failed {
+		for _, pd := range ret.diffs {
+			pd.newVal = pd.oldVal
+		}
 	}
 
 	// fill the diffs with new values
-	if cr.change.changeType != changeDelete {
+	if cr.change.changeType != changeDelete && !failed {
+
+		// collection changes are applied by a script, so we apply them to the old values read in the same
+		// transaction to know the new ones
+		collections := make(map[string]bool)
+
 		for _, change := range cr.change.changes {
 			if pd := ret.diffs[change.Property]; pd != nil {
 
+				if isCollectionOp(change.Op) {
+					if !collections[change.Property] {
+						pd.newVal = cloneCollection(pd.oldVal)
+						collections[change.Property] = true
+					}
+					if pd.newVal, err = applyCollectionOp(pd.newVal, change); err != nil {
+						return nil, err
+					}
+					pd.changed = true
+					continue
+				}
+
 				// mark the diff as a change or not - depending on whether the old and new values differ
 				pd.changed = change.Value != pd.oldVal
 
@@ -384,12 +588,15 @@ func (cr changeResult) getDiffs() (ret *entityDiff, err error) {
 	// now prepare the values for all raw diffs
 	for _, pd := range ret.diffs {
 
+		// keep the raw values for indexes that need them
+		pd.rawOld, pd.rawNew = pd.oldVal, pd.newVal
+
 		// now encode the values for indexing
-		if pd.oldVal, err = prepareValue(pd.oldVal); err != nil {
+		if pd.oldVal, err = encodeIndexValue(pd.oldVal); err != nil {
 			return nil, logging.Errorf("Error encoding value for indexing: %s", err)
 		}
 
-		if pd.newVal, err = prepareValue(pd.newVal); err != nil {
+		if pd.newVal, err = encodeIndexValue(pd.newVal); err != nil {
 			return nil, logging.Errorf("Error encoding value for indexing: %s", err)
 		}
 
@@ -397,6 +604,7 @@ func (cr changeResult) getDiffs() (ret *entityDiff, err error) {
 		// this is used to index unchanged properties in compound indexes.
 		if pd.loadOnly && cr.change.changeType != changeDelete {
 			pd.newVal = pd.oldVal
+			pd.rawNew = pd.rawOld
 		}
 
 	}
@@ -409,71 +617,286 @@ func (c *changeSet) indexChanges(results []changeResult) error {
 	tx := NewTransaction(pool.Get())
 	defer tx.Abort()
 
-	diffs := make([]*entityDiff, len(results))
-	for i, res := range results {
+	if err := c.writeIndexChanges(tx, results); err != nil {
+		return err
+	}
+
+	_, err := tx.Execute()
+	return err
+
+}
+
+// writeIndexChanges computes the index diffs of the change results and enqueues the commands applying them in
+// the transaction, without executing it
+func (c *changeSet) writeIndexChanges(tx *Transaction, results []changeResult) error {
+
+	tables, diffs, err := mergedDiffs(results)
+	if err != nil {
+		return err
+	}
+
+	for _, t := range tables {
+
+		indexes := append([]index{t.primary}, t.indexes...)
+		for _, idx := range indexes {
+			pipe, errchan := idx.Pipeline(tx)
+			for _, eDiff := range diffs[t] {
+				pipe <- eDiff
+			}
+			close(pipe)
+
+			// TODO: continue writing to next index, and collect errors from all eventually
+			if err := <-errchan; err != nil {
+				return logging.Errorf("Error indexing entities: %s", err)
+			}
+		}
+	}
+
+	return nil
+}
+
+// mergedDiffs computes the diffs of the change results, grouped by table as every table has its own indexes.
+//
+// Indexes remove all their old entries before adding the new ones, so the diffs of an entity changed more than once
+// are merged into one, from its values before the first change to its values after the last one. Otherwise the
+// entries of its intermediate values would be left behind
+func mergedDiffs(results []changeResult) ([]*table, map[*table][]*entityDiff, error) {
+
+	tables := make([]*table, 0, 1)
+	diffs := make(map[*table][]*entityDiff)
+	entities := make(map[string]*entityDiff)
+	for _, res := range results {
 		eDiff, err := res.getDiffs()
 		if err != nil {
-			return redisError(err)
+			return nil, nil, redisError(err)
+		}
+
+		t := res.change.table
+		if prev, found := entities[t.idKey(eDiff.id)]; found {
+			prev.merge(eDiff)
+			continue
 		}
+		entities[t.idKey(eDiff.id)] = eDiff
 
-		diffs[i] = eDiff
+		if _, found := diffs[t]; !found {
+			tables = append(tables, t)
+		}
+		diffs[t] = append(diffs[t], eDiff)
+	}
+
+	return tables, diffs, nil
+}
+
+// readOldValues watches the entities of the changes that need their old indexable values, and reads these values
+// before the transaction starts. It returns a promise of the values of every such change, and nil for the others.
+//
+// Atomic change sets use it to compute their index changes before the transaction is executed. If any of the
+// entities changes in the meantime, the transaction fails and the change set is retried
+func (c *changeSet) readOldValues(conn redis.Conn, changes []entityChange) ([]*Promise, error) {
+
+	ret := make([]*Promise, len(changes))
+	keys := make([]interface{}, 0)
+	for _, rc := range changes {
+		if rc.changeType == changeUpdate || rc.changeType == changeDelete {
+			keys = append(keys, rc.table.idKey(rc.objectId))
+		}
 	}
 
-	pipe, errchan := c.table.primary.Pipeline(tx)
-	for _, eDiff := range diffs {
-		pipe <- eDiff
+	if len(keys) == 0 {
+		return ret, nil
 	}
-	close(pipe)
 
-	// TODO: continue writing to next index, and collect errors from all eventually
-	if err := <-errchan; err != nil {
-		return logging.Errorf("Error indexing entities: %s", err)
+	if _, err := conn.Do("WATCH", keys...); err != nil {
+		return nil, redisError(err)
 	}
 
-	for _, idx := range c.table.indexes {
-		pipe, errchan := idx.Pipeline(tx)
-		for _, eDiff := range diffs {
-			pipe <- eDiff
+	batch := NewBatch(conn)
+	for i, rc := range changes {
+		if rc.changeType != changeUpdate && rc.changeType != changeDelete {
+			continue
 		}
-		close(pipe)
 
-		// TODO: continue writing to next index, and collect errors from all eventually
-		if err := <-errchan; err != nil {
-			return logging.Errorf("Error indexing entities: %s", err)
+		if indexable := c.indexableProperties(rc); len(indexable) > 0 {
+			args := make(redis.Args, 0, len(indexable)).Add(rc.table.idKey(rc.objectId)).AddFlat(indexable)
+
+			var err error
+			if ret[i], err = batch.Send("HMGET", args...); err != nil {
+				return nil, redisError(err)
+			}
 		}
 	}
 
-	_, err := tx.Execute()
-	return err
+	if _, err := batch.Execute(); err != nil {
+		return nil, redisError(err)
+	}
+	return ret, nil
+}
 
+// checkUnique makes sure every entity is changed at most once in the change set. Transactions check the conditions
+// and existence requirements of their changes before executing them, so a second change of an entity would not see
+// the first one
+func (c *changeSet) checkUnique() error {
+
+	seen := make(map[string]bool, len(c.changes))
+	for _, rc := range c.changes {
+		k := rc.table.idKey(rc.objectId)
+		if seen[k] {
+			return errors.NewError("Entity %s is changed more than once in the transaction", k)
+		}
+		seen[k] = true
+	}
+	return nil
 }
 
-// Execute takes the chagneset and executes it. returns the number of changes executed
+// maxWatchRetries is the number of times we retry a change set whose watched entities were modified concurrently
+const maxWatchRetries = 10
+
+// errWatchConflict is returned when a change set was aborted because a watched entity was modified
+var errWatchConflict = errors.NewError("Watched entity modified concurrently")
+
+// Execute takes the chagneset and executes it. returns the number of changes executed.
+//
+// If the change set has conditions or existence requirements, and the entities they apply to are concurrently
+// modified, it is retried
 func (c *changeSet) Execute() (int, error) {
+	return retryWatched(c.execute)
+}
+
+// retryWatched calls exec until it does not fail because of a concurrent modification of the keys it watches, at
+// most maxWatchRetries more times. If all of them fail, it returns errors.ConflictError
+func retryWatched(exec func() (int, error)) (int, error) {
+
+	for retry := 0; ; retry++ {
+		num, err := exec()
+		if err != errWatchConflict {
+			return num, err
+		} else if retry == maxWatchRetries {
+			return num, errors.ConflictError
+		}
+		logging.Debug("Retrying change set after concurrent modification (%d)", retry+1)
+	}
+}
+
+func (c *changeSet) execute() (int, error) {
 
 	tx := NewTransaction(pool.Get())
 	defer tx.Abort()
 
-	results := make([]changeResult, 0, len(c.changes))
+	return c.executeIn(tx)
+}
 
-	for _, rc := range c.changes {
+// executeIn executes the change set in a transaction, whose connection may already watch keys the change set
+// depends on
+func (c *changeSet) executeIn(tx *Transaction) (int, error) {
+
+	// existence requirements and conditions are checked before the transaction starts, watching the entities so the
+	// transaction fails if they change in the meantime
+	cs, err := c.checkExistence(tx.conn)
+	if err != nil {
+		return 0, err
+	} else if len(cs.changes) == 0 {
+		return 0, nil
+	}
+
+	if err := cs.checkConditions(tx.conn); err != nil {
+		return 0, err
+	}
+
+	changes := cs.changes
+
+	// writes to unique indexes are checked before the transaction, so their index changes must be known before it
+	atomic := c.atomic
+	for _, rc := range changes {
+		if rc.touchesUniqueIndexes() {
+			atomic = true
+			break
+		}
+	}
+
+	results := make([]changeResult, 0, len(changes))
+
+	// in atomic change sets the old values must be known before the transaction, to write the index changes in it
+	if atomic {
+		olds, err := c.readOldValues(tx.conn, changes)
+		if err != nil {
+			return 0, err
+		}
+
+		// the old values of an entity changed more than once are the new values of its previous change
+		prior := make(map[string]map[string]interface{})
+		for i, rc := range changes {
+			if indexable := c.indexableProperties(rc); len(indexable) > 0 && rc.changeType != changeNop {
+				res := changeResult{indexable, olds[i], rc, nil, prior[rc.table.idKey(rc.objectId)]}
+				results = append(results, res)
+
+				eDiff, err := res.getDiffs()
+				if err != nil {
+					return 0, redisError(err)
+				}
+				prior[rc.table.idKey(rc.objectId)] = eDiff.priorValues(res.prior)
+			}
+		}
+
+		if err := c.checkUniqueIndexes(tx.conn, results); err != nil {
+			return 0, err
+		}
+	}
+
+	if err := checkCollections(tx.conn, changes, atomic); err != nil {
+		return 0, err
+	}
+
+	outcomes := make([]outcomeResult, 0)
+	loads := make([]*Promise, 0)
+	scripts := make([]*Promise, 0)
+
+	// load sends the command loading a changed entity for returning it
+	load := func(rc entityChange) error {
+		cmd, args := rc.table.loadCommand(rc.objectId, c.returnProperties)
+		promise, err := tx.Send(cmd, args...)
+		if err != nil {
+			return redisError(err)
+		}
+		loads = append(loads, promise)
+		return nil
+	}
+
+	for _, rc := range changes {
+
+		// if we don't know yet whether the entity exists, we find out inside the transaction
+		if rc.outcome != nil && rc.existence == anyExistence {
+			promise, err := tx.Send("EXISTS", rc.table.idKey(rc.objectId))
+			if err != nil {
+				return 0, redisError(err)
+			}
+			outcomes = append(outcomes, outcomeResult{rc.outcome, promise})
+		}
 
 		// if we need to get the prev value of any fields prior to the change - we add an HMGET before
-		if indexable := c.indexableProperties(rc); len(indexable) > 0 {
+		result := -1
+		if indexable := c.indexableProperties(rc); len(indexable) > 0 && !atomic {
 
 			switch rc.changeType {
 
 			case changeUpdate, changeDelete:
-				args := make(redis.Args, 0, len(indexable)).Add(c.table.idKey(rc.objectId)).AddFlat(indexable)
+				args := make(redis.Args, 0, len(indexable)).Add(rc.table.idKey(rc.objectId)).AddFlat(indexable)
 
 				promise, err := tx.Send("HMGET", args...)
 				if err != nil {
 					return 0, redisError(err)
 				}
-				results = append(results, changeResult{indexable, promise, rc})
+				result = len(results)
+				results = append(results, changeResult{indexable, promise, rc, nil, nil})
 
 			case changeInsert, changeReindex:
-				results = append(results, changeResult{indexable, nil, rc})
+				results = append(results, changeResult{indexable, nil, rc, nil, nil})
+			}
+		}
+
+		// deleted entities are returned as they were before the change
+		if c.returning && rc.changeType == changeDelete {
+			if err := load(rc); err != nil {
+				return 0, err
 			}
 		}
 
@@ -484,26 +907,79 @@ func (c *changeSet) Execute() (int, error) {
 
 			for _, cmd := range cmds {
 				logging.Debug("Enqueuing command %s", *cmd)
-				if _, err := tx.Send(cmd.command, cmd.args...); err != nil {
+				promise, err := tx.Send(cmd.command, cmd.args...)
+				if err != nil {
 					return 0, redisError(err)
 				}
+
+				if cmd.command == "EVALSHA" {
+					scripts = append(scripts, promise)
+					if result >= 0 {
+						results[result].script = promise
+					}
+				}
+			}
+		}
+
+		// and other entities as they are after it
+		if c.returning && rc.changeType != changeDelete {
+			if err := load(rc); err != nil {
+				return 0, err
 			}
 		}
 
 	}
 
-	if _, err := tx.Execute(); err != nil {
+	// atomic change sets write their index changes in the same transaction
+	if atomic {
+		if err := c.writeIndexChanges(tx, results); err != nil {
+			return 0, err
+		}
+	}
+
+	if _, err := tx.Execute(); err == redis.ErrNil {
+		// EXEC returns nil if a watched entity was modified
+		return 0, errWatchConflict
+	} else if err != nil {
 		return 0, redisError(fmt.Errorf("Failed performing changeset transaction: %s", err))
 	}
 
-	if err := c.indexChanges(results); err != nil {
-		logging.Error("Could not index objects: %s", err)
-		return 0, err
+	for _, res := range outcomes {
+		if existed, _ := redis.Bool(res.promise.Reply()); existed {
+			*res.outcome = query.OutcomeUpdated
+		} else {
+			*res.outcome = query.OutcomeCreated
+		}
+	}
+
+	if c.returning {
+		c.returned = make([]schema.Entity, 0, len(loads))
+		for i, p := range loads {
+			if ent := changes[i].table.readReply(changes[i].objectId, p, c.returnProperties); ent != nil {
+				c.returned = append(c.returned, *ent)
+			}
+		}
+	}
+
+	if !atomic {
+		if err := c.indexChanges(results); err != nil {
+			logging.Error("Could not index objects: %s", err)
+			return 0, err
+		}
+	}
+
+	// the collection changes were checked before the transaction, but in change sets that are not atomic their
+	// entities may have changed since. A failed script leaves its entity unchanged, yet the other entities of the
+	// change set are written
+	for _, p := range scripts {
+		if err, failed := p.Value.(redis.Error); failed {
+			return 0, errors.NewError("%s", err)
+		}
 	}
 
 	if _, err := tx.Execute(); err != nil {
 		return 0, redisError(err)
 	}
-	return len(c.changes), nil
+	return len(cs.changes), nil
 
 }
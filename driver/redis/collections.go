@@ -0,0 +1,677 @@
+package redis
+
+import (
+	"crypto/sha1"
+	"fmt"
+	"reflect"
+
+	"github.com/garyburd/redigo/redis"
+	"github.com/EverythingMe/meduza/errors"
+	"github.com/EverythingMe/meduza/query"
+	"github.com/EverythingMe/meduza/schema"
+)
+
+// Sets, maps and lists are stored encoded in a single field of the entity's hash, so redis cannot change their
+// elements with its own commands. Instead their changes are applied by collectionScript, a Lua script that splices the
+// encoded elements of the collections, so they are atomic without reading the entities first. The script writes all
+// the changes of an entity that has collection changes, so if any of them fails the entity is left unchanged.
+//
+// The script is loaded once, and transactions call it by its hash
+
+// isCollectionOp tells us whether a change op modifies the elements of a set, map or list
+func isCollectionOp(op query.ChangeOp) bool {
+	switch op {
+	case query.OpSetAdd, query.OpSetDel, query.OpMapSet, query.OpMapDel:
+		return true
+	case query.OpListAppend, query.OpListPrepend, query.OpListRemove, query.OpListTrim, query.OpListSetAt:
+		return true
+	}
+	return false
+}
+
+// collectionScript applies the changes of an entity to the fields of the hash KEYS[1].
+//
+// Collections are encoded as a type prefix followed by a bson document, whose elements are the members of sets and
+// lists or the keys and values of maps. The script splits documents to their raw elements, without decoding them, so elements are
+// compared by their encoding. ARGV is a sequence of changes, each being an op, a property, the number of the op's
+// arguments and the arguments. Elements and map values are given encoded like the collections themselves. Besides the
+// collection ops, SET, HDEL, INCR and PEXPIRE write the rest of the entity's changes.
+//
+// The changes are first run against a copy of the fields they read, and only written if all of them succeed
+const collectionScript = `
+local function u32(s, i)
+	local a, b, c, d = string.byte(s, i, i + 3)
+	return a + b * 256 + c * 65536 + d * 16777216
+end
+
+local function p32(n)
+	return string.char(n % 256, math.floor(n / 256) % 256, math.floor(n / 65536) % 256, math.floor(n / 16777216) % 256)
+end
+
+-- sizes of fixed size bson values by their type. 0x3f is an unsigned 64 bit integer
+local sizes = {[1] = 8, [7] = 12, [8] = 1, [9] = 8, [10] = 0, [16] = 4, [17] = 8, [18] = 8, [19] = 16, [63] = 8}
+
+-- elements splits the bson document that starts after an encoded collection's prefix to the keys of its elements and
+-- their types and values. It returns nil if the document is malformed
+local function elements(v)
+	local keys, vals = {}, {}
+	local i = 6
+	while true do
+		local t = string.byte(v, i)
+		if t == nil then
+			return nil
+		elseif t == 0 then
+			return keys, vals
+		end
+
+		local e = string.find(v, '\0', i + 1, true)
+		if e == nil then
+			return nil
+		end
+
+		local n = sizes[t]
+		if n == nil then
+			if t == 2 or t == 13 or t == 14 then
+				n = 4 + u32(v, e + 1)
+			elseif t == 3 or t == 4 then
+				n = u32(v, e + 1)
+			elseif t == 5 then
+				n = 5 + u32(v, e + 1)
+			else
+				return nil
+			end
+		end
+
+		keys[#keys + 1] = string.sub(v, i + 1, e - 1)
+		vals[#vals + 1] = string.char(t) .. string.sub(v, e + 1, e + n)
+		i = e + 1 + n
+	end
+end
+
+-- encode builds an encoded collection from its elements. Elements of sets and lists are keyed by their position
+local function encode(c)
+	local parts = {}
+	for n = 1, #c.vals do
+		local k = tostring(n - 1)
+		if c.prefix == 'm' then
+			k = c.keys[n]
+		end
+		parts[n] = string.sub(c.vals[n], 1, 1) .. k .. '\0' .. string.sub(c.vals[n], 2)
+	end
+	local body = table.concat(parts)
+	return c.prefix .. p32(string.len(body) + 5) .. body .. '\0'
+end
+
+local function find(list, v)
+	for n = 1, #list do
+		if list[n] == v then
+			return n
+		end
+	end
+	return nil
+end
+
+-- without removes the elements at the given positions
+local function without(c, removed)
+	local keys, vals = {}, {}
+	for n = 1, #c.vals do
+		if not removed[n] then
+			keys[#keys + 1] = c.keys[n]
+			vals[#vals + 1] = c.vals[n]
+		end
+	end
+	c.keys, c.vals = keys, vals
+end
+
+local prefixes = {
+	SADD = 's', SDEL = 's', MSET = 'm', MDEL = 'm',
+	LAPPEND = 'l', LPREPEND = 'l', LREM = 'l', LTRIM = 'l', LSET = 'l'
+}
+local names = {s = 'set', m = 'map', l = 'list'}
+
+-- collection splits the encoded value of a property to its elements, or returns an error if it is not a collection
+-- of the op's type. Missing and nil values are empty collections
+local function collection(v, op, prop)
+	local prefix = prefixes[op]
+	if not v or v == 'N' then
+		return {prefix = prefix, keys = {}, vals = {}}
+	end
+	if string.sub(v, 1, 1) ~= prefix then
+		return nil, 'Cannot perform ' .. op .. ' on ' .. prop .. ': not a ' .. names[prefix]
+	end
+
+	local c = {prefix = prefix}
+	c.keys, c.vals = elements(v)
+	if c.keys == nil then
+		return nil, 'Could not decode ' .. prop .. ' of ' .. KEYS[1]
+	end
+	return c
+end
+
+-- modify applies a collection op to the elements of a collection, and returns an error if it cannot
+local function modify(c, op, prop, args)
+	if op == 'MDEL' then
+		local removed = {}
+		for n = 1, #args do
+			local at = find(c.keys, args[n])
+			if at then
+				removed[at] = true
+			end
+		end
+		without(c, removed)
+	elseif op == 'LTRIM' then
+		-- keep the first n elements, or the last -n
+		local n = tonumber(args[1])
+		local removed = {}
+		for at = 1, #c.vals do
+			if n >= 0 then
+				removed[at] = at > n
+			else
+				removed[at] = at <= #c.vals + n
+			end
+		end
+		without(c, removed)
+	elseif op == 'LSET' then
+		local at = tonumber(args[1])
+		local _, vals = elements(args[2])
+		if vals == nil or #vals ~= 1 then
+			return 'Could not decode the value of ' .. op .. ' on ' .. prop
+		end
+		if at < 0 then
+			at = at + #c.vals
+		end
+		if at < 0 or at >= #c.vals then
+			return 'Index ' .. args[1] .. ' out of range for ' .. prop .. ' of length ' .. #c.vals
+		end
+		c.vals[at + 1] = vals[1]
+	else
+		local keys, vals = elements(args[1])
+		if keys == nil then
+			return 'Could not decode the value of ' .. op .. ' on ' .. prop
+		end
+
+		if op == 'SADD' or op == 'LAPPEND' then
+			for n = 1, #vals do
+				if op == 'LAPPEND' or not find(c.vals, vals[n]) then
+					c.keys[#c.keys + 1] = ''
+					c.vals[#c.vals + 1] = vals[n]
+				end
+			end
+		elseif op == 'LPREPEND' then
+			for n = 1, #c.vals do
+				keys[#keys + 1] = c.keys[n]
+				vals[#vals + 1] = c.vals[n]
+			end
+			c.keys, c.vals = keys, vals
+		elseif op == 'SDEL' or op == 'LREM' then
+			local removed = {}
+			for n = 1, #c.vals do
+				removed[n] = find(vals, c.vals[n]) ~= nil
+			end
+			without(c, removed)
+		elseif op == 'MSET' then
+			for n = 1, #vals do
+				local at = find(c.keys, keys[n])
+				if at then
+					c.vals[at] = vals[n]
+				else
+					c.keys[#c.keys + 1] = keys[n]
+					c.vals[#c.vals + 1] = vals[n]
+				end
+			end
+		end
+	end
+	return nil
+end
+
+local changes = {}
+local i = 1
+while i <= #ARGV do
+	local op, prop, nargs = ARGV[i], ARGV[i + 1], tonumber(ARGV[i + 2])
+	local args = {}
+	for n = 1, nargs do
+		args[n] = ARGV[i + 2 + n]
+	end
+	i = i + 3 + nargs
+	changes[#changes + 1] = {op = op, prop = prop, args = args}
+end
+
+-- run applies the changes to a store of the entity's fields, and returns an error if any of them fails
+local function run(store)
+	for _, ch in ipairs(changes) do
+		local op, prop, args = ch.op, ch.prop, ch.args
+		if op == 'SET' then
+			store.set(prop, args[1])
+		elseif op == 'HDEL' then
+			store.del(prop)
+		elseif op == 'PEXPIRE' then
+			store.expire(args[1])
+		elseif op == 'INCR' then
+			local v = store.get(prop)
+			if (v and not string.match(v, '^-?%d+$')) or not string.match(args[1], '^-?%d+$') then
+				return 'Cannot increment ' .. prop .. ' of ' .. KEYS[1] .. ' by ' .. args[1]
+			end
+			store.incr(prop, args[1])
+		elseif prefixes[op] then
+			local c, err = collection(store.get(prop), op, prop)
+			if c == nil then
+				return err
+			end
+			err = modify(c, op, prop, args)
+			if err then
+				return err
+			end
+			store.set(prop, encode(c))
+		else
+			return 'Unsupported op ' .. op
+		end
+	end
+	return nil
+end
+
+-- the copy reads the fields from the hash once, and keeps their changes to itself
+local fields = {}
+local copy = {
+	get = function(prop)
+		if fields[prop] == nil then
+			fields[prop] = redis.call('HGET', KEYS[1], prop)
+		end
+		return fields[prop]
+	end,
+	set = function(prop, v) fields[prop] = v end,
+	del = function(prop) fields[prop] = false end,
+	incr = function(prop, n) fields[prop] = '0' end,
+	expire = function(ms) end
+}
+
+local hash = {
+	get = function(prop) return redis.call('HGET', KEYS[1], prop) end,
+	set = function(prop, v) redis.call('HSET', KEYS[1], prop, v) end,
+	del = function(prop) redis.call('HDEL', KEYS[1], prop) end,
+	incr = function(prop, n) redis.call('HINCRBY', KEYS[1], prop, n) end,
+	expire = function(ms) redis.call('PEXPIRE', KEYS[1], ms) end
+}
+
+local err = run(copy)
+if err then
+	return redis.error_reply(err)
+end
+run(hash)
+return #changes
+`
+
+// collectionScriptHash is the SHA1 digest of collectionScript, that transactions call it by
+var collectionScriptHash = fmt.Sprintf("%x", sha1.Sum([]byte(collectionScript)))
+
+// loadCollectionScript loads collectionScript to the server if it does not have it yet. It is called before
+// transactions that call the script, as a missing script only fails when the transaction executes
+func loadCollectionScript(conn redis.Conn) error {
+
+	exists, err := redis.Ints(conn.Do("SCRIPT", "EXISTS", collectionScriptHash))
+	if err != nil {
+		return redisError(err)
+	}
+	if len(exists) == 1 && exists[0] == 1 {
+		return nil
+	}
+
+	if _, err := conn.Do("SCRIPT", "LOAD", collectionScript); err != nil {
+		return redisError(err)
+	}
+	return nil
+}
+
+// collectionArgs returns the arguments of a set, map or list change for collectionScript
+func collectionArgs(ch query.Change) ([]interface{}, error) {
+
+	var args []interface{}
+	switch ch.Op {
+	case query.OpSetAdd, query.OpSetDel, query.OpListAppend, query.OpListPrepend, query.OpListRemove:
+		v, err := encoder.Encode(schema.NewList(changeElements(ch.Value)...))
+		if err != nil {
+			return nil, err
+		}
+		args = append(args, v)
+
+	case query.OpListTrim:
+		n, ok := changeInt(ch.Value)
+		if !ok {
+			return nil, errors.NewError("Invalid length for %s on %s: %v", ch.Op, ch.Property, ch.Value)
+		}
+		args = append(args, n)
+
+	case query.OpListSetAt:
+		vals := changeElements(ch.Value)
+		if len(vals) != 2 {
+			return nil, errors.NewError("Invalid value for %s on %s: %v", ch.Op, ch.Property, ch.Value)
+		}
+		i, ok := changeInt(vals[0])
+		if !ok {
+			return nil, errors.NewError("Invalid index for %s on %s: %v", ch.Op, ch.Property, vals[0])
+		}
+		v, err := encoder.Encode(schema.NewList(vals[1]))
+		if err != nil {
+			return nil, err
+		}
+		args = append(args, i, v)
+
+	case query.OpMapSet:
+		var vals map[string]interface{}
+		switch v := ch.Value.(type) {
+		case schema.Map:
+			vals = v
+		case map[string]interface{}:
+			vals = v
+		default:
+			return nil, errors.NewError("Invalid value for %s on %s: %v", ch.Op, ch.Property, ch.Value)
+		}
+
+		m := schema.NewMap()
+		for k, v := range vals {
+			m.Set(k, v)
+		}
+		v, err := encoder.Encode(m)
+		if err != nil {
+			return nil, err
+		}
+		args = append(args, v)
+
+	case query.OpMapDel:
+		for _, k := range changeElements(ch.Value) {
+			args = append(args, fmt.Sprintf("%v", k))
+		}
+
+	default:
+		return nil, errors.OpNotSupported
+	}
+
+	return append([]interface{}{string(ch.Op), ch.Property, len(args)}, args...), nil
+}
+
+// cloneCollection returns a shallow copy of a set, map or list value, so ops can be applied to it without changing
+// the original
+func cloneCollection(v interface{}) interface{} {
+
+	switch val := v.(type) {
+	case schema.Set:
+		ret := make(schema.Set, len(val))
+		for e := range val {
+			ret[e] = struct{}{}
+		}
+		return ret
+	case schema.Map:
+		ret := make(schema.Map, len(val))
+		for k, e := range val {
+			ret[k] = e
+		}
+		return ret
+	case schema.List:
+		return append(schema.List{}, val...)
+	}
+	return v
+}
+
+// changeInt converts the integer argument of a list change
+func changeInt(v interface{}) (int, bool) {
+	switch i := v.(type) {
+	case schema.Int:
+		return int(i), true
+	case int64:
+		return int(i), true
+	case int32:
+		return int(i), true
+	case int:
+		return i, true
+	case schema.Uint:
+		return int(i), true
+	case uint64:
+		return int(i), true
+	case uint32:
+		return int(i), true
+	case schema.Float:
+		return int(i), true
+	case float64:
+		return int(i), true
+	}
+	return 0, false
+}
+
+// applyListOp applies a list change to the current value of a property, and returns its new value
+func applyListOp(current interface{}, ch query.Change) (interface{}, error) {
+
+	l, ok := current.(schema.List)
+	if current == nil {
+		l, ok = schema.NewList(), true
+	}
+	if !ok {
+		return nil, errors.NewError("Cannot perform %s on %s: not a list", ch.Op, ch.Property)
+	}
+
+	switch ch.Op {
+	case query.OpListAppend, query.OpListPrepend:
+		elems := schema.NewList(changeElements(ch.Value)...)
+		if ch.Op == query.OpListAppend {
+			return append(l, elems...), nil
+		}
+		return append(elems, l...), nil
+
+	case query.OpListRemove:
+		values := schema.NewList(changeElements(ch.Value)...)
+		ret := make(schema.List, 0, len(l))
+		for _, e := range l {
+			removed := false
+			for _, v := range values {
+				if reflect.DeepEqual(e, v) {
+					removed = true
+					break
+				}
+			}
+			if !removed {
+				ret = append(ret, e)
+			}
+		}
+		return ret, nil
+
+	case query.OpListTrim:
+		n, ok := changeInt(ch.Value)
+		if !ok {
+			return nil, errors.NewError("Invalid length for %s on %s: %v", ch.Op, ch.Property, ch.Value)
+		}
+		switch {
+		case n >= 0 && n < len(l):
+			return l[:n], nil
+		case n < 0 && -n < len(l):
+			return l[len(l)+n:], nil
+		}
+		return l, nil
+
+	case query.OpListSetAt:
+		args := changeElements(ch.Value)
+		if len(args) != 2 {
+			return nil, errors.NewError("Invalid value for %s on %s: %v", ch.Op, ch.Property, ch.Value)
+		}
+		i, ok := changeInt(args[0])
+		if !ok {
+			return nil, errors.NewError("Invalid index for %s on %s: %v", ch.Op, ch.Property, args[0])
+		}
+		if i < 0 {
+			i += len(l)
+		}
+		if i < 0 || i >= len(l) {
+			return nil, errors.NewError("Index %v out of range for %s of length %d", args[0], ch.Property, len(l))
+		}
+		v, err := schema.InternalType(args[1])
+		if err != nil {
+			return nil, err
+		}
+		l[i] = v
+		return l, nil
+	}
+
+	return nil, errors.OpNotSupported
+}
+
+// changeElements returns the elements of a collection change's value, that can be a list, a set or a single element
+func changeElements(v interface{}) []interface{} {
+
+	switch val := v.(type) {
+	case schema.List:
+		return []interface{}(val)
+	case []interface{}:
+		return val
+	case schema.Set:
+		ret := make([]interface{}, 0, len(val))
+		for e := range val {
+			ret = append(ret, e)
+		}
+		return ret
+	}
+	return []interface{}{v}
+}
+
+// applyCollectionOp applies a set, map or list change to the current value of a property, and returns its new value.
+// A nil current value is treated as an empty collection
+func applyCollectionOp(current interface{}, ch query.Change) (interface{}, error) {
+
+	switch ch.Op {
+	case query.OpListAppend, query.OpListPrepend, query.OpListRemove, query.OpListTrim, query.OpListSetAt:
+		return applyListOp(current, ch)
+
+	case query.OpSetAdd, query.OpSetDel:
+		s, ok := current.(schema.Set)
+		if current == nil {
+			s, ok = schema.NewSet(), true
+		}
+		if !ok {
+			return nil, errors.NewError("Cannot perform %s on %s: not a set", ch.Op, ch.Property)
+		}
+
+		for _, e := range changeElements(ch.Value) {
+			v, err := schema.InternalType(e)
+			if err != nil {
+				return nil, err
+			}
+			if ch.Op == query.OpSetAdd {
+				s.Add(v)
+			} else {
+				delete(s, v)
+			}
+		}
+		return s, nil
+
+	case query.OpMapSet, query.OpMapDel:
+		m, ok := current.(schema.Map)
+		if current == nil {
+			m, ok = schema.NewMap(), true
+		}
+		if !ok {
+			return nil, errors.NewError("Cannot perform %s on %s: not a map", ch.Op, ch.Property)
+		}
+
+		if ch.Op == query.OpMapDel {
+			for _, k := range changeElements(ch.Value) {
+				delete(m, fmt.Sprintf("%v", k))
+			}
+			return m, nil
+		}
+
+		var vals map[string]interface{}
+		switch v := ch.Value.(type) {
+		case schema.Map:
+			vals = v
+		case map[string]interface{}:
+			vals = v
+		default:
+			return nil, errors.NewError("Invalid value for %s on %s: %v", ch.Op, ch.Property, ch.Value)
+		}
+		for k, v := range vals {
+			m.Set(k, v)
+		}
+		return m, nil
+	}
+
+	return nil, errors.OpNotSupported
+}
+
+// checkCollections makes sure the collection changes of entities can be applied before anything is written, so a
+// change that would fail, like setting a list element out of range or adding to a property that is not a set, fails
+// the whole change set. It applies the changes of every entity to the current values of their properties, and also
+// loads collectionScript if needed.
+//
+// With watch set the checked entities are watched, so the check still holds when the transaction executes. Atomic
+// change sets need it, as they write their index changes in the same transaction
+func checkCollections(conn redis.Conn, changes []entityChange, watch bool) error {
+
+	checked := make([]entityChange, 0)
+	keys := make([]interface{}, 0)
+	for _, rc := range changes {
+		if rc.hasCollectionOps() {
+			checked = append(checked, rc)
+			keys = append(keys, rc.table.idKey(rc.objectId))
+		}
+	}
+
+	if len(checked) == 0 {
+		return nil
+	}
+
+	if err := loadCollectionScript(conn); err != nil {
+		return err
+	}
+
+	if watch {
+		if _, err := conn.Do("WATCH", keys...); err != nil {
+			return redisError(err)
+		}
+	}
+
+	batch := NewBatch(conn)
+	props := make([][]string, len(checked))
+	promises := make([]*Promise, len(checked))
+	for i, rc := range checked {
+		for _, ch := range rc.changes {
+			if isCollectionOp(ch.Op) {
+				props[i] = append(props[i], ch.Property)
+			}
+		}
+
+		var err error
+		if promises[i], err = batch.Send("HMGET", redis.Args{}.Add(keys[i]).AddFlat(props[i])...); err != nil {
+			return redisError(err)
+		}
+	}
+	if _, err := batch.Execute(); err != nil {
+		return redisError(err)
+	}
+
+	for i, rc := range checked {
+		vals, err := redis.Values(promises[i].Reply())
+		if err != nil {
+			return redisError(err)
+		}
+
+		current := make(map[string]interface{}, len(props[i]))
+		for n, p := range props[i] {
+			if b, ok := vals[n].([]byte); ok {
+				if current[p], err = decoder.Decode(b, schema.UnknownType); err != nil {
+					return errors.NewError("Could not decode %s of %s: %s", p, keys[i], err)
+				}
+			}
+		}
+
+		for _, ch := range rc.changes {
+			switch {
+			case isCollectionOp(ch.Op):
+				if current[ch.Property], err = applyCollectionOp(cloneCollection(current[ch.Property]), ch); err != nil {
+					return err
+				}
+			case ch.Op == query.OpSet:
+				current[ch.Property] = ch.Value
+			case ch.Op == query.OpPropDel:
+				delete(current, ch.Property)
+			}
+		}
+	}
+
+	return nil
+}
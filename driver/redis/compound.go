@@ -45,6 +45,13 @@ func (i *CompoundIndex) String() string {
 //    4. the filter map is for P1,P3 -  we do not match
 func (i *CompoundIndex) Matches(filters query.Filters, order query.Ordering) (bool, float32) {
 
+	// geo and text filters can only be answered by geo and full text indexes
+	for _, f := range filters {
+		if isGeoFilter(f) || isTextFilter(f) {
+			return false, 0
+		}
+	}
+
 	expectedMatches := len(filters)
 	if !order.IsNil() {
 		// if we have an ordering - it must be the last property of this index or we couldn't sort by it
@@ -103,41 +110,42 @@ func (i *CompoundIndex) Properties() []string {
 	return i.properties
 }
 
-// redisKey generates the desired redis key for this index
+// redisKey generates the desired redis key for this index. The key contains the version of the entry encoding
 func (i *CompoundIndex) RedisKey() string {
 	if i.key == "" {
-		i.key = fmt.Sprintf("k:%s/%s", i.table, strings.Join(i.properties, "_"))
+		i.key = fmt.Sprintf("k:%s/%s:v%d", i.table, strings.Join(i.properties, "_"), entryEncodingVersion)
 	}
 	return i.key
 
 }
 
-// entry returns the internal entry for a value inside the index
+// legacyKey returns the key this index used before entries were versioned, see migrate
+func (i *CompoundIndex) legacyKey() string {
+	return fmt.Sprintf("k:%s/%s", i.table, strings.Join(i.properties, "_"))
+}
+
+// entry returns the internal entry for a value inside the index. properties are expected to be encoded with encodeIndexValue
 func (i *CompoundIndex) entry(id schema.Key, properties map[string]interface{}) string {
 
 	// a valid entry is one that contains at least one non nil value
 	validEntry := false
-	stringVals := make([]byte, 0, len(i.properties)*10)
-	for n, p := range i.properties {
-		if _, found := properties[p]; !found {
+	entry := make([]byte, 0, len(i.properties)*10)
+	for _, p := range i.properties {
+		v, found := properties[p]
+		if !found {
 			return ""
 		}
-		if n > 0 {
-			stringVals = append(stringVals, '|')
-		}
-
-		v := properties[p]
 
 		if v != nil {
 			validEntry = true
-			stringVals = append(stringVals, []byte(fmt.Sprintf("%v", v))...)
+			entry = append(entry, []byte(fmt.Sprintf("%v", v))...)
 		}
+		entry = append(entry, entryTerminator)
 
 	}
 	if validEntry {
-		stringVals = append(stringVals, '|', ':', ':')
-		stringVals = append(stringVals, []byte(id)...)
-		return string(stringVals)
+		entry = append(entry, escape([]byte(id))...)
+		return string(entry)
 	}
 
 	return ""
@@ -150,21 +158,36 @@ func (i *CompoundIndex) diffEntry(eDiff *entityDiff, useNew bool) string {
 	return i.entry(eDiff.id, eDiff.vals(useNew))
 }
 
-// entry returns the internal entry for a value inside the index
+// prefixEnd returns the lowest byte string greater than all the strings starting with b, or nil if there is none
+func prefixEnd(b []byte) []byte {
+	end := append([]byte{}, b...)
+	for n := len(end) - 1; n >= 0; n-- {
+		if end[n] < 0xff {
+			end[n]++
+			return end[:n+1]
+		}
+	}
+	return nil
+}
+
+// rangeKeys converts the filters to the min and max arguments of ZRANGEBYLEX.
+//
+// Equality filters make up a prefix of all the selected entries. A single range filter (BETWEEN, >, >=, <, <= or PREFIX)
+// may follow them, selecting a range of values after that prefix. NOT EQUAL filters cannot be selected as a single range,
+// see lexRanges
 func (i *CompoundIndex) rangeKeys(vals query.Filters, order query.Ordering) (rStart string, rEnd string, err error) {
 
-	startVals := []byte("[")
-	endVals := []byte("(")
-	var pv interface{}
+	// the encoded values of the equality filters
+	prefix := make([]byte, 0, len(i.properties)*10)
 
-	nProps := 0
+	// the bounds of the range after the prefix. the lower bound is inclusive and the upper one is exclusive.
+	// nil bounds mean we are bounded just by the prefix
+	var lower, upper []byte
 
 	numRanges := 0
 
 	for _, p := range i.properties {
 
-		// append the separator if this is not the first iteration
-
 		f, found := vals[p]
 
 		// we break at the first property missing from the query.
@@ -172,26 +195,13 @@ func (i *CompoundIndex) rangeKeys(vals query.Filters, order query.Ordering) (rSt
 		if !found {
 			break
 		}
-		nProps++
-
-		switch f.Operator {
 
-		case query.Eq:
+		if f.Operator == query.Eq {
 			if numRanges > 0 {
 				err = errors.NewError("Ranges must come after equality filters in the index's column order")
 				return
 			}
-
-			if pv, err = prepareValue(f.Values[0]); err != nil {
-				return
-			}
-
-			b := []byte(fmt.Sprintf("%v|", pv))
-			startVals = append(startVals, b...)
-			endVals = append(endVals, b...)
-
-		case query.Between:
-
+		} else {
 			if !order.IsNil() && order.By != p {
 				err = errors.NewError("Range queries can only be ordered by the range property")
 				return
@@ -201,17 +211,37 @@ func (i *CompoundIndex) rangeKeys(vals query.Filters, order query.Ordering) (rSt
 				return
 			}
 			numRanges++
-			if pv, err = prepareValue(f.Values[0]); err != nil {
+		}
+
+		var v []byte
+		if len(f.Values) > 0 {
+			if v, err = encodeValue(f.Values[0]); err != nil {
 				return
-			} else {
-				startVals = append(startVals, []byte(fmt.Sprintf("%v", pv))...)
 			}
+		}
 
-			if pv, err = prepareValue(f.Values[1]); err != nil {
+		// every value in an entry is followed by the terminator, so a value's own entries are between
+		// value+terminator and value+terminator+1
+		switch f.Operator {
+		case query.Eq:
+			prefix = append(append(prefix, v...), entryTerminator)
+		case query.Gt:
+			lower = append(v, entryTerminator+1)
+		case query.Gte:
+			lower = append(v, entryTerminator)
+		case query.Lt:
+			upper = append(v, entryTerminator)
+		case query.Lte:
+			upper = append(v, entryTerminator+1)
+		case query.Between:
+			lower = append(v, entryTerminator)
+			if v, err = encodeValue(f.Values[1]); err != nil {
 				return
-			} else {
-				endVals = append(endVals, []byte(fmt.Sprintf("%v", pv))...)
 			}
+			upper = append(v, entryTerminator+1)
+		case query.Prefix:
+			lower = v
+			upper = prefixEnd(v)
 		default:
 			err = errors.NewError("Invalid filter type for index %s: %s", i.desc.Name, f.Operator)
 			return
@@ -219,17 +249,64 @@ func (i *CompoundIndex) rangeKeys(vals query.Filters, order query.Ordering) (rSt
 
 	}
 
-	if nProps > 0 {
+	switch {
+	case lower != nil:
+		rStart = "[" + string(prefix) + string(lower)
+	case len(prefix) > 0:
+		rStart = "[" + string(prefix)
+	default:
+		rStart = "-"
+	}
 
-		endVals = append(endVals, 0xff)
-		rStart = string(startVals)
-		rEnd = string(endVals)
+	switch {
+	case upper != nil:
+		rEnd = "(" + string(prefix) + string(upper)
+	case len(prefix) > 0:
+		// all the values end with the terminator, so replacing the last one with the next byte gives us
+		// an exclusive upper bound for every entry starting with the prefix
+		rEnd = "(" + string(prefix[:len(prefix)-1]) + string([]byte{entryTerminator + 1})
+	default:
+		rEnd = "+"
 	}
+
 	logging.Debug("Ranges for filters: '%s' - '%s'", rStart, rEnd)
 	return
 
 }
 
+// lexRanges returns the ZRANGEBYLEX ranges selected by the filters, in ascending order.
+// A NOT EQUAL filter is selected as two ranges - below and above its value. Otherwise there's just one range
+func (i *CompoundIndex) lexRanges(filters query.Filters, order query.Ordering) ([][2]string, error) {
+
+	for p, f := range filters {
+		if f.Operator != query.Ne {
+			continue
+		}
+
+		ret := make([][2]string, 0, 2)
+		for _, op := range []string{query.Lt, query.Gt} {
+			split := make(query.Filters, len(filters))
+			for k, v := range filters {
+				split[k] = v
+			}
+			split[p] = query.Filter{Property: p, Operator: op, Values: f.Values}
+
+			start, end, err := i.rangeKeys(split, order)
+			if err != nil {
+				return nil, err
+			}
+			ret = append(ret, [2]string{start, end})
+		}
+		return ret, nil
+	}
+
+	start, end, err := i.rangeKeys(filters, order)
+	if err != nil {
+		return nil, err
+	}
+	return [][2]string{{start, end}}, nil
+}
+
 //// UnindexEntities removes a list of entities from this index
 //func (i *CompoundIndex) UnindexEntities(entities ...schema.Entity) error {
 
@@ -324,54 +401,142 @@ func (i *CompoundIndex) Pipeline(tx *Transaction) (chan<- *entityDiff, <-chan er
 // We assume matching of the index to the query has been checked before
 func (i *CompoundIndex) Find(filters query.Filters, offset, limit int, order query.Ordering) ([]schema.Key, int, error) {
 
-	// now we ZRANGE the selected key - either the original one or an aggregated one
-	b := NewBatch(pool.Get())
-	defer b.Abort()
-
-	rangeStart, rangeEnd, err := i.rangeKeys(filters, order)
+	ranges, err := i.lexRanges(filters, order)
 	if err != nil {
 		return nil, 0, err
 	}
 
-	cmd := newRedisCommand("ZRANGEBYLEX", i.RedisKey(), rangeStart, rangeEnd)
+	// If the query is ordered and descending, we go over the ranges in reverse
+	desc := !order.IsNil() && !order.Ascending
+	if desc {
+		for n := 0; n < len(ranges)/2; n++ {
+			ranges[n], ranges[len(ranges)-1-n] = ranges[len(ranges)-1-n], ranges[n]
+		}
+	}
 
-	// If the query is ordered and descending, we do a ZREVBYLEX and reverse end and start
-	if !order.IsNil() && !order.Ascending {
-		cmd = newRedisCommand("ZREVRANGEBYLEX", i.RedisKey(), rangeEnd, rangeStart)
+	// with multiple ranges we need their cardinalities first, to know how to page over them
+	counts := make([]int, len(ranges))
+	if len(ranges) > 1 {
+		if counts, err = i.rangeCounts(ranges); err != nil {
+			return nil, 0, err
+		}
 	}
 
-	if limit > 0 {
-		cmd.add("LIMIT", offset, offset+limit)
+	// now we ZRANGE the selected key - either the original one or an aggregated one
+	b := NewBatch(pool.Get())
+	defer b.Abort()
+
+	// like with a single range, a limit of 0 or less selects everything after the offset.
+	// remaining counts down the limit over multiple ranges, and 0 means it's been exhausted
+	remaining := limit
+	if remaining <= 0 {
+		remaining = -1
 	}
 
-	if _, err := b.Send(cmd.command, cmd.args...); err != nil {
-		return nil, 0, redisError(err)
+	var idsPromises []*Promise
+	for n, r := range ranges {
+
+		cmd := newRedisCommand("ZRANGEBYLEX", i.RedisKey(), r[0], r[1])
+
+		// If the query is ordered and descending, we do a ZREVBYLEX and reverse end and start
+		if desc {
+			cmd = newRedisCommand("ZREVRANGEBYLEX", i.RedisKey(), r[1], r[0])
+		}
+
+		if len(ranges) > 1 {
+			// skip ranges that are before the offset or after the limit
+			if offset >= counts[n] {
+				offset -= counts[n]
+				continue
+			}
+			if remaining == 0 {
+				break
+			}
+
+			cmd.add("LIMIT", offset, remaining)
+			if remaining > 0 {
+				if remaining -= counts[n] - offset; remaining < 0 {
+					remaining = 0
+				}
+			}
+			offset = 0
+		} else if limit > 0 {
+			cmd.add("LIMIT", offset, limit)
+		} else if offset > 0 {
+			cmd.add("LIMIT", offset, -1)
+		}
+
+		p, err := b.Send(cmd.command, cmd.args...)
+		if err != nil {
+			return nil, 0, redisError(err)
+		}
+		idsPromises = append(idsPromises, p)
 	}
 
 	//we also want the cardinality of the key - i.e. how many results did we find
-	// we reuse the args of the RANGE command but trim them if they have a LIMIT set
-	if _, err := b.Send("ZLEXCOUNT", cmd.args[:3]...); err != nil {
-		return nil, 0, redisError(err)
+	var countPromise *Promise
+	if len(ranges) == 1 {
+		if countPromise, err = b.Send("ZLEXCOUNT", i.RedisKey(), ranges[0][0], ranges[0][1]); err != nil {
+			return nil, 0, redisError(err)
+		}
 	}
 
-	rets, err := b.Execute()
-	if err != nil {
+	if _, err := b.Execute(); err != nil {
 		return nil, 0, redisError(err)
 	}
 
-	ids, _ := redis.Strings(rets[0].Reply())
-	card, _ := redis.Int(rets[1].Reply())
-	//logging.Debug("Ids: %s, total: %s", ids, card)
-	ret := make([]schema.Key, len(ids))
-	for n, id := range ids {
-		ret[n] = extractId(id)
+	ret := make([]schema.Key, 0, len(idsPromises))
+	for _, p := range idsPromises {
+		ids, _ := redis.Strings(p.Reply())
+		for _, id := range ids {
+			ret = append(ret, entryId(id))
+		}
+	}
 
+	card := 0
+	if countPromise != nil {
+		card, _ = redis.Int(countPromise.Reply())
+	} else {
+		for _, c := range counts {
+			card += c
+		}
 	}
 
 	return ret, card, nil
 
 }
 
+// rangeCounts returns the number of entries in each of the given ranges
+func (i *CompoundIndex) rangeCounts(ranges [][2]string) ([]int, error) {
+
+	b := NewBatch(pool.Get())
+	defer b.Abort()
+
+	for _, r := range ranges {
+		if _, err := b.Send("ZLEXCOUNT", i.RedisKey(), r[0], r[1]); err != nil {
+			return nil, redisError(err)
+		}
+	}
+
+	rets, err := b.Execute()
+	if err != nil {
+		return nil, redisError(err)
+	}
+
+	ret := make([]int, len(rets))
+	for n := range rets {
+		ret[n], _ = redis.Int(rets[n].Reply())
+	}
+	return ret, nil
+}
+
+// ExtractId returns the id of the entity an index entry points to
+func (i CompoundIndex) ExtractId(entry string) schema.Key {
+	return entryId(entry)
+}
+
+// extractId extracts the id from an entry in the form of value::id, used by full text and sorted indexes,
+// and by compound indexes before entries were versioned
 func extractId(s string) schema.Key {
 	parts := strings.Split(s, "::")
 	if len(parts) == 2 {
@@ -451,7 +616,7 @@ func (i CompoundIndex) Scan(chunk int) (<-chan schema.Key, chan<- bool) {
 		ch, sch := i.RawEntries(chunk)
 
 		for id := range ch {
-			k := extractId(id)
+			k := entryId(id)
 			select {
 			case idch <- k:
 				logging.Debug("Scann pushed id %s", id)
@@ -0,0 +1,209 @@
+package redis
+
+import (
+	"reflect"
+	"time"
+
+	"github.com/garyburd/redigo/redis"
+	"github.com/EverythingMe/meduza/errors"
+	"github.com/EverythingMe/meduza/query"
+	"github.com/EverythingMe/meduza/schema"
+)
+
+// conditionHolds checks a condition against the raw value of its property, as read from the entity's hash
+func conditionHolds(cond query.Condition, raw interface{}) (bool, error) {
+
+	var current interface{}
+	if b, ok := raw.([]byte); ok {
+		var err error
+		if current, err = decoder.Decode(b, schema.UnknownType); err != nil {
+			return false, errors.NewError("Could not decode %s: %s", cond.Property, err)
+		}
+	}
+
+	// entities that were never written have version 0
+	if cond.Property == schema.VersionKey && current == nil {
+		current = schema.Int(0)
+	}
+
+	expected, err := schema.InternalType(cond.Value)
+	if err != nil {
+		return false, err
+	}
+
+	return valuesEqual(current, expected), nil
+}
+
+// valuesEqual compares two values of internal types. Timestamps are stored at second precision and decoded in the
+// local time zone, so they are compared by their unix time, and integers are compared by value whether they are
+// signed or not
+func valuesEqual(a, b interface{}) bool {
+
+	switch x := a.(type) {
+	case schema.Timestamp:
+		if y, ok := b.(schema.Timestamp); ok {
+			return time.Time(x).Unix() == time.Time(y).Unix()
+		}
+	case schema.Int:
+		switch y := b.(type) {
+		case schema.Int:
+			return x == y
+		case schema.Uint:
+			return x >= 0 && schema.Uint(x) == y
+		}
+	case schema.Uint:
+		if y, ok := b.(schema.Int); ok {
+			return y >= 0 && schema.Uint(y) == x
+		}
+	}
+
+	return reflect.DeepEqual(a, b)
+}
+
+// checkConditions makes sure all the entities of the change set meet their conditions, and returns
+// errors.ConflictError if any of them does not.
+//
+// The entities are watched on the connection, so the transaction that follows fails if any of them changes
+// before it executes, and the conditions are checked again when the change set is retried
+func (c *changeSet) checkConditions(conn redis.Conn) error {
+
+	keys := make([]interface{}, 0)
+	for _, rc := range c.changes {
+		if len(rc.conditions) > 0 {
+			keys = append(keys, rc.table.idKey(rc.objectId))
+		}
+	}
+
+	if len(keys) == 0 {
+		return nil
+	}
+
+	if _, err := conn.Do("WATCH", keys...); err != nil {
+		return redisError(err)
+	}
+
+	for _, rc := range c.changes {
+		if len(rc.conditions) == 0 {
+			continue
+		}
+
+		args := redis.Args{}.Add(rc.table.idKey(rc.objectId))
+		for _, cond := range rc.conditions {
+			args = args.Add(cond.Property)
+		}
+		if err := conn.Send("HMGET", args...); err != nil {
+			return redisError(err)
+		}
+	}
+	if err := conn.Flush(); err != nil {
+		return redisError(err)
+	}
+
+	// we read all the replies before checking anything, so none are left pending on the connection
+	replies := make([][]interface{}, 0, len(keys))
+	for range keys {
+		vals, err := redis.Values(conn.Receive())
+		if err != nil {
+			return redisError(err)
+		}
+		replies = append(replies, vals)
+	}
+
+	n := 0
+	for _, rc := range c.changes {
+		if len(rc.conditions) == 0 {
+			continue
+		}
+
+		for i, cond := range rc.conditions {
+			if ok, err := conditionHolds(cond, replies[n][i]); err != nil {
+				return err
+			} else if !ok {
+				return errors.ConflictError
+			}
+		}
+		n++
+	}
+
+	return nil
+}
+
+// checkExistence checks the entities of the change set that must or must not exist, and returns a change set
+// without the changes of entities that don't meet their requirement. Their outcomes are set to rejected, and the
+// outcomes of the others to created or updated. Atomic change sets are not applied partially, so they fail with
+// errors.ConflictError instead if any entity is rejected.
+//
+// Entities with column defaults are checked too, and get their defaults only if they do not exist yet.
+//
+// Like conditions, the checked entities are watched so the requirements hold when the transaction executes
+func (c *changeSet) checkExistence(conn redis.Conn) (*changeSet, error) {
+
+	keys := make([]interface{}, 0)
+	for _, rc := range c.changes {
+		if rc.existence != anyExistence || len(rc.defaults) > 0 {
+			keys = append(keys, rc.table.idKey(rc.objectId))
+		}
+	}
+
+	if len(keys) == 0 {
+		return c, nil
+	}
+
+	if _, err := conn.Do("WATCH", keys...); err != nil {
+		return nil, redisError(err)
+	}
+
+	for _, k := range keys {
+		if err := conn.Send("EXISTS", k); err != nil {
+			return nil, redisError(err)
+		}
+	}
+	if err := conn.Flush(); err != nil {
+		return nil, redisError(err)
+	}
+
+	exists := make([]bool, 0, len(keys))
+	for range keys {
+		ok, err := redis.Bool(conn.Receive())
+		if err != nil {
+			return nil, redisError(err)
+		}
+		exists = append(exists, ok)
+	}
+
+	ret := newChangeSet(len(c.changes))
+	n := 0
+	for _, rc := range c.changes {
+		if rc.existence == anyExistence && len(rc.defaults) == 0 {
+			ret.Add(rc)
+			continue
+		}
+
+		outcome := query.OutcomeRejected
+		switch {
+		case rc.existence == mustExist && exists[n]:
+			outcome = query.OutcomeUpdated
+		case rc.existence == mustNotExist && !exists[n]:
+			outcome = query.OutcomeCreated
+		case rc.existence == anyExistence && exists[n]:
+			outcome = query.OutcomeUpdated
+		case rc.existence == anyExistence:
+			outcome = query.OutcomeCreated
+			rc = rc.withDefaults()
+		}
+		n++
+
+		if outcome == query.OutcomeRejected && c.atomic {
+			return nil, errors.ConflictError
+		}
+
+		if rc.outcome != nil {
+			*rc.outcome = outcome
+		}
+		if outcome != query.OutcomeRejected {
+			ret.Add(rc)
+		}
+	}
+
+	return ret, nil
+}
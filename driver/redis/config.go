@@ -10,15 +10,33 @@ type Config struct {
 	RepairFrequency       int    `yaml:"repair_freq_ms"`
 	TextCompressThreshold int    `yaml:"text_compress_threshold"`
 	DeleteChunkSize       int    `yaml:"del_chunk_size"`
+	// The maximal number of ids selected by a single index when intersecting indexes or evaluating
+	// filter expressions. 0 means no limit
+	MaxIntermediateResults int `yaml:"max_intermediate_results"`
+	// The same limit for COUNT queries, that only need the cardinality of the combined ids and not the entities.
+	// 0 means no limit
+	MaxCountIntermediateResults int `yaml:"max_count_intermediate_results"`
+	// How often index statistics are sampled for query planning, in seconds. 0 disables background sampling
+	StatsFrequency int `yaml:"stats_freq_sec"`
+	// The number of entities indexed at once when backfilling a new index
+	BackfillChunkSize int `yaml:"backfill_chunk_size"`
+	// How long the data of dropped tables and indexes is kept before it is deleted, in seconds, so they can be
+	// restored by adding them back. 0 deletes it right away
+	GarbageRetention int `yaml:"garbage_retention_sec"`
 }
 
 var DefaultConfig = Config{
-	Network:               "tcp",
-	Addr:                  "localhost:6379",
-	Timeout:               1000,
-	Master:                true,
-	RepairEnabled:         false,
-	RepairFrequency:       50,
-	TextCompressThreshold: 2048,
-	DeleteChunkSize:       100,
+	Network:                     "tcp",
+	Addr:                        "localhost:6379",
+	Timeout:                     1000,
+	Master:                      true,
+	RepairEnabled:               false,
+	RepairFrequency:             50,
+	TextCompressThreshold:       2048,
+	DeleteChunkSize:             100,
+	MaxIntermediateResults:      10000,
+	MaxCountIntermediateResults: 100000,
+	StatsFrequency:              60,
+	BackfillChunkSize:           100,
+	GarbageRetention:            86400,
 }
@@ -0,0 +1,114 @@
+package redis
+
+import (
+	"github.com/garyburd/redigo/redis"
+	"github.com/EverythingMe/meduza/errors"
+	"github.com/EverythingMe/meduza/query"
+	"github.com/EverythingMe/meduza/schema"
+)
+
+// countIndex is implemented by indexes that can count the entries matching a set of filters without reading them
+type countIndex interface {
+	index
+	count(filters query.Filters) (int, error)
+}
+
+// count sums the ZLEXCOUNT of all the ranges selected by the filters
+func (i *CompoundIndex) count(filters query.Filters) (int, error) {
+
+	ranges, err := i.lexRanges(filters, query.NoOrder)
+	if err != nil {
+		return 0, err
+	}
+
+	counts, err := i.rangeCounts(ranges)
+	if err != nil {
+		return 0, err
+	}
+
+	ret := 0
+	for _, c := range counts {
+		ret += c
+	}
+	return ret, nil
+}
+
+// count returns the ZCOUNT of the score range selected by the filter
+func (i *SortedIndex) count(filters query.Filters) (int, error) {
+
+	f, single := filters.One()
+	if !single || f.Property != i.prop() {
+		return 0, errors.NewError("Filters do not match sorted index %s", i)
+	}
+
+	min, max, err := i.scoreRange(f)
+	if err != nil {
+		return 0, err
+	}
+
+	conn := pool.Get()
+	defer conn.Close()
+
+	ret, err := redis.Int(conn.Do("ZCOUNT", i.RedisKey(), min, max))
+	if err != nil {
+		return 0, redisError(err)
+	}
+	return ret, nil
+}
+
+// Count returns the number of entities matching a selection, without loading them.
+//
+// Selections of all the table's ids are answered by the cardinality of the primary index, and lookups by id
+// by checking which of the ids exist. Compound and sorted indexes count the entries in their selected ranges.
+// Geo and full text indexes are counted by the total of a single id page. Intersections and expressions are counted
+// by the cardinality of their combined set. Their sorted index leaves are stored on the server, and the others with
+// the MaxCountIntermediateResults cap, that leaves answered by compound indexes check with ZLEXCOUNT before their
+// ids are read
+func (t *table) Count(sel query.Expression) (int, error) {
+
+	x := newExprEvaluator(t)
+	x.max = DefaultConfig.MaxCountIntermediateResults
+
+	if filters, ok := sel.Filters(); ok {
+
+		idx := t.selectIndex(filters, query.NoOrder)
+		if t.usePrimary(filters, query.NoOrder, idx) {
+
+			if f, single := filters.One(); single && f.Property == schema.IdKey && f.Operator == query.All {
+				conn := pool.Get()
+				defer conn.Close()
+
+				ret, err := redis.Int(conn.Do("ZCARD", t.primary.RedisKey()))
+				if err != nil {
+					return 0, redisError(err)
+				}
+				return ret, nil
+			}
+
+			ids, _, err := t.primary.Find(filters, 0, -1, query.NoOrder)
+			if err != nil {
+				return 0, err
+			}
+			return len(ids), nil
+		}
+
+		if ci, ok := idx.(countIndex); ok {
+			return ci.count(filters)
+		}
+
+		if idx != nil {
+			_, total, err := idx.Find(filters, 0, 1, query.NoOrder)
+			return total, err
+		}
+
+		groups := t.planIntersection(filters)
+		if groups == nil {
+			return 0, errors.NoIndexError
+		}
+		_, total, err := x.Intersect(groups, 0, 1, query.NoOrder)
+		return total, err
+	}
+
+	_, total, err := x.Find(sel, 0, 1, query.NoOrder)
+	return total, err
+}
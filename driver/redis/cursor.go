@@ -0,0 +1,396 @@
+package redis
+
+import (
+	"encoding/base64"
+	"encoding/binary"
+	"fmt"
+	"math"
+	"strconv"
+	"strings"
+
+	"github.com/garyburd/redigo/redis"
+	"github.com/EverythingMe/meduza/errors"
+	"github.com/EverythingMe/meduza/query"
+	"github.com/EverythingMe/meduza/schema"
+)
+
+// cursor marks where a page of results ended, so the next page can resume right after it.
+//
+// Index cursors hold the name of the scanned index and the raw entry of the last result. They resume scans of
+// compound indexes, sorted indexes and the primary index exactly where they stopped, regardless of entities
+// inserted or deleted in the meantime. The other selections - geo, full text, intersections and expressions - have
+// no stable order to resume from, so they fall back to offset cursors
+type cursor struct {
+	index  string
+	entry  string
+	offset int
+}
+
+// cursorVersion is the first byte of encoded cursors, so we can change their format without misreading old ones
+const cursorVersion = 1
+
+// encode returns the cursor as an opaque url safe token
+func (c cursor) encode() string {
+
+	buf := make([]byte, 0, 1+len(c.index)+len(c.entry)+3*binary.MaxVarintLen64)
+	tmp := make([]byte, binary.MaxVarintLen64)
+
+	buf = append(buf, cursorVersion)
+	for _, s := range []string{c.index, c.entry} {
+		buf = append(buf, tmp[:binary.PutUvarint(tmp, uint64(len(s)))]...)
+		buf = append(buf, s...)
+	}
+	buf = append(buf, tmp[:binary.PutUvarint(tmp, uint64(c.offset))]...)
+
+	return base64.RawURLEncoding.EncodeToString(buf)
+}
+
+// decodeCursor parses a token created by cursor.encode
+func decodeCursor(token string) (cursor, error) {
+
+	invalid := errors.NewError("Invalid cursor: %s", token)
+
+	buf, err := base64.RawURLEncoding.DecodeString(token)
+	if err != nil || len(buf) == 0 || buf[0] != cursorVersion {
+		return cursor{}, invalid
+	}
+	buf = buf[1:]
+
+	// reads the next varint from the buffer
+	next := func() (int, bool) {
+		v, n := binary.Uvarint(buf)
+		if n <= 0 || v > math.MaxInt32 {
+			return 0, false
+		}
+		buf = buf[n:]
+		return int(v), true
+	}
+
+	var strs [2]string
+	for n := range strs {
+		l, ok := next()
+		if !ok || l > len(buf) {
+			return cursor{}, invalid
+		}
+		strs[n], buf = string(buf[:l]), buf[l:]
+	}
+
+	offset, ok := next()
+	if !ok || len(buf) > 0 {
+		return cursor{}, invalid
+	}
+
+	return cursor{index: strs[0], entry: strs[1], offset: offset}, nil
+}
+
+// cursorIndex is implemented by indexes that can resume a scan right after one of their raw entries
+type cursorIndex interface {
+	index
+
+	// findAfter returns up to limit ids matching the filters that come after a raw entry in the query's order,
+	// and the total number of matching ids. An empty entry starts from the first match.
+	//
+	// It also returns the raw entry of the last id scanned, to resume the next page from, or an empty string if
+	// there are no more matches
+	findAfter(filters query.Filters, after string, limit int, order query.Ordering) ([]schema.Key, string, int, error)
+}
+
+// findAfter pages over the ranges of the filters, resuming each one right after the raw entry
+func (i *CompoundIndex) findAfter(filters query.Filters, after string, limit int, order query.Ordering) ([]schema.Key, string, int, error) {
+
+	ranges, err := i.lexRanges(filters, order)
+	if err != nil {
+		return nil, "", 0, err
+	}
+
+	desc := !order.IsNil() && !order.Ascending
+	if desc {
+		for n := 0; n < len(ranges)/2; n++ {
+			ranges[n], ranges[len(ranges)-1-n] = ranges[len(ranges)-1-n], ranges[n]
+		}
+	}
+
+	b := NewBatch(pool.Get())
+	defer b.Abort()
+
+	idsPromises := make([]*Promise, 0, len(ranges))
+	countPromises := make([]*Promise, 0, len(ranges))
+	for _, r := range ranges {
+
+		// the total counts the whole ranges, not just what's left of them
+		p, err := b.Send("ZLEXCOUNT", i.RedisKey(), r[0], r[1])
+		if err != nil {
+			return nil, "", 0, redisError(err)
+		}
+		countPromises = append(countPromises, p)
+
+		// the entry tightens the bound we start from, unless the range starts after it anyway.
+		// ranges that end before the entry become empty
+		min, max := r[0], r[1]
+		cmd := newRedisCommand("ZRANGEBYLEX", i.RedisKey())
+		if desc {
+			if after != "" && (max == "+" || after <= max[1:]) {
+				max = "(" + after
+			}
+			cmd.command = "ZREVRANGEBYLEX"
+			cmd.add(max, min)
+		} else {
+			if after != "" && (min == "-" || after >= min[1:]) {
+				min = "(" + after
+			}
+			cmd.add(min, max)
+		}
+		if limit > 0 {
+			cmd.add("LIMIT", 0, limit)
+		}
+
+		if p, err = b.Send(cmd.command, cmd.args...); err != nil {
+			return nil, "", 0, redisError(err)
+		}
+		idsPromises = append(idsPromises, p)
+	}
+
+	if _, err := b.Execute(); err != nil {
+		return nil, "", 0, redisError(err)
+	}
+
+	total := 0
+	for _, p := range countPromises {
+		n, _ := redis.Int(p.Reply())
+		total += n
+	}
+
+	entries := make([]string, 0)
+	for _, p := range idsPromises {
+		vals, _ := redis.Strings(p.Reply())
+		entries = append(entries, vals...)
+	}
+
+	next := ""
+	if limit > 0 && len(entries) >= limit {
+		entries = entries[:limit]
+		next = entries[limit-1]
+	}
+
+	ret := make([]schema.Key, len(entries))
+	for n, entry := range entries {
+		ret[n] = entryId(entry)
+	}
+
+	return ret, next, total, nil
+}
+
+// sortedEntry returns the raw entry of an id in a sorted index, in the form of score::id
+func sortedEntry(score, id string) string {
+	return fmt.Sprintf("%s::%s", score, id)
+}
+
+// findAfter pages over the score range of the filter, resuming right after the raw entry.
+//
+// Entries with equal scores are ordered by id, so we resume from the entry's score and skip the ids at that score
+// we have already returned
+func (i *SortedIndex) findAfter(filters query.Filters, after string, limit int, order query.Ordering) ([]schema.Key, string, int, error) {
+
+	f, single := filters.One()
+	if !single || f.Property != i.prop() {
+		return nil, "", 0, errors.NewError("Filters do not match sorted index %s", i)
+	}
+
+	min, max, err := i.scoreRange(f)
+	if err != nil {
+		return nil, "", 0, err
+	}
+
+	conn := pool.Get()
+	defer conn.Close()
+
+	total, err := redis.Int(conn.Do("ZCOUNT", i.RedisKey(), min, max))
+	if err != nil {
+		return nil, "", 0, redisError(err)
+	}
+
+	desc := !order.IsNil() && !order.Ascending
+
+	var lastScore float64
+	var lastId string
+	if after != "" {
+		parts := strings.SplitN(after, "::", 2)
+		if len(parts) != 2 {
+			return nil, "", 0, errors.NewError("Invalid entry for sorted index %s: %s", i, after)
+		}
+		if lastScore, err = strconv.ParseFloat(parts[0], 64); err != nil {
+			return nil, "", 0, errors.NewError("Invalid entry for sorted index %s: %s", i, after)
+		}
+		lastId = parts[1]
+
+		if desc {
+			max = parts[0]
+		} else {
+			min = parts[0]
+		}
+	}
+
+	ret := make([]schema.Key, 0)
+	next := ""
+	for offset := 0; ; {
+
+		cmd := newRedisCommand("ZRANGEBYSCORE", i.RedisKey(), min, max, "WITHSCORES")
+		if desc {
+			cmd = newRedisCommand("ZREVRANGEBYSCORE", i.RedisKey(), max, min, "WITHSCORES")
+		}
+		if limit > 0 {
+			cmd.add("LIMIT", offset, limit)
+		}
+
+		vals, err := redis.Strings(conn.Do(cmd.command, cmd.args...))
+		if err != nil {
+			return nil, "", 0, redisError(err)
+		}
+
+		// WITHSCORES returns member, score pairs
+		for n := 0; n+1 < len(vals); n += 2 {
+			offset++
+
+			if after != "" {
+				score, _ := strconv.ParseFloat(vals[n+1], 64)
+				if score == lastScore && ((!desc && vals[n] <= lastId) || (desc && vals[n] >= lastId)) {
+					continue
+				}
+			}
+
+			ret = append(ret, schema.Key(vals[n]))
+			if limit > 0 && len(ret) == limit {
+				next = sortedEntry(vals[n+1], vals[n])
+				return ret, next, total, nil
+			}
+		}
+
+		// we've exhausted the range
+		if limit <= 0 || len(vals) < 2*limit {
+			return ret, next, total, nil
+		}
+	}
+}
+
+// findAfter pages over all the ids of the table, resuming right after the id in the entry.
+// All the primary index's entries have the same score, so they are ordered by id
+func (i basePrimaryIndex) findAfter(filters query.Filters, after string, limit int, order query.Ordering) ([]schema.Key, string, int, error) {
+
+	if f, single := filters.One(); !single || f.Property != schema.IdKey || f.Operator != query.All {
+		return nil, "", 0, errors.NewError("Only scans of all ids can be resumed on the primary index")
+	}
+
+	start, end := "-", "+"
+	cmd := newRedisCommand("ZRANGEBYLEX", i.RedisKey())
+	if !order.Ascending {
+		start, end = end, start
+		cmd.command = "ZREVRANGEBYLEX"
+	}
+	if after != "" {
+		start = "(" + after
+	}
+	cmd.add(start, end)
+	if limit > 0 {
+		cmd.add("LIMIT", 0, limit)
+	}
+
+	conn := pool.Get()
+	entries, err := redis.Strings(conn.Do(cmd.command, cmd.args...))
+	conn.Close()
+	if err != nil {
+		return nil, "", 0, redisError(err)
+	}
+
+	next := ""
+	if limit > 0 && len(entries) == limit {
+		next = entries[limit-1]
+	}
+
+	// find drops and repairs dangling ids, and counts the whole index
+	args := make([]interface{}, len(entries))
+	for n := range entries {
+		args[n] = entries[n]
+	}
+	ids, total, err := i.find(args)
+	if err != nil {
+		return nil, "", 0, err
+	}
+
+	return ids, next, total, nil
+}
+
+// pageIds selects a page of ids for a selection, starting right after a cursor if one is given, and returns the
+// cursor of the next page along with the ids and the total number of matches. The cursor is empty if there are no
+// more matches.
+//
+// Index cursors pin the index they were created by, so changes in the index statistics don't switch the plan
+// in the middle of an iteration
+func (t *table) pageIds(sel query.Expression, paging query.Paging, token string, order query.Ordering) ([]schema.Key, int, string, error) {
+
+	c := cursor{offset: paging.Offset}
+	if token != "" {
+		var err error
+		if c, err = decodeCursor(token); err != nil {
+			return nil, 0, "", err
+		}
+	}
+
+	filters, isFilters := sel.Filters()
+
+	// primary lookups by id return all their ids at once, and the size of the table as their total
+	byIds := false
+	if isFilters {
+		f, single := filters.One()
+		if i := t.selectIndex(filters, order); t.usePrimary(filters, order, i) {
+			byIds = !(single && f.Operator == query.All)
+		}
+	}
+
+	// resume or start an index scan if we can
+	var idx cursorIndex
+	if isFilters {
+		if c.index != "" {
+			indexes := t.readyIndexes()
+			candidates := make([]index, 0, len(indexes)+1)
+			candidates = append(candidates, t.primary)
+			candidates = append(candidates, indexes...)
+			for _, i := range candidates {
+				if fmt.Sprint(i) == c.index {
+					if match, _ := i.Matches(filters, order); match {
+						idx, _ = i.(cursorIndex)
+					}
+					break
+				}
+			}
+			if idx == nil {
+				return nil, 0, "", errors.NewError("Cursor does not match the query")
+			}
+		} else if c.offset == 0 && !byIds {
+			if i := t.selectIndex(filters, order); t.usePrimary(filters, order, i) {
+				idx, _ = t.primary.(cursorIndex)
+			} else if i != nil {
+				idx, _ = i.(cursorIndex)
+			}
+		}
+	} else if c.index != "" {
+		return nil, 0, "", errors.NewError("Cursor does not match the query")
+	}
+
+	if idx != nil {
+		ids, entry, total, err := idx.findAfter(filters, c.entry, paging.Limit, order)
+		if err != nil || entry == "" {
+			return ids, total, "", err
+		}
+		return ids, total, cursor{index: fmt.Sprint(idx), entry: entry}.encode(), nil
+	}
+
+	ids, total, err := t.selectIds(sel, c.offset, paging.Limit, order)
+	if err != nil {
+		return nil, 0, "", err
+	}
+
+	if !byIds && paging.Limit > 0 && len(ids) > 0 && c.offset+len(ids) < total {
+		return ids, total, cursor{offset: c.offset + len(ids)}.encode(), nil
+	}
+	return ids, total, "", nil
+}
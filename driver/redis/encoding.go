@@ -0,0 +1,226 @@
+package redis
+
+import (
+	"bytes"
+	"encoding/binary"
+	"math"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/EverythingMe/meduza/errors"
+	"github.com/EverythingMe/meduza/schema"
+)
+
+// entryEncodingVersion is the version of the encoding of compound index entries. It is part of the index's
+// redis key, so indexes written in an older encoding can be detected and migrated
+const entryEncodingVersion = 2
+
+// Compound index entries are built of the encoded values of the indexed properties, each terminated by
+// entryTerminator, followed by the escaped entity id.
+//
+// Encoded values never contain the terminator - zero bytes are escaped as escapeByte+1, and escape bytes as
+// escapeByte+2. Since the terminator is lower than any other byte, an entry for a value always sorts before
+// entries for longer values sharing its prefix, making the encoding both order preserving and prefix free
+const (
+	entryTerminator = 0x00
+	escapeByte      = 0x01
+)
+
+// escape escapes a raw encoded value so it does not contain the entry terminator
+func escape(b []byte) []byte {
+
+	ret := make([]byte, 0, len(b)+2)
+	for _, c := range b {
+		switch c {
+		case entryTerminator, escapeByte:
+			ret = append(ret, escapeByte, c+1)
+		default:
+			ret = append(ret, c)
+		}
+	}
+	return ret
+}
+
+// unescape reverses escape
+func unescape(b []byte) []byte {
+
+	ret := make([]byte, 0, len(b))
+	for n := 0; n < len(b); n++ {
+		if b[n] == escapeByte && n+1 < len(b) {
+			n++
+			ret = append(ret, b[n]-1)
+			continue
+		}
+		ret = append(ret, b[n])
+	}
+	return ret
+}
+
+// encodeUint encodes an unsigned integer as 8 big endian bytes, preserving its order
+func encodeUint(v uint64) []byte {
+	ret := make([]byte, 8)
+	binary.BigEndian.PutUint64(ret, v)
+	return ret
+}
+
+// encodeInt encodes a signed integer, flipping its sign bit so negative numbers sort before positive ones
+func encodeInt(v int64) []byte {
+	return encodeUint(uint64(v) ^ 0x8000000000000000)
+}
+
+// encodeFloat encodes a float so that its byte order matches its numeric order. Positive numbers get their sign
+// bit set, and negative numbers are inverted entirely, reversing their order
+func encodeFloat(v float64) []byte {
+	bits := math.Float64bits(v)
+	if bits&0x8000000000000000 != 0 {
+		bits = ^bits
+	} else {
+		bits |= 0x8000000000000000
+	}
+	return encodeUint(bits)
+}
+
+// encodeElements encodes a sequence of values, each escaped and terminated, so sequences are ordered element by element
+func encodeElements(vals []interface{}) ([]byte, error) {
+
+	ret := make([]byte, 0, len(vals)*10)
+	for _, v := range vals {
+		b, err := encodeValue(v)
+		if err != nil {
+			return nil, err
+		}
+		ret = append(append(ret, b...), entryTerminator)
+	}
+	return ret, nil
+}
+
+// encodeRaw encodes a value into an order preserving byte representation, not yet escaped.
+// Texts are normalized before encoding, so they are matched case and accent insensitively
+func encodeRaw(val interface{}) ([]byte, error) {
+
+	switch v := val.(type) {
+	case schema.Text:
+		return encodeRaw(string(v))
+	case string:
+		nrml := getNormalizer()
+		defer putNormalizer(nrml)
+		s, err := nrml.NormalizeString(v)
+		if err != nil {
+			return nil, err
+		}
+		return []byte(s), nil
+	case schema.Key:
+		return []byte(v), nil
+	case schema.Binary:
+		return []byte(v), nil
+	case []byte:
+		return v, nil
+	case schema.Int:
+		return encodeInt(int64(v)), nil
+	case int64:
+		return encodeInt(v), nil
+	case int32:
+		return encodeInt(int64(v)), nil
+	case int:
+		return encodeInt(int64(v)), nil
+	case schema.Uint:
+		return encodeUint(uint64(v)), nil
+	case uint64:
+		return encodeUint(v), nil
+	case uint32:
+		return encodeUint(uint64(v)), nil
+	case schema.Float:
+		return encodeFloat(float64(v)), nil
+	case float64:
+		return encodeFloat(v), nil
+	case float32:
+		return encodeFloat(float64(v)), nil
+	case schema.Bool:
+		return encodeRaw(bool(v))
+	case bool:
+		if v {
+			return []byte{1}, nil
+		}
+		return []byte{0}, nil
+	case schema.Timestamp:
+		// timestamps are stored in second resolution, so we index them the same way
+		return encodeInt(time.Time(v).Unix()), nil
+	case time.Time:
+		return encodeInt(v.Unix()), nil
+	case schema.List:
+		return encodeElements(v)
+	case schema.Set:
+		// sets are encoded as the sorted list of their encoded elements
+		elems := make([][]byte, 0, len(v))
+		for e := range v {
+			b, err := encodeValue(e)
+			if err != nil {
+				return nil, err
+			}
+			elems = append(elems, b)
+		}
+		sort.Sort(byteSlices(elems))
+
+		ret := []byte{}
+		for _, b := range elems {
+			ret = append(append(ret, b...), entryTerminator)
+		}
+		return ret, nil
+	case schema.Map:
+		// maps are encoded as a list of key, value pairs sorted by key
+		keys := make([]string, 0, len(v))
+		for k := range v {
+			keys = append(keys, k)
+		}
+		sort.Strings(keys)
+
+		elems := make([]interface{}, 0, len(v)*2)
+		for _, k := range keys {
+			elems = append(elems, []byte(k), v[k])
+		}
+		return encodeElements(elems)
+	}
+
+	return nil, errors.NewError("Cannot encode value of type %T for indexing", val)
+}
+
+// encodeValue encodes a value for a compound index entry. The result preserves the value's order, and never contains
+// the entry terminator. nil values are encoded as nil
+func encodeValue(val interface{}) ([]byte, error) {
+	if val == nil {
+		return nil, nil
+	}
+
+	b, err := encodeRaw(val)
+	if err != nil {
+		return nil, err
+	}
+	return escape(b), nil
+}
+
+// entryId extracts the entity id from a compound index entry - the escaped part after the last terminator
+func entryId(entry string) schema.Key {
+	pos := strings.LastIndexByte(entry, entryTerminator)
+	if pos < 0 {
+		return ""
+	}
+	return schema.Key(unescape([]byte(entry[pos+1:])))
+}
+
+// byteSlices sorts a slice of byte slices
+type byteSlices [][]byte
+
+func (b byteSlices) Len() int           { return len(b) }
+func (b byteSlices) Less(i, j int) bool { return bytes.Compare(b[i], b[j]) < 0 }
+func (b byteSlices) Swap(i, j int)      { b[i], b[j] = b[j], b[i] }
+
+// encodeIndexValue encodes a value for indexing with encodeValue, returning it as a string, or an untyped nil
+// for nil values, so missing values can be told apart in entries
+func encodeIndexValue(val interface{}) (interface{}, error) {
+	b, err := encodeValue(val)
+	if b == nil || err != nil {
+		return nil, err
+	}
+	return string(b), nil
+}
@@ -0,0 +1,235 @@
+package redis
+
+import (
+	"fmt"
+	"math"
+	"sort"
+
+	"github.com/EverythingMe/meduza/errors"
+	"github.com/EverythingMe/meduza/query"
+	"github.com/EverythingMe/meduza/schema"
+)
+
+// indexType returns the schema type of an index, as reported by EXPLAIN
+func indexType(idx index) string {
+	switch i := idx.(type) {
+	case *CompoundIndex:
+		return string(i.desc.Type)
+	case *SortedIndex:
+		return string(i.desc.Type)
+	case *GeoIndex:
+		return string(i.desc.Type)
+	case *FullTextIndex:
+		return string(i.desc.Type)
+	case randomPrimaryIndex:
+		return fmt.Sprintf("primary/%s", i.desc.Type)
+	case compoundPrimaryIndex:
+		return fmt.Sprintf("primary/%s", i.desc.Type)
+	}
+	return ""
+}
+
+// explainCandidate describes how an index matches a set of filters and an ordering, and if it doesn't, why
+func (t *table) explainCandidate(idx index, filters query.Filters, order query.Ordering) query.IndexCandidate {
+
+	match, score := idx.Matches(filters, order)
+	covered, _ := coverage(idx, filters)
+
+	ret := query.IndexCandidate{
+		Index:      fmt.Sprint(idx),
+		Type:       indexType(idx),
+		Properties: idx.Properties(),
+		Matched:    match,
+		Score:      score,
+		Cost:       -1,
+		Covers:     make([]string, 0, len(covered)),
+	}
+	for p := range covered {
+		ret.Covers = append(ret.Covers, p)
+	}
+	sort.Strings(ret.Covers)
+
+	estimated := covered
+	if match {
+		estimated = filters
+	}
+	if len(estimated) > 0 {
+		if cost, ok := t.estimate(idx, estimated); ok && !math.IsInf(cost, 1) {
+			ret.Cost = cost
+		}
+	}
+
+	if !match {
+		if m, _ := idx.Matches(filters, query.NoOrder); m {
+			ret.Reason = fmt.Sprintf("Cannot order by %s", order.By)
+		} else if len(covered) > 0 {
+			ret.Reason = fmt.Sprintf("Can only answer filters on %s", ret.Covers)
+		} else {
+			ret.Reason = "Cannot answer the filters"
+		}
+	}
+
+	return ret
+}
+
+// primaryIds returns the ids a primary index selection will check for existence
+func (t *table) primaryIds(filters query.Filters) ([]interface{}, error) {
+
+	if f, single := filters.One(); single && f.Property == schema.IdKey {
+		return f.Values, nil
+	}
+
+	if cp, ok := t.primary.(compoundPrimaryIndex); ok {
+		return cp.filtersToIds(filters)
+	}
+	return nil, errors.NewError("Filters do not match primary key")
+}
+
+// explainScans returns the redis commands an index will issue to find the ids matching the filters
+func (t *table) explainScans(idx index, filters query.Filters, order query.Ordering) ([]query.IndexScan, error) {
+
+	name := fmt.Sprint(idx)
+	desc := !order.IsNil() && !order.Ascending
+	ret := make([]query.IndexScan, 0, 1)
+
+	switch i := idx.(type) {
+	case *CompoundIndex:
+		ranges, err := i.lexRanges(filters, order)
+		if err != nil {
+			return nil, err
+		}
+
+		cmd := "ZRANGEBYLEX"
+		if desc {
+			cmd = "ZREVRANGEBYLEX"
+		}
+		for _, r := range ranges {
+			ret = append(ret, query.IndexScan{Index: name, Command: cmd, Key: i.RedisKey(), Min: r[0], Max: r[1]})
+		}
+
+	case *SortedIndex:
+		f, _ := filters.One()
+		min, max, err := i.scoreRange(f)
+		if err != nil {
+			return nil, err
+		}
+
+		cmd := "ZRANGEBYSCORE"
+		if desc {
+			cmd = "ZREVRANGEBYSCORE"
+		}
+		ret = append(ret, query.IndexScan{Index: name, Command: cmd, Key: i.RedisKey(), Min: min, Max: max})
+
+	case *GeoIndex:
+		ret = append(ret, query.IndexScan{Index: name, Command: "GEORADIUS", Key: i.RedisKey()})
+
+	case *FullTextIndex:
+		f, _ := filters.One()
+		terms, err := queryTerms(f)
+		if err != nil {
+			return nil, err
+		}
+
+		// multiple terms are intersected into a temporary key, a single one is read directly
+		cmd := "ZREVRANGE"
+		if len(terms) > 1 {
+			cmd = "ZINTERSTORE"
+		}
+		for _, term := range terms {
+			ret = append(ret, query.IndexScan{Index: name, Command: cmd, Key: i.termKey(term)})
+		}
+
+	default:
+		if f, single := filters.One(); single && f.Operator == query.All {
+			cmd := "ZRANGE"
+			if desc {
+				cmd = "ZREVRANGE"
+			}
+			ret = append(ret, query.IndexScan{Index: name, Command: cmd, Key: idx.RedisKey()})
+			break
+		}
+
+		ids, err := t.primaryIds(filters)
+		if err != nil {
+			return nil, err
+		}
+		for _, id := range ids {
+			ret = append(ret, query.IndexScan{Index: name, Command: "EXISTS", Key: t.idKey(schema.Key(fmt.Sprintf("%s", id)))})
+		}
+	}
+
+	return ret, nil
+}
+
+// Explain describes how getIds would select the ids matching the query's filters and ordering: the candidate
+// indexes and their scores, the index or indexes it picks, the scans they perform and the estimated number of
+// matching entities. The cardinality is estimated like the costs of the candidates, so nothing is selected, and is
+// -1 if none of the chosen indexes has been sampled yet
+func (t *table) Explain(q query.ExplainQuery, res *query.ExplainResponse) {
+
+	filters, order := q.Filters, q.Order
+
+	indexes := t.readyIndexes()
+	candidates := make([]index, 0, len(indexes)+1)
+	candidates = append(candidates, t.primary)
+	candidates = append(candidates, indexes...)
+	for _, idx := range candidates {
+		res.Candidates = append(res.Candidates, t.explainCandidate(idx, filters, order))
+	}
+
+	var chosen []index
+	var groups []query.Filters
+
+	idx := t.selectIndex(filters, order)
+	if t.usePrimary(filters, order, idx) {
+		res.Plan = query.PlanPrimary
+		chosen, groups = []index{t.primary}, []query.Filters{filters}
+	} else if idx != nil {
+		res.Plan = query.PlanIndex
+		chosen, groups = []index{idx}, []query.Filters{filters}
+	} else if groups = t.planIntersection(filters); groups != nil {
+		res.Plan = query.PlanIntersect
+		for _, g := range groups {
+			if gi := t.selectIndex(g, query.NoOrder); t.usePrimary(g, query.NoOrder, gi) {
+				chosen = append(chosen, t.primary)
+			} else {
+				chosen = append(chosen, gi)
+			}
+		}
+	} else {
+		res.Plan = query.PlanNone
+		return
+	}
+
+	for n, idx := range chosen {
+		res.Chosen = append(res.Chosen, fmt.Sprint(idx))
+
+		scans, err := t.explainScans(idx, groups[n], order)
+		if err != nil {
+			res.Error = errors.Wrap(err)
+			return
+		}
+		res.Scans = append(res.Scans, scans...)
+	}
+
+	// intersections can only be ordered by id, or by a property with a sorted index
+	if res.Plan == query.PlanIntersect && !order.IsNil() && order.By != schema.IdKey {
+		if _, err := newExprEvaluator(t).orderKey(order); err != nil {
+			res.Error = errors.Wrap(err)
+			return
+		}
+	}
+
+	// the cardinality is estimated from the index statistics, without reading the indexes. An intersection selects
+	// at most as many entities as the smallest of its groups
+	res.Cardinality = -1
+	for n, idx := range chosen {
+		est, ok := t.estimate(idx, groups[n])
+		if !ok || math.IsInf(est, 1) {
+			continue
+		}
+		if c := int(est + 0.5); res.Cardinality < 0 || c < res.Cardinality {
+			res.Cardinality = c
+		}
+	}
+}
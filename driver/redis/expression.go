@@ -0,0 +1,462 @@
+package redis
+
+import (
+	"fmt"
+	"strings"
+
+	"github.com/dvirsky/go-pylog/logging"
+	"github.com/garyburd/redigo/redis"
+	"github.com/EverythingMe/meduza/errors"
+	"github.com/EverythingMe/meduza/query"
+	"github.com/EverythingMe/meduza/schema"
+)
+
+// selectIds returns the ids matching a selection expression, and the total number of entities matching it.
+//
+// Selections that are a conjunction of filters on distinct properties are answered by a single index, just like
+// a filters map. Other expressions are evaluated by exprEvaluator
+func (t *table) selectIds(sel query.Expression, offset, limit int, order query.Ordering) ([]schema.Key, int, error) {
+
+	if filters, ok := sel.Filters(); ok {
+		return t.getIds(filters, offset, limit, order)
+	}
+
+	logging.Debug("Evaluating expression %s on table %s", sel, t)
+	return newExprEvaluator(t).Find(sel, offset, limit, order)
+}
+
+// exprEvaluator evaluates boolean filter expressions on a table.
+//
+// The ids matching each branch of the expression are found using the best index for it, and written to temporary
+// sorted sets. Branches answered by indexes whose sorted sets hold the entity ids - sorted indexes, and the primary
+// index for selections of all ids - are stored straight from the index key, so their ids never leave redis and are
+// not capped. These are combined with ZINTERSTORE and ZUNIONSTORE into the result set, that is paged, counted and
+// deleted along with all the other temporary keys in a single transaction.
+//
+// NOT is evaluated as the difference between the table's primary index and the negated set, so we first push
+// negations down the expression to its leaves.
+//
+// The same machinery intersects the results of several indexes, when no single index can answer a query.
+//
+// Results are ordered by id, or by a property that has a sorted index
+type exprEvaluator struct {
+	t    *table
+	tx   *Transaction
+	keys []interface{}
+	// the temporary keys stored straight from index keys, that keep the scores of the index
+	direct map[string]bool
+	// the maximal number of ids selected by a single index, 0 means no limit
+	max int
+}
+
+func newExprEvaluator(t *table) *exprEvaluator {
+	return &exprEvaluator{
+		t:      t,
+		keys:   make([]interface{}, 0),
+		direct: make(map[string]bool),
+		max:    DefaultConfig.MaxIntermediateResults,
+	}
+}
+
+// storeIndex is implemented by indexes whose sorted sets hold entity ids, so the ids matching a set of filters can be
+// stored to a temporary key on the server without reading them
+type storeIndex interface {
+	index
+	store(tx *Transaction, key string, filters query.Filters) error
+}
+
+// store queues copying the index to the key, and removing the scores outside the range selected by the filter
+func (i *SortedIndex) store(tx *Transaction, key string, filters query.Filters) error {
+
+	f, single := filters.One()
+	if !single || f.Property != i.prop() {
+		return errors.NewError("Filters do not match sorted index %s", i)
+	}
+
+	min, max, err := i.scoreRange(f)
+	if err != nil {
+		return err
+	}
+
+	if err := newRedisCommand("ZUNIONSTORE", key, 1, i.RedisKey()).send(tx); err != nil {
+		return err
+	}
+	if min != "-inf" {
+		if err := newRedisCommand("ZREMRANGEBYSCORE", key, "-inf", excludeBound(min)).send(tx); err != nil {
+			return err
+		}
+	}
+	if max != "+inf" {
+		if err := newRedisCommand("ZREMRANGEBYSCORE", key, excludeBound(max), "+inf").send(tx); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// excludeBound turns an inclusive bound of a score range into an exclusive one and vice versa
+func excludeBound(bound string) string {
+	if strings.HasPrefix(bound, "(") {
+		return bound[1:]
+	}
+	return "(" + bound
+}
+
+// markScript copies the members of the sorted set KEYS[1] to KEYS[2], scoring them all 1
+const markScript = `
+local members = redis.call('ZRANGE', KEYS[1], 0, -1)
+for i = 1, #members, 1000 do
+	local args = {}
+	for j = i, math.min(i + 999, #members) do
+		args[#args + 1] = 1
+		args[#args + 1] = members[j]
+	end
+	redis.call('ZADD', KEYS[2], unpack(args))
+end
+return #members
+`
+
+// pushNot returns an equivalent expression where NOT nodes only negate leaves, using De Morgan's laws
+func pushNot(e query.Expression, negate bool) query.Expression {
+
+	switch e.Op {
+	case query.ExprNot:
+		return pushNot(e.Children[0], !negate)
+	case query.ExprAnd, query.ExprOr:
+		op := e.Op
+		if negate {
+			if op == query.ExprAnd {
+				op = query.ExprOr
+			} else {
+				op = query.ExprAnd
+			}
+		}
+
+		children := make([]query.Expression, len(e.Children))
+		for n, c := range e.Children {
+			children[n] = pushNot(c, negate)
+		}
+		return query.Expression{Op: op, Children: children}
+	}
+
+	if negate {
+		return query.Not(e)
+	}
+	return e
+}
+
+// tempKey allocates a new temporary key, that will be deleted at the end of the evaluation
+func (x *exprEvaluator) tempKey() string {
+	key := fmt.Sprintf("tmp:%s/expr:%d", x.t.desc.Name, len(x.keys))
+	x.keys = append(x.keys, key)
+	return key
+}
+
+// storeDirect queues storing the ids matching a filter set straight from the key of the index that answers it, if
+// the index holds entity ids. The stored ids keep the scores of the index. Returns false if no such index answers
+// the filters
+func (x *exprEvaluator) storeDirect(filters query.Filters) (string, bool, error) {
+
+	if f, single := filters.One(); single && f.Property == schema.IdKey && f.Operator == query.All {
+		key := x.tempKey()
+		x.direct[key] = true
+		return key, true, newRedisCommand("ZUNIONSTORE", key, 1, x.t.primary.RedisKey()).send(x.tx)
+	}
+
+	idx := x.t.selectIndex(filters, query.NoOrder)
+	if x.t.usePrimary(filters, query.NoOrder, idx) {
+		return "", false, nil
+	}
+
+	si, ok := idx.(storeIndex)
+	if !ok {
+		return "", false, nil
+	}
+
+	key := x.tempKey()
+	x.direct[key] = true
+	return key, true, si.store(x.tx, key, filters)
+}
+
+// storeIds finds the ids matching a filter set and queues their writing to a temporary key.
+// Members of leaf sets are scored 1, so they can be told apart from the primary index when negating them, unless
+// they are stored directly from an index.
+//
+// To protect redis, we fail if the filters select more than the evaluator's maximum of ids, unless they are
+// stored directly from an index
+func (x *exprEvaluator) storeIds(filters query.Filters) (string, error) {
+
+	if key, ok, err := x.storeDirect(filters); ok {
+		return key, err
+	}
+
+	max := x.max
+	limit := -1
+	if max > 0 {
+		limit = max + 1
+
+		// indexes that count their ranges let us fail before reading any ids
+		idx := x.t.selectIndex(filters, query.NoOrder)
+		if ci, ok := idx.(countIndex); ok && !x.t.usePrimary(filters, query.NoOrder, idx) {
+			n, err := ci.count(filters)
+			if err != nil {
+				return "", err
+			}
+			if n > max {
+				return "", errors.NewError("Filters %s select more than %d ids, cannot combine them with other filters", filters, max)
+			}
+		}
+	}
+
+	ids, _, err := x.t.getIds(filters, 0, limit, query.NoOrder)
+	if err != nil {
+		return "", err
+	}
+	if max > 0 && len(ids) > max {
+		return "", errors.NewError("Filters %s select more than %d ids, cannot combine them with other filters", filters, max)
+	}
+
+	key := x.tempKey()
+
+	// an empty set is just a missing key for ZINTERSTORE and ZUNIONSTORE
+	if len(ids) == 0 {
+		return key, nil
+	}
+
+	cmd := newRedisCommand("ZADD", key)
+	for _, id := range ids {
+		cmd.add(1, string(id))
+	}
+
+	return key, cmd.send(x.tx)
+}
+
+// indexable tells us whether a set of filters can be answered by a single index of the table
+func (x *exprEvaluator) indexable(filters query.Filters) bool {
+	if m, _ := x.t.primary.Matches(filters, query.NoOrder); m {
+		return true
+	}
+	return x.t.selectIndex(filters, query.NoOrder) != nil
+}
+
+// combine queues a ZINTERSTORE or ZUNIONSTORE of the given keys into a new temporary key
+func (x *exprEvaluator) combine(command string, keys []string) (string, error) {
+
+	if len(keys) == 1 {
+		return keys[0], nil
+	}
+
+	key := x.tempKey()
+	cmd := newRedisCommand(command, key, len(keys))
+	for _, k := range keys {
+		cmd.add(k)
+	}
+
+	// the scores of the result are meaningless, so we zero them
+	cmd.add("WEIGHTS")
+	for range keys {
+		cmd.add(0)
+	}
+
+	return key, cmd.send(x.tx)
+}
+
+// eval queues the commands evaluating a normalized expression, and returns the key its result will be stored in
+func (x *exprEvaluator) eval(e query.Expression) (string, error) {
+
+	switch e.Op {
+	case "":
+		return x.storeIds(query.NewFilters(e.Filter))
+
+	case query.ExprNot:
+
+		leaf, err := x.eval(e.Children[0])
+		if err != nil {
+			return "", err
+		}
+
+		// sets stored directly from indexes have the index scores, so we score their members 1 first
+		if x.direct[leaf] {
+			marked := x.tempKey()
+			if err := newRedisCommand("EVAL", markScript, 2, leaf, marked).send(x.tx); err != nil {
+				return "", err
+			}
+			leaf = marked
+		}
+
+		// the union scores the members of the negated set 1 and all the others 0, and we keep just the zeros
+		key := x.tempKey()
+		if err := newRedisCommand("ZUNIONSTORE", key, 2, x.t.primary.RedisKey(), leaf,
+			"WEIGHTS", 0, 1, "AGGREGATE", "MAX").send(x.tx); err != nil {
+			return "", err
+		}
+		if err := newRedisCommand("ZREMRANGEBYSCORE", key, "(0", "+inf").send(x.tx); err != nil {
+			return "", err
+		}
+		return key, nil
+
+	case query.ExprAnd:
+
+		keys := make([]string, 0, len(e.Children))
+
+		// leaf children that can be answered together by one index are evaluated as a single filter set
+		filters := make(query.Filters)
+		others := make([]query.Expression, 0, len(e.Children))
+		for _, c := range e.Children {
+			if _, dup := filters[c.Filter.Property]; c.IsLeaf() && !dup {
+				filters[c.Filter.Property] = c.Filter
+			} else {
+				others = append(others, c)
+			}
+		}
+
+		if len(filters) > 1 && x.indexable(filters) {
+			key, err := x.storeIds(filters)
+			if err != nil {
+				return "", err
+			}
+			keys = append(keys, key)
+		} else {
+			for _, f := range filters {
+				others = append(others, query.Cond(f))
+			}
+		}
+
+		for _, c := range others {
+			key, err := x.eval(c)
+			if err != nil {
+				return "", err
+			}
+			keys = append(keys, key)
+		}
+
+		return x.combine("ZINTERSTORE", keys)
+
+	case query.ExprOr:
+
+		keys := make([]string, 0, len(e.Children))
+		for _, c := range e.Children {
+			key, err := x.eval(c)
+			if err != nil {
+				return "", err
+			}
+			keys = append(keys, key)
+		}
+
+		return x.combine("ZUNIONSTORE", keys)
+	}
+
+	return "", errors.NewError("Unsupported expression operator: '%s'", e.Op)
+}
+
+// orderKey returns the key of a sorted index on the ordering property. Combined results can only be ordered
+// by id, or by properties with a sorted index
+func (x *exprEvaluator) orderKey(order query.Ordering) (string, error) {
+
+	for _, idx := range x.t.readyIndexes() {
+		if sorted, ok := idx.(*SortedIndex); ok && sorted.prop() == order.By {
+			return sorted.RedisKey(), nil
+		}
+	}
+	return "", errors.NewError("Cannot order results combined from several indexes by %s without a sorted index", order.By)
+}
+
+// Find evaluates an expression and returns the ids matching it, paged and ordered, and the total number of
+// entities matching it
+func (x *exprEvaluator) Find(e query.Expression, offset, limit int, order query.Ordering) ([]schema.Key, int, error) {
+
+	x.tx = NewTransaction(pool.Get())
+	defer x.tx.Abort()
+
+	key, err := x.eval(pushNot(e, false))
+	if err != nil {
+		return nil, 0, redisError(err)
+	}
+
+	return x.page(key, offset, limit, order)
+}
+
+// Intersect returns the ids matching all the given filter sets, each answered by its own index, paged and ordered,
+// and the total number of entities matching them
+func (x *exprEvaluator) Intersect(groups []query.Filters, offset, limit int, order query.Ordering) ([]schema.Key, int, error) {
+
+	x.tx = NewTransaction(pool.Get())
+	defer x.tx.Abort()
+
+	keys := make([]string, 0, len(groups))
+	for _, filters := range groups {
+		key, err := x.storeIds(filters)
+		if err != nil {
+			return nil, 0, redisError(err)
+		}
+		keys = append(keys, key)
+	}
+
+	key, err := x.combine("ZINTERSTORE", keys)
+	if err != nil {
+		return nil, 0, redisError(err)
+	}
+
+	return x.page(key, offset, limit, order)
+}
+
+// page queues the paging and counting of the result key and the deletion of all temporary keys, and executes the
+// transaction
+func (x *exprEvaluator) page(key string, offset, limit int, order query.Ordering) ([]schema.Key, int, error) {
+
+	// when ordering by a property, we take the scores from its sorted index. Entities without a value in the
+	// sorted index are not selected
+	if !order.IsNil() && order.By != schema.IdKey {
+		sortKey, err := x.orderKey(order)
+		if err != nil {
+			return nil, 0, err
+		}
+
+		ordered := x.tempKey()
+		if err := newRedisCommand("ZINTERSTORE", ordered, 2, key, sortKey, "WEIGHTS", 0, 1).send(x.tx); err != nil {
+			return nil, 0, redisError(err)
+		}
+		key = ordered
+	}
+
+	cmd := newRedisCommand("ZRANGE", key)
+	if !order.IsNil() && !order.Ascending {
+		cmd.command = "ZREVRANGE"
+	}
+	if limit > 0 {
+		cmd.add(offset, offset+limit-1)
+	} else {
+		cmd.add(offset, -1)
+	}
+
+	idsP, err := x.tx.Send(cmd.command, cmd.args...)
+	if err != nil {
+		return nil, 0, redisError(err)
+	}
+
+	totalP, err := x.tx.Send("ZCARD", key)
+	if err != nil {
+		return nil, 0, redisError(err)
+	}
+
+	if _, err := x.tx.Send("DEL", x.keys...); err != nil {
+		return nil, 0, redisError(err)
+	}
+
+	if _, err := x.tx.Execute(); err != nil {
+		return nil, 0, redisError(err)
+	}
+
+	ids, err := redis.Strings(idsP.Reply())
+	if err != nil {
+		return nil, 0, redisError(err)
+	}
+	total, _ := redis.Int(totalP.Reply())
+
+	ret := make([]schema.Key, len(ids))
+	for n, id := range ids {
+		ret[n] = schema.Key(id)
+	}
+
+	return ret, total, nil
+}
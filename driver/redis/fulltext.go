@@ -0,0 +1,448 @@
+package redis
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+
+	"github.com/dvirsky/go-pylog/logging"
+	"github.com/garyburd/redigo/redis"
+	"github.com/EverythingMe/meduza/errors"
+	"github.com/EverythingMe/meduza/query"
+	"github.com/EverythingMe/meduza/schema"
+)
+
+// FullTextIndex indexes the text columns of entities by the terms they contain.
+//
+// Each term has a posting set - a sorted set of the ids of the entities containing it, scored by the number
+// of times the term appears in them. A dictionary set holds all the terms in the index, for scanning it.
+//
+// It answers MATCH filters on the index's first column, with AND semantics across the terms of the query,
+// ranking results by the sum of their term frequencies
+type FullTextIndex struct {
+	desc       schema.Index
+	properties propertyList
+	table      string
+	key        string
+}
+
+// NewFullTextIndex creates a new full text index using a descriptor, for the given table name
+func NewFullTextIndex(idx schema.Index, table string) *FullTextIndex {
+	return &FullTextIndex{
+		desc:       idx,
+		properties: propertyList(idx.Columns),
+		table:      table,
+	}
+}
+
+func (i *FullTextIndex) String() string {
+	return i.desc.Name
+}
+
+// isTextFilter tells us whether a filter can be answered only by a full text index
+func isTextFilter(f query.Filter) bool {
+	return f.Operator == query.Match
+}
+
+// Matches returns true if the filters contain a single MATCH filter on our first column.
+// Results are ranked by relevance, so ordered queries cannot be answered by a full text index
+func (i *FullTextIndex) Matches(filters query.Filters, order query.Ordering) (bool, float32) {
+
+	f, single := filters.One()
+	if !single || !isTextFilter(f) || f.Property != i.properties[0] {
+		return false, 0
+	}
+
+	if !order.IsNil() {
+		logging.Debug("Order by '%s' cannot be done by %s", order.By, i.desc.Name)
+		return false, 0
+	}
+
+	return true, 1
+}
+
+// MatchesProperties tells us whether the properties are a subset of our own properties
+func (i *FullTextIndex) MatchesProperties(properties ...string) bool {
+
+	for _, p := range properties {
+		if !i.properties.contains(p) {
+			return false
+		}
+	}
+	return true
+}
+
+// Properties returns the text properties indexed by this index
+func (i *FullTextIndex) Properties() []string {
+	return i.properties
+}
+
+// RedisKey returns the key of the term dictionary of this index. Posting sets are prefixed by it
+func (i *FullTextIndex) RedisKey() string {
+	if i.key == "" {
+		i.key = fmt.Sprintf("k:%s/%s:ft", i.table, strings.Join(i.properties, "_"))
+	}
+	return i.key
+}
+
+// termKey returns the key of the posting set of a single term
+func (i *FullTextIndex) termKey(term string) string {
+	return fmt.Sprintf("%s:%s", i.RedisKey(), term)
+}
+
+// tokenize normalizes a text and breaks it into terms
+func tokenize(text string) ([]string, error) {
+
+	nrml := getNormalizer()
+	defer putNormalizer(nrml)
+
+	tokenizer := schema.NewTokenizer(nrml)
+	if err := tokenizer.Tokenize(text); err != nil {
+		return nil, err
+	}
+
+	ret := []string{}
+	for tokenizer.HasNext() {
+		ret = append(ret, tokenizer.NextToken())
+	}
+	return ret, nil
+}
+
+// termFrequencies counts the occurrences of each term in the indexed properties of a set of raw values
+func (i *FullTextIndex) termFrequencies(vals map[string]interface{}) (map[string]int, error) {
+
+	ret := make(map[string]int)
+	for _, p := range i.properties {
+
+		var text string
+		switch v := vals[p].(type) {
+		case schema.Text:
+			text = string(v)
+		case string:
+			text = v
+		case nil:
+			continue
+		default:
+			return nil, errors.NewError("Cannot index non text value of %s in full text index %s", p, i)
+		}
+
+		terms, err := tokenize(text)
+		if err != nil {
+			return nil, err
+		}
+		for _, t := range terms {
+			ret[t]++
+		}
+	}
+
+	return ret, nil
+}
+
+// Pipeline is the main indexing utility, that allows concurrent and bulk indexing of entities on a single transaction.
+//
+// It returns a channel the caller sends entity diffs down, and a channel that eventually sends errors in indexing back.
+// The caller needs to close the entity diff channel, and then wait for an error on the error channel, before executing the
+// transaction.
+func (i *FullTextIndex) Pipeline(tx *Transaction) (chan<- *entityDiff, <-chan error) {
+
+	ch := make(chan *entityDiff)
+	ech := make(chan error)
+
+	// posting set commands, per term
+	addCmds := make(map[string]*redisCommand)
+	delCmds := make(map[string]*unindexCommand)
+	dictCmd := newRedisCommand("SADD", i.RedisKey())
+
+	go func() {
+		var err error
+		for eDiff := range ch {
+			// sending nil down the channel aborts it without closing
+			if eDiff == nil {
+				break
+			}
+
+			// we keep consuming diffs after an error so the caller will not block
+			if err != nil {
+				continue
+			}
+
+			var oldTerms, newTerms map[string]int
+			if oldTerms, err = i.termFrequencies(eDiff.rawVals(false)); err != nil {
+				continue
+			}
+			if eDiff.changeType == changeDelete {
+				newTerms = map[string]int{}
+			} else if newTerms, err = i.termFrequencies(eDiff.rawVals(true)); err != nil {
+				continue
+			}
+
+			for term := range oldTerms {
+				if _, found := newTerms[term]; !found {
+					if _, found = delCmds[term]; !found {
+						delCmds[term] = newUnindexCommand(i.termKey(term))
+					}
+					delCmds[term].addEntry(string(eDiff.id))
+				}
+			}
+
+			for term, freq := range newTerms {
+				if oldTerms[term] == freq {
+					continue
+				}
+				if _, found := addCmds[term]; !found {
+					addCmds[term] = newRedisCommand("ZADD", i.termKey(term))
+					dictCmd.add(term)
+				}
+				addCmds[term].add(freq, string(eDiff.id))
+			}
+		}
+
+		if err != nil {
+			logging.Error("Error indexing entities in %s: %s", i, err)
+			ech <- err
+			return
+		}
+
+		for _, cmd := range delCmds {
+			if err := cmd.send(tx); err != nil {
+				logging.Error("Error sending command to transaction: %s", err)
+				ech <- err
+				return
+			}
+		}
+
+		for _, cmd := range addCmds {
+			if err := cmd.send(tx); err != nil {
+				logging.Error("Error sending command to transaction: %s", err)
+				ech <- err
+				return
+			}
+		}
+
+		if dictCmd.valid() {
+			if err := dictCmd.send(tx); err != nil {
+				logging.Error("Error sending command to transaction: %s", err)
+				ech <- err
+				return
+			}
+		}
+
+		// we send this to the error channel so the caller knows they can continue
+		ech <- nil
+
+	}()
+
+	return ch, ech
+}
+
+// queryTerms extracts the unique terms of a MATCH filter's values, sorted
+func queryTerms(f query.Filter) ([]string, error) {
+
+	unique := make(map[string]bool)
+	for _, v := range f.Values {
+
+		var text string
+		switch tv := v.(type) {
+		case schema.Text:
+			text = string(tv)
+		case string:
+			text = tv
+		default:
+			return nil, errors.NewError("Invalid value for MATCH filter: %v", v)
+		}
+
+		terms, err := tokenize(text)
+		if err != nil {
+			return nil, err
+		}
+		for _, t := range terms {
+			unique[t] = true
+		}
+	}
+
+	ret := make([]string, 0, len(unique))
+	for t := range unique {
+		ret = append(ret, t)
+	}
+	sort.Strings(ret)
+	return ret, nil
+}
+
+// Find returns the ids of the entities containing all the terms of a MATCH filter, ranked by the sum of their
+// term frequencies.
+//
+// Single term queries are read directly from the term's posting set. Multi term queries intersect the posting
+// sets into a temporary key, that is read and deleted on the same transaction
+func (i *FullTextIndex) Find(filters query.Filters, offset, limit int, order query.Ordering) ([]schema.Key, int, error) {
+
+	f, single := filters.One()
+	if !single || !isTextFilter(f) || f.Property != i.properties[0] {
+		return nil, 0, errors.NewError("Filters do not match full text index %s", i)
+	}
+
+	terms, err := queryTerms(f)
+	if err != nil {
+		return nil, 0, err
+	}
+	if len(terms) == 0 {
+		return []schema.Key{}, 0, nil
+	}
+
+	tx := NewTransaction(pool.Get())
+	defer tx.Abort()
+
+	key := i.termKey(terms[0])
+	if len(terms) > 1 {
+		key = i.termKey("tmp:" + strings.Join(terms, "|"))
+
+		cmd := newRedisCommand("ZINTERSTORE", key, len(terms))
+		for _, t := range terms {
+			cmd.add(i.termKey(t))
+		}
+		cmd.add("AGGREGATE", "SUM")
+
+		if err := cmd.send(tx); err != nil {
+			return nil, 0, redisError(err)
+		}
+	}
+
+	cmd := newRedisCommand("ZREVRANGE", key)
+	if limit > 0 {
+		cmd.add(offset, offset+limit-1)
+	} else {
+		cmd.add(offset, -1)
+	}
+
+	idsP, err := tx.Send(cmd.command, cmd.args...)
+	if err != nil {
+		return nil, 0, redisError(err)
+	}
+
+	totalP, err := tx.Send("ZCARD", key)
+	if err != nil {
+		return nil, 0, redisError(err)
+	}
+
+	if len(terms) > 1 {
+		if _, err := tx.Send("DEL", key); err != nil {
+			return nil, 0, redisError(err)
+		}
+	}
+
+	if _, err = tx.Execute(); err != nil {
+		return nil, 0, redisError(err)
+	}
+
+	ids, err := redis.Strings(idsP.Reply())
+	if err != nil {
+		return nil, 0, redisError(err)
+	}
+	total, _ := redis.Int(totalP.Reply())
+
+	ret := make([]schema.Key, len(ids))
+	for n, id := range ids {
+		ret[n] = schema.Key(id)
+	}
+
+	return ret, total, nil
+}
+
+// RawEntries scans the index and returns all its entries. Entries are in the form of term::id,
+// going over the term dictionary and returning the members of each term's posting set
+func (i *FullTextIndex) RawEntries(chunk int) (<-chan string, chan<- bool) {
+
+	idch := make(chan string)
+	stopch := make(chan bool)
+	go func() {
+		defer close(idch)
+
+		conn := pool.Get()
+		defer conn.Close()
+
+		cursor := 0
+		for {
+			vals, err := redis.Values(conn.Do("SSCAN", i.RedisKey(), cursor, "COUNT", chunk))
+			if err != nil || len(vals) != 2 {
+				logging.Error("Error scanning %s: %s", i, err)
+				return
+			}
+
+			cursor, _ = redis.Int(vals[0], nil)
+			terms, _ := redis.Strings(vals[1], nil)
+
+			for _, term := range terms {
+				ids, err := redis.Strings(conn.Do("ZRANGE", i.termKey(term), 0, -1))
+				if err != nil {
+					logging.Error("Error scanning %s: %s", i, err)
+					return
+				}
+
+				for _, id := range ids {
+					select {
+					case idch <- fmt.Sprintf("%s::%s", term, id):
+					case <-stopch:
+						logging.Info("Stopping scan loop")
+						return
+					}
+				}
+			}
+
+			if cursor == 0 {
+				return
+			}
+		}
+	}()
+
+	return idch, stopch
+}
+
+// Scan returns a channel that scans through the index and returns all the ids of the objects indexed in it.
+// Every id is returned once, even if it is indexed under many terms
+func (i *FullTextIndex) Scan(chunk int) (<-chan schema.Key, chan<- bool) {
+
+	idch := make(chan schema.Key)
+	stopch := make(chan bool)
+	go func() {
+		defer close(idch)
+		ch, sch := i.RawEntries(chunk)
+
+		seen := make(map[schema.Key]bool)
+		for entry := range ch {
+			k := extractId(entry)
+			if seen[k] {
+				continue
+			}
+			seen[k] = true
+
+			select {
+			case idch <- k:
+			case <-stopch:
+				logging.Info("Stopping scan loop")
+				sch <- true
+				return
+			}
+		}
+	}()
+
+	return idch, stopch
+}
+
+// ExtractId returns the id part of a term::id entry
+func (i *FullTextIndex) ExtractId(entry string) schema.Key {
+	return extractId(entry)
+}
+
+// RemoveEntry removes a term::id entry from the term's posting set
+func (i *FullTextIndex) RemoveEntry(entry string) error {
+
+	parts := strings.Split(entry, "::")
+	if len(parts) != 2 {
+		return errors.NewError("Invalid full text index entry: %s", entry)
+	}
+
+	conn := pool.Get()
+	defer conn.Close()
+
+	_, err := conn.Do("ZREM", i.termKey(parts[0]), parts[1])
+	return err
+}
@@ -0,0 +1,276 @@
+package redis
+
+import (
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/dvirsky/go-pylog/logging"
+	"github.com/garyburd/redigo/redis"
+	"github.com/EverythingMe/meduza/schema"
+)
+
+// When an index or a table is dropped from a schema, its data is garbage. Every server that gets the schema update
+// marks the garbage in redis, and once it has been kept for the retention period, the master deletes it in the
+// background, in chunks, so huge indexes and tables don't block redis. Garbage is marked in a sorted set of items,
+// in the form of index:<index key> or table:<table name>, scored by the time they were marked.
+//
+// A dropped index is marked garbage in its persisted state as well. If it is added back before it is collected,
+// the collection is canceled and the index is backfilled again. A table added back keeps the entities not collected
+
+// the redis sorted set holding the garbage items to collect, scored by the unix time they were marked
+const garbageKey = "__mdz_garbage__"
+
+// how often the master collects garbage
+const gcFrequency = 10 * time.Second
+
+func indexGarbage(key string) string {
+	return "index:" + key
+}
+
+func tableGarbage(name string) string {
+	return "table:" + name
+}
+
+// markGarbage marks the data of the changes dropping indexes and tables for collection. Dropped indexes are found
+// in prev, the tables of the schema before the changes
+func (r *Driver) markGarbage(changes []interface{}, prev map[string]*table) error {
+
+	conn := pool.Get()
+	defer conn.Close()
+
+	// markIndex marks a dropped index as garbage
+	markIndex := func(idx index) error {
+		logging.Info("Marking index %s as garbage", idx)
+		if err := saveProgress(conn, idx, backfillProgress{state: schema.IndexGarbage}); err != nil {
+			return err
+		}
+		_, err := conn.Do("ZADD", garbageKey, time.Now().Unix(), indexGarbage(idx.RedisKey()))
+		return err
+	}
+
+	for _, change := range changes {
+		switch ch := change.(type) {
+
+		case schema.IndexRemovedChange:
+			t := prev[ch.Table.Name]
+			if t == nil {
+				continue
+			}
+			for _, idx := range t.indexes {
+				if fmt.Sprint(idx) == ch.Index.Name {
+					if err := markIndex(idx); err != nil {
+						return redisError(err)
+					}
+				}
+			}
+
+		case schema.TableDeletedChange:
+			r.tableLock.Lock()
+			t := r.tables[ch.Table.Name]
+			delete(r.tables, ch.Table.Name)
+			r.tableLock.Unlock()
+			if t == nil {
+				continue
+			}
+
+			logging.Info("Marking table %s as garbage", t)
+			for _, idx := range t.indexes {
+				if err := markIndex(idx); err != nil {
+					return redisError(err)
+				}
+			}
+			if _, err := conn.Do("ZADD", garbageKey, time.Now().Unix(), tableGarbage(t.desc.Name)); err != nil {
+				return redisError(err)
+			}
+
+		case schema.TableAddedChange:
+			// a table added back before it was purged keeps its remaining entities
+			if _, err := conn.Do("ZREM", garbageKey, tableGarbage(ch.Table.Name)); err != nil {
+				return redisError(err)
+			}
+		}
+	}
+
+	return nil
+}
+
+// gcLoop periodically collects the garbage of dropped indexes and tables. It is run by the master
+func (r *Driver) gcLoop(freq time.Duration) {
+
+	logging.Info("Starting garbage collection loop, frequency %s", freq)
+	for range time.Tick(freq) {
+		if err := collectGarbage(); err != nil {
+			logging.Error("Error collecting garbage: %s", err)
+		}
+	}
+}
+
+// collectGarbage deletes the data of the garbage items that have been kept for the retention period
+func collectGarbage() error {
+
+	conn := pool.Get()
+	defer conn.Close()
+
+	until := time.Now().Unix() - int64(DefaultConfig.GarbageRetention)
+	items, err := redis.Strings(conn.Do("ZRANGEBYSCORE", garbageKey, "-inf", until))
+	if err != nil {
+		return redisError(err)
+	}
+
+	chunk := DefaultConfig.DeleteChunkSize
+	if chunk <= 0 {
+		chunk = 100
+	}
+
+	for _, item := range items {
+
+		var err error
+		switch {
+		case strings.HasPrefix(item, "index:"):
+			err = collectIndex(conn, item, strings.TrimPrefix(item, "index:"), chunk)
+		case strings.HasPrefix(item, "table:"):
+			err = collectTable(conn, item, strings.TrimPrefix(item, "table:"), chunk)
+		default:
+			logging.Warning("Unknown garbage item %s", item)
+		}
+		if err != nil {
+			return err
+		}
+
+		if _, err := conn.Do("ZREM", garbageKey, item); err != nil {
+			return redisError(err)
+		}
+	}
+
+	return nil
+}
+
+// isGarbage tells whether an item is still marked as garbage. Items are unmarked if their index or table is added back
+func isGarbage(conn redis.Conn, item string) (bool, error) {
+	score, err := conn.Do("ZSCORE", garbageKey, item)
+	if err != nil {
+		return false, redisError(err)
+	}
+	return score != nil, nil
+}
+
+// deleteKey deletes a sorted set or a set in chunks, as long as its item is garbage, and any other key at once.
+// It returns false if the item stopped being garbage before the key was deleted
+func deleteKey(conn redis.Conn, item, key string, chunk int) (bool, error) {
+
+	tp, err := redis.String(conn.Do("TYPE", key))
+	if err != nil {
+		return false, redisError(err)
+	}
+
+	for {
+		if garbage, err := isGarbage(conn, item); err != nil || !garbage {
+			return false, err
+		}
+
+		var n int
+		switch tp {
+		case "zset":
+			n, err = redis.Int(conn.Do("ZREMRANGEBYRANK", key, 0, chunk-1))
+		case "set":
+			var members []interface{}
+			members, err = redis.Values(conn.Do("SPOP", key, chunk))
+			n = len(members)
+		default:
+			_, err = conn.Do("DEL", key)
+		}
+		if err != nil {
+			return false, redisError(err)
+		}
+
+		if n < chunk {
+			return true, nil
+		}
+	}
+}
+
+// collectIndex deletes the entries of a dropped index, including the keys prefixed by its key that full text indexes
+// keep their terms in, and its persisted state
+func collectIndex(conn redis.Conn, item, key string, chunk int) error {
+
+	logging.Info("Collecting the garbage of index %s", key)
+
+	keys := []string{key}
+	cursor := 0
+	for {
+		vals, err := redis.Values(conn.Do("SCAN", cursor, "MATCH", key+":*", "COUNT", chunk))
+		if err != nil {
+			return redisError(err)
+		}
+		cursor, _ = redis.Int(vals[0], nil)
+		more, _ := redis.Strings(vals[1], nil)
+		keys = append(keys, more...)
+
+		if cursor == 0 {
+			break
+		}
+	}
+
+	for _, k := range keys {
+		if deleted, err := deleteKey(conn, item, k, chunk); err != nil || !deleted {
+			return err
+		}
+	}
+
+	if _, err := conn.Do("DEL", backfillKey(key)); err != nil {
+		return redisError(err)
+	}
+
+	logging.Info("Deleted %d keys of index %s", len(keys), key)
+	return nil
+}
+
+// collectTable purges the entities of a deleted table, its primary index and its persisted migration progress
+func collectTable(conn redis.Conn, item, name string, chunk int) error {
+
+	logging.Info("Purging the entities of table %s", name)
+
+	if deleted, err := deleteKey(conn, item, primaryKey(name), chunk); err != nil || !deleted {
+		return err
+	}
+
+	// entity hashes are keyed by the table name and their id. Deleting keys while scanning may make the scan skip
+	// others, so we scan again until a whole scan finds nothing to delete
+	num := 0
+	for deleted := true; deleted; {
+		deleted = false
+		cursor := 0
+		for {
+			if garbage, err := isGarbage(conn, item); err != nil || !garbage {
+				return err
+			}
+
+			vals, err := redis.Values(conn.Do("SCAN", cursor, "MATCH", name+":*", "COUNT", chunk))
+			if err != nil {
+				return redisError(err)
+			}
+			cursor, _ = redis.Int(vals[0], nil)
+			keys, _ := redis.Strings(vals[1], nil)
+
+			if len(keys) > 0 {
+				if _, err := conn.Do("DEL", redis.Args{}.AddFlat(keys)...); err != nil {
+					return redisError(err)
+				}
+				num += len(keys)
+				deleted = true
+			}
+
+			if cursor == 0 {
+				break
+			}
+		}
+	}
+
+	if _, err := conn.Do("DEL", migrationKey(name)); err != nil {
+		return redisError(err)
+	}
+
+	logging.Info("Purged %d entities of table %s", num, name)
+	return nil
+}
@@ -0,0 +1,485 @@
+package redis
+
+import (
+	"fmt"
+	"math"
+	"strings"
+	"time"
+
+	"github.com/dvirsky/go-pylog/logging"
+	"github.com/garyburd/redigo/redis"
+	"github.com/EverythingMe/meduza/errors"
+	"github.com/EverythingMe/meduza/query"
+	"github.com/EverythingMe/meduza/schema"
+)
+
+// GeoIndex indexes entities by their location, using redis' GEO commands. It is defined on exactly two
+// numeric columns - latitude and longitude, in that order.
+//
+// It answers NEAR (radius) and WITHIN_BOX (bounding box) filters on the latitude column,
+// returning results ordered by their distance from the query's point or the box's center.
+type GeoIndex struct {
+	desc       schema.Index
+	properties propertyList
+	table      string
+	key        string
+}
+
+// earth radius in meters, used for distance calculations
+const earthRadius = 6372797.560856
+
+// redis can't index locations outside these bounds
+const (
+	maxLatitude  = 85.05112878
+	maxLongitude = 180.0
+)
+
+// NewGeoIndex creates a new geo index using a descriptor, for the given table name
+func NewGeoIndex(idx schema.Index, table string) *GeoIndex {
+	return &GeoIndex{
+		desc:       idx,
+		properties: propertyList(idx.Columns),
+		table:      table,
+	}
+}
+
+func (i *GeoIndex) String() string {
+	return i.desc.Name
+}
+
+func (i *GeoIndex) latProp() string {
+	return i.properties[0]
+}
+
+func (i *GeoIndex) lonProp() string {
+	return i.properties[1]
+}
+
+// isGeoFilter tells us whether a filter can be answered only by a geo index
+func isGeoFilter(f query.Filter) bool {
+	return f.Operator == query.Near || f.Operator == query.WithinBox
+}
+
+// Matches returns true if the filters contain a single geo filter on our latitude column.
+// Ordering is always by distance, so if the query is ordered, it must be by the latitude column as well
+func (i *GeoIndex) Matches(filters query.Filters, order query.Ordering) (bool, float32) {
+
+	f, single := filters.One()
+	if !single || !isGeoFilter(f) || f.Property != i.latProp() {
+		return false, 0
+	}
+
+	if !order.IsNil() && order.By != i.latProp() {
+		logging.Debug("Order by '%s' cannot be done by %s", order.By, i.desc.Name)
+		return false, 0
+	}
+
+	return true, 1
+}
+
+// MatchesProperties tells us whether the properties are a subset of our own properties
+func (i *GeoIndex) MatchesProperties(properties ...string) bool {
+
+	for _, p := range properties {
+		if !i.properties.contains(p) {
+			return false
+		}
+	}
+	return true
+}
+
+// Properties returns the latitude and longitude properties of this index
+func (i *GeoIndex) Properties() []string {
+	return i.properties
+}
+
+// RedisKey returns the key of the GEO sorted set of this index
+func (i *GeoIndex) RedisKey() string {
+	if i.key == "" {
+		i.key = fmt.Sprintf("k:%s/%s:geo", i.table, strings.Join(i.properties, "_"))
+	}
+	return i.key
+}
+
+// toFloat converts a numeric or Timestamp value to a float64. Timestamps are converted to unix time.
+// Besides internal types we accept the raw types the BSON decoder produces for filter values
+func toFloat(v interface{}) (float64, bool) {
+	switch n := v.(type) {
+	case schema.Float:
+		return float64(n), true
+	case schema.Int:
+		return float64(n), true
+	case schema.Uint:
+		return float64(n), true
+	case schema.Timestamp:
+		return float64(time.Time(n).Unix()), true
+	case time.Time:
+		return float64(n.Unix()), true
+	case float64:
+		return n, true
+	case float32:
+		return float64(n), true
+	case int64:
+		return float64(n), true
+	case int32:
+		return float64(n), true
+	case int:
+		return float64(n), true
+	case uint64:
+		return float64(n), true
+	case uint32:
+		return float64(n), true
+	case uint:
+		return float64(n), true
+	}
+	return 0, false
+}
+
+// location extracts a valid (lat, lon) pair from a set of raw property values.
+// If the values are missing or not a valid location we return false
+func (i *GeoIndex) location(vals map[string]interface{}) (lat, lon float64, ok bool) {
+
+	if lat, ok = toFloat(vals[i.latProp()]); !ok {
+		return
+	}
+	if lon, ok = toFloat(vals[i.lonProp()]); !ok {
+		return
+	}
+
+	if math.Abs(lat) > maxLatitude || math.Abs(lon) > maxLongitude {
+		logging.Warning("Location (%f, %f) is out of bounds for index %s", lat, lon, i)
+		return 0, 0, false
+	}
+	return
+}
+
+// Pipeline is the main indexing utility, that allows concurrent and bulk indexing of entities on a single transaction.
+//
+// It returns a channel the caller sends entity diffs down, and a channel that eventually sends errors in indexing back.
+// The caller needs to close the entity diff channel, and then wait for an error on the error channel, before executing the
+// transaction.
+func (i *GeoIndex) Pipeline(tx *Transaction) (chan<- *entityDiff, <-chan error) {
+
+	ch := make(chan *entityDiff)
+	ech := make(chan error)
+
+	addCmd := newRedisCommand("GEOADD", i.RedisKey())
+	delCmd := newUnindexCommand(i.RedisKey())
+
+	go func() {
+		for eDiff := range ch {
+			// sending nil down the channel aborts it without closing
+			if eDiff == nil {
+				break
+			}
+
+			oldLat, oldLon, hadOld := i.location(eDiff.rawVals(false))
+
+			if eDiff.changeType == changeDelete {
+				if hadOld {
+					delCmd.addEntry(string(eDiff.id))
+				}
+				continue
+			}
+
+			newLat, newLon, hasNew := i.location(eDiff.rawVals(true))
+			switch {
+			case hasNew && (!hadOld || newLat != oldLat || newLon != oldLon):
+				// GEOADD takes the longitude first
+				addCmd.add(newLon, newLat, string(eDiff.id))
+			case !hasNew && hadOld:
+				delCmd.addEntry(string(eDiff.id))
+			}
+		}
+
+		// enqueue the ZREM command if we need to unindex anything
+		if delCmd.valid() {
+			if err := delCmd.send(tx); err != nil {
+				logging.Error("Error sending command to transaction: %s", err)
+				ech <- err
+				return
+			}
+		}
+
+		// enqueue the GEOADD command if we need to index anything
+		if addCmd.valid() {
+			if err := addCmd.send(tx); err != nil {
+				logging.Error("Error sending command to transaction: %s", err)
+				ech <- err
+				return
+			}
+		}
+
+		// we send this to the error channel so the caller knows they can continue
+		ech <- nil
+
+	}()
+
+	return ch, ech
+}
+
+// filterValues converts the values of a geo filter to floats
+func filterValues(f query.Filter) ([]float64, error) {
+	ret := make([]float64, len(f.Values))
+	for n, v := range f.Values {
+		var ok bool
+		if ret[n], ok = toFloat(v); !ok {
+			return nil, errors.NewError("Invalid value for %s filter: %v", f.Operator, v)
+		}
+	}
+	return ret, nil
+}
+
+// distance returns the distance in meters between two points, using the haversine formula
+func distance(lat1, lon1, lat2, lon2 float64) float64 {
+
+	rad := math.Pi / 180
+	dLat := (lat2 - lat1) * rad
+	dLon := (lon2 - lon1) * rad
+
+	a := math.Pow(math.Sin(dLat/2), 2) + math.Cos(lat1*rad)*math.Cos(lat2*rad)*math.Pow(math.Sin(dLon/2), 2)
+	return 2 * earthRadius * math.Asin(math.Sqrt(a))
+}
+
+// radiusCommand builds the GEORADIUS command for a center point and radius, ordered by the query's direction
+func (i *GeoIndex) radiusCommand(lat, lon, radius float64, order query.Ordering) *redisCommand {
+
+	cmd := newRedisCommand("GEORADIUS", i.RedisKey(), lon, lat, radius, "m")
+	if !order.IsNil() && !order.Ascending {
+		return cmd.add("DESC")
+	}
+	return cmd.add("ASC")
+}
+
+// findNear returns all the ids within radius meters of (lat, lon), ordered by distance
+func (i *GeoIndex) findNear(f query.Filter, order query.Ordering) ([]string, error) {
+
+	vals, err := filterValues(f)
+	if err != nil {
+		return nil, err
+	}
+
+	lat, lon, radius := vals[0], vals[1], vals[2]
+	if radius <= 0 {
+		return nil, errors.NewError("Invalid radius for NEAR filter: %f", radius)
+	}
+
+	conn := pool.Get()
+	defer conn.Close()
+
+	cmd := i.radiusCommand(lat, lon, radius, order)
+	ids, err := redis.Strings(conn.Do(cmd.command, cmd.args...))
+	if err != nil {
+		return nil, redisError(err)
+	}
+	return ids, nil
+}
+
+// findInBox returns all the ids inside a bounding box, ordered by their distance from its center.
+//
+// Since GEORADIUS only selects circles, we select the circle containing the box, and filter out
+// the entries that fall outside of it
+func (i *GeoIndex) findInBox(f query.Filter, order query.Ordering) ([]string, error) {
+
+	vals, err := filterValues(f)
+	if err != nil {
+		return nil, err
+	}
+
+	minLat, minLon, maxLat, maxLon := vals[0], vals[1], vals[2], vals[3]
+	if minLat > maxLat || minLon > maxLon {
+		return nil, errors.NewError("Invalid bounding box: (%f, %f) - (%f, %f)", minLat, minLon, maxLat, maxLon)
+	}
+
+	centerLat, centerLon := (minLat+maxLat)/2, (minLon+maxLon)/2
+
+	// the circle must contain all the corners of the box. we add a meter to avoid rounding errors
+	radius := math.Max(distance(centerLat, centerLon, minLat, minLon), distance(centerLat, centerLon, maxLat, maxLon))
+	radius = math.Max(radius, distance(centerLat, centerLon, minLat, maxLon)) + 1
+
+	conn := pool.Get()
+	defer conn.Close()
+
+	cmd := i.radiusCommand(centerLat, centerLon, radius, order).add("WITHCOORD")
+	entries, err := redis.Values(conn.Do(cmd.command, cmd.args...))
+	if err != nil {
+		return nil, redisError(err)
+	}
+
+	ret := make([]string, 0, len(entries))
+	for _, e := range entries {
+
+		// each entry is a [member, [lon, lat]] tuple
+		tuple, err := redis.Values(e, nil)
+		if err != nil || len(tuple) != 2 {
+			return nil, redisError(errors.NewError("Invalid GEORADIUS reply: %v", e))
+		}
+		coords, err := redis.Values(tuple[1], nil)
+		if err != nil || len(coords) != 2 {
+			return nil, redisError(errors.NewError("Invalid GEORADIUS coordinates: %v", tuple[1]))
+		}
+
+		id, _ := redis.String(tuple[0], nil)
+		lon, _ := redis.Float64(coords[0], nil)
+		lat, _ := redis.Float64(coords[1], nil)
+
+		if lat >= minLat && lat <= maxLat && lon >= minLon && lon <= maxLon {
+			ret = append(ret, id)
+		}
+	}
+
+	return ret, nil
+}
+
+// Find returns the ids matching a single geo filter, ordered by distance.
+//
+// GEORADIUS cannot skip results, so we select all the matching entries and page them here.
+// The total returned is the number of entities matching the filter
+func (i *GeoIndex) Find(filters query.Filters, offset, limit int, order query.Ordering) ([]schema.Key, int, error) {
+
+	f, single := filters.One()
+	if !single || f.Property != i.latProp() {
+		return nil, 0, errors.NewError("Filters do not match geo index %s", i)
+	}
+
+	var ids []string
+	var err error
+	switch f.Operator {
+	case query.Near:
+		ids, err = i.findNear(f, order)
+	case query.WithinBox:
+		ids, err = i.findInBox(f, order)
+	default:
+		err = errors.NewError("Invalid filter type for index %s: %s", i.desc.Name, f.Operator)
+	}
+	if err != nil {
+		return nil, 0, err
+	}
+
+	total := len(ids)
+
+	if offset >= total {
+		return []schema.Key{}, total, nil
+	}
+	ids = ids[offset:]
+	if limit > 0 && len(ids) > limit {
+		ids = ids[:limit]
+	}
+
+	ret := make([]schema.Key, len(ids))
+	for n, id := range ids {
+		ret[n] = schema.Key(id)
+	}
+
+	return ret, total, nil
+}
+
+// scanRaw returns a partial scan of the raw entries in the index, based on limit and order
+func (i *GeoIndex) scanRaw(offset, limit int, order query.Ordering) ([]string, int, error) {
+
+	cmd := newRedisCommand("ZRANGE", i.RedisKey())
+	if !order.Ascending {
+		cmd.command = "ZREVRANGE"
+	}
+
+	if limit > 0 {
+		cmd.add(offset, offset+limit-1)
+	} else {
+		cmd.add(0, -1)
+	}
+
+	tx := NewTransaction(pool.Get())
+	defer tx.Abort()
+
+	idsP, err := tx.Send(cmd.command, cmd.args...)
+	if err != nil {
+		return nil, 0, redisError(err)
+	}
+
+	totalP, err := tx.Send("ZCARD", i.RedisKey())
+	if err != nil {
+		return nil, 0, redisError(err)
+	}
+
+	if _, err = tx.Execute(); err != nil {
+		return nil, 0, redisError(err)
+	}
+
+	ids, _ := redis.Strings(idsP.Reply())
+	total, _ := redis.Int(totalP.Reply())
+
+	return ids, total, nil
+}
+
+// RawEntries scans the index and returns all its entries. In a geo index the entries are the ids themselves
+func (i *GeoIndex) RawEntries(chunk int) (<-chan string, chan<- bool) {
+
+	idch := make(chan string)
+	stopch := make(chan bool)
+	go func() {
+		offset := 0
+		defer close(idch)
+		for {
+			ids, total, err := i.scanRaw(offset, chunk, query.Ordering{Ascending: true})
+			if err != nil {
+				logging.Error("Error scanning %s: %s", i, err)
+				return
+			}
+
+			for _, id := range ids {
+				select {
+				case idch <- id:
+				case <-stopch:
+					logging.Info("Stopping scan loop")
+					return
+				}
+			}
+
+			if len(ids) == 0 || total < offset+chunk {
+				return
+			}
+
+			offset += chunk
+		}
+	}()
+
+	return idch, stopch
+}
+
+// Scan returns a channel that scans through the index and returns all the ids of the objects indexed in it
+func (i *GeoIndex) Scan(chunk int) (<-chan schema.Key, chan<- bool) {
+
+	idch := make(chan schema.Key)
+	stopch := make(chan bool)
+	go func() {
+		defer close(idch)
+		ch, sch := i.RawEntries(chunk)
+
+		for id := range ch {
+			select {
+			case idch <- schema.Key(id):
+			case <-stopch:
+				logging.Info("Stopping scan loop")
+				sch <- true
+				return
+			}
+		}
+	}()
+
+	return idch, stopch
+}
+
+// ExtractId returns the entry as is, since a geo index stores just the entity ids
+func (i *GeoIndex) ExtractId(entry string) schema.Key {
+	return schema.Key(entry)
+}
+
+// RemoveEntry removes a single entry from the index
+func (i *GeoIndex) RemoveEntry(entry string) error {
+
+	conn := pool.Get()
+	defer conn.Close()
+
+	_, err := conn.Do("ZREM", i.RedisKey(), entry)
+	return err
+}
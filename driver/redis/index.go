@@ -44,6 +44,9 @@ type index interface {
 
 	RemoveEntry(entry string) error
 
+	// ExtractId returns the id of the entity a raw index entry (as returned by RawEntries) points to
+	ExtractId(entry string) schema.Key
+
 	RedisKey() string
 
 	//UnindexEntities(entities ...schema.Entity) error
@@ -74,9 +77,12 @@ func (c *indexCommand) addEntry(entry string) {
 	c.add(0, entry)
 }
 
-// prepareValue takes a value and if needed pre-processes it for indexing. This is mainly used for
-// normalizing texts
-func prepareValue(val interface{}) (interface{}, error) {
+// prepareKeyValue takes a value and if needed pre-processes it for building compound primary keys. This is mainly used for
+// normalizing texts.
+//
+// NOTE: This encoding determines the ids of existing entities and must not change. Secondary index entries are
+// encoded with encodeValue, which preserves the order of values
+func prepareKeyValue(val interface{}) (interface{}, error) {
 	if val == nil {
 		return nil, nil
 	}
@@ -105,7 +111,7 @@ func prepareValue(val interface{}) (interface{}, error) {
 		} else {
 			uintval |= 0x8000000000000000
 		}
-		return prepareValue(schema.Uint(uintval))
+		return prepareKeyValue(schema.Uint(uintval))
 
 	default:
 		return encoder.Encode(val)
@@ -114,7 +120,7 @@ func prepareValue(val interface{}) (interface{}, error) {
 
 }
 
-// formatValue takes a prepared value and  converts it to the serialized version we use in indexing
+// formatValue takes a prepared value and  converts it to the serialized version we use in compound primary keys
 func formatValue(val interface{}) []byte {
 
 	switch v := val.(type) {
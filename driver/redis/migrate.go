@@ -0,0 +1,401 @@
+package redis
+
+import (
+	"fmt"
+	"hash/fnv"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/dvirsky/go-pylog/logging"
+	"github.com/garyburd/redigo/redis"
+	"github.com/EverythingMe/meduza/driver"
+	"github.com/EverythingMe/meduza/errors"
+	"github.com/EverythingMe/meduza/query"
+	"github.com/EverythingMe/meduza/schema"
+)
+
+// the number of legacy entries, or entities, we migrate at once
+const migrationChunkSize = 100
+
+// the maximal number of conversion errors kept in a migration report
+const maxMigrationErrors = 20
+
+// migrateIndexes migrates all the compound indexes of all tables written in a legacy entry encoding.
+// It is run in the background by the master on startup
+func (r *Driver) migrateIndexes() {
+
+	r.tableLock.RLock()
+	tables := make([]*table, 0, len(r.tables))
+	for _, t := range r.tables {
+		tables = append(tables, t)
+	}
+	r.tableLock.RUnlock()
+
+	for _, t := range tables {
+		for _, idx := range t.indexes {
+			if ci, ok := idx.(*CompoundIndex); ok {
+				if err := ci.migrate(t); err != nil {
+					logging.Error("Could not migrate index %s: %s", ci, err)
+				}
+			}
+		}
+	}
+}
+
+// legacyEntryId extracts the id of an unversioned entry, in the form of v1|v2|::id. Since values were not escaped,
+// we take the last separator
+func legacyEntryId(entry string) schema.Key {
+	pos := strings.LastIndex(entry, "::")
+	if pos < 0 {
+		return ""
+	}
+	return schema.Key(entry[pos+2:])
+}
+
+// migrate rewrites an index stored under the legacy unversioned key into the current encoding.
+//
+// Since legacy entries cannot be decoded reliably, we just take the ids from them and reindex their entities,
+// and remove the legacy key once done. Nothing writes to the legacy key anymore, so it is safe to page over it while
+// the index is being used. Until the migration is done, queries using the index might return partial results
+func (i *CompoundIndex) migrate(t *table) error {
+
+	conn := pool.Get()
+	defer conn.Close()
+
+	total, err := redis.Int(conn.Do("ZCARD", i.legacyKey()))
+	if err != nil {
+		return redisError(err)
+	} else if total == 0 {
+		return nil
+	}
+
+	logging.Info("Migrating %d entries of index %s from %s to %s", total, i, i.legacyKey(), i.RedisKey())
+
+	for offset := 0; offset < total; offset += migrationChunkSize {
+
+		entries, err := redis.Strings(conn.Do("ZRANGE", i.legacyKey(), offset, offset+migrationChunkSize-1))
+		if err != nil {
+			return redisError(err)
+		}
+
+		ids := make([]schema.Key, 0, len(entries))
+		for _, e := range entries {
+			if id := legacyEntryId(e); !id.IsNull() {
+				ids = append(ids, id)
+			}
+		}
+
+		// entities deleted since the legacy index was written will just not be loaded
+		ents, err := t.load(ids)
+		if err != nil {
+			return err
+		}
+
+		if len(ents) > 0 {
+			if err := t.reindex(ents...); err != nil {
+				return err
+			}
+		}
+	}
+
+	if _, err := conn.Do("DEL", i.legacyKey()); err != nil {
+		return redisError(err)
+	}
+
+	logging.Info("Finished migrating index %s", i)
+	return nil
+}
+
+// When columns are altered or renamed, the stored entities of their table are migrated - their values are converted
+// to the columns' new types and moved to the columns' new names, and the indexes are updated accordingly.
+//
+// The master migrates a table in the background whenever a schema update alters its columns, and migrations can be
+// run, or dry run, through the ctl server. Migrations scan the table's primary index in chunks, like backfills, and
+// their progress is persisted in redis and reported in the table's stats. A migration that was interrupted resumes
+// from the last chunk it finished, unless the columns changed since. Since a migration only writes entities whose
+// values do not match their columns, running it again is harmless
+
+// migrationKey returns the key of the hash the progress of a table's data migration is persisted in
+func migrationKey(table string) string {
+	return fmt.Sprintf("__mdz_migration__:%s", table)
+}
+
+// migrationProgress is the state and progress of a table's data migration
+type migrationProgress struct {
+	state    string
+	scanned  int
+	total    int
+	migrated int
+	failed   int
+	// cursor is the primary index entry of the last entity scanned
+	cursor string
+	// columns is the signature of the columns the entities are migrated to
+	columns string
+}
+
+const (
+	migrationRunning = "running"
+	migrationDone    = "done"
+	migrationFailed  = "failed"
+)
+
+// String returns a description of the progress for the driver stats, or an empty string if the table was never migrated
+func (p migrationProgress) String() string {
+	if p.state == "" {
+		return ""
+	}
+	if p.total == 0 {
+		return fmt.Sprintf("%s %d, %d migrated, %d failed", p.state, p.scanned, p.migrated, p.failed)
+	}
+	return fmt.Sprintf("%s %d/%d (%d%%), %d migrated, %d failed", p.state, p.scanned, p.total, p.scanned*100/p.total,
+		p.migrated, p.failed)
+}
+
+// loadMigration reads the persisted progress of a table's data migration
+func loadMigration(conn redis.Conn, table string) (migrationProgress, error) {
+
+	vals, err := redis.StringMap(conn.Do("HGETALL", migrationKey(table)))
+	if err != nil {
+		return migrationProgress{}, redisError(err)
+	}
+
+	p := migrationProgress{state: vals["state"]}
+	p.scanned, _ = strconv.Atoi(vals["scanned"])
+	p.total, _ = strconv.Atoi(vals["total"])
+	p.migrated, _ = strconv.Atoi(vals["migrated"])
+	p.failed, _ = strconv.Atoi(vals["failed"])
+	p.cursor, p.columns = vals["cursor"], vals["columns"]
+	return p, nil
+}
+
+// saveMigration persists the progress of a table's data migration
+func saveMigration(conn redis.Conn, table string, p migrationProgress) error {
+
+	if _, err := conn.Do("HMSET", migrationKey(table), "state", p.state, "scanned", p.scanned, "total", p.total,
+		"migrated", p.migrated, "failed", p.failed, "cursor", p.cursor, "columns", p.columns); err != nil {
+		return redisError(err)
+	}
+	return nil
+}
+
+// migrationColumns returns the signature of the names, types and previous names of a table's columns. A migration
+// is resumed only if the signature did not change, as otherwise the entities it already scanned may need migrating
+// again
+func migrationColumns(desc *schema.Table) string {
+
+	cols := make([]string, 0, len(desc.Columns))
+	for name, col := range desc.Columns {
+		cols = append(cols, fmt.Sprintf("%s:%s:%s", name, col.Type, col.RenamedFrom))
+	}
+	sort.Strings(cols)
+
+	h := fnv.New64a()
+	h.Write([]byte(strings.Join(cols, ",")))
+	return strconv.FormatUint(h.Sum64(), 16)
+}
+
+// migrateEntities migrates a chunk of entities, adding what it did to the report. Each entity is written only if it
+// has not changed since it was loaded, and the chunk is loaded and migrated again if any has
+func (t *table) migrateEntities(ids []schema.Key, dryRun bool, rep *driver.MigrationReport) error {
+
+	for retry := 0; ; retry++ {
+
+		// entities deleted since they were scanned will just not be loaded
+		ents, err := t.load(ids)
+		if err != nil {
+			return err
+		}
+
+		cs := newChangeSet(len(ents))
+		migrated, failed := 0, 0
+		errs := make([]string, 0)
+
+		for _, ent := range ents {
+
+			vs := schema.Violations{}
+			set, del := t.desc.MigrateProperties(ent.Properties, &vs)
+			if len(vs) > 0 {
+				failed++
+				errs = append(errs, fmt.Sprintf("%s: %s", ent.Id, strings.Join(vs, "; ")))
+			}
+			if len(set) == 0 && len(del) == 0 {
+				continue
+			}
+			migrated++
+
+			props := make([]string, 0, len(set))
+			for k := range set {
+				props = append(props, k)
+			}
+			sort.Strings(props)
+
+			changes := make([]query.Change, 0, len(set)+len(del))
+			for _, k := range props {
+				changes = append(changes, query.Set(k, set[k]))
+			}
+			for _, k := range del {
+				changes = append(changes, query.DelProperty(k))
+			}
+
+			ec := newEntityChange(t, ent.Id, changeUpdate, changes...)
+			ec.conditions = []query.Condition{query.IfVersion(ent.Version)}
+			ec.existence = mustExist
+			cs.Add(ec)
+		}
+
+		if !dryRun && len(cs.changes) > 0 {
+			if _, err := cs.Execute(); (err == errWatchConflict || errors.IsConflict(err)) && retry < maxWatchRetries {
+				logging.Debug("Entities of table %s changed while migrating them, retrying (%d)", t, retry+1)
+				continue
+			} else if err != nil {
+				return err
+			}
+		}
+
+		rep.Migrated += driver.Counter(migrated)
+		rep.Failed += driver.Counter(failed)
+		for _, e := range errs {
+			if len(rep.Errors) < maxMigrationErrors {
+				rep.Errors = append(rep.Errors, e)
+			}
+		}
+		return nil
+	}
+}
+
+// migrate migrates all the stored entities of the table to its columns, scanning its primary index in chunks.
+// Unless it is a dry run, its progress is persisted as it goes, and a previous migration of the same columns that
+// did not finish is resumed, adding to its counts
+func (t *table) migrate(dryRun bool) (*driver.MigrationReport, error) {
+
+	conn := pool.Get()
+	defer conn.Close()
+
+	rep := &driver.MigrationReport{Table: t.desc.Name, DryRun: dryRun, Errors: make([]string, 0)}
+	p := migrationProgress{state: migrationRunning, columns: migrationColumns(&t.desc)}
+
+	if !dryRun {
+		prev, err := loadMigration(conn, t.desc.Name)
+		if err != nil {
+			return nil, err
+		}
+		if prev.state != migrationDone && prev.cursor != "" && prev.columns == p.columns {
+			logging.Info("Resuming the migration of table %s after %d entities", t, prev.scanned)
+			p.cursor = prev.cursor
+			rep.Scanned, rep.Migrated, rep.Failed = driver.Counter(prev.scanned), driver.Counter(prev.migrated),
+				driver.Counter(prev.failed)
+		}
+	}
+
+	// save persists the progress, unless this is a dry run
+	save := func() error {
+		if dryRun {
+			return nil
+		}
+		p.scanned, p.migrated, p.failed = int(rep.Scanned), int(rep.Migrated), int(rep.Failed)
+		return saveMigration(conn, t.desc.Name, p)
+	}
+
+	logging.Info("Migrating the entities of table %s (dry run: %v)", t, dryRun)
+
+	for {
+		min := "-"
+		if p.cursor != "" {
+			min = "(" + p.cursor
+		}
+
+		entries, err := redis.Strings(conn.Do("ZRANGEBYLEX", t.primary.RedisKey(), min, "+", "LIMIT", 0,
+			migrationChunkSize))
+		if err != nil {
+			return nil, redisError(err)
+		}
+		if p.total, err = redis.Int(conn.Do("ZCARD", t.primary.RedisKey())); err != nil {
+			return nil, redisError(err)
+		}
+
+		ids := make([]schema.Key, len(entries))
+		for i, e := range entries {
+			ids[i] = t.primary.ExtractId(e)
+		}
+
+		if err := t.migrateEntities(ids, dryRun, rep); err != nil {
+			p.state = migrationFailed
+			if e := save(); e != nil {
+				logging.Error("Could not save the progress of migrating table %s: %s", t, e)
+			}
+			return nil, err
+		}
+		rep.Scanned += driver.Counter(len(entries))
+
+		if len(entries) > 0 {
+			p.cursor = entries[len(entries)-1]
+		}
+		if len(entries) < migrationChunkSize {
+			break
+		}
+
+		if err := save(); err != nil {
+			return nil, err
+		}
+	}
+
+	p.state = migrationDone
+	if err := save(); err != nil {
+		return nil, err
+	}
+
+	logging.Info("Finished migrating table %s: %d entities scanned, %d migrated, %d failed", t, rep.Scanned,
+		rep.Migrated, rep.Failed)
+	return rep, nil
+}
+
+// needsMigration tells whether a column alter change affects the stored values of the column
+func needsMigration(ch schema.ColumnAlterChange) bool {
+	return ch.From == nil || ch.From.Type != ch.Column.Type || ch.From.Name != ch.Column.Name
+}
+
+// migrateAltered starts migrating the tables whose columns were altered or renamed by schema changes in the background
+func (r *Driver) migrateAltered(changes []interface{}) {
+
+	started := make(map[string]bool)
+	for _, change := range changes {
+		if ch, ok := change.(schema.ColumnAlterChange); ok && needsMigration(ch) && !started[ch.Table.Name] {
+			started[ch.Table.Name] = true
+
+			go func(name string) {
+				if _, err := r.Migrate(name, false); err != nil {
+					logging.Error("Error migrating table %s: %s", name, err)
+				}
+			}(ch.Table.Name)
+		}
+	}
+}
+
+// Migrate migrates the stored entities of a table to its columns, or just reports what would be migrated in a dry
+// run. Only one migration of a table may run at a time
+func (r *Driver) Migrate(table string, dryRun bool) (*driver.MigrationReport, error) {
+
+	tbl, found := r.getTable(table)
+	if !found {
+		return nil, errors.InvalidTableError
+	}
+
+	if !dryRun {
+		r.migrationLock.Lock()
+		if r.migrations[table] {
+			r.migrationLock.Unlock()
+			return nil, errors.NewError("Table %s is already being migrated", table)
+		}
+		r.migrations[table] = true
+		r.migrationLock.Unlock()
+
+		defer func() {
+			r.migrationLock.Lock()
+			delete(r.migrations, table)
+			r.migrationLock.Unlock()
+		}()
+	}
+
+	return tbl.migrate(dryRun)
+}
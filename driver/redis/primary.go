@@ -151,6 +151,11 @@ func (i basePrimaryIndex) RawEntries(chunk int) (<-chan string, chan<- bool) {
 	return nil, nil
 }
 
+// ExtractId returns the entry as is, since the primary index stores just the entity ids
+func (i basePrimaryIndex) ExtractId(entry string) schema.Key {
+	return schema.Key(entry)
+}
+
 func (i basePrimaryIndex) RemoveEntry(entry string) error {
 
 	conn := pool.Get()
@@ -209,12 +214,17 @@ func (i basePrimaryIndex) Scan(chunk int) (<-chan schema.Key, chan<- bool) {
 func (i basePrimaryIndex) RedisKey() string {
 
 	if i.idkey == "" {
-		i.idkey = fmt.Sprintf("%s::PRIMARY", i.table.desc.Name)
+		i.idkey = primaryKey(i.table.desc.Name)
 	}
 	return i.idkey
 
 }
 
+// primaryKey returns the key of the primary index of a table
+func primaryKey(table string) string {
+	return fmt.Sprintf("%s::PRIMARY", table)
+}
+
 func (i basePrimaryIndex) Unindex(ids ...schema.Key) error {
 	logging.Info("Unindexing ids %s in primary %s", ids, i.desc.Name)
 	delCmd := newUnindexCommand(i.RedisKey())
@@ -480,7 +490,7 @@ func (idx compoundPrimaryIndex) filtersToIds(filters query.Filters) ([]interface
 		// in the first iteration we start with a serialized version of each of filters' values
 		if i == 0 {
 			for _, val := range flt.Values {
-				pv, err := prepareValue(val)
+				pv, err := prepareKeyValue(val)
 				if err != nil {
 					return nil, err
 				}
@@ -498,7 +508,7 @@ func (idx compoundPrimaryIndex) filtersToIds(filters query.Filters) ([]interface
 				for _, v := range flt.Values {
 
 					// format the value and append it to a new copy of the current id buffer
-					pv, err := prepareValue(v)
+					pv, err := prepareKeyValue(v)
 					if err != nil {
 						return nil, err
 					}
@@ -542,7 +552,7 @@ func (i compoundPrimaryIndex) GenerateId(ent schema.Entity) (schema.Key, error)
 			return "", errors.NewError("Cannot index entity with missing/nil value for %s", p)
 		}
 
-		pv, err := prepareValue(val)
+		pv, err := prepareKeyValue(val)
 		if err != nil {
 			return "", err
 		}
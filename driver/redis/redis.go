@@ -50,13 +50,23 @@ type Driver struct {
 	tableLock sync.RWMutex
 	tables    map[string]*table
 	schemas   map[string]*schema.Schema
+
+	// the keys of the indexes being backfilled
+	backfillLock sync.Mutex
+	backfills    map[string]bool
+
+	// the names of the tables being migrated
+	migrationLock sync.Mutex
+	migrations    map[string]bool
 }
 
 // NewDriver creates a new redis driver instance
 func NewDriver() *Driver {
 	return &Driver{
-		tables:  make(map[string]*table),
-		schemas: make(map[string]*schema.Schema),
+		tables:     make(map[string]*table),
+		schemas:    make(map[string]*schema.Schema),
+		backfills:  make(map[string]bool),
+		migrations: make(map[string]bool),
 	}
 }
 
@@ -102,6 +112,9 @@ func (r *Driver) newTable(desc schema.Table) (*table, error) {
 	tbl := &table{
 		desc:    desc,
 		indexes: make([]index, 0, len(desc.Indexes)),
+		stats:   newStatsCache(),
+		states:  newIndexStates(),
+		props:   newIndexableCache(),
 	}
 
 	for _, idx := range desc.Indexes {
@@ -122,6 +135,11 @@ func (r *Driver) newTable(desc schema.Table) (*table, error) {
 		}
 	}
 
+	// if we can't tell which indexes are new, we let the planner use them all
+	if err := tbl.loadIndexStates(); err != nil {
+		logging.Error("Could not load the index states of table %s: %s", desc.Name, err)
+	}
+
 	return tbl, nil
 }
 
@@ -149,6 +167,24 @@ func (r *Driver) Init(sp schema.SchemaProvider, config interface{}) error {
 
 	go r.monitorChanges(sp)
 
+	// rewrite indexes written in older entry encodings
+	if conf.Master {
+		go r.migrateIndexes()
+	}
+
+	// backfill new indexes, and track their progress
+	go r.backfillLoop(backfillCheckFrequency)
+
+	// delete the data of dropped indexes and tables
+	if conf.Master {
+		go r.gcLoop(gcFrequency)
+	}
+
+	// sample index statistics for the query planner
+	if conf.StatsFrequency > 0 {
+		go r.statsLoop(time.Duration(conf.StatsFrequency) * time.Second)
+	}
+
 	if conf.Master && conf.RepairEnabled {
 
 		if conf.RepairFrequency < MinRepairFrequency {
@@ -163,9 +199,22 @@ func (r *Driver) Init(sp schema.SchemaProvider, config interface{}) error {
 	return nil
 }
 
-// handleSchema takes a schema spec and breaks it into tables, putting them in the table scec of the driver
+// handleSchema takes a schema spec and breaks it into tables, putting them in the table scec of the driver.
+//
+// If the schema was already loaded, the data of the indexes and tables dropped from it is marked as garbage, and the
+// master migrates the entities of tables whose columns were altered
 func (r *Driver) handleSchema(sc *schema.Schema) error {
 
+	var changes []interface{}
+	if old, found := r.schemas[sc.Name]; found {
+		var err error
+		if changes, err = old.Diff(sc); err != nil {
+			logging.Error("Could not compare schema %s to its previous version: %s", sc.Name, err)
+			return err
+		}
+	}
+
+	prev := make(map[string]*table)
 	for _, desc := range sc.Tables {
 		logging.Debug("Creating table %s on schema %s", desc.Name, sc.Name)
 		tbl, err := r.newTable(*desc)
@@ -175,12 +224,22 @@ func (r *Driver) handleSchema(sc *schema.Schema) error {
 		}
 
 		r.tableLock.Lock()
+		prev[desc.Name] = r.tables[desc.Name]
 		r.tables[desc.Name] = tbl
 		r.tableLock.Unlock()
 
 	}
 
 	r.schemas[sc.Name] = sc
+
+	if err := r.markGarbage(changes, prev); err != nil {
+		logging.Error("Could not mark the garbage of schema %s: %s", sc.Name, err)
+		return err
+	}
+
+	if DefaultConfig.Master {
+		r.migrateAltered(changes)
+	}
 	return nil
 
 }
@@ -194,9 +253,10 @@ func (r *Driver) Put(q query.PutQuery) *query.PutResponse {
 		ret.Error = errors.InvalidTableError
 	} else {
 
-		ids, err := tbl.Put(q.Entities...)
+		ids, outcomes, err := tbl.Write(q)
 		ret.Error = errors.Wrap(err)
 		ret.Ids = ids
+		ret.Outcomes = outcomes
 
 	}
 
@@ -302,13 +362,130 @@ func (r *Driver) Delete(q query.DelQuery) *query.DelResponse {
 	if tbl, found := r.getTable(q.Table); !found {
 		ret.Error = errors.InvalidTableError
 	} else {
-		num, err := tbl.Delete(q.Filters)
+		num, ents, err := tbl.Delete(q)
 		ret.Error = errors.Wrap(err)
 		ret.Num = num
+		ret.Entities = ents
+	}
+	return ret
+}
+
+// Explain executes an EXPLAIN query on the driver, describing how it would select the entities matching the
+// query's filters and ordering
+func (r *Driver) Explain(q query.ExplainQuery) *query.ExplainResponse {
+	ret := query.NewExplainResponse(nil)
+	defer ret.Done()
+
+	if tbl, found := r.getTable(q.Table); !found {
+		ret.Error = errors.InvalidTableError
+	} else {
+		tbl.Explain(q, ret)
 	}
 	return ret
 }
 
+// Count executes a COUNT query on the driver, counting the entities matching the query's selection
+func (r *Driver) Count(q query.CountQuery) *query.CountResponse {
+	ret := query.NewCountResponse(nil, 0)
+	defer ret.Done()
+
+	if tbl, found := r.getTable(q.Table); !found {
+		ret.Error = errors.InvalidTableError
+	} else {
+		num, err := tbl.Count(query.Selection(q.Filters, q.Expression))
+		ret.Error = errors.Wrap(err)
+		ret.Num = num
+	}
+	return ret
+}
+
+// Transaction executes a TX query on the driver. All of its statements are converted to a single change set, that
+// is written in one redis transaction along with its index changes, so either all of them are applied or none are.
+//
+// The index keys the UPDATE and DEL statements select their entities from are watched before the entities are
+// selected, so if the selections change before the transaction executes, the statements are converted again and the
+// transaction is retried
+func (r *Driver) Transaction(q query.TxQuery) *query.TxResponse {
+	ret := query.NewTxResponse(nil)
+	defer ret.Done()
+
+	var results []query.TxResult
+	_, err := retryWatched(func() (int, error) {
+		tx := NewTransaction(pool.Get())
+		defer tx.Abort()
+
+		cs, res, err := r.txChanges(tx.conn, q)
+		if err != nil {
+			return 0, err
+		}
+		results = res
+		return cs.executeIn(tx)
+	})
+	if err != nil {
+		ret.Error = errors.Wrap(err)
+		return ret
+	}
+
+	ret.Results = results
+	return ret
+}
+
+// txChanges converts the statements of a TX query to a change set, and returns it with the results of the
+// statements. The selection keys of UPDATE and DEL statements are watched on conn before their entities are selected
+func (r *Driver) txChanges(conn redis.Conn, q query.TxQuery) (*changeSet, []query.TxResult, error) {
+
+	tables := make([]*table, len(q.Statements))
+	keys := make([]interface{}, 0)
+	for i, st := range q.Statements {
+		tbl, found := r.getTable(st.Table())
+		if !found {
+			return nil, nil, errors.InvalidTableError
+		}
+		tables[i] = tbl
+
+		switch {
+		case st.Update != nil:
+			keys = append(keys, tbl.selectionKeys(query.Selection(st.Update.Filters, st.Update.Expression))...)
+		case st.Del != nil:
+			keys = append(keys, tbl.selectionKeys(query.Selection(st.Del.Filters, st.Del.Expression))...)
+		}
+	}
+
+	if len(keys) > 0 {
+		if _, err := conn.Do("WATCH", keys...); err != nil {
+			return nil, nil, redisError(err)
+		}
+	}
+
+	results := make([]query.TxResult, len(q.Statements))
+	cs := newChangeSet(len(q.Statements))
+	cs.atomic = true
+
+	for i, st := range q.Statements {
+		tbl := tables[i]
+
+		var err error
+		switch {
+		case st.Put != nil:
+			results[i].Outcomes = make([]query.PutOutcome, len(st.Put.Entities))
+			results[i].Ids, err = tbl.putChanges(cs, *st.Put, results[i].Outcomes)
+		case st.Update != nil:
+			results[i].Num, err = tbl.updateChanges(cs, *st.Update)
+		case st.Del != nil:
+			results[i].Num, err = tbl.deleteChanges(cs, query.Selection(st.Del.Filters, st.Del.Expression), -1)
+		}
+		if err != nil {
+			return nil, nil, err
+		}
+	}
+
+	if err := cs.checkUnique(); err != nil {
+		return nil, nil, err
+	}
+
+	return cs, results, nil
+}
+
 // Update executes an UPDATE query on the driver, performing a series of changes on entities specified
 // by a set of filters
 func (r *Driver) Update(q query.UpdateQuery) *query.UpdateResponse {
@@ -317,9 +494,10 @@ func (r *Driver) Update(q query.UpdateQuery) *query.UpdateResponse {
 	if tbl, found := r.getTable(q.Table); !found {
 		ret.Error = errors.InvalidTableError
 	} else {
-		num, err := tbl.Update(q)
+		num, ents, err := tbl.Update(q)
 		ret.Error = errors.Wrap(err)
 		ret.Num = num
+		ret.Entities = ents
 	}
 	return ret
 
@@ -5,6 +5,8 @@ import (
 	"math"
 	"os"
 	"reflect"
+	"strings"
+	"sync"
 	"testing"
 	"time"
 
@@ -12,11 +14,11 @@ import (
 	"github.com/stretchr/testify/assert"
 
 	"github.com/EverythingMe/disposable-redis"
-	"github.com/garyburd/redigo/redis"
 	"github.com/EverythingMe/meduza/driver"
 	"github.com/EverythingMe/meduza/errors"
 	"github.com/EverythingMe/meduza/query"
 	"github.com/EverythingMe/meduza/schema"
+	"github.com/garyburd/redigo/redis"
 )
 
 var srv *disposable_redis.Server
@@ -42,6 +44,10 @@ tables:
                 type: Int
             mip:
                 type: Map
+            tags:
+                type: Set
+            recent:
+                type: List
         indexes:
             -   type: simple
                 columns: [name]
@@ -68,6 +74,78 @@ tables:
         indexes:
             -   type: simple
                 columns: [name]                             
+
+    Places:
+        engines: 
+            - redis
+        primary:
+            type: random
+        columns:
+            name: 
+                type: Text
+            lat:
+                type: Float
+            lon:
+                type: Float
+        indexes:
+            -   type: geo
+                columns: [lat,lon]
+
+    Articles:
+        engines: 
+            - redis
+        primary:
+            type: random
+        columns:
+            title: 
+                type: Text
+            body:
+                type: Text
+        indexes:
+            -   type: fulltext
+                columns: [title,body]
+
+    Events:
+        engines: 
+            - redis
+        primary:
+            type: random
+        columns:
+            name: 
+                type: Text
+            score:
+                type: Int
+            time:
+                type: Timestamp
+        indexes:
+            -   type: simple
+                columns: [score]
+            -   type: sorted
+                columns: [score]
+            -   type: sorted
+                columns: [time]
+
+    Accounts:
+        engines: 
+            - redis
+        strict: true
+        primary:
+            type: random
+        columns:
+            email:
+                type: Text
+                options:
+                    required: true
+            score:
+                type: Int
+                default: 0
+            tags:
+                type: Set
+        indexes:
+            -   type: simple
+                columns: [email]
+                options:
+                    unique: true
 `
 
 func setUp() (err error) {
@@ -231,6 +309,10 @@ func TestMain(m *testing.M) {
 
 const usersTable = "testung.Users"
 const appsTable = "testung.Apps"
+const placesTable = "testung.Places"
+const articlesTable = "testung.Articles"
+const eventsTable = "testung.Events"
+const accountsTable = "testung.Accounts"
 
 var mipmap = schema.NewMap().Set("foo", "bar")
 var ents = []schema.Entity{
@@ -282,8 +364,9 @@ func TestPut(t *testing.T) {
 			t.Error("Entity not written to redis", id)
 		}
 
-		if len(res) != 8 {
-			t.Error("Invalid num of elements in set expected %d, got %d", 8, len(res))
+		// the entity's properties and its version
+		if len(res) != 10 {
+			t.Error("Invalid num of elements in set expected %d, got %d", 10, len(res))
 		}
 	}
 
@@ -818,7 +901,7 @@ func TestTTL(t *testing.T) {
 	}
 
 	if len(gr.Entities) != 0 {
-		t.Errorf("We should have gotten nothing! got %s", gr.Entities)
+		t.Errorf("We should have gotten nothing! got %v", gr.Entities)
 	}
 
 	tbl, _ := drv.(*Driver).getTable(usersTable)
@@ -1046,7 +1129,7 @@ func TestStats(t *testing.T) {
 	globalStats, err := drv.Stats()
 	assert.NoError(t, err)
 	assert.NotNil(t, globalStats)
-	assert.Equal(t, 2, len(globalStats.Tables))
+	assert.Equal(t, len(drv.(*Driver).tables), len(globalStats.Tables))
 	t.Logf("Sampled driver data: %#v", globalStats)
 
 }
@@ -1138,3 +1221,1987 @@ func TestDelProperty(t *testing.T) {
 	assert.False(t, found)
 
 }
+
+func TestGeoIndex(t *testing.T) {
+
+	conn.Do("FLUSHDB")
+	defer conn.Do("FLUSHDB")
+
+	places := []struct {
+		name     string
+		lat, lon float64
+	}{
+		{"dizengoff", 32.0778, 34.7740},
+		{"rabin", 32.0809, 34.7806},
+		{"jaffa", 32.0543, 34.7516},
+		{"jerusalem", 31.7683, 35.2137},
+	}
+
+	pq := query.NewPutQuery(placesTable)
+	for _, p := range places {
+		pq.AddEntity(*schema.NewEntity("").Set("name", p.name).Set("lat", p.lat).Set("lon", p.lon))
+	}
+	pr := drv.Put(*pq)
+	if pr.Error != nil {
+		t.Fatal(pr.Error)
+	}
+
+	// places within 5km of dizengoff, closest first
+	gr := drv.Get(*query.NewGetQuery(placesTable).FilterNear("lat", 32.0778, 34.7740, 5000))
+	assert.NoError(t, gr.Err())
+	assert.Equal(t, 3, gr.Total)
+	if assert.Len(t, gr.Entities, 3) {
+		assert.EqualValues(t, "dizengoff", gr.Entities[0].Properties["name"])
+		assert.EqualValues(t, "rabin", gr.Entities[1].Properties["name"])
+		assert.EqualValues(t, "jaffa", gr.Entities[2].Properties["name"])
+	}
+
+	// paging over distance ordered results
+	gr = drv.Get(*query.NewGetQuery(placesTable).FilterNear("lat", 32.0778, 34.7740, 5000).Page(1, 1))
+	assert.NoError(t, gr.Err())
+	assert.Equal(t, 3, gr.Total)
+	if assert.Len(t, gr.Entities, 1) {
+		assert.EqualValues(t, "rabin", gr.Entities[0].Properties["name"])
+	}
+
+	// a box around central tel aviv should not include jaffa or jerusalem
+	gr = drv.Get(*query.NewGetQuery(placesTable).FilterWithinBox("lat", 32.07, 34.77, 32.09, 34.79))
+	assert.NoError(t, gr.Err())
+	assert.Len(t, gr.Entities, 2)
+
+	// moving a place should reindex it
+	ur := drv.Update(*query.NewUpdateQuery(placesTable).WhereId(pr.Ids[3]).Set("lat", 32.0800).Set("lon", 34.7800))
+	assert.NoError(t, ur.Err())
+
+	gr = drv.Get(*query.NewGetQuery(placesTable).FilterNear("lat", 32.0778, 34.7740, 5000))
+	assert.NoError(t, gr.Err())
+	assert.Equal(t, 4, gr.Total)
+
+	// deleting should unindex
+	dr := drv.Delete(*query.NewDelQuery(placesTable).Where("id", query.In, pr.Ids[0]))
+	assert.NoError(t, dr.Err())
+
+	gr = drv.Get(*query.NewGetQuery(placesTable).FilterNear("lat", 32.0778, 34.7740, 5000))
+	assert.NoError(t, gr.Err())
+	assert.Equal(t, 3, gr.Total)
+
+	// geo filters cannot be used without a geo index
+	gr = drv.Get(*query.NewGetQuery(usersTable).FilterNear("name", 32.0778, 34.7740, 5000))
+	assert.Error(t, gr.Err())
+}
+
+func TestFullTextIndex(t *testing.T) {
+
+	conn.Do("FLUSHDB")
+	defer conn.Do("FLUSHDB")
+
+	pq := query.NewPutQuery(articlesTable).
+		AddEntity(*schema.NewEntity("").Set("title", "Redis Indexing").Set("body", "indexing data in redis, redis all the way")).
+		AddEntity(*schema.NewEntity("").Set("title", "Cooking with Redis").Set("body", "a short recipe")).
+		AddEntity(*schema.NewEntity("").Set("title", "Gardening").Set("body", "Nothing to see here"))
+	pr := drv.Put(*pq)
+	if pr.Error != nil {
+		t.Fatal(pr.Error)
+	}
+
+	// single term, ranked by term frequency
+	gr := drv.Get(*query.NewGetQuery(articlesTable).FilterMatch("title", "REDIS"))
+	assert.NoError(t, gr.Err())
+	assert.Equal(t, 2, gr.Total)
+	if assert.Len(t, gr.Entities, 2) {
+		assert.EqualValues(t, pr.Ids[0], gr.Entities[0].Id)
+		assert.EqualValues(t, pr.Ids[1], gr.Entities[1].Id)
+	}
+
+	// multiple terms are AND-ed
+	gr = drv.Get(*query.NewGetQuery(articlesTable).FilterMatch("title", "redis recipe"))
+	assert.NoError(t, gr.Err())
+	assert.Equal(t, 1, gr.Total)
+	if assert.Len(t, gr.Entities, 1) {
+		assert.EqualValues(t, pr.Ids[1], gr.Entities[0].Id)
+	}
+
+	// paging
+	gr = drv.Get(*query.NewGetQuery(articlesTable).FilterMatch("title", "redis").Page(1, 1))
+	assert.NoError(t, gr.Err())
+	assert.Equal(t, 2, gr.Total)
+	if assert.Len(t, gr.Entities, 1) {
+		assert.EqualValues(t, pr.Ids[1], gr.Entities[0].Id)
+	}
+
+	// updating the text should reindex it
+	ur := drv.Update(*query.NewUpdateQuery(articlesTable).WhereId(pr.Ids[1]).Set("title", "Cooking with Gas"))
+	assert.NoError(t, ur.Err())
+
+	gr = drv.Get(*query.NewGetQuery(articlesTable).FilterMatch("title", "redis"))
+	assert.NoError(t, gr.Err())
+	assert.Equal(t, 1, gr.Total)
+
+	gr = drv.Get(*query.NewGetQuery(articlesTable).FilterMatch("title", "gas recipe"))
+	assert.NoError(t, gr.Err())
+	assert.Equal(t, 1, gr.Total)
+
+	// deleting should unindex
+	dr := drv.Delete(*query.NewDelQuery(articlesTable).Where("id", query.In, pr.Ids[0]))
+	assert.NoError(t, dr.Err())
+
+	gr = drv.Get(*query.NewGetQuery(articlesTable).FilterMatch("title", "indexing"))
+	assert.NoError(t, gr.Err())
+	assert.Equal(t, 0, gr.Total)
+
+	// text filters cannot be used without a full text index
+	gr = drv.Get(*query.NewGetQuery(usersTable).FilterMatch("name", "user1"))
+	assert.Error(t, gr.Err())
+}
+
+func TestSortedIndex(t *testing.T) {
+
+	conn.Do("FLUSHDB")
+	defer conn.Do("FLUSHDB")
+
+	now := time.Now()
+	pq := query.NewPutQuery(eventsTable)
+	for n := 0; n < 10; n++ {
+		pq.AddEntity(*schema.NewEntity("").
+			Set("name", fmt.Sprintf("event%d", n)).
+			Set("score", n*100-500).
+			Set("time", now.Add(time.Duration(n)*time.Hour)))
+	}
+	pr := drv.Put(*pq)
+	if pr.Error != nil {
+		t.Fatal(pr.Error)
+	}
+
+	// the sorted index is preferred over the simple index for ranges
+	tbl := drv.(*Driver).tables[eventsTable]
+	idx := tbl.selectIndex(query.Filters{"score": query.Range("score", -200, 200)}, query.NoOrder)
+	if _, ok := idx.(*SortedIndex); !ok {
+		t.Errorf("Expected a sorted index, got %s", idx)
+	}
+
+	// negative and positive ranges
+	gr := drv.Get(*query.NewGetQuery(eventsTable).FilterBetween("score", -200, 200))
+	assert.NoError(t, gr.Err())
+	assert.Equal(t, 5, gr.Total)
+	if assert.Len(t, gr.Entities, 5) {
+		assert.EqualValues(t, "event3", gr.Entities[0].Properties["name"])
+		assert.EqualValues(t, "event7", gr.Entities[4].Properties["name"])
+	}
+
+	// reverse ordering with paging
+	gr = drv.Get(*query.NewGetQuery(eventsTable).Filter("score", query.Gt, 0).OrderBy("score", query.DESC).Page(1, 2))
+	assert.NoError(t, gr.Err())
+	assert.Equal(t, 4, gr.Total)
+	if assert.Len(t, gr.Entities, 2) {
+		assert.EqualValues(t, "event8", gr.Entities[0].Properties["name"])
+		assert.EqualValues(t, "event7", gr.Entities[1].Properties["name"])
+	}
+
+	// timestamps
+	gr = drv.Get(*query.NewGetQuery(eventsTable).Filter("time", query.Lt, now.Add(150*time.Minute)))
+	assert.NoError(t, gr.Err())
+	assert.Equal(t, 3, gr.Total)
+
+	// raw values as they come from the BSON decoder, without internal type conversion
+	q := query.NewGetQuery(eventsTable)
+	q.Filters["time"] = query.Filter{Property: "time", Operator: query.Lt, Values: []interface{}{now.Add(150 * time.Minute)}}
+	gr = drv.Get(*q)
+	assert.NoError(t, gr.Err())
+	assert.Equal(t, 3, gr.Total)
+
+	q = query.NewGetQuery(eventsTable)
+	q.Filters["score"] = query.Filter{Property: "score", Operator: query.Gte, Values: []interface{}{int32(300)}}
+	gr = drv.Get(*q)
+	assert.NoError(t, gr.Err())
+	assert.Equal(t, 2, gr.Total)
+
+	// updating the value should reindex it
+	ur := drv.Update(*query.NewUpdateQuery(eventsTable).WhereId(pr.Ids[0]).Set("score", 1000))
+	assert.NoError(t, ur.Err())
+
+	gr = drv.Get(*query.NewGetQuery(eventsTable).Filter("score", query.Gt, 400))
+	assert.NoError(t, gr.Err())
+	assert.Equal(t, 1, gr.Total)
+
+	// deleting should unindex
+	dr := drv.Delete(*query.NewDelQuery(eventsTable).Where("id", query.In, pr.Ids[0]))
+	assert.NoError(t, dr.Err())
+
+	gr = drv.Get(*query.NewGetQuery(eventsTable).Filter("score", query.Gt, 400))
+	assert.NoError(t, gr.Err())
+	assert.Equal(t, 0, gr.Total)
+}
+
+func TestEntryEncoding(t *testing.T) {
+
+	// encoded values must sort like the values themselves
+	ordered := [][]interface{}{
+		{schema.Int(-1000), schema.Int(-1), schema.Int(0), schema.Int(1), schema.Int(1000)},
+		{schema.Float(-10.5), schema.Float(-0.1), schema.Float(0), schema.Float(0.1), schema.Float(10.5)},
+		{schema.Text("a"), schema.Text("a b"), schema.Text("ab"), schema.Text("a|"), schema.Text("b")},
+		{schema.Binary{0}, schema.Binary{0, 0}, schema.Binary{0, 1}, schema.Binary{1}, schema.Binary{2}},
+		{schema.Bool(false), schema.Bool(true)},
+		{schema.Timestamp(time.Unix(-100, 0)), schema.Timestamp(time.Unix(0, 0)), schema.Timestamp(time.Unix(100, 0))},
+	}
+
+	for _, vals := range ordered {
+		prev := ""
+		for n, v := range vals {
+			enc, err := encodeValue(v)
+			if err != nil {
+				t.Fatal(err)
+			}
+			// we compare terminated values, as they appear in entries
+			cur := string(append(enc, entryTerminator))
+			if n > 0 && cur <= prev {
+				t.Errorf("Encoding of %v does not sort after %v", v, vals[n-1])
+			}
+			prev = cur
+		}
+	}
+
+	// 32 bit values decoded from BSON must encode like their 64 bit internal types
+	for raw, wide := range map[interface{}]interface{}{
+		int32(-5):     schema.Int(-5),
+		uint32(5):     schema.Uint(5),
+		float32(-0.5): schema.Float(-0.5),
+	} {
+		r, err := encodeValue(raw)
+		assert.NoError(t, err)
+		w, _ := encodeValue(wide)
+		assert.Equal(t, w, r)
+	}
+
+	// ids and values containing separators must not corrupt entries
+	idx := NewCompoundIndex(schema.Index{Name: "test", Columns: []string{"a", "b"}}, "test")
+	a, _ := encodeIndexValue(schema.Text("x|y::z"))
+	b, _ := encodeIndexValue(schema.Binary{0, 1, 2})
+	entry := idx.entry(schema.Key("id|::\x00"), map[string]interface{}{"a": a, "b": b})
+	assert.EqualValues(t, "id|::\x00", idx.ExtractId(entry))
+}
+
+func TestCompoundIndexRanges(t *testing.T) {
+
+	conn.Do("FLUSHDB")
+	defer conn.Do("FLUSHDB")
+
+	pq := query.NewPutQuery(usersTable)
+	for _, score := range []int{-10, -1, 0, 5, 20} {
+		pq.AddEntity(*schema.NewEntity("").Set("name", "joe").Set("score", score))
+	}
+	pq.AddEntity(*schema.NewEntity("").Set("name", "joe|bar::baz").Set("score", 1))
+	pr := drv.Put(*pq)
+	if pr.Error != nil {
+		t.Fatal(pr.Error)
+	}
+
+	// negative values must sort before positive ones
+	gr := drv.Get(*query.NewGetQuery(usersTable).FilterEq("name", "joe").FilterBetween("score", -5, 10))
+	assert.NoError(t, gr.Err())
+	if assert.Len(t, gr.Entities, 3) {
+		assert.EqualValues(t, -1, gr.Entities[0].Properties["score"])
+		assert.EqualValues(t, 0, gr.Entities[1].Properties["score"])
+		assert.EqualValues(t, 5, gr.Entities[2].Properties["score"])
+	}
+
+	// separators in values must not leak into other values
+	gr = drv.Get(*query.NewGetQuery(usersTable).FilterEq("name", "joe"))
+	assert.NoError(t, gr.Err())
+	assert.Equal(t, 5, gr.Total)
+
+	gr = drv.Get(*query.NewGetQuery(usersTable).FilterEq("name", "joe|bar::baz"))
+	assert.NoError(t, gr.Err())
+	if assert.Len(t, gr.Entities, 1) {
+		assert.EqualValues(t, pr.Ids[5], gr.Entities[0].Id)
+	}
+
+	// a limit of 0 means no limit on both single and multiple ranges
+	filters := query.NewFilters(query.Equals("name", "joe"), query.NotEquals("score", 0))
+	idx := drv.(*Driver).tables[usersTable].selectIndex(filters, query.NoOrder)
+	if assert.NotNil(t, idx) {
+		ids, _, err := idx.Find(filters, 0, 0, query.NoOrder)
+		assert.NoError(t, err)
+		assert.Len(t, ids, 4)
+
+		ids, _, err = idx.Find(filters, 1, 0, query.NoOrder)
+		assert.NoError(t, err)
+		assert.Len(t, ids, 3)
+	}
+}
+
+func TestIndexMigration(t *testing.T) {
+
+	conn.Do("FLUSHDB")
+	defer conn.Do("FLUSHDB")
+
+	pr := drv.Put(*query.NewPutQuery(usersTable).AddEntity(*schema.NewEntity("").Set("name", "migrated")))
+	if pr.Error != nil {
+		t.Fatal(pr.Error)
+	}
+
+	// simulate an index written in the legacy encoding, pointing to an existing and a deleted entity
+	tbl := drv.(*Driver).tables[usersTable]
+	var idx *CompoundIndex
+	for _, i := range tbl.indexes {
+		if ci, ok := i.(*CompoundIndex); ok && len(ci.properties) == 1 && ci.properties[0] == "name" {
+			idx = ci
+		}
+	}
+	if idx == nil {
+		t.Fatal("name index not found")
+	}
+
+	conn.Do("DEL", idx.RedisKey())
+	conn.Do("ZADD", idx.legacyKey(), 0, fmt.Sprintf("migrated|::%s", pr.Ids[0]), 0, "deleted|::nosuchid")
+
+	gr := drv.Get(*query.NewGetQuery(usersTable).FilterEq("name", "migrated"))
+	assert.NoError(t, gr.Err())
+	assert.Len(t, gr.Entities, 0)
+
+	if err := idx.migrate(tbl); err != nil {
+		t.Fatal(err)
+	}
+
+	gr = drv.Get(*query.NewGetQuery(usersTable).FilterEq("name", "migrated"))
+	assert.NoError(t, gr.Err())
+	if assert.Len(t, gr.Entities, 1) {
+		assert.EqualValues(t, pr.Ids[0], gr.Entities[0].Id)
+	}
+
+	n, _ := redis.Int(conn.Do("EXISTS", idx.legacyKey()))
+	assert.Equal(t, 0, n)
+	n, _ = redis.Int(conn.Do("ZCARD", idx.RedisKey()))
+	assert.Equal(t, 1, n)
+}
+
+func TestRangeOperators(t *testing.T) {
+
+	conn.Do("FLUSHDB")
+	defer conn.Do("FLUSHDB")
+
+	pq := query.NewPutQuery(usersTable)
+	for n, name := range []string{"alice", "bob", "bobby", "carol", "dave"} {
+		pq.AddEntity(*schema.NewEntity("").Set("name", name).Set("score", n*10))
+	}
+	pr := drv.Put(*pq)
+	if pr.Error != nil {
+		t.Fatal(pr.Error)
+	}
+
+	names := func(gr *query.GetResponse) []string {
+		ret := []string{}
+		for _, e := range gr.Entities {
+			ret = append(ret, fmt.Sprintf("%s", e.Properties["name"]))
+		}
+		return ret
+	}
+
+	cases := []struct {
+		q        *query.GetQuery
+		expected []string
+	}{
+		{query.NewGetQuery(usersTable).FilterGt("name", "bob"), []string{"bobby", "carol", "dave"}},
+		{query.NewGetQuery(usersTable).FilterGte("name", "bob"), []string{"bob", "bobby", "carol", "dave"}},
+		{query.NewGetQuery(usersTable).FilterLt("name", "bobby"), []string{"alice", "bob"}},
+		{query.NewGetQuery(usersTable).FilterLte("name", "bobby"), []string{"alice", "bob", "bobby"}},
+		{query.NewGetQuery(usersTable).FilterPrefix("name", "BO"), []string{"bob", "bobby"}},
+		{query.NewGetQuery(usersTable).FilterNe("name", "carol"), []string{"alice", "bob", "bobby", "dave"}},
+		{query.NewGetQuery(usersTable).FilterNe("name", "carol").OrderBy("name", query.DESC), []string{"dave", "bobby", "bob", "alice"}},
+		{query.NewGetQuery(usersTable).FilterNe("name", "bob").Page(1, 2), []string{"bobby", "carol"}},
+		{query.NewGetQuery(usersTable).FilterEq("name", "bob").FilterGte("score", 10), []string{"bob"}},
+		{query.NewGetQuery(usersTable).FilterEq("name", "bob").FilterLt("score", 10), []string{}},
+	}
+
+	for _, c := range cases {
+		gr := drv.Get(*c.q)
+		if assert.NoError(t, gr.Err()) {
+			assert.Equal(t, c.expected, names(gr), "query %s", c.q)
+		}
+	}
+
+	// total is the number of entities in all ranges
+	gr := drv.Get(*query.NewGetQuery(usersTable).FilterNe("name", "bob").Page(1, 2))
+	assert.Equal(t, 4, gr.Total)
+
+	// update and delete with the new operators
+	ur := drv.Update(*query.NewUpdateQuery(usersTable).WherePrefix("name", "bob").Set("score", 100))
+	assert.NoError(t, ur.Err())
+	assert.Equal(t, 2, ur.Num)
+
+	dr := drv.Delete(*query.NewDelQuery(usersTable).WhereGt("name", "bobby"))
+	assert.NoError(t, dr.Err())
+	assert.Equal(t, 2, dr.Num)
+}
+
+func TestExpressions(t *testing.T) {
+
+	conn.Do("FLUSHDB")
+	defer conn.Do("FLUSHDB")
+
+	pq := query.NewPutQuery(eventsTable)
+	for n, name := range []string{"a", "b", "c", "d", "e", "f"} {
+		pq.AddEntity(*schema.NewEntity(schema.Key(name)).Set("name", name).Set("score", n*10))
+	}
+	pr := drv.Put(*pq)
+	if pr.Error != nil {
+		t.Fatal(pr.Error)
+	}
+
+	names := func(gr *query.GetResponse) []string {
+		ret := []string{}
+		for _, e := range gr.Entities {
+			ret = append(ret, fmt.Sprintf("%s", e.Properties["name"]))
+		}
+		return ret
+	}
+
+	lowOrHigh := query.Or(query.Cond(query.LessThan("score", 20)), query.Cond(query.GreaterOrEqual("score", 40)))
+
+	cases := []struct {
+		q        *query.GetQuery
+		expected []string
+	}{
+		// two conditions on the same property
+		{query.NewGetQuery(eventsTable).FilterExpr(query.And(
+			query.Cond(query.GreaterThan("score", 10)), query.Cond(query.LessThan("score", 40)))), []string{"c", "d"}},
+		{query.NewGetQuery(eventsTable).FilterExpr(lowOrHigh), []string{"a", "b", "e", "f"}},
+		{query.NewGetQuery(eventsTable).FilterExpr(query.Not(lowOrHigh)), []string{"c", "d"}},
+		{query.NewGetQuery(eventsTable).FilterExpr(lowOrHigh).OrderBy("score", query.DESC), []string{"f", "e", "b", "a"}},
+		{query.NewGetQuery(eventsTable).FilterExpr(lowOrHigh).Page(1, 2), []string{"b", "e"}},
+		// filters and expressions are AND-ed
+		{query.NewGetQuery(eventsTable).FilterGt("score", 0).FilterExpr(lowOrHigh), []string{"b", "e", "f"}},
+		{query.NewGetQuery(eventsTable).FilterExpr(query.Or(
+			query.Cond(query.Within(schema.IdKey, schema.Key("a"))), query.Cond(query.Equals("score", 50)))), []string{"a", "f"}},
+	}
+
+	for _, c := range cases {
+		gr := drv.Get(*c.q)
+		if assert.NoError(t, gr.Err()) {
+			assert.Equal(t, c.expected, names(gr), "query %s", c.q)
+		}
+	}
+
+	gr := drv.Get(*query.NewGetQuery(eventsTable).FilterExpr(lowOrHigh).Page(1, 2))
+	assert.Equal(t, 4, gr.Total)
+
+	// leaves answered by sorted indexes are not capped, even when negated
+	func() {
+		defer func(old int) { DefaultConfig.MaxIntermediateResults = old }(DefaultConfig.MaxIntermediateResults)
+		DefaultConfig.MaxIntermediateResults = 1
+
+		gr := drv.Get(*query.NewGetQuery(eventsTable).FilterExpr(query.Not(lowOrHigh)))
+		if assert.NoError(t, gr.Err()) {
+			assert.Equal(t, []string{"c", "d"}, names(gr))
+		}
+
+		gr = drv.Get(*query.NewGetQuery(eventsTable).FilterExpr(query.And(query.Cond(query.Within(schema.IdKey, schema.Key("a"), schema.Key("b"))),
+			query.Cond(query.LessThan("score", 20)))))
+		assert.Error(t, gr.Err())
+	}()
+
+	// expression results can only be ordered by sorted indexes
+	gr = drv.Get(*query.NewGetQuery(eventsTable).FilterExpr(lowOrHigh).OrderBy("name", query.ASC))
+	assert.Error(t, gr.Err())
+
+	// no temporary keys are left behind
+	keys, _ := redis.Strings(conn.Do("KEYS", "tmp:*"))
+	assert.Len(t, keys, 0)
+
+	ur := drv.Update(*query.NewUpdateQuery(eventsTable).WhereExpr(query.Not(lowOrHigh)).Set("name", "mid"))
+	assert.NoError(t, ur.Err())
+	assert.Equal(t, 2, ur.Num)
+
+	dr := drv.Delete(*query.NewDelQuery(eventsTable).WhereExpr(lowOrHigh))
+	assert.NoError(t, dr.Err())
+	assert.Equal(t, 4, dr.Num)
+
+	gr = drv.Get(*query.NewGetQuery(eventsTable).All())
+	assert.Equal(t, []string{"mid", "mid"}, names(gr))
+}
+
+func TestIndexIntersection(t *testing.T) {
+
+	conn.Do("FLUSHDB")
+	defer conn.Do("FLUSHDB")
+
+	now := time.Now()
+	pq := query.NewPutQuery(eventsTable)
+	for n := 0; n < 10; n++ {
+		pq.AddEntity(*schema.NewEntity("").
+			Set("name", fmt.Sprintf("event%d", n)).
+			Set("score", n%2).
+			Set("time", now.Add(time.Duration(n)*time.Hour)))
+	}
+	pr := drv.Put(*pq)
+	if pr.Error != nil {
+		t.Fatal(pr.Error)
+	}
+
+	// no single index covers score and time, so we need two
+	tbl := drv.(*Driver).tables[eventsTable]
+	filters := query.NewFilters(query.Equals("score", 1), query.GreaterThan("time", now.Add(150*time.Minute)))
+	assert.Nil(t, tbl.selectIndex(filters, query.NoOrder))
+	assert.Len(t, tbl.planIntersection(filters), 2)
+
+	gr := drv.Get(*query.NewGetQuery(eventsTable).
+		FilterEq("score", 1).
+		FilterGt("time", now.Add(150*time.Minute)).
+		OrderBy("time", query.DESC).
+		Page(1, 2))
+	assert.NoError(t, gr.Err())
+	assert.Equal(t, 4, gr.Total)
+	if assert.Len(t, gr.Entities, 2) {
+		assert.EqualValues(t, "event7", gr.Entities[0].Properties["name"])
+		assert.EqualValues(t, "event5", gr.Entities[1].Properties["name"])
+	}
+
+	// the primary index can be intersected as well
+	gr = drv.Get(*query.NewGetQuery(eventsTable).FilterIn("id", pr.Ids[0], pr.Ids[1], pr.Ids[2]).FilterEq("score", 0))
+	assert.NoError(t, gr.Err())
+	assert.Equal(t, 2, gr.Total)
+
+	// intermediate results are capped, unless they are stored straight from sorted indexes
+	defer func(old int) { DefaultConfig.MaxIntermediateResults = old }(DefaultConfig.MaxIntermediateResults)
+	DefaultConfig.MaxIntermediateResults = 4
+
+	gr = drv.Get(*query.NewGetQuery(eventsTable).FilterEq("score", 1).FilterGt("time", now.Add(150*time.Minute)))
+	assert.NoError(t, gr.Err())
+	assert.Equal(t, 4, gr.Total)
+
+	gr = drv.Get(*query.NewGetQuery(eventsTable).FilterIn("id", pr.Ids[0], pr.Ids[1], pr.Ids[2], pr.Ids[3], pr.Ids[4]).
+		FilterEq("score", 1))
+	assert.Error(t, gr.Err())
+
+	// unindexed filters still cannot be queried
+	gr = drv.Get(*query.NewGetQuery(eventsTable).FilterEq("score", 1).FilterEq("name", "event1"))
+	assert.Equal(t, errors.NoIndexError, gr.Err())
+}
+
+func TestExplain(t *testing.T) {
+
+	conn.Do("FLUSHDB")
+	defer conn.Do("FLUSHDB")
+
+	now := time.Now()
+	pq := query.NewPutQuery(eventsTable)
+	for n := 0; n < 10; n++ {
+		pq.AddEntity(*schema.NewEntity("").
+			Set("name", fmt.Sprintf("event%d", n)).
+			Set("score", n%2).
+			Set("time", now.Add(time.Duration(n)*time.Hour)))
+	}
+	pr := drv.Put(*pq)
+	if pr.Error != nil {
+		t.Fatal(pr.Error)
+	}
+
+	// both score indexes match, and the sorted one wins the tie
+	er := drv.Explain(*query.NewExplainQuery(eventsTable).Filter("score", query.Eq, 1))
+	assert.NoError(t, er.Err())
+	assert.Equal(t, query.PlanIndex, er.Plan)
+	assert.Len(t, er.Candidates, 4)
+	assert.Equal(t, []string{"testung.Events__score_sorted"}, er.Chosen)
+	if assert.Len(t, er.Scans, 1) {
+		assert.Equal(t, "ZRANGEBYSCORE", er.Scans[0].Command)
+		assert.Equal(t, "1", er.Scans[0].Min)
+		assert.Equal(t, "1", er.Scans[0].Max)
+	}
+
+	// the cardinality is estimated from the sampled statistics of the indexes
+	if err := drv.(*Driver).tables[eventsTable].refreshStats(SampleSize); err != nil {
+		t.Fatal(err)
+	}
+	er = drv.Explain(*query.NewExplainQuery(eventsTable).Filter("score", query.Eq, 1))
+	assert.NoError(t, er.Err())
+	assert.Equal(t, []string{"testung.Events__score_sorted"}, er.Chosen)
+	assert.Equal(t, 5, er.Cardinality)
+
+	// ordering by another property rules out the score indexes, and the fallback plan cannot order by it either
+	er = drv.Explain(*query.NewExplainQuery(eventsTable).Filter("score", query.Eq, 1).OrderBy("name", query.ASC))
+	assert.Error(t, er.Err())
+	assert.Equal(t, query.PlanIntersect, er.Plan)
+	for _, c := range er.Candidates {
+		if c.Type == string(schema.SortedIndex) && c.Properties[0] == "score" {
+			assert.False(t, c.Matched)
+			assert.Equal(t, "Cannot order by name", c.Reason)
+		}
+	}
+
+	// intersections list all the indexes used
+	er = drv.Explain(*query.NewExplainQuery(eventsTable).
+		Filter("score", query.Eq, 1).
+		Filter("time", query.Gt, now.Add(150*time.Minute)).
+		OrderBy("time", query.DESC))
+	assert.NoError(t, er.Err())
+	assert.Equal(t, query.PlanIntersect, er.Plan)
+	assert.Len(t, er.Chosen, 2)
+	assert.Len(t, er.Scans, 2)
+	assert.Equal(t, 5, er.Cardinality)
+
+	// primary lookups are estimated by the number of ids they look up
+	er = drv.Explain(*query.NewExplainQuery(eventsTable).Filter("id", query.In, pr.Ids[0], pr.Ids[1], schema.Key("nosuchid")))
+	assert.NoError(t, er.Err())
+	assert.Equal(t, query.PlanPrimary, er.Plan)
+	assert.Len(t, er.Scans, 3)
+	assert.Equal(t, 3, er.Cardinality)
+
+	// unindexed filters have no plan, and the candidates tell us why
+	er = drv.Explain(*query.NewExplainQuery(eventsTable).Filter("score", query.Eq, 1).Filter("name", query.Eq, "event1"))
+	assert.NoError(t, er.Err())
+	assert.Equal(t, query.PlanNone, er.Plan)
+	assert.Empty(t, er.Chosen)
+	for _, c := range er.Candidates {
+		assert.False(t, c.Matched)
+		assert.NotEmpty(t, c.Reason)
+	}
+}
+
+func TestIndexStats(t *testing.T) {
+
+	conn.Do("FLUSHDB")
+	defer conn.Do("FLUSHDB")
+
+	now := time.Now()
+	pq := query.NewPutQuery(eventsTable)
+	for n := 0; n < 10; n++ {
+		pq.AddEntity(*schema.NewEntity("").
+			Set("name", fmt.Sprintf("event%d", n)).
+			Set("score", n%2).
+			Set("time", now.Add(time.Duration(n)*time.Hour)))
+	}
+	pr := drv.Put(*pq)
+	if pr.Error != nil {
+		t.Fatal(pr.Error)
+	}
+
+	tbl := drv.(*Driver).tables[eventsTable]
+	tbl.stats = newStatsCache()
+
+	indexes := make(map[string]index)
+	for _, idx := range tbl.indexes {
+		indexes[fmt.Sprint(idx)] = idx
+	}
+	simple := indexes["testung.Events__score_simple"]
+	sortedScore := indexes["testung.Events__score_sorted"]
+	sortedTime := indexes["testung.Events__time_sorted"]
+
+	// without statistics we can't estimate anything but primary lookups
+	_, ok := tbl.estimate(simple, query.NewFilters(query.Equals("score", 1)))
+	assert.False(t, ok)
+	cost, ok := tbl.estimate(tbl.primary, query.NewFilters(query.Within("id", pr.Ids[0], pr.Ids[1], pr.Ids[2])))
+	assert.True(t, ok)
+	assert.EqualValues(t, 3, cost)
+
+	if err := tbl.refreshStats(SampleSize); err != nil {
+		t.Fatal(err)
+	}
+
+	st := tbl.stats.get(simple)
+	assert.Equal(t, 10, st.entries)
+	assert.Equal(t, []int{2}, st.distinct)
+	assert.Equal(t, []int{10}, tbl.stats.get(sortedTime).distinct)
+
+	cost, ok = tbl.estimate(simple, query.NewFilters(query.Equals("score", 1)))
+	assert.True(t, ok)
+	assert.EqualValues(t, 5, cost)
+
+	cost, _ = tbl.estimate(sortedTime, query.NewFilters(query.GreaterThan("time", now.Add(150*time.Minute))))
+	assert.EqualValues(t, 7, cost)
+
+	// both score indexes estimate the range the same, so the sorted one still wins
+	filters := query.NewFilters(query.GreaterThan("score", 0))
+	cost, _ = tbl.estimate(simple, filters)
+	assert.EqualValues(t, 5, cost)
+	cost, _ = tbl.estimate(sortedScore, filters)
+	assert.EqualValues(t, 5, cost)
+	assert.Equal(t, sortedScore, tbl.selectIndex(filters, query.NoOrder))
+
+	// the statistics are reported by the driver
+	stats, err := drv.Stats()
+	assert.NoError(t, err)
+	if ts := stats.Tables[eventsTable]; assert.NotNil(t, ts) {
+		assert.Len(t, ts.Indexes, 4)
+		if is := ts.Indexes["testung.Events__time_sorted"]; assert.NotNil(t, is) {
+			assert.EqualValues(t, 10, is.Entries)
+			assert.Equal(t, string(schema.SortedIndex), is.Type)
+		}
+	}
+
+	// queries still work with cost based planning
+	gr := drv.Get(*query.NewGetQuery(eventsTable).FilterEq("score", 1).FilterGt("time", now.Add(150*time.Minute)))
+	assert.NoError(t, gr.Err())
+	assert.Equal(t, 4, gr.Total)
+}
+
+func TestEstimateDistinct(t *testing.T) {
+
+	unique := make([]string, 100)
+	repeated := make([]string, 100)
+	for n := range unique {
+		unique[n] = fmt.Sprint(n)
+		repeated[n] = fmt.Sprint(n % 2)
+	}
+
+	assert.Equal(t, 10000, estimateDistinct(unique, 10000))
+	assert.Equal(t, 100, estimateDistinct(unique, 100))
+	assert.Equal(t, 2, estimateDistinct(repeated, 10000))
+	assert.Equal(t, 0, estimateDistinct(nil, 10000))
+}
+
+func TestCursor(t *testing.T) {
+
+	conn.Do("FLUSHDB")
+	defer conn.Do("FLUSHDB")
+
+	now := time.Now()
+	pq := query.NewPutQuery(eventsTable)
+	for n := 0; n < 10; n++ {
+		pq.AddEntity(*schema.NewEntity("").
+			Set("name", fmt.Sprintf("event%d", n)).
+			Set("score", n%3).
+			Set("time", now.Add(time.Duration(n)*time.Hour)))
+	}
+	pr := drv.Put(*pq)
+	if pr.Error != nil {
+		t.Fatal(pr.Error)
+	}
+
+	// walks over all the pages of a query, inserting an entity after the first page
+	walk := func(q *query.GetQuery, insert bool) (map[schema.Key]int, []*query.GetResponse) {
+
+		seen := make(map[schema.Key]int)
+		var pages []*query.GetResponse
+		for len(pages) < 20 {
+			gr := drv.Get(*q)
+			if !assert.NoError(t, gr.Err()) {
+				break
+			}
+			pages = append(pages, gr)
+			for _, ent := range gr.Entities {
+				seen[ent.Id]++
+			}
+
+			if insert && len(pages) == 1 {
+				pr := drv.Put(*query.NewPutQuery(eventsTable).AddEntity(*schema.NewEntity("").
+					Set("name", "inserted").Set("score", 0).Set("time", now)))
+				assert.NoError(t, pr.Err())
+			}
+
+			if gr.Cursor == "" {
+				break
+			}
+			q.After(gr.Cursor)
+		}
+		return seen, pages
+	}
+
+	checkAll := func(seen map[schema.Key]int) {
+		for _, id := range pr.Ids {
+			assert.Equal(t, 1, seen[id], "id %s", id)
+		}
+		for id, n := range seen {
+			assert.Equal(t, 1, n, "id %s", id)
+		}
+	}
+
+	// sorted index with ties on the score, resuming while entities are inserted
+	q := query.NewGetQuery(eventsTable).Filter("score", query.Gte, 0).OrderBy("score", query.ASC).Limit(3)
+	seen, pages := walk(q, true)
+	checkAll(seen)
+	assert.Equal(t, 10, pages[0].Total)
+	assert.NotEmpty(t, pages[0].Cursor)
+	assert.Empty(t, pages[len(pages)-1].Cursor)
+
+	// sorted index, descending
+	q = query.NewGetQuery(eventsTable).Filter("time", query.Gte, now).OrderBy("time", query.DESC).Limit(4)
+	seen, _ = walk(q, false)
+	checkAll(seen)
+	assert.Len(t, seen, 11)
+
+	// compound index over the two ranges of a NOT EQUAL filter
+	q = query.NewGetQuery(eventsTable).Filter("score", query.Ne, 1).Limit(2)
+	seen, pages = walk(q, false)
+	assert.Len(t, seen, 8)
+	assert.Equal(t, 8, pages[0].Total)
+	for _, p := range pages {
+		for _, ent := range p.Entities {
+			assert.NotEqual(t, int64(1), ent.Properties["score"])
+		}
+	}
+
+	// the primary index
+	q = query.NewGetQuery(eventsTable).Filter("id", query.All).Limit(4)
+	seen, _ = walk(q, true)
+	checkAll(seen)
+
+	// the cursor pins the index it was created by
+	q = query.NewGetQuery(eventsTable).Filter("score", query.Gte, 0).Limit(3)
+	gr := drv.Get(*q)
+	assert.NoError(t, gr.Err())
+	gr = drv.Get(*query.NewGetQuery(eventsTable).Filter("name", query.Eq, "event1").After(gr.Cursor))
+	assert.Error(t, gr.Err())
+
+	gr = drv.Get(*query.NewGetQuery(eventsTable).Filter("id", query.All).After("garbage"))
+	assert.Error(t, gr.Err())
+
+	assert.Error(t, query.NewGetQuery(eventsTable).Filter("id", query.All).After("x").Page(1, 10).Validate())
+}
+
+func TestCount(t *testing.T) {
+
+	conn.Do("FLUSHDB")
+	defer conn.Do("FLUSHDB")
+
+	now := time.Now()
+	pq := query.NewPutQuery(eventsTable)
+	for n := 0; n < 10; n++ {
+		pq.AddEntity(*schema.NewEntity("").
+			Set("name", fmt.Sprintf("event%d", n)).
+			Set("score", n%3).
+			Set("time", now.Add(time.Duration(n)*time.Hour)))
+	}
+	pr := drv.Put(*pq)
+	if pr.Error != nil {
+		t.Fatal(pr.Error)
+	}
+
+	count := func(q *query.CountQuery) int {
+		cr := drv.Count(*q)
+		assert.NoError(t, cr.Err())
+		return cr.Num
+	}
+
+	assert.Equal(t, 10, count(query.NewCountQuery(eventsTable).Where("id", query.All)))
+	assert.Equal(t, 2, count(query.NewCountQuery(eventsTable).Where("id", query.In, pr.Ids[0], pr.Ids[1], schema.Key("nosuchid"))))
+	assert.Equal(t, 4, count(query.NewCountQuery(eventsTable).Where("score", query.Eq, 0)))
+	assert.Equal(t, 7, count(query.NewCountQuery(eventsTable).Where("score", query.Ne, 2)))
+	assert.Equal(t, 6, count(query.NewCountQuery(eventsTable).Where("score", query.Gt, 0)))
+	assert.Equal(t, 3, count(query.NewCountQuery(eventsTable).Where("time", query.Lt, now.Add(150*time.Minute))))
+	assert.Equal(t, 0, count(query.NewCountQuery(eventsTable).Where("score", query.Eq, 5)))
+
+	// expressions and intersections
+	assert.Equal(t, 3, count(query.NewCountQuery(eventsTable).WhereExpr(query.Or(
+		query.Cond(query.NewFilter("score", query.Eq, 1)),
+		query.Cond(query.NewFilter("score", query.Gt, 5)),
+	))))
+	assert.Equal(t, 3, count(query.NewCountQuery(eventsTable).Where("score", query.Eq, 0).Where("time", query.Gt, now)))
+
+	// counting is not limited by the cap on intermediate results of queries
+	defer func(old int) { DefaultConfig.MaxIntermediateResults = old }(DefaultConfig.MaxIntermediateResults)
+	DefaultConfig.MaxIntermediateResults = 2
+	assert.Equal(t, 3, count(query.NewCountQuery(eventsTable).Where("score", query.Eq, 0).Where("time", query.Gt, now)))
+	assert.Equal(t, 6, count(query.NewCountQuery(eventsTable).WhereExpr(query.Not(
+		query.Cond(query.NewFilter("score", query.Eq, 0)),
+	))))
+
+	// counts have their own cap, that only limits the ids read from compound indexes
+	defer func(old int) { DefaultConfig.MaxCountIntermediateResults = old }(DefaultConfig.MaxCountIntermediateResults)
+	DefaultConfig.MaxCountIntermediateResults = 4
+	assert.Equal(t, 6, count(query.NewCountQuery(eventsTable).Where("score", query.Gt, 0).Where("time", query.Gt, now.Add(-time.Hour))))
+	cr := drv.Count(*query.NewCountQuery(eventsTable).Where("score", query.Ne, 2).Where("time", query.Gt, now.Add(-time.Hour)))
+	assert.Error(t, cr.Err())
+
+	cr = drv.Count(*query.NewCountQuery(eventsTable).Where("name", query.Eq, "event1"))
+	assert.Error(t, cr.Err())
+}
+
+func TestCollectionChanges(t *testing.T) {
+
+	conn.Do("FLUSHDB")
+	defer conn.Do("FLUSHDB")
+
+	pr := drv.Put(*query.NewPutQuery(usersTable).AddEntity(ents[0]))
+	if pr.Error != nil {
+		t.Fatal(pr.Error)
+	}
+	id := pr.Ids[0]
+
+	load := func() schema.Entity {
+		gr := drv.Get(*query.NewGetQuery(usersTable).Filter(schema.IdKey, query.Eq, id))
+		if assert.NoError(t, gr.Err()) && assert.Len(t, gr.Entities, 1) {
+			return gr.Entities[0]
+		}
+		return schema.Entity{}
+	}
+
+	ur := drv.Update(*query.NewUpdateQuery(usersTable).Where(schema.IdKey, query.Eq, id).
+		SetAdd("tags", "a", "b").MapSet("mip", "x", "y").MapDel("mip", "foo"))
+	assert.NoError(t, ur.Err())
+	assert.Equal(t, 1, ur.Num)
+
+	ent := load()
+	assert.Equal(t, schema.NewSet("a", "b"), ent.Properties["tags"])
+	assert.Equal(t, schema.NewMap().Set("x", "y"), ent.Properties["mip"])
+
+	// several changes to the same property are applied in order
+	ur = drv.Update(*query.NewUpdateQuery(usersTable).Where(schema.IdKey, query.Eq, id).
+		SetDel("tags", "a").SetAdd("tags", "c"))
+	assert.NoError(t, ur.Err())
+	assert.Equal(t, schema.NewSet("b", "c"), load().Properties["tags"])
+
+	// collection ops on other types fail
+	ur = drv.Update(*query.NewUpdateQuery(usersTable).Where(schema.IdKey, query.Eq, id).SetAdd("name", "foo"))
+	assert.Error(t, ur.Err())
+	ur = drv.Update(*query.NewUpdateQuery(usersTable).Where(schema.IdKey, query.Eq, id).MapSet("tags", "foo", "bar"))
+	assert.Error(t, ur.Err())
+
+	// concurrent additions are all kept, without conflicts
+	var wg sync.WaitGroup
+	for n := 0; n < 50; n++ {
+		wg.Add(1)
+		go func(n int) {
+			defer wg.Done()
+			ur := drv.Update(*query.NewUpdateQuery(usersTable).Where(schema.IdKey, query.Eq, id).
+				SetAdd("tags", fmt.Sprintf("tag%d", n)))
+			assert.NoError(t, ur.Err())
+		}(n)
+	}
+	wg.Wait()
+
+	tags := load().Properties["tags"].(schema.Set)
+	assert.Len(t, tags, 52)
+	for n := 0; n < 50; n++ {
+		assert.Contains(t, tags, schema.Text(fmt.Sprintf("tag%d", n)))
+	}
+}
+
+func TestConditions(t *testing.T) {
+
+	conn.Do("FLUSHDB")
+	defer conn.Do("FLUSHDB")
+
+	pr := drv.Put(*query.NewPutQuery(usersTable).AddEntityIf(ents[0], query.IfVersion(0)))
+	if pr.Error != nil {
+		t.Fatal(pr.Error)
+	}
+	id := pr.Ids[0]
+
+	load := func() schema.Entity {
+		gr := drv.Get(*query.NewGetQuery(usersTable).Filter(schema.IdKey, query.Eq, id))
+		if assert.NoError(t, gr.Err()) && assert.Len(t, gr.Entities, 1) {
+			return gr.Entities[0]
+		}
+		return schema.Entity{}
+	}
+
+	ent := load()
+	assert.EqualValues(t, 1, ent.Version)
+	assert.NotContains(t, ent.Properties, schema.VersionKey)
+
+	// updates at the current version succeed and bump it
+	ur := drv.Update(*query.NewUpdateQuery(usersTable).WhereId(id).Set("score", 10).If(query.IfVersion(1)))
+	assert.NoError(t, ur.Err())
+	assert.Equal(t, 1, ur.Num)
+	assert.EqualValues(t, 2, load().Version)
+
+	// stale versions are rejected
+	ur = drv.Update(*query.NewUpdateQuery(usersTable).WhereId(id).Set("score", 20).If(query.IfVersion(1)))
+	assert.True(t, errors.IsConflict(ur.Err()))
+	assert.Equal(t, schema.Int(10), load().Properties["score"])
+
+	// property preconditions
+	ur = drv.Update(*query.NewUpdateQuery(usersTable).WhereId(id).Set("score", 30).If(query.IfEquals("name", "user1")))
+	assert.NoError(t, ur.Err())
+	ur = drv.Update(*query.NewUpdateQuery(usersTable).WhereId(id).Set("score", 40).If(query.IfEquals("name", "foo")))
+	assert.True(t, errors.IsConflict(ur.Err()))
+	ur = drv.Update(*query.NewUpdateQuery(usersTable).WhereId(id).Set("score", 40).If(query.IfEquals("lastVisit", nil)))
+	assert.NoError(t, ur.Err())
+
+	// timestamps are compared at the precision they are stored in, and integers whether they are signed or not
+	now := time.Now()
+	ur = drv.Update(*query.NewUpdateQuery(usersTable).WhereId(id).Set("lastVisit", schema.Timestamp(now)))
+	assert.NoError(t, ur.Err())
+	ur = drv.Update(*query.NewUpdateQuery(usersTable).WhereId(id).Set("score", 50).
+		If(query.IfEquals("lastVisit", now), query.IfEquals("score", uint64(40))))
+	assert.NoError(t, ur.Err())
+	assert.Equal(t, schema.Int(50), load().Properties["score"])
+
+	// if any entity of a put fails its conditions, none are written
+	ent = load()
+	ent.Set("name", "changed")
+	pr = drv.Put(*query.NewPutQuery(usersTable).AddEntity(*schema.NewEntity("").Set("name", "other")).
+		AddEntityIf(ent, query.IfVersion(0)))
+	assert.True(t, errors.IsConflict(pr.Err()))
+	assert.Equal(t, schema.Text("user1"), load().Properties["name"])
+
+	gr := drv.Get(*query.NewGetQuery(usersTable).Filter("name", query.Eq, "other"))
+	assert.NoError(t, gr.Err())
+	assert.Len(t, gr.Entities, 0)
+
+	// out of concurrent writers at the same version, exactly one wins
+	version := load().Version
+	var wg sync.WaitGroup
+	var lock sync.Mutex
+	wins := 0
+	for n := 0; n < 10; n++ {
+		wg.Add(1)
+		go func(n int) {
+			defer wg.Done()
+			ur := drv.Update(*query.NewUpdateQuery(usersTable).WhereId(id).Set("score", n).If(query.IfVersion(version)))
+			if ur.Err() == nil {
+				lock.Lock()
+				wins++
+				lock.Unlock()
+			} else {
+				assert.True(t, errors.IsConflict(ur.Err()))
+			}
+		}(n)
+	}
+	wg.Wait()
+
+	assert.Equal(t, 1, wins)
+	assert.Equal(t, version+1, load().Version)
+}
+
+func TestPutModes(t *testing.T) {
+
+	conn.Do("FLUSHDB")
+	defer conn.Do("FLUSHDB")
+
+	put := func(mode query.PutMode, ents ...schema.Entity) *query.PutResponse {
+		q := query.NewPutQuery(usersTable).WithMode(mode)
+		for _, e := range ents {
+			q.AddEntity(e)
+		}
+		return drv.Put(*q)
+	}
+	name := func(id schema.Key) interface{} {
+		gr := drv.Get(*query.NewGetQuery(usersTable).Filter(schema.IdKey, query.Eq, id))
+		assert.NoError(t, gr.Err())
+		if len(gr.Entities) == 0 {
+			return nil
+		}
+		return gr.Entities[0].Properties["name"]
+	}
+
+	// upserts report whether they created or updated entities
+	pr := put("", *schema.NewEntity("u1").Set("name", "first"))
+	assert.NoError(t, pr.Err())
+	assert.Equal(t, []query.PutOutcome{query.OutcomeCreated}, pr.Outcomes)
+
+	pr = put(query.Upsert, *schema.NewEntity("u1").Set("name", "second"))
+	assert.NoError(t, pr.Err())
+	assert.Equal(t, []query.PutOutcome{query.OutcomeUpdated}, pr.Outcomes)
+	assert.Equal(t, schema.Text("second"), name("u1"))
+
+	// inserts reject existing entities, and write the rest
+	pr = put(query.InsertOnly, *schema.NewEntity("u1").Set("name", "third"), *schema.NewEntity("u2").Set("name", "other"))
+	assert.NoError(t, pr.Err())
+	assert.Equal(t, []schema.Key{"u1", "u2"}, pr.Ids)
+	assert.Equal(t, []query.PutOutcome{query.OutcomeRejected, query.OutcomeCreated}, pr.Outcomes)
+	assert.Equal(t, schema.Text("second"), name("u1"))
+	assert.Equal(t, schema.Text("other"), name("u2"))
+
+	// updates reject missing entities
+	pr = put(query.UpdateOnly, *schema.NewEntity("u1").Set("name", "fourth"), *schema.NewEntity("u3").Set("name", "missing"))
+	assert.NoError(t, pr.Err())
+	assert.Equal(t, []query.PutOutcome{query.OutcomeUpdated, query.OutcomeRejected}, pr.Outcomes)
+	assert.Equal(t, schema.Text("fourth"), name("u1"))
+	assert.Nil(t, name("u3"))
+
+	// a put whose entities are all rejected writes nothing
+	pr = put(query.UpdateOnly, *schema.NewEntity("u3").Set("name", "missing"))
+	assert.NoError(t, pr.Err())
+	assert.Equal(t, []query.PutOutcome{query.OutcomeRejected}, pr.Outcomes)
+	assert.Nil(t, name("u3"))
+
+	assert.Error(t, query.NewPutQuery(usersTable).WithMode("FOO").AddEntity(ents[0]).Validate())
+}
+
+func TestReturning(t *testing.T) {
+
+	conn.Do("FLUSHDB")
+	defer conn.Do("FLUSHDB")
+
+	pr := drv.Put(*query.NewPutQuery(usersTable).AddEntity(ents[0]).AddEntity(ents[1]))
+	if pr.Error != nil {
+		t.Fatal(pr.Error)
+	}
+
+	// updated entities are returned with their new values
+	ur := drv.Update(*query.NewUpdateQuery(usersTable).WhereId(pr.Ids[0]).Increment("score", 5).Return())
+	assert.NoError(t, ur.Err())
+	if assert.Len(t, ur.Entities, 1) {
+		assert.Equal(t, pr.Ids[0], ur.Entities[0].Id)
+		assert.EqualValues(t, 6, ur.Entities[0].Properties["score"])
+		assert.Equal(t, schema.Text("user1"), ur.Entities[0].Properties["name"])
+		assert.EqualValues(t, 2, ur.Entities[0].Version)
+	}
+
+	ur = drv.Update(*query.NewUpdateQuery(usersTable).WhereId(pr.Ids[0]).Increment("score", 1))
+	assert.NoError(t, ur.Err())
+	assert.Empty(t, ur.Entities)
+
+	ur = drv.Update(*query.NewUpdateQuery(usersTable).WhereId(pr.Ids[0], pr.Ids[1]).Increment("score", 1).Return("score"))
+	assert.NoError(t, ur.Err())
+	if assert.Len(t, ur.Entities, 2) {
+		for _, ent := range ur.Entities {
+			assert.Len(t, ent.Properties, 1)
+		}
+	}
+
+	// deleted entities are returned as they were before being deleted
+	dr := drv.Delete(*query.NewDelQuery(usersTable).Where("name", query.Eq, "user2").Return())
+	assert.NoError(t, dr.Err())
+	assert.Equal(t, 1, dr.Num)
+	if assert.Len(t, dr.Entities, 1) {
+		assert.Equal(t, pr.Ids[1], dr.Entities[0].Id)
+		assert.EqualValues(t, 3, dr.Entities[0].Properties["score"])
+	}
+
+	gr := drv.Get(*query.NewGetQuery(usersTable).Filter(schema.IdKey, query.Eq, pr.Ids[1]))
+	assert.NoError(t, gr.Err())
+	assert.Len(t, gr.Entities, 0)
+}
+
+func TestListChanges(t *testing.T) {
+
+	conn.Do("FLUSHDB")
+	defer conn.Do("FLUSHDB")
+
+	pr := drv.Put(*query.NewPutQuery(usersTable).AddEntity(ents[0]))
+	if pr.Error != nil {
+		t.Fatal(pr.Error)
+	}
+	id := pr.Ids[0]
+
+	update := func() *query.UpdateQuery {
+		return query.NewUpdateQuery(usersTable).Where(schema.IdKey, query.Eq, id)
+	}
+	load := func() schema.List {
+		gr := drv.Get(*query.NewGetQuery(usersTable).Filter(schema.IdKey, query.Eq, id))
+		if assert.NoError(t, gr.Err()) && assert.Len(t, gr.Entities, 1) {
+			l, _ := gr.Entities[0].Properties["recent"].(schema.List)
+			return l
+		}
+		return nil
+	}
+
+	ur := drv.Update(*update().ListAppend("recent", "b", "c").ListPrepend("recent", "a"))
+	assert.NoError(t, ur.Err())
+	assert.Equal(t, 1, ur.Num)
+	assert.Equal(t, schema.NewList("a", "b", "c"), load())
+
+	ur = drv.Update(*update().ListAppend("recent", "a", "d").ListRemove("recent", "a"))
+	assert.NoError(t, ur.Err())
+	assert.Equal(t, schema.NewList("b", "c", "d"), load())
+
+	ur = drv.Update(*update().ListSetAt("recent", -1, "e").ListSetAt("recent", 0, "f"))
+	assert.NoError(t, ur.Err())
+	assert.Equal(t, schema.NewList("f", "c", "e"), load())
+
+	ur = drv.Update(*update().ListTrim("recent", 2))
+	assert.NoError(t, ur.Err())
+	assert.Equal(t, schema.NewList("f", "c"), load())
+
+	ur = drv.Update(*update().ListTrim("recent", -1))
+	assert.NoError(t, ur.Err())
+	assert.Equal(t, schema.NewList("c"), load())
+
+	// BSON clients send small integers as int32
+	ur = drv.Update(*update().Set("recent", schema.NewList("a", "b", "c")))
+	assert.NoError(t, ur.Err())
+	ur = drv.Update(query.UpdateQuery{Table: usersTable, Filters: query.NewFilters(query.Equals(schema.IdKey, id)),
+		Changes: []query.Change{
+			{Property: "recent", Op: query.OpListSetAt, Value: []interface{}{int32(0), "x"}},
+			{Property: "recent", Op: query.OpListTrim, Value: uint32(2)},
+		}})
+	assert.NoError(t, ur.Err())
+	assert.Equal(t, schema.NewList("x", "b"), load())
+
+	// out of range indexes and list ops on other types fail, and leave the whole entity unchanged
+	entity := func() schema.Entity {
+		gr := drv.Get(*query.NewGetQuery(usersTable).Filter(schema.IdKey, query.Eq, id))
+		if assert.NoError(t, gr.Err()) && assert.Len(t, gr.Entities, 1) {
+			return gr.Entities[0]
+		}
+		return schema.Entity{}
+	}
+	before := entity()
+
+	ur = drv.Update(*update().Set("name", "changed").ListAppend("recent", "y").ListSetAt("recent", 3, "x"))
+	assert.Error(t, ur.Err())
+	ur = drv.Update(*update().Increment("score", 1).ListAppend("name", "x"))
+	assert.Error(t, ur.Err())
+	assert.Equal(t, before, entity())
+
+	// the script checks the changes itself too, in case the entity changed after they were checked
+	tbl, _ := drv.(*Driver).getTable(usersTable)
+	list, _ := encoder.Encode(schema.NewList("x"))
+	_, err := conn.Do("EVAL", collectionScript, 1, tbl.idKey(id),
+		"SET", "name", 1, "xchanged", "INCR", schema.VersionKey, 1, 1, "LSET", "recent", 2, 3, list)
+	assert.Error(t, err)
+	assert.Equal(t, before, entity())
+
+	// a bounded list of recent items updated concurrently
+	var wg sync.WaitGroup
+	for n := 0; n < 50; n++ {
+		wg.Add(1)
+		go func(n int) {
+			defer wg.Done()
+			ur := drv.Update(*update().ListPrepend("recent", n).ListTrim("recent", 5))
+			assert.NoError(t, ur.Err())
+		}(n)
+	}
+	wg.Wait()
+
+	assert.Len(t, load(), 5)
+}
+
+func TestTxQuery(t *testing.T) {
+
+	conn.Do("FLUSHDB")
+	defer conn.Do("FLUSHDB")
+
+	pr := drv.Put(*query.NewPutQuery(usersTable).AddEntity(ents[0]))
+	if pr.Error != nil {
+		t.Fatal(pr.Error)
+	}
+	uid := pr.Ids[0]
+
+	ev := schema.NewEntity("").Set("name", schema.Text("first")).Set("score", schema.Int(1))
+	if pr = drv.Put(*query.NewPutQuery(eventsTable).AddEntity(*ev)); pr.Error != nil {
+		t.Fatal(pr.Error)
+	}
+
+	count := func(table, prop string, value interface{}) int {
+		gr := drv.Get(*query.NewGetQuery(table).Filter(prop, query.Eq, value))
+		assert.NoError(t, gr.Err())
+		return len(gr.Entities)
+	}
+
+	// statements on different tables are applied together, indexes included
+	ev = schema.NewEntity("").Set("name", schema.Text("second")).Set("score", schema.Int(10))
+	q := query.NewTxQuery().
+		Update(query.NewUpdateQuery(usersTable).WhereId(uid).Set("name", "renamed")).
+		Put(query.NewPutQuery(eventsTable).AddEntity(*ev)).
+		Del(query.NewDelQuery(eventsTable).Where("score", query.Eq, 1))
+	assert.NoError(t, q.Validate())
+
+	tr := drv.Transaction(*q)
+	assert.NoError(t, tr.Err())
+	if assert.Len(t, tr.Results, 3) {
+		assert.Equal(t, 1, tr.Results[0].Num)
+		assert.Len(t, tr.Results[1].Ids, 1)
+		assert.Equal(t, []query.PutOutcome{query.OutcomeCreated}, tr.Results[1].Outcomes)
+		assert.Equal(t, 1, tr.Results[2].Num)
+	}
+
+	assert.Equal(t, 1, count(usersTable, "name", "renamed"))
+	assert.Equal(t, 0, count(usersTable, "name", "user1"))
+	assert.Equal(t, 1, count(eventsTable, "score", 10))
+	assert.Equal(t, 0, count(eventsTable, "score", 1))
+
+	// if any statement fails its conditions, none of them are applied
+	ev = schema.NewEntity("").Set("name", schema.Text("third")).Set("score", schema.Int(20))
+	q = query.NewTxQuery().
+		Put(query.NewPutQuery(eventsTable).AddEntity(*ev)).
+		Update(query.NewUpdateQuery(usersTable).WhereId(uid).Set("name", "again").If(query.IfVersion(1)))
+
+	tr = drv.Transaction(*q)
+	assert.True(t, errors.IsConflict(tr.Err()))
+	assert.Empty(t, tr.Results)
+	assert.Equal(t, 0, count(eventsTable, "score", 20))
+	assert.Equal(t, 0, count(usersTable, "name", "again"))
+	assert.Equal(t, 1, count(usersTable, "name", "renamed"))
+
+	// neither are they if a PUT statement rejects any of its entities
+	q = query.NewTxQuery().
+		Put(query.NewPutQuery(usersTable).WithMode(query.InsertOnly).
+			AddEntity(*schema.NewEntity("fresh").Set("name", "fresh")).
+			AddEntity(*schema.NewEntity(uid).Set("name", "inserted"))).
+		Update(query.NewUpdateQuery(eventsTable).Where("score", query.Eq, 10).Set("name", "fourth"))
+
+	tr = drv.Transaction(*q)
+	assert.True(t, errors.IsConflict(tr.Err()))
+	assert.Empty(t, tr.Results)
+	assert.Equal(t, 0, count(usersTable, "name", "fresh"))
+	assert.Equal(t, 0, count(usersTable, "name", "inserted"))
+	assert.Equal(t, 1, count(usersTable, "name", "renamed"))
+	gr := drv.Get(*query.NewGetQuery(eventsTable).Filter("score", query.Eq, 10))
+	if assert.NoError(t, gr.Err()) && assert.Len(t, gr.Entities, 1) {
+		assert.Equal(t, schema.Text("second"), gr.Entities[0].Properties["name"])
+	}
+
+	// an entity can only be changed once in a transaction
+	q = query.NewTxQuery().
+		Update(query.NewUpdateQuery(usersTable).WhereId(uid).Set("name", "once")).
+		Update(query.NewUpdateQuery(usersTable).Where("name", query.Eq, "renamed").Increment("score", 1))
+	tr = drv.Transaction(*q)
+	assert.Error(t, tr.Err())
+	assert.Equal(t, 0, count(usersTable, "name", "once"))
+
+	// statements must be on tables of a single schema
+	q = query.NewTxQuery().
+		Del(query.NewDelQuery(usersTable).Where("name", query.Eq, "renamed")).
+		Del(query.NewDelQuery("other.Users").Where("name", query.Eq, "renamed"))
+	assert.Error(t, q.Validate())
+}
+
+func TestStrictSchema(t *testing.T) {
+
+	conn.Do("FLUSHDB")
+	defer conn.Do("FLUSHDB")
+
+	// inserted entities get the column defaults
+	ent := schema.NewEntity("", schema.NewText("email", "foo@bar.com"))
+	pr := drv.Put(*query.NewPutQuery(accountsTable).AddEntity(*ent))
+	if pr.Error != nil {
+		t.Fatal(pr.Error)
+	}
+	id := pr.Ids[0]
+
+	gr := drv.Get(*query.NewGetQuery(accountsTable).Filter(schema.IdKey, query.Eq, id))
+	assert.NoError(t, gr.Err())
+	if assert.Len(t, gr.Entities, 1) {
+		assert.Equal(t, schema.Int(0), gr.Entities[0].Properties["score"])
+	}
+
+	// invalid entities are rejected, listing all their violations, and nothing is written
+	ent = schema.NewEntity("", schema.NewText("score", "high"), schema.NewText("nick", "foo"))
+	pr = drv.Put(*query.NewPutQuery(accountsTable).AddEntity(*ent))
+	if assert.Error(t, pr.Err()) {
+		for _, v := range []string{"score: expected Int, got Text", "nick: unknown property", "email: required"} {
+			assert.Contains(t, pr.Err().Error(), v)
+		}
+	}
+
+	// updates are checked too
+	update := func() *query.UpdateQuery {
+		return query.NewUpdateQuery(accountsTable).Where(schema.IdKey, query.Eq, id)
+	}
+	ur := drv.Update(*update().Set("score", "high").Increment("email", 1).DelProperty("email").SetAdd("nick", "x"))
+	if assert.Error(t, ur.Err()) {
+		for _, v := range []string{"score: expected Int", "email: cannot perform INCR", "email: required property", "nick: unknown"} {
+			assert.Contains(t, ur.Err().Error(), v)
+		}
+	}
+
+	// required columns cannot be set to nil
+	ur = drv.Update(*update().Set("email", nil))
+	if assert.Error(t, ur.Err()) {
+		assert.Contains(t, ur.Err().Error(), "email: required")
+	}
+
+	ur = drv.Update(*update().Set("score", 5).Increment("score", 1).SetAdd("tags", "a"))
+	assert.NoError(t, ur.Err())
+	assert.Equal(t, 1, ur.Num)
+
+	// upserted entities get the defaults only if they don't exist yet
+	pr = drv.Put(*query.NewPutQuery(accountsTable).AddEntity(*schema.NewEntity("upserted", schema.NewText("email", "up@bar.com"))))
+	assert.NoError(t, pr.Err())
+	assert.Equal(t, []query.PutOutcome{query.OutcomeCreated}, pr.Outcomes)
+
+	gr = drv.Get(*query.NewGetQuery(accountsTable).Filter(schema.IdKey, query.Eq, schema.Key("upserted")))
+	assert.NoError(t, gr.Err())
+	if assert.Len(t, gr.Entities, 1) {
+		assert.Equal(t, schema.Int(0), gr.Entities[0].Properties["score"])
+	}
+
+	ur = drv.Update(*query.NewUpdateQuery(accountsTable).Where(schema.IdKey, query.Eq, schema.Key("upserted")).Set("score", 3))
+	assert.NoError(t, ur.Err())
+	pr = drv.Put(*query.NewPutQuery(accountsTable).AddEntity(*schema.NewEntity("upserted", schema.NewText("email", "up2@bar.com"))))
+	assert.NoError(t, pr.Err())
+	assert.Equal(t, []query.PutOutcome{query.OutcomeUpdated}, pr.Outcomes)
+
+	gr = drv.Get(*query.NewGetQuery(accountsTable).Filter(schema.IdKey, query.Eq, schema.Key("upserted")))
+	assert.NoError(t, gr.Err())
+	if assert.Len(t, gr.Entities, 1) {
+		assert.Equal(t, schema.Int(3), gr.Entities[0].Properties["score"])
+		assert.Equal(t, schema.Text("up2@bar.com"), gr.Entities[0].Properties["email"])
+	}
+
+	// tables that are not strict accept anything
+	pr = drv.Put(*query.NewPutQuery(usersTable).AddEntity(*schema.NewEntity("", schema.NewText("nick", "foo"))))
+	assert.NoError(t, pr.Err())
+}
+
+func TestUniqueIndex(t *testing.T) {
+
+	conn.Do("FLUSHDB")
+	defer conn.Do("FLUSHDB")
+
+	put := func(ents ...schema.Entity) *query.PutResponse {
+		q := query.NewPutQuery(accountsTable)
+		for _, ent := range ents {
+			q.AddEntity(ent)
+		}
+		return drv.Put(*q)
+	}
+
+	pr := put(*schema.NewEntity("", schema.NewText("email", "foo@bar.com")))
+	if pr.Error != nil {
+		t.Fatal(pr.Error)
+	}
+	foo := pr.Ids[0]
+
+	// texts are indexed case insensitively, so this is the same email
+	pr = put(*schema.NewEntity("", schema.NewText("email", "Foo@Bar.com")))
+	if assert.Error(t, pr.Err()) {
+		assert.True(t, errors.IsUniqueViolation(pr.Err()))
+		assert.Contains(t, pr.Err().Error(), string(foo))
+	}
+
+	// two new entities of the same write conflict with each other
+	pr = put(*schema.NewEntity("", schema.NewText("email", "bar@bar.com")),
+		*schema.NewEntity("", schema.NewText("email", "bar@bar.com")))
+	assert.True(t, errors.IsUniqueViolation(pr.Err()))
+
+	pr = put(*schema.NewEntity("", schema.NewText("email", "bar@bar.com")))
+	if pr.Error != nil {
+		t.Fatal(pr.Error)
+	}
+	bar := pr.Ids[0]
+
+	// rewriting an entity with its own values is fine
+	pr = put(*schema.NewEntity(bar, schema.NewText("email", "bar@bar.com")).Set("score", 3))
+	assert.NoError(t, pr.Err())
+
+	// so is writing an entity more than once in the same batch, only its last values are indexed
+	pr = put(*schema.NewEntity(bar, schema.NewText("email", "bar2@bar.com")),
+		*schema.NewEntity(bar, schema.NewText("email", "bar@bar.com")))
+	assert.NoError(t, pr.Err())
+
+	gr := drv.Get(*query.NewGetQuery(accountsTable).Filter("email", query.Eq, "bar2@bar.com"))
+	if assert.NoError(t, gr.Err()) {
+		assert.Empty(t, gr.Entities)
+	}
+
+	// unique indexes pending backfill are not checked
+	tbl, _ := drv.(*Driver).getTable(accountsTable)
+	unique := tbl.uniqueIndexes()[0]
+	tbl.states.set(unique, backfillProgress{state: schema.IndexPending})
+	pr = put(*schema.NewEntity("", schema.NewText("email", "pending@bar.com")),
+		*schema.NewEntity("", schema.NewText("email", "pending@bar.com")))
+	tbl.states.set(unique, backfillProgress{state: schema.IndexReady})
+	if assert.NoError(t, pr.Err()) {
+		dr := drv.Delete(*query.NewDelQuery(accountsTable).Where(schema.IdKey, query.In, pr.Ids[0], pr.Ids[1]))
+		assert.NoError(t, dr.Err())
+	}
+
+	update := func(id schema.Key, email string) *query.UpdateResponse {
+		return drv.Update(*query.NewUpdateQuery(accountsTable).Where(schema.IdKey, query.Eq, id).Set("email", email))
+	}
+
+	ur := update(bar, "foo@bar.com")
+	if assert.Error(t, ur.Err()) {
+		assert.True(t, errors.IsUniqueViolation(ur.Err()))
+	}
+
+	// values released by other changes of the same transaction can be taken
+	tr := drv.Transaction(*query.NewTxQuery().
+		Update(query.NewUpdateQuery(accountsTable).Where(schema.IdKey, query.Eq, foo).Set("email", "baz@bar.com")).
+		Update(query.NewUpdateQuery(accountsTable).Where(schema.IdKey, query.Eq, bar).Set("email", "foo@bar.com")))
+	assert.NoError(t, tr.Err())
+
+	gr = drv.Get(*query.NewGetQuery(accountsTable).Filter("email", query.Eq, "foo@bar.com"))
+	if assert.NoError(t, gr.Err()) && assert.Len(t, gr.Entities, 1) {
+		assert.Equal(t, bar, gr.Entities[0].Id)
+	}
+
+	// once an entity is deleted its values are free
+	dr := drv.Delete(*query.NewDelQuery(accountsTable).Where(schema.IdKey, query.Eq, bar))
+	assert.NoError(t, dr.Err())
+	ur = update(foo, "foo@bar.com")
+	assert.NoError(t, ur.Err())
+
+	dups, err := drv.Duplicates(accountsTable, "email")
+	assert.NoError(t, err)
+	assert.Empty(t, dups)
+
+	// duplicates are found in indexes that are not unique
+	pr = drv.Put(*query.NewPutQuery(usersTable).
+		AddEntity(*schema.NewEntity("", schema.NewText("name", "dup"))).
+		AddEntity(*schema.NewEntity("", schema.NewText("name", "Dup"))).
+		AddEntity(*schema.NewEntity("", schema.NewText("name", "other"))))
+	if pr.Error != nil {
+		t.Fatal(pr.Error)
+	}
+
+	dups, err = drv.Duplicates(usersTable, "name")
+	assert.NoError(t, err)
+	if assert.Len(t, dups, 1) {
+		assert.Len(t, dups[0].Ids, 2)
+		assert.Contains(t, dups[0].Ids, pr.Ids[0])
+		assert.Contains(t, dups[0].Ids, pr.Ids[1])
+	}
+
+	_, err = drv.Duplicates(usersTable, "score")
+	assert.Error(t, err)
+}
+
+func TestBackfill(t *testing.T) {
+
+	conn.Do("FLUSHDB")
+	defer conn.Do("FLUSHDB")
+
+	N := 250
+	pq := query.NewPutQuery(usersTable)
+	for i := 0; i < N; i++ {
+		pq.AddEntity(*schema.NewEntity("").Set("name", fmt.Sprintf("user%d", i)).Set("score", i%10))
+	}
+	pr := drv.Put(*pq)
+	if pr.Error != nil {
+		t.Fatal(pr.Error)
+	}
+
+	// add an index on score to the users table
+	tbl, _ := drv.(*Driver).getTable(usersTable)
+	desc := tbl.desc
+	desc.Indexes = append([]*schema.Index{{Columns: []string{"score"}, Type: schema.SimpleIndex}}, tbl.desc.Indexes...)
+	desc.Indexes[0].SetName(desc.Name)
+
+	nt, err := drv.(*Driver).newTable(desc)
+	if err != nil {
+		t.Fatal(err)
+	}
+	idx := nt.indexes[0]
+
+	// the new index is pending, while the existing ones are ready
+	assert.True(t, nt.states.pending(idx))
+	assert.Len(t, nt.readyIndexes(), len(nt.indexes)-1)
+	filters := query.Filters{"score": query.NewFilter("score", query.Eq, 5)}
+	assert.Nil(t, nt.selectIndex(filters, query.NoOrder))
+
+	st := nt.indexStats()[fmt.Sprint(idx)]
+	if assert.NotNil(t, st) {
+		assert.Equal(t, "pending", st.State)
+		assert.Equal(t, "0", st.Backfill)
+	}
+
+	if err := nt.backfill(idx); err != nil {
+		t.Fatal(err)
+	}
+	assert.False(t, nt.states.pending(idx))
+	assert.Equal(t, idx, nt.selectIndex(filters, query.NoOrder))
+
+	ids, total, err := idx.Find(filters, 0, -1, query.NoOrder)
+	assert.NoError(t, err)
+	assert.Len(t, ids, N/10)
+	assert.Equal(t, N/10, total)
+
+	// the progress is persisted, so the index is ready from now on
+	p, err := loadProgress(conn, idx)
+	assert.NoError(t, err)
+	assert.Equal(t, schema.IndexReady, p.state)
+	assert.Equal(t, N, p.scanned)
+
+	// writes to tables rebuilt with a new index update it, and do not use what was cached for the previous table
+	visit := func(ts time.Time) {
+		ur := drv.Update(*query.NewUpdateQuery(usersTable).Where(schema.IdKey, query.Eq, pr.Ids[0]).Set("lastVisit", ts))
+		assert.NoError(t, ur.Err())
+	}
+	before, after := time.Unix(1000, 0), time.Unix(2000, 0)
+	visit(before)
+
+	vdesc := tbl.desc
+	vdesc.Indexes = append([]*schema.Index{{Columns: []string{"lastVisit"}, Type: schema.SimpleIndex}}, tbl.desc.Indexes...)
+	vdesc.Indexes[0].SetName(vdesc.Name)
+	vt, err := drv.(*Driver).newTable(vdesc)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := vt.backfill(vt.indexes[0]); err != nil {
+		t.Fatal(err)
+	}
+
+	defer replaceTable(replaceTable(vt))
+	visit(after)
+
+	for ts, found := range map[time.Time]bool{before: false, after: true} {
+		ids, _, err = vt.indexes[0].Find(query.Filters{"lastVisit": query.NewFilter("lastVisit", query.Eq, ts)}, 0, -1,
+			query.NoOrder)
+		assert.NoError(t, err)
+		assert.Equal(t, found, len(ids) == 1 && ids[0] == pr.Ids[0])
+	}
+
+	nt, err = drv.(*Driver).newTable(desc)
+	assert.NoError(t, err)
+	assert.False(t, nt.states.pending(nt.indexes[0]))
+}
+
+// replaceTable makes the driver use a table built by the test, and returns the table it replaced
+func replaceTable(tbl *table) *table {
+
+	d := drv.(*Driver)
+	d.tableLock.Lock()
+	defer d.tableLock.Unlock()
+
+	prev := d.tables[tbl.desc.Name]
+	d.tables[tbl.desc.Name] = tbl
+	return prev
+}
+
+func TestUniqueBackfill(t *testing.T) {
+
+	conn.Do("FLUSHDB")
+	defer conn.Do("FLUSHDB")
+
+	pr := drv.Put(*query.NewPutQuery(usersTable).
+		AddEntity(*schema.NewEntity("").Set("name", "foo").Set("email", "dup@bar.com")).
+		AddEntity(*schema.NewEntity("").Set("name", "bar").Set("email", "dup@bar.com")).
+		AddEntity(*schema.NewEntity("").Set("name", "baz").Set("email", "baz@bar.com")))
+	if pr.Error != nil {
+		t.Fatal(pr.Error)
+	}
+
+	// add a unique index on email to the users table
+	tbl, _ := drv.(*Driver).getTable(usersTable)
+	desc := tbl.desc
+	unique := &schema.Index{Columns: []string{"email"}, Type: schema.SimpleIndex,
+		ExtraParams: map[string]interface{}{schema.OptUnique: true}}
+	unique.SetName(desc.Name)
+	desc.Indexes = append([]*schema.Index{unique}, tbl.desc.Indexes...)
+
+	nt, err := drv.(*Driver).newTable(desc)
+	if err != nil {
+		t.Fatal(err)
+	}
+	idx := nt.indexes[0]
+	assert.True(t, nt.states.pending(idx))
+
+	// the existing entities have duplicates, so the index fails and is neither used nor checked
+	if err := nt.backfill(idx); err != nil {
+		t.Fatal(err)
+	}
+	assert.Equal(t, schema.IndexFailed, nt.states.get(idx).state)
+	assert.NotContains(t, nt.readyIndexes(), idx)
+	assert.Empty(t, nt.uniqueIndexes())
+
+	st := nt.indexStats()[fmt.Sprint(idx)]
+	if assert.NotNil(t, st) {
+		assert.Equal(t, "failed", st.State)
+		assert.Equal(t, "1 duplicates", st.Backfill)
+	}
+
+	// once the duplicates are resolved, the index is checked again when the table is rebuilt
+	defer replaceTable(replaceTable(nt))
+	dr := drv.Delete(*query.NewDelQuery(usersTable).Where(schema.IdKey, query.Eq, pr.Ids[1]))
+	if dr.Error != nil {
+		t.Fatal(dr.Error)
+	}
+
+	nt, err = drv.(*Driver).newTable(desc)
+	if err != nil {
+		t.Fatal(err)
+	}
+	assert.True(t, nt.states.pending(idx))
+	if err := nt.backfill(nt.indexes[0]); err != nil {
+		t.Fatal(err)
+	}
+	assert.Equal(t, schema.IndexReady, nt.states.get(nt.indexes[0]).state)
+	assert.Len(t, nt.uniqueIndexes(), 1)
+}
+
+const gcSchema = `
+schema: gc
+tables:
+    Things:
+        engines: 
+            - redis
+        primary:
+            type: random
+        columns:
+            name: 
+                type: Text
+            score:
+                type: Int
+        indexes:
+            -   type: simple
+                columns: [score]
+%s
+%s
+`
+
+const gcNameIndexes = `
+            -   type: simple
+                columns: [name]
+            -   type: fulltext
+                columns: [name]
+`
+
+const gcJunkTable = `
+    Junk:
+        engines: 
+            - redis
+        primary:
+            type: random
+        columns:
+            name: 
+                type: Text
+        indexes:
+            -   type: simple
+                columns: [name]
+`
+
+func TestGarbageCollection(t *testing.T) {
+
+	conn.Do("FLUSHDB")
+	defer conn.Do("FLUSHDB")
+
+	d := drv.(*Driver)
+	defer func() {
+		delete(d.schemas, "gc")
+		delete(d.tables, "gc.Things")
+		delete(d.tables, "gc.Junk")
+	}()
+
+	load := func(withDropped bool) {
+		indexes, junk := "", ""
+		if withDropped {
+			indexes, junk = gcNameIndexes, gcJunkTable
+		}
+		sc, err := schema.Load(strings.NewReader(fmt.Sprintf(gcSchema, indexes, junk)))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err := d.handleSchema(sc); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	load(true)
+
+	N := 120
+	things, junk := query.NewPutQuery("gc.Things"), query.NewPutQuery("gc.Junk")
+	for i := 0; i < N; i++ {
+		things.AddEntity(*schema.NewEntity("").Set("name", fmt.Sprintf("thing number %d", i)).Set("score", i))
+		junk.AddEntity(*schema.NewEntity("").Set("name", fmt.Sprintf("junk%d", i)))
+	}
+	for _, q := range []*query.PutQuery{things, junk} {
+		if pr := drv.Put(*q); pr.Error != nil {
+			t.Fatal(pr.Error)
+		}
+	}
+
+	tbl, _ := d.getTable("gc.Things")
+	dropped := []string{tbl.indexes[1].RedisKey(), tbl.indexes[2].RedisKey()}
+	jt, _ := d.getTable("gc.Junk")
+	dropped = append(dropped, jt.indexes[0].RedisKey())
+
+	garbage := func() []string {
+		items, err := redis.Strings(conn.Do("ZRANGE", garbageKey, 0, -1))
+		assert.NoError(t, err)
+		return items
+	}
+
+	// dropping the indexes and the table marks them as garbage
+	load(false)
+	assert.Len(t, garbage(), 4)
+	_, found := d.getTable("gc.Junk")
+	assert.False(t, found)
+	p, err := loadProgress(conn, jt.indexes[0])
+	assert.NoError(t, err)
+	assert.Equal(t, schema.IndexGarbage, p.state)
+
+	// adding them back before they are collected unmarks them, and the indexes are rebuilt
+	load(true)
+	assert.Empty(t, garbage())
+	tbl, _ = d.getTable("gc.Things")
+	assert.True(t, tbl.states.pending(tbl.indexes[1]))
+
+	// the garbage is kept for the retention period
+	defer func(retention int) {
+		DefaultConfig.GarbageRetention = retention
+	}(DefaultConfig.GarbageRetention)
+	DefaultConfig.GarbageRetention = 3600
+
+	load(false)
+	assert.Len(t, garbage(), 4)
+	if err := collectGarbage(); err != nil {
+		t.Fatal(err)
+	}
+	assert.Len(t, garbage(), 4)
+	for _, k := range dropped {
+		n, _ := redis.Int(conn.Do("EXISTS", k))
+		assert.Equal(t, 1, n, k)
+	}
+
+	DefaultConfig.GarbageRetention = 0
+
+	if err := collectGarbage(); err != nil {
+		t.Fatal(err)
+	}
+	assert.Empty(t, garbage())
+
+	for _, k := range dropped {
+		n, _ := redis.Int(conn.Do("EXISTS", k))
+		assert.Equal(t, 0, n, k)
+		n, _ = redis.Int(conn.Do("EXISTS", backfillKey(k)))
+		assert.Equal(t, 0, n, k)
+	}
+
+	for _, pattern := range []string{"gc.Junk:*", dropped[1] + ":*"} {
+		keys, _ := redis.Strings(conn.Do("KEYS", pattern))
+		assert.Empty(t, keys, pattern)
+	}
+
+	// the rest of the data is untouched
+	n, _ := redis.Int(conn.Do("ZCARD", primaryKey("gc.Things")))
+	assert.Equal(t, N, n)
+	keys, _ := redis.Strings(conn.Do("KEYS", "gc.Things:*"))
+	assert.Len(t, keys, N+1)
+}
+
+const migrationSchema = `
+schema: migration
+tables:
+    Items:
+        engines: 
+            - redis
+        primary:
+            type: random
+        columns:
+            name: 
+                type: Text
+            score:
+                type: Int
+        indexes:
+            -   type: simple
+                columns: [name]
+            -   type: simple
+                columns: [score]
+`
+
+const migrationSchema2 = `
+schema: migration
+tables:
+    Items:
+        engines: 
+            - redis
+        primary:
+            type: random
+        columns:
+            title: 
+                type: Text
+                renamedFrom: name
+            score:
+                type: Float
+        indexes:
+            -   type: simple
+                columns: [title]
+            -   type: simple
+                columns: [score]
+`
+
+func TestMigrate(t *testing.T) {
+
+	conn.Do("FLUSHDB")
+	defer conn.Do("FLUSHDB")
+
+	d := drv.(*Driver)
+	defer func() {
+		delete(d.schemas, "migration")
+		delete(d.tables, "migration.Items")
+	}()
+
+	load := func(s string) {
+		sc, err := schema.Load(strings.NewReader(s))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err := d.handleSchema(sc); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	load(migrationSchema)
+
+	// more than a chunk of entities, and one with a score that cannot be converted
+	N := 150
+	pq := query.NewPutQuery("migration.Items")
+	for i := 0; i < N; i++ {
+		pq.AddEntity(*schema.NewEntity("").Set("name", fmt.Sprintf("item%d", i)).Set("score", i))
+	}
+	pq.AddEntity(*schema.NewEntity("").Set("name", "bad").Set("score", "lots"))
+	pr := drv.Put(*pq)
+	if pr.Error != nil {
+		t.Fatal(pr.Error)
+	}
+
+	load(migrationSchema2)
+
+	get := func(id schema.Key) schema.Entity {
+		gr := drv.Get(*query.NewGetQuery("migration.Items").Filter("id", query.In, id))
+		if gr.Error != nil || len(gr.Entities) != 1 {
+			t.Fatal(gr.Error, gr.Entities)
+		}
+		return gr.Entities[0]
+	}
+
+	// dry runs only report
+	rep, err := drv.Migrate("migration.Items", true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	assert.EqualValues(t, N+1, rep.Scanned)
+	assert.EqualValues(t, N+1, rep.Migrated)
+	assert.EqualValues(t, 1, rep.Failed)
+	assert.Len(t, rep.Errors, 1)
+	assert.Equal(t, schema.Int(3), get(pr.Ids[3]).Properties["score"])
+
+	rep, err = drv.Migrate("migration.Items", false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	assert.EqualValues(t, N+1, rep.Scanned)
+	assert.EqualValues(t, N+1, rep.Migrated)
+	assert.EqualValues(t, 1, rep.Failed)
+
+	ent := get(pr.Ids[3])
+	assert.Equal(t, schema.Float(3), ent.Properties["score"])
+	assert.Equal(t, schema.Text("item3"), ent.Properties["title"])
+	assert.NotContains(t, ent.Properties, "name")
+	assert.EqualValues(t, 2, ent.Version)
+
+	ent = get(pr.Ids[N])
+	assert.Equal(t, schema.Text("lots"), ent.Properties["score"])
+	assert.Equal(t, schema.Text("bad"), ent.Properties["title"])
+
+	// the indexes of the migrated columns are updated
+	gr := drv.Get(*query.NewGetQuery("migration.Items").Filter("score", query.Eq, 3.0))
+	if assert.Nil(t, gr.Error) && assert.Len(t, gr.Entities, 1) {
+		assert.Equal(t, pr.Ids[3], gr.Entities[0].Id)
+	}
+	tbl, _ := d.getTable("migration.Items")
+	n, _ := redis.Int(conn.Do("ZCARD", tbl.indexes[0].RedisKey()))
+	assert.Equal(t, N+1, n)
+
+	p, err := loadMigration(conn, "migration.Items")
+	assert.NoError(t, err)
+	assert.Equal(t, migrationDone, p.state)
+	assert.Equal(t, N+1, p.scanned)
+
+	// migrating again changes nothing
+	rep, err = drv.Migrate("migration.Items", false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	assert.EqualValues(t, 0, rep.Migrated)
+	assert.EqualValues(t, 2, get(pr.Ids[3]).Version)
+
+	// an interrupted migration resumes after the last chunk it finished, keeping its counts
+	entries, err := redis.Strings(conn.Do("ZRANGE", tbl.primary.RedisKey(), 0, migrationChunkSize-1))
+	assert.NoError(t, err)
+	interrupted := migrationProgress{state: migrationRunning, scanned: migrationChunkSize, migrated: migrationChunkSize,
+		cursor: entries[len(entries)-1], columns: migrationColumns(&tbl.desc)}
+	assert.NoError(t, saveMigration(conn, "migration.Items", interrupted))
+
+	rep, err = drv.Migrate("migration.Items", false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	assert.EqualValues(t, N+1, rep.Scanned)
+	assert.EqualValues(t, migrationChunkSize, rep.Migrated)
+
+	// unless the columns changed since
+	interrupted.columns = "other"
+	assert.NoError(t, saveMigration(conn, "migration.Items", interrupted))
+
+	rep, err = drv.Migrate("migration.Items", false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	assert.EqualValues(t, N+1, rep.Scanned)
+	assert.EqualValues(t, 0, rep.Migrated)
+}
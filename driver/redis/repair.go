@@ -146,7 +146,7 @@ func (t *table) repair(freq time.Duration) {
 		idch, stopch := idx.RawEntries(10)
 		_ = stopch
 		for rawId := range idch {
-			id := extractId(rawId)
+			id := idx.ExtractId(rawId)
 			if !id.IsNull() {
 				ents, err := t.load([]schema.Key{id})
 				if err != nil {
@@ -0,0 +1,381 @@
+package redis
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+
+	"github.com/dvirsky/go-pylog/logging"
+	"github.com/garyburd/redigo/redis"
+	"github.com/EverythingMe/meduza/errors"
+	"github.com/EverythingMe/meduza/query"
+	"github.com/EverythingMe/meduza/schema"
+)
+
+// SortedIndex indexes a single numeric or Timestamp column, storing entity ids in a sorted set with the column's value
+// as their score.
+//
+// Unlike compound indexes, values are not encoded into the entries, so ranges are selected with ZRANGEBYSCORE and can
+// be ordered in both directions. Note that scores are double precision floats, so Int values beyond 2^53 lose precision
+type SortedIndex struct {
+	desc       schema.Index
+	properties propertyList
+	table      string
+	key        string
+}
+
+// NewSortedIndex creates a new sorted index using a descriptor, for the given table name
+func NewSortedIndex(idx schema.Index, table string) *SortedIndex {
+	return &SortedIndex{
+		desc:       idx,
+		properties: propertyList(idx.Columns),
+		table:      table,
+	}
+}
+
+func (i *SortedIndex) String() string {
+	return i.desc.Name
+}
+
+func (i *SortedIndex) prop() string {
+	return i.properties[0]
+}
+
+// isScoreFilter tells us whether a filter can be converted to a score range
+func isScoreFilter(f query.Filter) bool {
+	switch f.Operator {
+	case query.Eq, query.Between, query.Gt, query.Gte, query.Lt, query.Lte:
+		return true
+	}
+	return false
+}
+
+// Matches returns true if the filters contain a single range or equality filter on our column,
+// and the ordering, if there is one, is by our column as well
+func (i *SortedIndex) Matches(filters query.Filters, order query.Ordering) (bool, float32) {
+
+	f, single := filters.One()
+	if !single || !isScoreFilter(f) || f.Property != i.prop() {
+		return false, 0
+	}
+
+	if !order.IsNil() && order.By != i.prop() {
+		logging.Debug("Order by '%s' cannot be done by %s", order.By, i.desc.Name)
+		return false, 0
+	}
+
+	return true, 1
+}
+
+// MatchesProperties tells us whether the properties are a subset of our own properties
+func (i *SortedIndex) MatchesProperties(properties ...string) bool {
+
+	for _, p := range properties {
+		if !i.properties.contains(p) {
+			return false
+		}
+	}
+	return true
+}
+
+// Properties returns the single property indexed by this index
+func (i *SortedIndex) Properties() []string {
+	return i.properties
+}
+
+// RedisKey returns the key of the sorted set of this index
+func (i *SortedIndex) RedisKey() string {
+	if i.key == "" {
+		i.key = fmt.Sprintf("k:%s/%s:sorted", i.table, strings.Join(i.properties, "_"))
+	}
+	return i.key
+}
+
+// score extracts the score of an entity from its raw property values.
+// If the value is missing or not numeric we return false
+func (i *SortedIndex) score(vals map[string]interface{}) (float64, bool) {
+	return toFloat(vals[i.prop()])
+}
+
+// Pipeline is the main indexing utility, that allows concurrent and bulk indexing of entities on a single transaction.
+//
+// It returns a channel the caller sends entity diffs down, and a channel that eventually sends errors in indexing back.
+// The caller needs to close the entity diff channel, and then wait for an error on the error channel, before executing the
+// transaction.
+func (i *SortedIndex) Pipeline(tx *Transaction) (chan<- *entityDiff, <-chan error) {
+
+	ch := make(chan *entityDiff)
+	ech := make(chan error)
+
+	addCmd := newRedisCommand("ZADD", i.RedisKey())
+	delCmd := newUnindexCommand(i.RedisKey())
+
+	go func() {
+		for eDiff := range ch {
+			// sending nil down the channel aborts it without closing
+			if eDiff == nil {
+				break
+			}
+
+			oldScore, hadOld := i.score(eDiff.rawVals(false))
+
+			if eDiff.changeType == changeDelete {
+				if hadOld {
+					delCmd.addEntry(string(eDiff.id))
+				}
+				continue
+			}
+
+			newScore, hasNew := i.score(eDiff.rawVals(true))
+			switch {
+			case hasNew && (!hadOld || newScore != oldScore):
+				addCmd.add(newScore, string(eDiff.id))
+			case !hasNew && hadOld:
+				delCmd.addEntry(string(eDiff.id))
+			}
+		}
+
+		// enqueue the ZREM command if we need to unindex anything
+		if delCmd.valid() {
+			if err := delCmd.send(tx); err != nil {
+				logging.Error("Error sending command to transaction: %s", err)
+				ech <- err
+				return
+			}
+		}
+
+		// enqueue the ZADD command if we need to index anything
+		if addCmd.valid() {
+			if err := addCmd.send(tx); err != nil {
+				logging.Error("Error sending command to transaction: %s", err)
+				ech <- err
+				return
+			}
+		}
+
+		// we send this to the error channel so the caller knows they can continue
+		ech <- nil
+
+	}()
+
+	return ch, ech
+}
+
+// scoreValue converts a filter value to a score bound, exclusive bounds are prefixed with '('
+func scoreValue(v interface{}, exclusive bool) (string, error) {
+
+	f, ok := toFloat(v)
+	if !ok {
+		return "", errors.NewError("Invalid value for sorted index: %v", v)
+	}
+
+	ret := strconv.FormatFloat(f, 'f', -1, 64)
+	if exclusive {
+		ret = "(" + ret
+	}
+	return ret, nil
+}
+
+// scoreRange converts a filter to the min and max arguments of ZRANGEBYSCORE
+func (i *SortedIndex) scoreRange(f query.Filter) (min string, max string, err error) {
+
+	switch f.Operator {
+	case query.Eq:
+		if min, err = scoreValue(f.Values[0], false); err != nil {
+			return
+		}
+		max = min
+	case query.Between:
+		if min, err = scoreValue(f.Values[0], false); err != nil {
+			return
+		}
+		max, err = scoreValue(f.Values[1], false)
+	case query.Gt:
+		min, err = scoreValue(f.Values[0], true)
+		max = "+inf"
+	case query.Gte:
+		min, err = scoreValue(f.Values[0], false)
+		max = "+inf"
+	case query.Lt:
+		min = "-inf"
+		max, err = scoreValue(f.Values[0], true)
+	case query.Lte:
+		min = "-inf"
+		max, err = scoreValue(f.Values[0], false)
+	default:
+		err = errors.NewError("Invalid filter type for index %s: %s", i.desc.Name, f.Operator)
+	}
+	return
+}
+
+// Find returns the ids matching a single range or equality filter, ordered by our column
+func (i *SortedIndex) Find(filters query.Filters, offset, limit int, order query.Ordering) ([]schema.Key, int, error) {
+
+	f, single := filters.One()
+	if !single || f.Property != i.prop() {
+		return nil, 0, errors.NewError("Filters do not match sorted index %s", i)
+	}
+
+	min, max, err := i.scoreRange(f)
+	if err != nil {
+		return nil, 0, err
+	}
+
+	cmd := newRedisCommand("ZRANGEBYSCORE", i.RedisKey(), min, max)
+	if !order.IsNil() && !order.Ascending {
+		cmd = newRedisCommand("ZREVRANGEBYSCORE", i.RedisKey(), max, min)
+	}
+	if limit > 0 {
+		cmd.add("LIMIT", offset, limit)
+	} else if offset > 0 {
+		cmd.add("LIMIT", offset, -1)
+	}
+
+	tx := NewTransaction(pool.Get())
+	defer tx.Abort()
+
+	idsP, err := tx.Send(cmd.command, cmd.args...)
+	if err != nil {
+		return nil, 0, redisError(err)
+	}
+
+	totalP, err := tx.Send("ZCOUNT", i.RedisKey(), min, max)
+	if err != nil {
+		return nil, 0, redisError(err)
+	}
+
+	if _, err = tx.Execute(); err != nil {
+		return nil, 0, redisError(err)
+	}
+
+	ids, err := redis.Strings(idsP.Reply())
+	if err != nil {
+		return nil, 0, redisError(err)
+	}
+	total, _ := redis.Int(totalP.Reply())
+
+	ret := make([]schema.Key, len(ids))
+	for n, id := range ids {
+		ret[n] = schema.Key(id)
+	}
+
+	return ret, total, nil
+}
+
+// scanRaw returns a partial scan of the raw entries in the index, based on limit and order.
+// Entries are in the form of score::id
+func (i *SortedIndex) scanRaw(offset, limit int, order query.Ordering) ([]string, int, error) {
+
+	cmd := newRedisCommand("ZRANGE", i.RedisKey())
+	if !order.Ascending {
+		cmd.command = "ZREVRANGE"
+	}
+
+	if limit > 0 {
+		cmd.add(offset, offset+limit-1)
+	} else {
+		cmd.add(0, -1)
+	}
+	cmd.add("WITHSCORES")
+
+	tx := NewTransaction(pool.Get())
+	defer tx.Abort()
+
+	entriesP, err := tx.Send(cmd.command, cmd.args...)
+	if err != nil {
+		return nil, 0, redisError(err)
+	}
+
+	totalP, err := tx.Send("ZCARD", i.RedisKey())
+	if err != nil {
+		return nil, 0, redisError(err)
+	}
+
+	if _, err = tx.Execute(); err != nil {
+		return nil, 0, redisError(err)
+	}
+
+	vals, _ := redis.Strings(entriesP.Reply())
+	total, _ := redis.Int(totalP.Reply())
+
+	// WITHSCORES returns member, score pairs
+	ret := make([]string, 0, len(vals)/2)
+	for n := 0; n+1 < len(vals); n += 2 {
+		ret = append(ret, fmt.Sprintf("%s::%s", vals[n+1], vals[n]))
+	}
+
+	return ret, total, nil
+}
+
+// RawEntries scans the index and returns all its entries, in the form of score::id
+func (i *SortedIndex) RawEntries(chunk int) (<-chan string, chan<- bool) {
+
+	idch := make(chan string)
+	stopch := make(chan bool)
+	go func() {
+		offset := 0
+		defer close(idch)
+		for {
+			entries, total, err := i.scanRaw(offset, chunk, query.Ordering{Ascending: true})
+			if err != nil {
+				logging.Error("Error scanning %s: %s", i, err)
+				return
+			}
+
+			for _, e := range entries {
+				select {
+				case idch <- e:
+				case <-stopch:
+					logging.Info("Stopping scan loop")
+					return
+				}
+			}
+
+			if len(entries) == 0 || total < offset+chunk {
+				return
+			}
+
+			offset += chunk
+		}
+	}()
+
+	return idch, stopch
+}
+
+// Scan returns a channel that scans through the index and returns all the ids of the objects indexed in it
+func (i *SortedIndex) Scan(chunk int) (<-chan schema.Key, chan<- bool) {
+
+	idch := make(chan schema.Key)
+	stopch := make(chan bool)
+	go func() {
+		defer close(idch)
+		ch, sch := i.RawEntries(chunk)
+
+		for entry := range ch {
+			select {
+			case idch <- extractId(entry):
+			case <-stopch:
+				logging.Info("Stopping scan loop")
+				sch <- true
+				return
+			}
+		}
+	}()
+
+	return idch, stopch
+}
+
+// ExtractId returns the id part of a score::id entry
+func (i *SortedIndex) ExtractId(entry string) schema.Key {
+	return extractId(entry)
+}
+
+// RemoveEntry removes a score::id entry from the index
+func (i *SortedIndex) RemoveEntry(entry string) error {
+
+	conn := pool.Get()
+	defer conn.Close()
+
+	_, err := conn.Do("ZREM", i.RedisKey(), string(extractId(entry)))
+	return err
+}
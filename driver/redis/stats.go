@@ -0,0 +1,432 @@
+package redis
+
+import (
+	"fmt"
+	"math"
+	"math/rand"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/dvirsky/go-pylog/logging"
+	"github.com/garyburd/redigo/redis"
+	"github.com/EverythingMe/meduza/driver"
+	"github.com/EverythingMe/meduza/query"
+	"github.com/EverythingMe/meduza/schema"
+)
+
+// indexStats holds the sampled statistics of a single index, used to estimate the cost of selecting from it
+type indexStats struct {
+	// the number of entries in the index
+	entries int
+	// the estimated number of distinct values of each prefix of the index's properties
+	distinct []int
+	// sampled raw entries of compound indexes, in ascending order
+	members []string
+	// sampled scores of sorted indexes, in ascending order
+	scores []float64
+}
+
+// statsCache holds the latest statistics of a table's indexes, by index name.
+// It is shared by the query path and the background sampling, so it is locked
+type statsCache struct {
+	lock    sync.RWMutex
+	indexes map[string]*indexStats
+}
+
+func newStatsCache() *statsCache {
+	return &statsCache{
+		indexes: make(map[string]*indexStats),
+	}
+}
+
+func (c *statsCache) get(idx index) *indexStats {
+	c.lock.RLock()
+	defer c.lock.RUnlock()
+	return c.indexes[fmt.Sprint(idx)]
+}
+
+func (c *statsCache) set(idx index, st *indexStats) {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	c.indexes[fmt.Sprint(idx)] = st
+}
+
+// estimateDistinct estimates the number of distinct values in a population of the given size, from a random
+// sample of it, using the Duj1 estimator of Haas and Stokes: n*d / (n - f1 + f1*n/N), where d is the number of
+// distinct values in the sample and f1 the number of values appearing in it exactly once
+func estimateDistinct(sample []string, size int) int {
+
+	n := len(sample)
+	if n == 0 {
+		return 0
+	}
+
+	counts := make(map[string]int)
+	for _, v := range sample {
+		counts[v]++
+	}
+
+	d := len(counts)
+	if n >= size {
+		return d
+	}
+
+	f1 := 0
+	for _, c := range counts {
+		if c == 1 {
+			f1++
+		}
+	}
+
+	est := float64(n*d) / (float64(n-f1) + float64(f1*n)/float64(size))
+	return int(math.Max(float64(d), math.Min(est, float64(size))))
+}
+
+// entryPrefix returns the part of a compound index entry holding the values of its first n properties
+func entryPrefix(entry string, n int) string {
+	pos := 0
+	for ; n > 0; n-- {
+		next := strings.IndexByte(entry[pos:], entryTerminator)
+		if next < 0 {
+			return entry
+		}
+		pos += next + 1
+	}
+	return entry[:pos]
+}
+
+// sampleEntries reads up to numSamples distinct random entries of a sorted set of the given size, with their
+// scores, in ascending order. If the set is not larger than the sample we just read all of it
+func sampleEntries(key string, size, numSamples int) ([]string, []float64, error) {
+
+	b := NewBatch(pool.Get())
+	defer b.Abort()
+
+	if size <= numSamples {
+		if _, err := b.Send("ZRANGE", key, 0, -1, "WITHSCORES"); err != nil {
+			return nil, nil, redisError(err)
+		}
+	} else {
+		offsets := make(map[int]bool, numSamples)
+		for len(offsets) < numSamples {
+			offsets[rand.Intn(size)] = true
+		}
+		sorted := make([]int, 0, numSamples)
+		for o := range offsets {
+			sorted = append(sorted, o)
+		}
+		sort.Ints(sorted)
+
+		for _, o := range sorted {
+			if _, err := b.Send("ZRANGE", key, o, o, "WITHSCORES"); err != nil {
+				return nil, nil, redisError(err)
+			}
+		}
+	}
+
+	promises, err := b.Execute()
+	if err != nil {
+		return nil, nil, redisError(err)
+	}
+
+	members := make([]string, 0, numSamples)
+	scores := make([]float64, 0, numSamples)
+	for _, p := range promises {
+
+		// WITHSCORES returns member, score pairs
+		vals, _ := redis.Strings(p.Reply())
+		for n := 0; n+1 < len(vals); n += 2 {
+			score, _ := strconv.ParseFloat(vals[n+1], 64)
+			members = append(members, vals[n])
+			scores = append(scores, score)
+		}
+	}
+
+	return members, scores, nil
+}
+
+// sampleIndex counts the entries of an index and samples their value distribution.
+//
+// Compound indexes keep their sampled entries and the distinct count of each property prefix, sorted indexes keep
+// their sampled scores. For the other indexes we just count the entries
+func sampleIndex(idx index, numSamples int) (*indexStats, error) {
+
+	conn := pool.Get()
+	defer conn.Close()
+
+	// full text indexes keep a dictionary set of their terms under their key
+	card := "ZCARD"
+	if _, ok := idx.(*FullTextIndex); ok {
+		card = "SCARD"
+	}
+
+	size, err := redis.Int(conn.Do(card, idx.RedisKey()))
+	if err != nil {
+		return nil, redisError(err)
+	}
+
+	ret := &indexStats{entries: size}
+
+	switch i := idx.(type) {
+	case *CompoundIndex:
+		if ret.members, _, err = sampleEntries(i.RedisKey(), size, numSamples); err != nil {
+			return nil, err
+		}
+
+		ret.distinct = make([]int, len(i.properties))
+		prefixes := make([]string, len(ret.members))
+		for n := range i.properties {
+			for m, entry := range ret.members {
+				prefixes[m] = entryPrefix(entry, n+1)
+			}
+			ret.distinct[n] = estimateDistinct(prefixes, size)
+		}
+
+	case *SortedIndex:
+		if _, ret.scores, err = sampleEntries(i.RedisKey(), size, numSamples); err != nil {
+			return nil, err
+		}
+
+		values := make([]string, len(ret.scores))
+		for n, s := range ret.scores {
+			values[n] = fmt.Sprint(s)
+		}
+		ret.distinct = []int{estimateDistinct(values, size)}
+	}
+
+	return ret, nil
+}
+
+// refreshStats samples all the indexes of the table and replaces their cached statistics
+func (t *table) refreshStats(numSamples int) error {
+
+	candidates := make([]index, 0, len(t.indexes)+1)
+	candidates = append(candidates, t.primary)
+	candidates = append(candidates, t.indexes...)
+
+	for _, idx := range candidates {
+		st, err := sampleIndex(idx, numSamples)
+		if err != nil {
+			return logging.Errorf("Error sampling index %s: %s", idx, err)
+		}
+		t.stats.set(idx, st)
+	}
+	return nil
+}
+
+// indexStats returns the cached statistics of the table's indexes, in the form reported by the driver's Stats
+func (t *table) indexStats() map[string]*driver.IndexStats {
+
+	candidates := make([]index, 0, len(t.indexes)+1)
+	candidates = append(candidates, t.primary)
+	candidates = append(candidates, t.indexes...)
+
+	ret := make(map[string]*driver.IndexStats)
+	for n, idx := range candidates {
+		st := t.stats.get(idx)
+		ready := t.states.ready(idx)
+		if st == nil && ready {
+			continue
+		}
+
+		is := &driver.IndexStats{
+			Type: indexType(idx),
+		}
+		if st != nil {
+			is.Entries = driver.Counter(st.entries)
+			for _, d := range st.distinct {
+				is.Distinct = append(is.Distinct, driver.Counter(d))
+			}
+		}
+
+		// the primary index is always ready
+		if n > 0 {
+			is.State = schema.IndexReady.String()
+			if !ready {
+				p := t.states.get(idx)
+				is.State = p.state.String()
+				is.Backfill = p.String()
+			}
+		}
+		ret[fmt.Sprint(idx)] = is
+	}
+	return ret
+}
+
+// statsLoop periodically refreshes the index statistics of all the tables
+func (r *Driver) statsLoop(freq time.Duration) {
+
+	logging.Info("Starting index statistics loop, frequency %s", freq)
+	for {
+		r.tableLock.RLock()
+		tables := make([]*table, 0, len(r.tables))
+		for _, tbl := range r.tables {
+			tables = append(tables, tbl)
+		}
+		r.tableLock.RUnlock()
+
+		for _, tbl := range tables {
+			if err := tbl.refreshStats(SampleSize); err != nil {
+				logging.Error("Could not refresh statistics of table %s: %s", tbl, err)
+			}
+		}
+
+		time.Sleep(freq)
+	}
+}
+
+// rangeSelectivity is the fraction of an index's entries we assume a range selects when we have no sample
+const rangeSelectivity = 0.3
+
+// inLexRange tells us whether a raw entry is inside a ZRANGEBYLEX range
+func inLexRange(entry, min, max string) bool {
+
+	switch {
+	case min == "-":
+	case min[0] == '[' && entry < min[1:]:
+		return false
+	case min[0] == '(' && entry <= min[1:]:
+		return false
+	}
+
+	switch {
+	case max == "+":
+	case max[0] == '[' && entry > max[1:]:
+		return false
+	case max[0] == '(' && entry >= max[1:]:
+		return false
+	}
+	return true
+}
+
+// sampledFraction returns the fraction of sampled values selected by a predicate. If none of the sampled values
+// is selected we assume half a sample does, so rare values don't look free
+func sampledFraction(n int, selected func(i int) bool) float64 {
+
+	count := 0.0
+	for i := 0; i < n; i++ {
+		if selected(i) {
+			count++
+		}
+	}
+	if count == 0 {
+		count = 0.5
+	}
+	return count / float64(n)
+}
+
+// inScoreRange tells us whether a score is selected by a sorted index's filter
+func inScoreRange(score float64, f query.Filter) bool {
+
+	vals := make([]float64, len(f.Values))
+	for n, v := range f.Values {
+		vals[n], _ = toFloat(v)
+	}
+
+	switch f.Operator {
+	case query.Eq:
+		return score == vals[0]
+	case query.Between:
+		return score >= vals[0] && score <= vals[1]
+	case query.Gt:
+		return score > vals[0]
+	case query.Gte:
+		return score >= vals[0]
+	case query.Lt:
+		return score < vals[0]
+	case query.Lte:
+		return score <= vals[0]
+	}
+	return false
+}
+
+// estimate returns the estimated number of ids an index reads to answer a set of filters it matches.
+//
+// Primary index lookups read an id per value, or per combination of values for compound primary keys. Equality
+// selections on secondary indexes are estimated by the number of distinct values of their properties, and ranges
+// by the fraction of the sampled entries they contain. If we have no statistics for the index we return false
+func (t *table) estimate(idx index, filters query.Filters) (float64, bool) {
+
+	switch idx.(type) {
+	case randomPrimaryIndex, compoundPrimaryIndex:
+		f, single := filters.One()
+		if single && f.Property == schema.IdKey && f.Operator != query.All {
+			return float64(len(f.Values)), true
+		}
+
+		if !single || f.Property != schema.IdKey {
+			ret := 1.0
+			for _, f := range filters {
+				// compound primary keys can only be built from exact values
+				if f.Operator != query.Eq && f.Operator != query.In {
+					return math.Inf(1), true
+				}
+				ret *= float64(len(f.Values))
+			}
+			return ret, true
+		}
+	}
+
+	st := t.stats.get(idx)
+	if st == nil {
+		return 0, false
+	}
+	entries := float64(st.entries)
+
+	switch i := idx.(type) {
+	case randomPrimaryIndex, compoundPrimaryIndex:
+		return entries, true
+
+	case *CompoundIndex:
+		// equality filters on a prefix of the properties select the average number of entries per prefix value
+		numEq := 0
+		for _, p := range i.properties {
+			if f, found := filters[p]; !found || f.Operator != query.Eq {
+				break
+			}
+			numEq++
+		}
+		if numEq == len(filters) {
+			if numEq == 0 || st.distinct[numEq-1] == 0 {
+				return entries, true
+			}
+			return entries / float64(st.distinct[numEq-1]), true
+		}
+
+		if len(st.members) == 0 {
+			return entries * rangeSelectivity, true
+		}
+
+		ranges, err := i.lexRanges(filters, query.NoOrder)
+		if err != nil {
+			return 0, false
+		}
+		fraction := sampledFraction(len(st.members), func(n int) bool {
+			for _, r := range ranges {
+				if inLexRange(st.members[n], r[0], r[1]) {
+					return true
+				}
+			}
+			return false
+		})
+		return entries * fraction, true
+
+	case *SortedIndex:
+		f, _ := filters.One()
+		if f.Operator == query.Eq && len(st.distinct) > 0 && st.distinct[0] > 0 {
+			return entries / float64(st.distinct[0]), true
+		}
+		if len(st.scores) == 0 {
+			return entries * rangeSelectivity, true
+		}
+		return entries * sampledFraction(len(st.scores), func(n int) bool {
+			return inScoreRange(st.scores[n], f)
+		}), true
+	}
+
+	// geo and full text indexes are the only ones answering their filters, so a rough estimate will do
+	return entries * rangeSelectivity, true
+}
@@ -2,6 +2,7 @@ package redis
 
 import (
 	"fmt"
+	"math"
 	"math/rand"
 	"regexp"
 	"strconv"
@@ -19,6 +20,9 @@ type table struct {
 	desc    schema.Table
 	indexes []index
 	primary primaryIndex
+	stats   *statsCache
+	states  *indexStates
+	props   *indexableCache
 }
 
 func (t *table) String() string {
@@ -40,6 +44,25 @@ func (t *table) AddIndex(desc *schema.Index) error {
 
 	case schema.CompoundIndex:
 		idx = NewCompoundIndex(*desc, t.desc.Name)
+	case schema.GeoIndex:
+		if len(desc.Columns) != 2 {
+			return logging.Errorf("Geo index %s must have exactly two properties - latitude and longitude", desc.Name)
+		}
+		idx = NewGeoIndex(*desc, t.desc.Name)
+	case schema.SortedIndex:
+		if len(desc.Columns) != 1 {
+			return logging.Errorf("Cannot create sorted index %s with more than one property", desc.Name)
+		}
+		if col, found := t.desc.Columns[desc.Columns[0]]; found {
+			switch col.Type {
+			case schema.IntType, schema.FloatType, schema.TimestampType:
+			default:
+				return logging.Errorf("Sorted index %s can only index numeric or Timestamp columns", desc.Name)
+			}
+		}
+		idx = NewSortedIndex(*desc, t.desc.Name)
+	case schema.FullTextIndex:
+		idx = NewFullTextIndex(*desc, t.desc.Name)
 	default:
 		return errors.Context(logging.Errorf("Unsupported index type %s", desc.Type))
 	}
@@ -58,7 +81,7 @@ func (t table) idKey(id schema.Key) string {
 // the proper secondary indexes
 func (t *table) reindex(entities ...schema.Entity) error {
 
-	cs := newChangeSet(t, len(entities))
+	cs := newChangeSet(len(entities))
 	for _, ent := range entities {
 
 		if ent.Id.IsNull() {
@@ -91,10 +114,43 @@ func (t *table) reindex(entities ...schema.Entity) error {
 // flag indicates if this is a newly created object or an updated one, that should be re-indexed
 // and removed from existing indexes
 func (t *table) Put(entities ...schema.Entity) ([]schema.Key, error) {
+	ids, _, err := t.Write(query.PutQuery{Entities: entities})
+	return ids, err
+}
+
+// Write executes a PUT query, and returns the ids of its entities and what happened to each of them.
+//
+// Each entity is written only if it meets its conditions, matched to it by position. If any entity does not
+// meet its conditions, none of them are written and errors.ConflictError is returned.
+// In InsertOnly and UpdateOnly modes, entities that exist or don't exist respectively are rejected and not
+// written, while the rest of the entities are
+func (t *table) Write(q query.PutQuery) ([]schema.Key, []query.PutOutcome, error) {
+
+	outcomes := make([]query.PutOutcome, len(q.Entities))
+
+	cs := newChangeSet(len(q.Entities))
+	ret, err := t.putChanges(cs, q, outcomes)
+	if err != nil {
+		return nil, nil, err
+	}
 
+	// execute the entire changeset at once
+	if _, err := cs.Execute(); err != nil {
+		logging.Error("Could not execute changeset: %s", err)
+		return nil, nil, err
+	}
+	logging.Debug("Put %d entities, ids: %s, outcomes: %s", len(q.Entities), ret, outcomes)
+
+	return ret, outcomes, nil
+}
+
+// putChanges adds the changes writing the entities of a PUT query to a change set, and returns the entities' ids.
+// The outcome of every entity is set in outcomes, matched to the entities by position, when the change set executes
+func (t *table) putChanges(cs *changeSet, q query.PutQuery, outcomes []query.PutOutcome) ([]schema.Key, error) {
+
+	entities := q.Entities
 	ret := make([]schema.Key, len(entities))
 
-	cs := newChangeSet(t, len(entities))
 	for i, ent := range entities {
 
 		changeType := changeUpdate
@@ -108,11 +164,31 @@ func (t *table) Put(entities ...schema.Entity) ([]schema.Key, error) {
 			changeType = changeInsert
 		}
 
+		// entities of strict tables are validated against the schema with the column defaults of the properties they
+		// miss. Inserted entities always get them, and upserted ones if they turn out not to exist yet
+		insert := changeType == changeInsert || q.Mode == query.InsertOnly
+		missing := make(map[string]bool)
+		if t.desc.Strict && !insert && q.Mode != query.UpdateOnly {
+			for name := range t.desc.Columns {
+				if _, found := ent.Properties[name]; !found {
+					missing[name] = true
+				}
+			}
+		}
+		if err := t.desc.ValidateEntity(&ent, insert || len(missing) > 0); err != nil {
+			return nil, err
+		}
+
 		ret[i] = ent.Id
 		// we transform the entity into an entityChange set of changes (sets in this case)
 		changes := make([]query.Change, 0, len(ent.Properties))
+		defaults := make([]query.Change, 0)
 		for k, p := range ent.Properties {
-			changes = append(changes, query.Set(k, p))
+			if missing[k] {
+				defaults = append(defaults, query.Set(k, p))
+			} else {
+				changes = append(changes, query.Set(k, p))
+			}
 		}
 
 		// the expiry must be the last change
@@ -121,16 +197,18 @@ func (t *table) Put(entities ...schema.Entity) ([]schema.Key, error) {
 		}
 
 		// now we add this change into the change set for the entire batch
-		cs.Add(newEntityChange(t, ent.Id, changeType, changes...))
-	}
-
-	// execute the entire changeset at once
-	_, err := cs.Execute()
-	if err != nil {
-		logging.Error("Could not execute changeset: %s", err)
-		return nil, err
+		ec := newEntityChange(t, ent.Id, changeType, changes...)
+		ec.conditions = q.EntityConditions(i)
+		ec.outcome = &outcomes[i]
+		ec.defaults = defaults
+		switch q.Mode {
+		case query.InsertOnly:
+			ec.existence = mustNotExist
+		case query.UpdateOnly:
+			ec.existence = mustExist
+		}
+		cs.Add(ec)
 	}
-	logging.Debug("Put %d entities, ids: %s", len(entities), ret)
 
 	return ret, nil
 }
@@ -140,7 +218,10 @@ func (t *table) Put(entities ...schema.Entity) ([]schema.Key, error) {
 // limit of -1 means all ids
 func (t *table) getIds(filters query.Filters, offset, limit int, order query.Ordering) (ids []schema.Key, total int, err error) {
 
-	if m, _ := t.primary.Matches(filters, order); m {
+	// find the best secondary index, and see if the primary index is better
+	idx := t.selectIndex(filters, order)
+
+	if t.usePrimary(filters, order, idx) {
 
 		if ids, total, err = t.primary.Find(filters, offset, limit, order); err != nil {
 			return
@@ -157,9 +238,14 @@ func (t *table) getIds(filters query.Filters, offset, limit int, order query.Ord
 		return
 	}
 
-	// for secondary indexes, let's just find the relevant index
-	idx := t.selectIndex(filters, order)
 	if idx == nil {
+
+		// if no single index covers the filters, we try to intersect the results of several indexes
+		if groups := t.planIntersection(filters); groups != nil {
+			logging.Debug("Intersecting indexes for filters %s: %s", filters, groups)
+			return newExprEvaluator(t).Intersect(groups, offset, limit, order)
+		}
+
 		err = errors.NoIndexError
 		ids = nil
 		return
@@ -172,56 +258,207 @@ func (t *table) getIds(filters query.Filters, offset, limit int, order query.Ord
 
 }
 
-// Update updates an existing object with new or existing properties
-func (t *table) Update(q query.UpdateQuery) (int, error) {
-
-	ids, total, err := t.getIds(q.Filters, 0, -1, query.NoOrder)
-	if err != nil {
-		return 0, err
-	} else if len(ids) == 0 {
-		return 0, nil
-	}
-	logging.Debug("Ids for update: %s", ids)
+// Update updates an existing object with new or existing properties. If the query asks for them, it also
+// returns the updated entities
+func (t *table) Update(q query.UpdateQuery) (int, []schema.Entity, error) {
 
 	// convert the query to a change set
-	cs := newChangeSet(t, len(ids))
-	for _, id := range ids {
-		cs.Add(newEntityChange(t, id, changeUpdate, q.Changes...))
+	cs := newChangeSet(0)
+	cs.returning, cs.returnProperties = q.Returning, q.ReturnProperties
+	total, err := t.updateChanges(cs, q)
+	if err != nil {
+		return 0, nil, err
+	} else if len(cs.changes) == 0 {
+		return 0, nil, nil
 	}
 
 	// execute the change set, indexing everything we've updated
 	num, err := cs.Execute()
 	if err != nil {
-		return 0, err
+		return 0, nil, err
 	}
 	logging.Info("Performed %d changes in changeset for query %s", num, q)
 
-	return total, err
+	return total, cs.returned, err
 
 }
 
-// selectIndex chooses the right index for the query, or returns nil if no index
-// was found for the query
+// updateChanges adds the changes of an UPDATE query to a change set for every entity it selects, and returns the
+// total number of selected entities
+func (t *table) updateChanges(cs *changeSet, q query.UpdateQuery) (int, error) {
+
+	if err := q.CheckSchema(&t.desc); err != nil {
+		return 0, err
+	}
+
+	ids, total, err := t.selectIds(query.Selection(q.Filters, q.Expression), 0, -1, query.NoOrder)
+	if err != nil {
+		return 0, err
+	}
+	logging.Debug("Ids for update: %s", ids)
+
+	for _, id := range ids {
+		ec := newEntityChange(t, id, changeUpdate, q.Changes...)
+		ec.conditions = q.Conditions
+		cs.Add(ec)
+	}
+	return total, nil
+}
+
+// selectIndex chooses the right secondary index for the query, or returns nil if no index
+// was found for the query.
+//
+// If we have statistics for all the matching indexes, we pick the one estimated to read the fewest ids.
+// Otherwise, or on equal estimates, we pick the index with the best match score
 func (t table) selectIndex(filters query.Filters, order query.Ordering) index {
 
 	var bestIdx index = nil
 	var bestScore float32 = 0
+	bestCost := math.Inf(1)
+	costBased := true
 
-	for _, idx := range t.indexes {
+	type candidate struct {
+		idx   index
+		score float32
+		cost  float64
+	}
+	indexes := t.readyIndexes()
+	candidates := make([]candidate, 0, len(indexes))
+
+	for _, idx := range indexes {
 		logging.Debug("Matching filters %s order %s against index %s", filters, order, idx)
 		if match, score := idx.Matches(filters, order); match {
-			logging.Debug("Match score for %s: %f", idx, score)
-			if bestIdx == nil || score > bestScore {
-				bestIdx = idx
-				bestScore = score
-			}
+			cost, ok := t.estimate(idx, filters)
+			logging.Debug("Match score for %s: %f, estimated cost: %f", idx, score, cost)
+
+			costBased = costBased && ok
+			candidates = append(candidates, candidate{idx, score, cost})
+		}
+	}
+
+	for _, c := range candidates {
+
+		// on equal scores we prefer sorted indexes, as they answer numeric ranges natively
+		_, sorted := c.idx.(*SortedIndex)
+		better := bestIdx == nil || c.score > bestScore || (c.score == bestScore && sorted)
+		if costBased && bestIdx != nil && c.cost != bestCost {
+			better = c.cost < bestCost
+		}
+
+		if better {
+			bestIdx = c.idx
+			bestScore = c.score
+			bestCost = c.cost
 		}
 	}
 	logging.Debug("Best index match for %s: %s (%f)", filters, bestIdx, bestScore)
 	return bestIdx
 
-	return nil
+}
+
+// usePrimary tells us whether the filters should be answered by the primary index rather than the selected
+// secondary index. The primary index is preferred, unless the secondary index is estimated to be cheaper
+func (t table) usePrimary(filters query.Filters, order query.Ordering, idx index) bool {
+
+	if m, _ := t.primary.Matches(filters, order); !m {
+		return false
+	}
+	if idx == nil {
+		return true
+	}
+
+	primaryCost, ok1 := t.estimate(t.primary, filters)
+	idxCost, ok2 := t.estimate(idx, filters)
+	return !(ok1 && ok2 && idxCost < primaryCost)
+}
+
+// coverage returns the largest subset of the filters an index can answer, and its match score.
+//
+// We try the prefixes of the index's properties that are all in the filters, and stop after the first range filter,
+// since compound indexes can't select anything after a range
+func coverage(idx index, filters query.Filters) (query.Filters, float32) {
+
+	var best query.Filters
+	var bestScore float32
+
+	subset := make(query.Filters)
+	for _, p := range idx.Properties() {
+		f, found := filters[p]
+		if !found {
+			break
+		}
+		subset[p] = f
+
+		if match, score := idx.Matches(subset, query.NoOrder); match {
+			best = make(query.Filters, len(subset))
+			for k, v := range subset {
+				best[k] = v
+			}
+			bestScore = score
+		}
+
+		if f.Operator != query.Eq {
+			break
+		}
+	}
+
+	return best, bestScore
+}
+
+// planIntersection splits the filters into groups that can each be answered by a single index, so their results
+// can be intersected. We greedily pick the index covering the most remaining filters, preferring cheaper indexes,
+// or better scores if we have no statistics. If some filters cannot be answered by any index we return nil
+func (t table) planIntersection(filters query.Filters) []query.Filters {
+
+	remaining := make(query.Filters, len(filters))
+	for k, v := range filters {
+		remaining[k] = v
+	}
+
+	indexes := t.readyIndexes()
+	candidates := make([]index, 0, len(indexes)+1)
+	candidates = append(candidates, t.primary)
+	candidates = append(candidates, indexes...)
+
+	ret := make([]query.Filters, 0)
+	for len(remaining) > 0 {
+
+		var best query.Filters
+		var bestScore float32
+		var bestCost float64
+		var bestKnown bool
+		for _, idx := range candidates {
+			covered, score := coverage(idx, remaining)
+			if len(covered) == 0 || len(covered) < len(best) {
+				continue
+			}
+
+			// on equal coverage we prefer the cheaper index if we can estimate both, or the better score
+			cost, known := t.estimate(idx, covered)
+			if len(covered) == len(best) {
+				if known && bestKnown {
+					if cost >= bestCost {
+						continue
+					}
+				} else if score <= bestScore {
+					continue
+				}
+			}
+			best, bestScore, bestCost, bestKnown = covered, score, cost, known
+		}
+
+		if len(best) == 0 {
+			logging.Debug("No index covers filters %s", remaining)
+			return nil
+		}
 
+		for p := range best {
+			delete(remaining, p)
+		}
+		ret = append(ret, best)
+	}
+
+	return ret
 }
 
 // redisError generates an internal Error object for redis problems
@@ -245,6 +482,14 @@ func (t *table) readEntity(id schema.Key, vals []interface{}) *schema.Entity {
 		if propName == schema.IdKey {
 			continue
 		}
+
+		// the version is stored as a plain integer, so it can be incremented in place
+		if propName == schema.VersionKey {
+			if b, ok := vals[i+1].([]byte); ok {
+				ret.Version, _ = strconv.ParseInt(string(b), 10, 64)
+			}
+			continue
+		}
 		//no such property
 		if vals[i+1] == nil {
 			continue
@@ -312,32 +557,48 @@ func (t *table) load(ids []schema.Key, properties ...string) (ents []schema.Enti
 	}
 
 	for i := 0; i < len(ids); i++ {
-		vals, _ := redis.Values(rets[i].Reply())
-
-		// if we only had a partial-property query, we need to "zip" the requested properties and values
-		if len(properties) > 0 && len(properties) == len(vals) {
+		if ent := t.readReply(ids[i], rets[i], properties); ent != nil {
+			ents = append(ents, *ent)
+		}
+	}
 
-			zipped := make([]interface{}, len(vals)*2)
-			for i, v := range vals {
-				zipped[i*2] = []byte(properties[i])
-				zipped[i*2+1] = v
-			}
+	return
 
-			vals = zipped
-		}
-		if len(vals) > 1 {
-			ents = append(ents, *t.readEntity(ids[i], vals))
-		}
+}
 
+// loadCommand returns the command that loads an entity - HGETALL, or HMGET if only some properties are loaded
+func (t *table) loadCommand(id schema.Key, properties []string) (string, redis.Args) {
+	if len(properties) == 0 {
+		return "HGETALL", redis.Args{t.idKey(id)}
 	}
+	return "HMGET", redis.Args{t.idKey(id)}.AddFlat(properties)
+}
 
-	return
+// readReply reads an entity from the reply of its load command. It returns nil if the entity does not exist
+func (t *table) readReply(id schema.Key, p *Promise, properties []string) *schema.Entity {
+
+	vals, _ := redis.Values(p.Reply())
 
+	// if we only had a partial-property query, we need to "zip" the requested properties and values
+	if len(properties) > 0 && len(properties) == len(vals) {
+
+		zipped := make([]interface{}, len(vals)*2)
+		for i, v := range vals {
+			zipped[i*2] = []byte(properties[i])
+			zipped[i*2+1] = v
+		}
+
+		vals = zipped
+	}
+	if len(vals) > 1 {
+		return t.readEntity(id, vals)
+	}
+	return nil
 }
 
 func (t *table) Get(q query.GetQuery, res *query.GetResponse) {
 
-	ids, total, err := t.getIds(q.Filters, q.Paging.Offset, q.Paging.Limit, q.Order)
+	ids, total, cursor, err := t.pageIds(query.Selection(q.Filters, q.Expression), q.Paging, q.Cursor, q.Order)
 	if err != nil {
 		res.Error = errors.Wrap(err)
 		return
@@ -350,48 +611,102 @@ func (t *table) Get(q query.GetQuery, res *query.GetResponse) {
 	}
 	res.Total = total
 	res.Entities = ents
+	res.Cursor = cursor
 
 	return
 
 }
 
-func (t *table) Delete(filters query.Filters) (int, error) {
+// Delete deletes all the entities matching the query's selection, in chunks. If the query asks for them,
+// it also returns the deleted entities
+func (t *table) Delete(q query.DelQuery) (int, []schema.Entity, error) {
 
+	sel := query.Selection(q.Filters, q.Expression)
 	chunk := DefaultConfig.DeleteChunkSize
 
 	//offset := 0
 	total := 0
+	var deleted []schema.Entity
 
 	for {
-		ids, _, err := t.getIds(filters, 0, chunk, query.NoOrder)
+		cs := newChangeSet(chunk)
+		cs.returning, cs.returnProperties = q.Returning, q.ReturnProperties
 
-		if err != nil {
-			return 0, err
-		} else if len(ids) == 0 {
+		if n, err := t.deleteChanges(cs, sel, chunk); err != nil {
+			return 0, nil, err
+		} else if n == 0 {
 			break
 		}
 
-		cs := newChangeSet(t, len(ids))
-		for _, id := range ids {
-
-			cs.Add(newEntityChange(t, id, changeDelete, query.Change{Op: query.OpDel}))
-
-		}
-
 		num, err := cs.Execute()
 		if err != nil {
-			return 0, err
+			return 0, nil, err
 		}
 		total += num
+		deleted = append(deleted, cs.returned...)
 		// if we've deleted all object, offset remains 0. if there were holes, they are now at the start
 		// and we need to skip them
 
-		logging.Debug("Performed %d changes in changeset for delete, deleted %d objects", num, len(ids))
+		logging.Debug("Performed %d changes in changeset for delete, deleted %d objects", num, len(cs.changes))
 
 	}
 
 	logging.Info("Total deleted rows: %d", total)
-	return total, nil
+	return total, deleted, nil
+}
+
+// deleteChanges adds DEL changes to a change set for up to limit entities of the selection, and returns their
+// number. limit of -1 means all the selected entities
+func (t *table) deleteChanges(cs *changeSet, sel query.Expression, limit int) (int, error) {
+
+	ids, _, err := t.selectIds(sel, 0, limit, query.NoOrder)
+	if err != nil {
+		return 0, err
+	}
+
+	for _, id := range ids {
+		cs.Add(newEntityChange(t, id, changeDelete, query.Change{Op: query.OpDel}))
+	}
+	return len(ids), nil
+}
+
+// selectionKeys returns the keys a selection of the table's entities may read: the keys of the primary and
+// secondary indexes, and the posting sets of the terms of its full text filters, as the term dictionary does not
+// change when entities are unindexed.
+//
+// Transactions watch them before selecting the entities of their statements, so they fail if the selection
+// changes before they execute
+func (t *table) selectionKeys(sel query.Expression) []interface{} {
+
+	keys := []interface{}{t.primary.RedisKey()}
+	for _, idx := range t.indexes {
+		keys = append(keys, idx.RedisKey())
+	}
+
+	var addTerms func(e query.Expression)
+	addTerms = func(e query.Expression) {
+		for _, c := range e.Children {
+			addTerms(c)
+		}
+		if !e.IsLeaf() || !isTextFilter(e.Filter) {
+			return
+		}
+
+		terms, err := queryTerms(e.Filter)
+		if err != nil {
+			return
+		}
+		for _, idx := range t.indexes {
+			if ft, ok := idx.(*FullTextIndex); ok && ft.MatchesProperties(e.Filter.Property) {
+				for _, term := range terms {
+					keys = append(keys, ft.termKey(term))
+				}
+			}
+		}
+	}
+	addTerms(sel)
+
+	return keys
 }
 
 var sizeRE = regexp.MustCompile("serializedlength:([0-9]+)")
@@ -450,10 +765,21 @@ func (t *table) Stats(numSamples int) (*driver.TableStats, error) {
 
 	}
 
+	if err := t.refreshStats(numSamples); err != nil {
+		logging.Error("Error sampling indexes: %s", err)
+	}
+
+	migration, err := loadMigration(conn, t.desc.Name)
+	if err != nil {
+		logging.Error("Error reading the migration progress of %s: %s", t, err)
+	}
+
 	return &driver.TableStats{
 		NumRows:           driver.Counter(sz),
 		EstimatedDataSize: driver.ByteCounter(totalSize),
 		EstimatedKeysSize: driver.ByteCounter(keysSize),
+		Indexes:           t.indexStats(),
+		Migration:         migration.String(),
 	}, nil
 
 }
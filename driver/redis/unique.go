@@ -0,0 +1,261 @@
+package redis
+
+import (
+	"strings"
+
+	"github.com/dvirsky/go-pylog/logging"
+	"github.com/garyburd/redigo/redis"
+	"github.com/EverythingMe/meduza/driver"
+	"github.com/EverythingMe/meduza/errors"
+	"github.com/EverythingMe/meduza/schema"
+)
+
+// Unique indexes are compound indexes in which no two entities may have the same entry values.
+//
+// Writes changing the entries of unique indexes are executed as atomic change sets, whose index changes are known
+// before their transaction. Before the transaction starts, the indexes are watched and the new entries are checked
+// against them. If another write adds a conflicting entry in the meantime, the transaction fails and is retried.
+//
+// Like in the index itself, entities that have none of the index's columns set are not checked. Unique indexes pending
+// backfill are not checked either, as they do not have the entries of all the entities yet. Their backfill checks
+// them for duplicates instead, and fails them if it finds any
+
+// the number of entries we read at once when scanning an index for duplicates
+const duplicatesChunkSize = 500
+
+// entryValues returns the values part of a compound index entry, without the id
+func entryValues(entry string) string {
+	return entry[:strings.LastIndexByte(entry, entryTerminator)+1]
+}
+
+// uniqueIndexes returns the unique indexes of the table that writes are checked against, that is the ready ones
+func (t *table) uniqueIndexes() []*CompoundIndex {
+
+	ret := make([]*CompoundIndex, 0)
+	for _, idx := range t.indexes {
+		if ci, ok := idx.(*CompoundIndex); ok && ci.desc.Unique() && t.states.ready(ci) {
+			ret = append(ret, ci)
+		}
+	}
+	return ret
+}
+
+// touchesUniqueIndexes tells whether the change writes properties indexed by any unique index of its table
+func (rc entityChange) touchesUniqueIndexes() bool {
+
+	if rc.changeType != changeInsert && rc.changeType != changeUpdate {
+		return false
+	}
+
+	for _, idx := range rc.table.uniqueIndexes() {
+		for _, p := range rc.changedProperties {
+			if idx.properties.contains(p) {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// uniqueClaim is a new entry a change set adds to a unique index, that no other entity may have the values of
+type uniqueClaim struct {
+	idx    *CompoundIndex
+	values string
+	id     schema.Key
+}
+
+// checkUniqueIndexes makes sure the results of an atomic change set do not add entries to unique indexes with the
+// same values as the entries of other entities, either in the index or in the change set itself. Entries the change
+// set removes from the index do not conflict, and neither do the values of an entity changed more than once, that
+// are checked only as they are after its last change.
+//
+// It must be called before the transaction starts, and it watches the checked indexes so the transaction fails if
+// they change before it is executed
+func (c *changeSet) checkUniqueIndexes(conn redis.Conn, results []changeResult) error {
+
+	claims := make([]uniqueClaim, 0)
+	claimed := make(map[string]schema.Key)
+	released := make(map[string]bool)
+	watched := make(map[string]bool)
+	keys := make([]interface{}, 0)
+
+	tables, diffs, err := mergedDiffs(results)
+	if err != nil {
+		return err
+	}
+
+	for _, t := range tables {
+
+		indexes := t.uniqueIndexes()
+		if len(indexes) == 0 {
+			continue
+		}
+
+		for _, eDiff := range diffs[t] {
+			if eDiff.changeType == changeReindex {
+				continue
+			}
+
+			for _, idx := range indexes {
+				delEntry := idx.diffEntry(eDiff, false)
+				if delEntry != "" {
+					released[idx.RedisKey()+delEntry] = true
+				}
+
+				if eDiff.changeType == changeDelete {
+					continue
+				}
+
+				addEntry := idx.diffEntry(eDiff, true)
+				if addEntry == "" || addEntry == delEntry {
+					continue
+				}
+
+				values := entryValues(addEntry)
+				if other, found := claimed[idx.RedisKey()+values]; found && other != eDiff.id {
+					return errors.UniqueViolation(idx.desc.Name, other)
+				}
+				claimed[idx.RedisKey()+values] = eDiff.id
+				claims = append(claims, uniqueClaim{idx, values, eDiff.id})
+
+				if !watched[idx.RedisKey()] {
+					watched[idx.RedisKey()] = true
+					keys = append(keys, idx.RedisKey())
+				}
+			}
+		}
+	}
+
+	if len(claims) == 0 {
+		return nil
+	}
+
+	if _, err := conn.Do("WATCH", keys...); err != nil {
+		return redisError(err)
+	}
+
+	// entries are prefix free, so the entries with a claim's values are exactly those starting with them
+	batch := NewBatch(conn)
+	for _, cl := range claims {
+		if _, err := batch.Send("ZRANGEBYLEX", cl.idx.RedisKey(), "["+cl.values,
+			"("+string(prefixEnd([]byte(cl.values)))); err != nil {
+			return redisError(err)
+		}
+	}
+
+	promises, err := batch.Execute()
+	if err != nil {
+		return redisError(err)
+	}
+
+	for i, cl := range claims {
+		entries, err := redis.Strings(promises[i].Reply())
+		if err != nil {
+			return redisError(err)
+		}
+		for _, entry := range entries {
+			if id := entryId(entry); id != cl.id && !released[cl.idx.RedisKey()+entry] {
+				logging.Info("Entity %s conflicts with entity %s in unique index %s", cl.id, id, cl.idx)
+				return errors.UniqueViolation(cl.idx.desc.Name, id)
+			}
+		}
+	}
+
+	return nil
+}
+
+// columnsIndex returns the simple or compound index of the table on exactly the given columns, or nil if there is none
+func (t *table) columnsIndex(columns []string) *CompoundIndex {
+
+	for _, idx := range t.indexes {
+		if ci, ok := idx.(*CompoundIndex); ok && ci.properties.equals(propertyList(columns)) {
+			return ci
+		}
+	}
+	return nil
+}
+
+// duplicates scans the simple or compound index on the given columns, and returns the groups of entities that have
+// the same values in it, that would violate the index's uniqueness were it unique
+func (t *table) duplicates(columns []string) ([]driver.Duplicate, error) {
+
+	idx := t.columnsIndex(columns)
+	if idx == nil {
+		return nil, errors.NewError("Table %s has no simple or compound index on %s", t, columns)
+	}
+
+	return t.indexDuplicates(idx)
+}
+
+// indexDuplicates scans a simple or compound index, and returns the groups of entities that have the same values in it.
+//
+// Entries are sorted by their values, so the entries of each group are adjacent in the index
+func (t *table) indexDuplicates(idx *CompoundIndex) ([]driver.Duplicate, error) {
+
+	conn := pool.Get()
+	defer conn.Close()
+
+	ret := make([]driver.Duplicate, 0)
+	group := make([]schema.Key, 0)
+	values := ""
+
+	// flush adds the current group of entities to the duplicates if there's more than one of them
+	flush := func() error {
+		if len(group) < 2 {
+			return nil
+		}
+
+		dup := driver.Duplicate{Ids: group}
+		ents, err := t.load(group[:1], idx.properties...)
+		if err != nil {
+			return err
+		}
+		if len(ents) > 0 {
+			dup.Values = ents[0].Properties
+		}
+		ret = append(ret, dup)
+		return nil
+	}
+
+	for offset := 0; ; offset += duplicatesChunkSize {
+
+		entries, err := redis.Strings(conn.Do("ZRANGE", idx.RedisKey(), offset, offset+duplicatesChunkSize-1))
+		if err != nil {
+			return nil, redisError(err)
+		}
+
+		for _, entry := range entries {
+			if v := entryValues(entry); v != values {
+				if err := flush(); err != nil {
+					return nil, err
+				}
+				values = v
+				group = make([]schema.Key, 0, 1)
+			}
+			group = append(group, entryId(entry))
+		}
+
+		if len(entries) < duplicatesChunkSize {
+			break
+		}
+	}
+
+	if err := flush(); err != nil {
+		return nil, err
+	}
+
+	logging.Info("Found %d groups of duplicates in index %s", len(ret), idx)
+	return ret, nil
+}
+
+// Duplicates returns the groups of entities of a table that have the same values of the given columns, and would
+// violate a unique index on them. The columns must be those of a simple or compound index of the table
+func (r *Driver) Duplicates(table string, columns ...string) ([]driver.Duplicate, error) {
+
+	tbl, found := r.getTable(table)
+	if !found {
+		return nil, errors.InvalidTableError
+	}
+
+	return tbl.duplicates(columns)
+}
@@ -116,8 +116,33 @@ var (
 	NoIndexError      = NewError("No index matches the filter").(*Error)
 	OpNotSupported    = NewError("Operation not supported by the index").(*Error)
 	EmptyResult       = NewError("No results found for query").(*Error)
+	ConflictError     = NewError("Conflict: entity does not match the write's conditions").(*Error)
+	UniqueError       = NewError("Unique index violation").(*Error)
 )
 
+// UniqueViolation returns the error of a write that would give an entity the same values of a unique index's
+// columns as another entity has, naming the index and the conflicting entity
+func UniqueViolation(index string, conflicting interface{}) error {
+	return NewError("%s: index %s already has entity %v with the same values", UniqueError, index, conflicting)
+}
+
+// IsUniqueViolation tells whether an error is a UniqueViolation error, either returned by a driver or received
+// from the server
+func IsUniqueViolation(err error) bool {
+	if err == nil {
+		return false
+	}
+	return strings.Contains(err.Error(), UniqueError.Error()+":")
+}
+
+// IsConflict tells whether an error is a ConflictError, either returned by a driver or received from the server
+func IsConflict(err error) bool {
+	if err == nil {
+		return false
+	}
+	return err == ConflictError || strings.HasSuffix(err.Error(), ConflictError.Error())
+}
+
 // Context wraps the error with an underlying "contextual" error object containing
 // a stack trace
 func Context(err error) error {
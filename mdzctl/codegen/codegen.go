@@ -36,7 +36,9 @@ func formatGo(b []byte, err error) ([]byte, error) {
 
 func generate(templateString string, sc *schema.Schema) ([]byte, error) {
 	tpl, err := template.New("schema").Funcs(template.FuncMap{
-		"getDefault": preprocessDefault,
+		"getDefault":     preprocessDefault,
+		"hasCollections": hasCollections,
+		"columnOf":       columnOf,
 	}).Parse(templateString)
 
 	if err != nil {
@@ -118,3 +120,25 @@ func preprocessDefault(value interface{}, lang string) string {
 	}
 
 }
+
+// hasCollections tells the templates whether a schema has set, map or list columns, that get UPDATE change helpers
+func hasCollections(sc *schema.Schema) bool {
+	for _, t := range sc.Tables {
+		for _, c := range t.Columns {
+			if c.Type == schema.SetType || c.Type == schema.MapType || c.Type == schema.ListType {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// tableColumn is passed to templates that need a column along with the class of its table
+type tableColumn struct {
+	Class  string
+	Column *schema.Column
+}
+
+func columnOf(class string, col *schema.Column) tableColumn {
+	return tableColumn{class, col}
+}
@@ -141,6 +141,13 @@ func TestGenPython(t *testing.T) {
 		t.Errorf("Error parsing python file: %s", string(out))
 	}
 
+	if !strings.Contains(string(gen), "def properties_set(key, value):") {
+		t.Error("No map change helpers generated")
+	}
+	if !strings.Contains(string(gen), "def screenshots_trim(n):") {
+		t.Error("No list change helpers generated")
+	}
+
 }
 
 func TestGenGo(t *testing.T) {
@@ -157,4 +164,11 @@ func TestGenGo(t *testing.T) {
 	if out.Len() < 500 {
 		t.Fatal("Output too small")
 	}
+
+	if !strings.Contains(out.String(), "func (MarketInfoClass) PropertiesSet(key string, value interface{}) query.Change") {
+		t.Error("No map change helpers generated")
+	}
+	if !strings.Contains(out.String(), "func (MarketInfoClass) ScreenshotsTrim(n int) query.Change") {
+		t.Error("No list change helpers generated")
+	}
 }
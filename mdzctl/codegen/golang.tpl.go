@@ -5,7 +5,10 @@ const goTemplate = `
 
 package model
 
-import "github.com/EverythingMe/meduza/schema"
+import (
+    "github.com/EverythingMe/meduza/schema"
+{{ if hasCollections . }}    "github.com/EverythingMe/meduza/query"{{ end }}
+)
 
 {{ define "Column" }}\
 {{ .GoName }} schema.{{.Type}} ~db:"{{.Name}}\
@@ -15,6 +18,54 @@ import "github.com/EverythingMe/meduza/schema"
 {{ if .HasDefault }} default:"{{ getDefault .Default "go" }}"{{end}}\
 ~
 {{end}}
+{{ define "Changes" }}\
+{{ if eq .Column.Type "Set" }}
+// {{ .Column.GoName }}Add returns an UPDATE change adding elements to the {{ .Column.Name }} set
+func ({{ .Class }}) {{ .Column.GoName }}Add(elements ...interface{}) query.Change {
+    return query.SetAdd("{{ .Column.Name }}", elements...)
+}
+
+// {{ .Column.GoName }}Del returns an UPDATE change removing elements from the {{ .Column.Name }} set
+func ({{ .Class }}) {{ .Column.GoName }}Del(elements ...interface{}) query.Change {
+    return query.SetDel("{{ .Column.Name }}", elements...)
+}
+{{ else if eq .Column.Type "Map" }}
+// {{ .Column.GoName }}Set returns an UPDATE change setting a key of the {{ .Column.Name }} map
+func ({{ .Class }}) {{ .Column.GoName }}Set(key string, value interface{}) query.Change {
+    return query.MapSet("{{ .Column.Name }}", key, value)
+}
+
+// {{ .Column.GoName }}Del returns an UPDATE change deleting keys from the {{ .Column.Name }} map
+func ({{ .Class }}) {{ .Column.GoName }}Del(keys ...string) query.Change {
+    return query.MapDel("{{ .Column.Name }}", keys...)
+}
+{{ else if eq .Column.Type "List" }}
+// {{ .Column.GoName }}Append returns an UPDATE change appending elements to the {{ .Column.Name }} list
+func ({{ .Class }}) {{ .Column.GoName }}Append(elements ...interface{}) query.Change {
+    return query.ListAppend("{{ .Column.Name }}", elements...)
+}
+
+// {{ .Column.GoName }}Prepend returns an UPDATE change inserting elements at the beginning of the {{ .Column.Name }} list
+func ({{ .Class }}) {{ .Column.GoName }}Prepend(elements ...interface{}) query.Change {
+    return query.ListPrepend("{{ .Column.Name }}", elements...)
+}
+
+// {{ .Column.GoName }}Remove returns an UPDATE change removing values from the {{ .Column.Name }} list
+func ({{ .Class }}) {{ .Column.GoName }}Remove(values ...interface{}) query.Change {
+    return query.ListRemove("{{ .Column.Name }}", values...)
+}
+
+// {{ .Column.GoName }}Trim returns an UPDATE change keeping the first n elements of the {{ .Column.Name }} list, or the last -n
+func ({{ .Class }}) {{ .Column.GoName }}Trim(n int) query.Change {
+    return query.ListTrim("{{ .Column.Name }}", n)
+}
+
+// {{ .Column.GoName }}SetAt returns an UPDATE change replacing the element at an index of the {{ .Column.Name }} list
+func ({{ .Class }}) {{ .Column.GoName }}SetAt(index int, value interface{}) query.Change {
+    return query.ListSetAt("{{ .Column.Name }}", index, value)
+}
+{{ end }}\
+{{end}}
 {{ $sc := .Name }}\
 const Schema_{{.Name}} = "{{.Name}}"
 
@@ -34,4 +85,8 @@ type {{ .Class }} struct {
     {{ template "Column" . }}\
 {{ end }}\
 }
+{{ $cls := .Class }}\
+{{ range .Columns }}\
+{{ template "Changes" columnOf $cls . }}\
+{{ end }}\
 {{ end }}`
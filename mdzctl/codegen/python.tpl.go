@@ -13,6 +13,54 @@ Generated by Meduza. Do not rewrite unless you know what you're doing...
 {{ if .HasDefault }}, default={{ getDefault .Default "py" }}{{end}}\
 )
 {{end}}
+{{ define "Changes" }}\
+{{ if eq .Type "Set" }}
+    @staticmethod
+    def {{ .ClientName }}_add(*elements):
+        """ An UPDATE change adding elements to the {{ .Name }} set """
+        return {'property': '{{ .Name }}', 'op': 'SADD', 'value': list(elements)}
+
+    @staticmethod
+    def {{ .ClientName }}_del(*elements):
+        """ An UPDATE change removing elements from the {{ .Name }} set """
+        return {'property': '{{ .Name }}', 'op': 'SDEL', 'value': list(elements)}
+{{ else if eq .Type "Map" }}
+    @staticmethod
+    def {{ .ClientName }}_set(key, value):
+        """ An UPDATE change setting a key of the {{ .Name }} map """
+        return {'property': '{{ .Name }}', 'op': 'MSET', 'value': {key: value}}
+
+    @staticmethod
+    def {{ .ClientName }}_del(*keys):
+        """ An UPDATE change deleting keys from the {{ .Name }} map """
+        return {'property': '{{ .Name }}', 'op': 'MDEL', 'value': list(keys)}
+{{ else if eq .Type "List" }}
+    @staticmethod
+    def {{ .ClientName }}_append(*elements):
+        """ An UPDATE change appending elements to the {{ .Name }} list """
+        return {'property': '{{ .Name }}', 'op': 'LAPPEND', 'value': list(elements)}
+
+    @staticmethod
+    def {{ .ClientName }}_prepend(*elements):
+        """ An UPDATE change inserting elements at the beginning of the {{ .Name }} list """
+        return {'property': '{{ .Name }}', 'op': 'LPREPEND', 'value': list(elements)}
+
+    @staticmethod
+    def {{ .ClientName }}_remove(*values):
+        """ An UPDATE change removing values from the {{ .Name }} list """
+        return {'property': '{{ .Name }}', 'op': 'LREM', 'value': list(values)}
+
+    @staticmethod
+    def {{ .ClientName }}_trim(n):
+        """ An UPDATE change keeping the first n elements of the {{ .Name }} list, or the last -n """
+        return {'property': '{{ .Name }}', 'op': 'LTRIM', 'value': n}
+
+    @staticmethod
+    def {{ .ClientName }}_set_at(index, value):
+        """ An UPDATE change replacing the element at an index of the {{ .Name }} list """
+        return {'property': '{{ .Name }}', 'op': 'LSET', 'value': [index, value]}
+{{ end }}\
+{{end}}
 
 from meduza.model import Model
 from meduza.columns import *
@@ -31,6 +79,9 @@ class {{ .Class }}(Model):
 {{end}}\
     {{ template "Column" . }}
 {{ end }}\
+{{ range .Columns }}\
+{{ template "Changes" . }}\
+{{ end }}\
 
 {{ end }}
 ## End schema {{ .Name }}
@@ -5,6 +5,7 @@ import (
 	"io"
 	"io/ioutil"
 	"net/http"
+	"net/url"
 	"os"
 
 	"github.com/codegangsta/cli"
@@ -27,6 +28,11 @@ var deployCommand = cli.Command{
 			Value: "http://localhost:9966",
 			Usage: "The meduza control server to deploy to",
 		},
+		cli.StringFlag{
+			Name:  "author, a",
+			Value: os.Getenv("USER"),
+			Usage: "The author of the deployed schema version",
+		},
 	},
 	Action: deploy,
 }
@@ -53,7 +59,7 @@ func deploy(c *cli.Context) {
 		body = fp
 	}
 
-	u := fmt.Sprintf("%s/deploy", server)
+	u := fmt.Sprintf("%s/deploy?author=%s", server, url.QueryEscape(c.String("author")))
 
 	res, err := http.Post(u, "text/yaml", body)
 
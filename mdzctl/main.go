@@ -23,6 +23,8 @@ func main() {
 		statsCommand,
 		dumpCommand,
 		loadCommand,
+		migrateCommand,
+		schemaCommand,
 	}
 	app.RunAndExitOnError()
 }
@@ -0,0 +1,74 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"os"
+
+	"github.com/codegangsta/cli"
+)
+
+var migrateCommand = cli.Command{
+	Name:  "migrate",
+	Usage: "Migrate the stored entities of a table to its altered and renamed columns",
+	Flags: []cli.Flag{
+		cli.StringFlag{
+			Name:  "server, s",
+			Value: "http://localhost:9966",
+			Usage: "The meduza control server to deploy to",
+		},
+
+		cli.StringFlag{
+			Name:  "schema, S",
+			Usage: "The schema of the table we'll be migrating",
+		},
+
+		cli.StringFlag{
+			Name:  "table, t",
+			Usage: "The table we'll be migrating",
+		},
+
+		cli.BoolFlag{
+			Name:  "dry-run, n",
+			Usage: "Only report what would be migrated, without writing anything",
+		},
+	},
+
+	Action: migrate,
+}
+
+func migrate(c *cli.Context) {
+
+	server := c.String("server")
+	table := c.String("table")
+	schm := c.String("schema")
+
+	if table == "" || schm == "" {
+		perror("No schema or table given")
+		return
+	}
+
+	u := fmt.Sprintf("%s/migrate?schema=%s&table=%s&dry_run=%v", server, url.QueryEscape(schm),
+		url.QueryEscape(table), c.Bool("dry-run"))
+
+	res, err := http.Post(u, "text/plain", nil)
+	if err != nil {
+		perror("Could not post migrate request to server: %s", err)
+		return
+	}
+	defer res.Body.Close()
+
+	if res.StatusCode != http.StatusOK {
+		b, _ := ioutil.ReadAll(res.Body)
+		perror("Error migrating table. Server error: %s", b)
+		return
+	}
+
+	if _, err = io.Copy(os.Stdout, res.Body); err != nil {
+		perror("Could not get body: %s", err)
+	}
+
+}
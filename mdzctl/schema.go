@@ -0,0 +1,99 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"os"
+	"strconv"
+
+	"github.com/codegangsta/cli"
+)
+
+var schemaFlags = []cli.Flag{
+	cli.StringFlag{
+		Name:  "server, s",
+		Value: "http://localhost:9966",
+		Usage: "The meduza control server to deploy to",
+	},
+
+	cli.StringFlag{
+		Name:  "schema, S",
+		Usage: "The name of the schema",
+	},
+}
+
+var schemaCommand = cli.Command{
+	Name:  "schema",
+	Usage: "Show the deployed versions of a schema, or roll it back to one of them",
+	Subcommands: []cli.Command{
+		{
+			Name:   "history",
+			Usage:  "List the deployed versions of a schema and their changes",
+			Flags:  schemaFlags,
+			Action: schemaHistory,
+		},
+		{
+			Name:  "rollback",
+			Usage: "Deploy an old version of a schema again: rollback -S <schema> <version>",
+			Flags: append(schemaFlags, cli.StringFlag{
+				Name:  "author, a",
+				Value: os.Getenv("USER"),
+				Usage: "The author of the rollback",
+			}),
+			Action: schemaRollback,
+		},
+	},
+}
+
+// schemaRequest posts a request to a schema endpoint of the control server, and prints its response
+func schemaRequest(u string) {
+
+	res, err := http.Post(u, "text/plain", nil)
+	if err != nil {
+		perror("Could not post request to server: %s", err)
+		return
+	}
+	defer res.Body.Close()
+
+	if res.StatusCode != http.StatusOK {
+		b, _ := ioutil.ReadAll(res.Body)
+		perror("Server error: %s", b)
+		return
+	}
+
+	if _, err = io.Copy(os.Stdout, res.Body); err != nil {
+		perror("Could not get body: %s", err)
+	}
+}
+
+func schemaHistory(c *cli.Context) {
+
+	schm := c.String("schema")
+	if schm == "" {
+		perror("No schema given")
+		return
+	}
+
+	schemaRequest(fmt.Sprintf("%s/schema/history?schema=%s", c.String("server"), url.QueryEscape(schm)))
+}
+
+func schemaRollback(c *cli.Context) {
+
+	schm := c.String("schema")
+	if schm == "" {
+		perror("No schema given")
+		return
+	}
+
+	version, err := strconv.Atoi(c.Args().First())
+	if err != nil {
+		perror("Invalid version '%s'", c.Args().First())
+		return
+	}
+
+	schemaRequest(fmt.Sprintf("%s/schema/rollback?schema=%s&version=%d&author=%s", c.String("server"),
+		url.QueryEscape(schm), version, url.QueryEscape(c.String("author"))))
+}
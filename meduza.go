@@ -41,6 +41,66 @@ func (s Session) Get(table string, dst interface{}, ids ...schema.Key) error {
 	return err
 }
 
+// GetRequest describes loading objects by their primary ids from a table into Dst, for Session.GetMany.
+// Dst must be a pointer to a slice of matching model objects, or a pointer to a single model object
+type GetRequest struct {
+	Table string
+	Ids   []schema.Key
+	Dst   interface{}
+}
+
+// GetMany loads objects by primary ids from several tables in a single round trip, mapping the objects loaded by every
+// request into its Dst. The server runs the requests concurrently.
+//
+// If any of the requests fails, its error is returned. Unlike Get, requests whose ids do not exist are not
+// an error, and their Dst is left unchanged
+func (s Session) GetMany(requests ...GetRequest) error {
+
+	client, err := s.pool.Get()
+	if err != nil {
+		return err
+	}
+
+	q := query.NewMultiGetQuery()
+	for _, req := range requests {
+		qids := make([]interface{}, len(req.Ids))
+		for i := range req.Ids {
+			qids[i] = req.Ids[i]
+		}
+		q.Add(query.NewGetQuery(s.qualifiedName(req.Table)).FilterIn("id", qids...).Limit(len(qids)))
+	}
+
+	if err := q.Validate(); err != nil {
+		return err
+	}
+
+	res, err := client.Do(*q)
+	if err != nil {
+		return errors.NewError("Could not perform  %s", err)
+	}
+
+	resp, ok := res.(query.MultiGetResponse)
+	if !ok {
+		return errors.NewError("Invalid response object for MULTIGET  %s", res)
+	}
+	if err := resp.Err(); err != nil {
+		return err
+	}
+	if len(resp.Responses) != len(requests) {
+		return errors.NewError("Not all responses returned, expected %d but got %d", len(requests), len(resp.Responses))
+	}
+
+	for i, r := range resp.Responses {
+		if err := r.Err(); err != nil {
+			return errors.NewError("Could not load results from %s: %s", requests[i].Table, err)
+		}
+		if err := r.MapEntities(requests[i].Dst); err != nil && err != errors.EmptyResult {
+			return err
+		}
+	}
+	return nil
+}
+
 // Setup initializes a default session for the default schema, and exposes the redis LB to all sessions
 func Setup(defaultSchema string, dialer client.Dialer) {
 
@@ -87,6 +147,97 @@ func (s Session) Select(table string, dst interface{}, offset, limit int, filter
 
 }
 
+// Iterator walks over all the results of a selection page by page, following the cursors the server returns,
+// so entities inserted or deleted during the iteration don't cause duplicate or skipped results
+type Iterator struct {
+	session Session
+	q       *query.GetQuery
+	done    bool
+	err     error
+	// Total is the total number of entities matching the selection, as of the last page loaded
+	Total int
+}
+
+// SelectIter returns an iterator over the objects selected from a table by the filters, loading pageSize objects
+// at a time. See Iterator.Next
+func (s Session) SelectIter(table string, pageSize int, filters ...query.Filter) *Iterator {
+
+	it := &Iterator{
+		session: s,
+		q:       query.NewGetQuery(s.qualifiedName(table)).Limit(pageSize),
+	}
+
+	if len(filters) == 0 {
+		it.err = errors.NewError("No filters given to query.")
+		it.done = true
+	}
+	it.q.Filters = query.NewFilters(filters...)
+
+	return it
+}
+
+// Next loads the next page of results into dst, that must be a pointer to a slice of matching model objects.
+//
+// It returns false when there are no more results or if loading the page failed - check Err to tell them apart.
+// The iteration can be ordered by setting the iterator's ordering before the first page with OrderBy
+func (it *Iterator) Next(dst interface{}) bool {
+
+	if it.done {
+		return false
+	}
+
+	client, err := it.session.pool.Get()
+	if err != nil {
+		it.err, it.done = err, true
+		return false
+	}
+
+	res, err := client.Do(*it.q)
+	if err != nil {
+		it.err, it.done = errors.NewError("Could not perform  %s", err), true
+		return false
+	}
+
+	resp, ok := res.(query.GetResponse)
+	if !ok {
+		it.err, it.done = errors.NewError("Invalid response object for GET  %s", res), true
+		return false
+	}
+	if err := resp.Err(); err != nil {
+		it.err, it.done = err, true
+		return false
+	}
+
+	it.Total = resp.Total
+	if len(resp.Entities) == 0 {
+		it.done = true
+		return false
+	}
+
+	if err := resp.MapEntities(dst); err != nil {
+		it.err, it.done = err, true
+		return false
+	}
+
+	if resp.Cursor == "" {
+		it.done = true
+	} else {
+		it.q.After(resp.Cursor)
+	}
+	return true
+}
+
+// OrderBy sets the ordering of the iteration. It must be called before the first page is loaded
+func (it *Iterator) OrderBy(prop string, mode query.SortMode) *Iterator {
+	it.q.OrderBy(prop, mode)
+	return it
+}
+
+// Err returns the error that stopped the iteration, if any
+func (it *Iterator) Err() error {
+	return it.err
+}
+
 // Put saves a list of objects into the database in a batch, and returns the resulting ids of the operation.
 //
 // If the objects' id field is empty we will allocate ids for them and return these ids.
@@ -102,19 +253,32 @@ func (s Session) Put(table string, objects ...interface{}) ([]schema.Key, error)
 
 // PutExpiring is identical to Put but expires all entities with a given TTL
 func (s Session) PutExpiring(table string, ttl time.Duration, objects ...interface{}) ([]schema.Key, error) {
+	ids, _, err := s.put(table, ttl, query.Upsert, objects)
+	return ids, err
+}
+
+// PutWithMode is like Put, but lets the caller decide what happens to objects that already exist - see query.PutMode.
+// Along with the ids of the objects, it returns whether each of them was created, updated or rejected.
+// Objects rejected by InsertOnly or UpdateOnly modes are not written, while the rest of the objects are
+func (s Session) PutWithMode(table string, mode query.PutMode, objects ...interface{}) ([]schema.Key, []query.PutOutcome, error) {
+	return s.put(table, 0, mode, objects)
+}
+
+// put encodes the objects and saves them with a PUT query in the given mode
+func (s Session) put(table string, ttl time.Duration, mode query.PutMode, objects []interface{}) ([]schema.Key, []query.PutOutcome, error) {
 
 	client, err := s.pool.Get()
 	if err != nil {
-		return nil, err
+		return nil, nil, err
 	}
 
-	q := query.NewPutQuerySize(s.qualifiedName(table), len(objects))
+	q := query.NewPutQuerySize(s.qualifiedName(table), len(objects)).WithMode(mode)
 
 	for _, obj := range objects {
 
 		ent, err := schema.EncodeStruct(obj)
 		if err != nil {
-			return nil, logging.Errorf("Could not save object %s: %s", obj, err)
+			return nil, nil, logging.Errorf("Could not save object %s: %s", obj, err)
 		}
 
 		// Expire the entities if an expire was set
@@ -126,16 +290,63 @@ func (s Session) PutExpiring(table string, ttl time.Duration, objects ...interfa
 
 	res, err := client.Do(q)
 	if err != nil {
-		return nil, errors.NewError("Could not perform  %s", err)
+		return nil, nil, errors.NewError("Could not perform  %s", err)
 	}
 
+	return s.putResponse(res, objects)
+}
+
+// PutIfVersion saves an object only if its entity's version in the database is the given version, and returns
+// its id. If the entity was written by someone else since it was read, the put fails with errors.ConflictError
+// (see errors.IsConflict). A version of 0 means the entity must not exist yet.
+//
+// If the object is a pointer, its version field (tagged with `db:",version"`) is set to the new version
+func (s Session) PutIfVersion(table string, version int64, object interface{}) (schema.Key, error) {
+
+	client, err := s.pool.Get()
+	if err != nil {
+		return "", err
+	}
+
+	ent, err := schema.EncodeStruct(object)
+	if err != nil {
+		return "", logging.Errorf("Could not save object %s: %s", object, err)
+	}
+
+	q := query.NewPutQuery(s.qualifiedName(table)).AddEntityIf(*ent, query.IfVersion(version))
+
+	res, err := client.Do(q)
+	if err != nil {
+		return "", errors.NewError("Could not perform  %s", err)
+	}
+
+	ids, _, err := s.putResponse(res, []interface{}{object})
+	if err != nil {
+		return "", err
+	}
+
+	if reflect.ValueOf(object).Kind() == reflect.Ptr {
+		if err := schema.SetVersion(version+1, object); err != nil {
+			logging.Error("Error mapping version to object: %s", err)
+		}
+	}
+	return ids[0], nil
+}
+
+// putResponse reads the response to a PUT query and maps the returned ids to the objects that were put
+func (s Session) putResponse(res interface{}, objects []interface{}) ([]schema.Key, []query.PutOutcome, error) {
+
 	resp, ok := res.(query.PutResponse)
 	if !ok {
-		return nil, errors.NewError("Invalid response object for  %s", res)
+		return nil, nil, errors.NewError("Invalid response object for  %s", res)
+	}
+
+	if err := resp.Err(); err != nil {
+		return nil, nil, err
 	}
 
 	if len(resp.Ids) != len(objects) {
-		return nil, errors.NewError("Not all ids returned, expected %d but got %d", len(objects), len(resp.Ids))
+		return nil, nil, errors.NewError("Not all ids returned, expected %d but got %d", len(objects), len(resp.Ids))
 	}
 
 	for i, id := range resp.Ids {
@@ -147,7 +358,7 @@ func (s Session) PutExpiring(table string, ttl time.Duration, objects ...interfa
 			}
 		}
 	}
-	return resp.Ids, nil
+	return resp.Ids, resp.Outcomes, nil
 
 }
 
@@ -182,6 +393,72 @@ func (s Session) Update(table string, where query.Filters, changes ...query.Chan
 
 }
 
+// UpdateReturning is like Update, but also maps the updated entities, with their values after the update, into dst.
+// This saves a GET after updates whose results depend on the current values, such as increments.
+// dst must be a pointer to a slice of model objects, or a pointer to a single model object
+func (s Session) UpdateReturning(table string, where query.Filters, dst interface{}, changes ...query.Change) (int, error) {
+
+	if len(where) == 0 {
+		return 0, errors.NewError("No selection supplied for query")
+	}
+
+	client, err := s.pool.Get()
+	if err != nil {
+		return 0, err
+	}
+
+	q := query.NewUpdateQuery(s.qualifiedName(table)).Return()
+	q.Filters = where
+	q.Changes = changes
+
+	res, err := client.Do(q)
+	if err != nil {
+		return 0, errors.NewError("Could not perform  %s", err)
+	}
+
+	resp, ok := res.(query.UpdateResponse)
+	if !ok {
+		return 0, errors.NewError("Invalid response object for update  %s", res)
+	} else if resp.Err() != nil {
+		return 0, resp.Err()
+	}
+
+	if resp.Num == 0 {
+		return 0, nil
+	}
+	return resp.Num, resp.MapEntities(dst)
+}
+
+// UpdateIfVersion is like Update, but the changes are applied only if all the selected entities are at the given
+// version. If any of them was written since it was read, nothing is updated and the update fails with
+// errors.ConflictError (see errors.IsConflict)
+func (s Session) UpdateIfVersion(table string, where query.Filters, version int64, changes ...query.Change) (int, error) {
+
+	if where == nil || len(where) == 0 {
+		return 0, errors.NewError("No selection supplied for query")
+	}
+
+	client, err := s.pool.Get()
+	if err != nil {
+		return 0, err
+	}
+
+	q := query.NewUpdateQuery(s.qualifiedName(table)).If(query.IfVersion(version))
+	q.Filters = where
+	q.Changes = changes
+
+	res, err := client.Do(q)
+	if err != nil {
+		return 0, errors.NewError("Could not perform  %s", err)
+	}
+
+	resp, ok := res.(query.UpdateResponse)
+	if !ok {
+		return 0, errors.NewError("Invalid response object for update  %s", res)
+	}
+	return resp.Num, resp.Err()
+}
+
 // Delete deletes entities from a table, based on the where filters.
 // It returns the number of deleted rows, or an error if something went wrong
 func (s Session) Delete(table string, where ...query.Filter) (int, error) {
@@ -214,6 +491,241 @@ func (s Session) Delete(table string, where ...query.Filter) (int, error) {
 
 }
 
+// DeleteReturning is like Delete, but also maps the deleted entities, as they were before being deleted, into dst.
+// dst must be a pointer to a slice of model objects, or a pointer to a single model object
+func (s Session) DeleteReturning(table string, dst interface{}, where ...query.Filter) (int, error) {
+
+	if len(where) == 0 {
+		return 0, errors.NewError("No selection supplied for query")
+	}
+
+	client, err := s.pool.Get()
+	if err != nil {
+		return 0, err
+	}
+
+	q := query.NewDelQuery(s.qualifiedName(table)).Return()
+	q.Filters = query.NewFilters(where...)
+
+	if err := q.Validate(); err != nil {
+		return 0, err
+	}
+
+	res, err := client.Do(q)
+	if err != nil {
+		return 0, errors.NewError("Could not perform  %s", err)
+	}
+
+	resp, ok := res.(query.DelResponse)
+	if !ok {
+		return 0, errors.NewError("Invalid response object for DEL  %s", res)
+	} else if resp.Err() != nil {
+		return 0, resp.Err()
+	}
+
+	if resp.Num == 0 {
+		return 0, nil
+	}
+	return resp.Num, resp.MapEntities(dst)
+}
+
+// Explain asks the server how it would select entities from a table using the given filters and ordering:
+// which indexes competed, which one was chosen, what it will scan and how many entities match.
+//
+// If the server found a plan but the selection would fail, the plan is returned along with the error
+func (s Session) Explain(table string, filters query.Filters, order query.Ordering) (*query.ExplainResponse, error) {
+
+	if len(filters) == 0 {
+		return nil, errors.NewError("No filters given to query.")
+	}
+
+	client, err := s.pool.Get()
+	if err != nil {
+		return nil, err
+	}
+
+	q := query.NewExplainQuery(s.qualifiedName(table))
+	q.Filters = filters
+	q.Order = order
+
+	res, err := client.Do(q)
+	if err != nil {
+		return nil, errors.NewError("Could not perform  %s", err)
+	}
+
+	resp, ok := res.(query.ExplainResponse)
+	if !ok {
+		return nil, errors.NewError("Invalid response object for EXPLAIN  %s", res)
+	}
+
+	return &resp, resp.Err()
+}
+
+// Count returns the number of entities in a table matching the where filters, without loading them
+func (s Session) Count(table string, where ...query.Filter) (int, error) {
+
+	if len(where) == 0 {
+		return 0, errors.NewError("No selection supplied for query")
+	}
+
+	client, err := s.pool.Get()
+	if err != nil {
+		return 0, err
+	}
+
+	q := query.NewCountQuery(s.qualifiedName(table))
+	q.Filters = query.NewFilters(where...)
+
+	if err := q.Validate(); err != nil {
+		return 0, err
+	}
+
+	res, err := client.Do(q)
+	if err != nil {
+		return 0, errors.NewError("Could not perform  %s", err)
+	}
+
+	resp, ok := res.(query.CountResponse)
+	if !ok {
+		return 0, errors.NewError("Invalid response object for COUNT  %s", res)
+	}
+	return resp.Num, resp.Err()
+}
+
+// Pipeline returns a pipeline on one of the session's connections, for sending many queries to the server in a
+// single round trip. The tables of the queries must be qualified with their schema's name. See client.Pipeline
+func (s Session) Pipeline() (client.Pipeline, error) {
+
+	c, err := s.pool.Get()
+	if err != nil {
+		return nil, err
+	}
+	return c.Pipeline(), nil
+}
+
+// Tx collects PUT, UPDATE and DEL queries on tables of the session's schema, and sends them to the server as a
+// single transaction when it is committed. Either all of them are applied, or none of them are
+type Tx struct {
+	session Session
+	q       *query.TxQuery
+	// objects holds the objects of PUT statements by statement index, to map their new ids to them on commit
+	objects map[int][]interface{}
+	err     error
+}
+
+// Begin starts a new transaction on the session. Nothing is sent to the server until the transaction is committed
+func (s Session) Begin() *Tx {
+	return &Tx{
+		session: s,
+		q:       query.NewTxQuery(),
+		objects: make(map[int][]interface{}),
+	}
+}
+
+// Put adds the saving of objects to a table to the transaction. See Session.Put
+func (tx *Tx) Put(table string, objects ...interface{}) *Tx {
+
+	q := query.NewPutQuerySize(tx.session.qualifiedName(table), len(objects))
+	for _, obj := range objects {
+		ent, err := schema.EncodeStruct(obj)
+		if err != nil {
+			tx.err = logging.Errorf("Could not save object %s: %s", obj, err)
+			return tx
+		}
+		q.AddEntity(*ent)
+	}
+
+	tx.objects[len(tx.q.Statements)] = objects
+	tx.q.Put(q)
+	return tx
+}
+
+// Update adds an update of the entities selected by the where filters to the transaction. See Session.Update
+func (tx *Tx) Update(table string, where query.Filters, changes ...query.Change) *Tx {
+
+	if len(where) == 0 {
+		tx.err = errors.NewError("No selection supplied for query")
+		return tx
+	}
+
+	q := query.NewUpdateQuery(tx.session.qualifiedName(table))
+	q.Filters = where
+	q.Changes = changes
+	tx.q.Update(q)
+	return tx
+}
+
+// Delete adds the deletion of the entities selected by the where filters to the transaction. See Session.Delete
+func (tx *Tx) Delete(table string, where ...query.Filter) *Tx {
+
+	if len(where) == 0 {
+		tx.err = errors.NewError("No selection supplied for query")
+		return tx
+	}
+
+	q := query.NewDelQuery(tx.session.qualifiedName(table))
+	q.Filters = query.NewFilters(where...)
+	tx.q.Del(q)
+	return tx
+}
+
+// Abort discards the statements of the transaction. Since nothing was sent to the server, nothing needs to be undone
+func (tx *Tx) Abort() {
+	tx.q = query.NewTxQuery()
+	tx.objects = make(map[int][]interface{})
+	tx.err = nil
+}
+
+// Commit sends the transaction to the server, and returns the results of its statements in the order they were added.
+// The ids of put objects are mapped to them if they are pointers.
+//
+// If any statement fails, for example because of unmet conditions, none of them are applied and an error is returned
+func (tx *Tx) Commit() ([]query.TxResult, error) {
+
+	if tx.err != nil {
+		return nil, tx.err
+	}
+
+	if err := tx.q.Validate(); err != nil {
+		return nil, err
+	}
+
+	client, err := tx.session.pool.Get()
+	if err != nil {
+		return nil, err
+	}
+
+	res, err := client.Do(*tx.q)
+	if err != nil {
+		return nil, errors.NewError("Could not perform  %s", err)
+	}
+
+	resp, ok := res.(query.TxResponse)
+	if !ok {
+		return nil, errors.NewError("Invalid response object for TX  %s", res)
+	}
+	if err := resp.Err(); err != nil {
+		return nil, err
+	}
+
+	for i, objects := range tx.objects {
+		if i >= len(resp.Results) {
+			return nil, errors.NewError("Not all statement results returned, expected %d but got %d",
+				len(tx.q.Statements), len(resp.Results))
+		}
+
+		for n, id := range resp.Results[i].Ids {
+			if n < len(objects) && reflect.ValueOf(objects[n]).Kind() == reflect.Ptr {
+				if err := schema.SetPrimary(id, objects[n]); err != nil {
+					logging.Error("Error mapping id to object: %s", err)
+				}
+			}
+		}
+	}
+
+	return resp.Results, nil
+}
+
 // DefaultSession is the sessions that all static calls operate on
 var DefaultSession *Session
 
@@ -222,26 +734,76 @@ func Select(table string, dst interface{}, offset, limit int, filters ...query.F
 	return DefaultSession.Select(table, dst, offset, limit, filters...)
 }
 
+// SelectIter iterates over a selection on the default session. See Session.SelectIter
+func SelectIter(table string, pageSize int, filters ...query.Filter) *Iterator {
+	return DefaultSession.SelectIter(table, pageSize, filters...)
+}
+
 // Get performs a Get query on the default session. See Session.Get
 func Get(table string, dst interface{}, ids ...schema.Key) error {
 	return DefaultSession.Get(table, dst, ids...)
 }
 
+// GetMany loads objects from several tables on the default session. See Session.GetMany
+func GetMany(requests ...GetRequest) error {
+	return DefaultSession.GetMany(requests...)
+}
+
 // Put performs a Put query on the default session. See Session.Put
 func Put(table string, objects ...interface{}) ([]schema.Key, error) {
 	return DefaultSession.Put(table, objects...)
 }
 
+// PutWithMode performs a Put query in the given mode on the default session. See Session.PutWithMode
+func PutWithMode(table string, mode query.PutMode, objects ...interface{}) ([]schema.Key, []query.PutOutcome, error) {
+	return DefaultSession.PutWithMode(table, mode, objects...)
+}
+
+// PutIfVersion performs a conditional Put query on the default session. See Session.PutIfVersion
+func PutIfVersion(table string, version int64, object interface{}) (schema.Key, error) {
+	return DefaultSession.PutIfVersion(table, version, object)
+}
+
 // Delete performs a Delete query on the default session. See Session.Delete
 func Delete(table string, where ...query.Filter) (int, error) {
 	return DefaultSession.Delete(table, where...)
 }
 
+// DeleteReturning performs a Delete query returning the deleted entities on the default session. See Session.DeleteReturning
+func DeleteReturning(table string, dst interface{}, where ...query.Filter) (int, error) {
+	return DefaultSession.DeleteReturning(table, dst, where...)
+}
+
 // Update performs an update on the Default Session. See Session.Update
 func Update(table string, where query.Filters, changes ...query.Change) (int, error) {
 	return DefaultSession.Update(table, where, changes...)
 }
 
+// UpdateReturning performs an update returning the updated entities on the Default Session. See Session.UpdateReturning
+func UpdateReturning(table string, where query.Filters, dst interface{}, changes ...query.Change) (int, error) {
+	return DefaultSession.UpdateReturning(table, where, dst, changes...)
+}
+
+// UpdateIfVersion performs a conditional Update query on the default session. See Session.UpdateIfVersion
+func UpdateIfVersion(table string, where query.Filters, version int64, changes ...query.Change) (int, error) {
+	return DefaultSession.UpdateIfVersion(table, where, version, changes...)
+}
+
+// Explain explains a selection on the Default Session. See Session.Explain
+func Explain(table string, filters query.Filters, order query.Ordering) (*query.ExplainResponse, error) {
+	return DefaultSession.Explain(table, filters, order)
+}
+
+// Count counts entities on the Default Session. See Session.Count
+func Count(table string, where ...query.Filter) (int, error) {
+	return DefaultSession.Count(table, where...)
+}
+
+// Begin starts a transaction on the Default Session. See Session.Begin
+func Begin() *Tx {
+	return DefaultSession.Begin()
+}
+
 func init() {
 
 }
@@ -1,13 +1,16 @@
 package main
 
 import (
+	"encoding/json"
 	"errors"
 	"fmt"
 	"io/ioutil"
 	"net/http"
+	"strconv"
 	"strings"
 
 	"github.com/EverythingMe/meduza/query"
+	"github.com/EverythingMe/meduza/schema"
 
 	"gopkg.in/yaml.v2"
 
@@ -26,6 +29,12 @@ func ListenCtl(addr string) {
 	mux.HandleFunc("/dump", HandleDumpData)
 	mux.HandleFunc("/load", HandleLoadDump)
 	mux.HandleFunc("/drop", HandleDrop)
+	mux.HandleFunc("/explain", HandleExplain)
+	mux.HandleFunc("/count", HandleCount)
+	mux.HandleFunc("/duplicates", HandleDuplicates)
+	mux.HandleFunc("/migrate", HandleMigrate)
+	mux.HandleFunc("/schema/history", HandleSchemaHistory)
+	mux.HandleFunc("/schema/rollback", HandleSchemaRollback)
 
 	go func() {
 		logging.Info("Starting ctl server on %s", addr)
@@ -99,6 +108,166 @@ func HandleDrop(w http.ResponseWriter, r *http.Request) {
 
 }
 
+// parseValue converts a filter value given over http to an int, a float or a string
+func parseValue(v string) interface{} {
+	if i, err := strconv.ParseInt(v, 10, 64); err == nil {
+		return i
+	}
+	if f, err := strconv.ParseFloat(v, 64); err == nil {
+		return f
+	}
+	return v
+}
+
+// parseFilters reads the filters of a request, given as where=<property>,<operator>,<value>[,<value>...] parameters
+func parseFilters(r *http.Request) (query.Filters, error) {
+
+	ret := make(query.Filters)
+	for _, where := range r.Form["where"] {
+		parts := strings.Split(where, ",")
+		if len(parts) < 2 {
+			return nil, fmt.Errorf("Invalid filter: %s", where)
+		}
+
+		vals := make([]interface{}, 0, len(parts)-2)
+		for _, v := range parts[2:] {
+			vals = append(vals, parseValue(v))
+		}
+		ret[parts[0]] = query.NewFilter(parts[0], parts[1], vals...)
+	}
+	return ret, nil
+}
+
+// HandleExplain explains how the driver would select entities from a table.
+//
+// Filters are given as where=<property>,<operator>,<value>[,<value>...] parameters, and the ordering as
+// order=<property> and an optional desc=1
+func HandleExplain(w http.ResponseWriter, r *http.Request) {
+	r.ParseForm()
+
+	sch := r.FormValue("schema")
+	tbl := r.FormValue("table")
+
+	q := query.NewExplainQuery(fmt.Sprintf("%s.%s", sch, tbl))
+	filters, err := parseFilters(r)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	q.Filters = filters
+
+	if order := r.FormValue("order"); order != "" {
+		mode := query.ASC
+		if r.FormValue("desc") == "1" {
+			mode = query.DESC
+		}
+		q.OrderBy(order, mode)
+	}
+
+	if err := q.Validate(); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	res := meduzaServer.drv.Explain(*q)
+
+	b, err := json.MarshalIndent(res, "", "  ")
+	if err != nil {
+		http.Error(w, "Error dumping plan: "+err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.Write(b)
+}
+
+// HandleCount returns the number of entities in a table matching the where=<property>,<operator>,<value>[,<value>...]
+// filters, as a JSON count response
+func HandleCount(w http.ResponseWriter, r *http.Request) {
+	r.ParseForm()
+
+	sch := r.FormValue("schema")
+	tbl := r.FormValue("table")
+
+	q := query.NewCountQuery(fmt.Sprintf("%s.%s", sch, tbl))
+	filters, err := parseFilters(r)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	q.Filters = filters
+
+	if err := q.Validate(); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	res := meduzaServer.drv.Count(*q)
+
+	b, err := json.MarshalIndent(res, "", "  ")
+	if err != nil {
+		http.Error(w, "Error dumping count: "+err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.Write(b)
+}
+
+// HandleDuplicates reports the groups of entities of a table with the same values of the comma separated columns=
+// parameter, as YAML. It is used to find the entities violating an index's uniqueness before making it unique
+func HandleDuplicates(w http.ResponseWriter, r *http.Request) {
+	r.ParseForm()
+
+	sch := r.FormValue("schema")
+	tbl := r.FormValue("table")
+	columns := r.FormValue("columns")
+	if columns == "" {
+		http.Error(w, "No columns given", http.StatusBadRequest)
+		return
+	}
+
+	dups, err := meduzaServer.drv.Duplicates(fmt.Sprintf("%s.%s", sch, tbl), strings.Split(columns, ",")...)
+	if err != nil {
+		http.Error(w, "Error finding duplicates: "+err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	b, err := yaml.Marshal(dups)
+	if err != nil {
+		http.Error(w, "Error dumping duplicates: "+err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "text/yaml")
+	w.Write(b)
+}
+
+// HandleMigrate migrates the stored entities of a table to its columns, and reports the migration as YAML. With
+// dry_run=1 it only reports what would be migrated
+func HandleMigrate(w http.ResponseWriter, r *http.Request) {
+	r.ParseForm()
+
+	sch := r.FormValue("schema")
+	tbl := r.FormValue("table")
+	dryRun, _ := strconv.ParseBool(r.FormValue("dry_run"))
+
+	rep, err := meduzaServer.drv.Migrate(fmt.Sprintf("%s.%s", sch, tbl), dryRun)
+	if err != nil {
+		http.Error(w, "Error migrating table: "+err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	b, err := yaml.Marshal(rep)
+	if err != nil {
+		http.Error(w, "Error dumping migration report: "+err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "text/yaml")
+	w.Write(b)
+}
+
 func HandleDeploySchema(w http.ResponseWriter, r *http.Request) {
 	r.ParseForm()
 
@@ -129,7 +298,12 @@ func HandleDeploySchema(w http.ResponseWriter, r *http.Request) {
 			logging.Info("Deploying raw schema data '%s...' (%d bytes)", data[:10], len(data))
 		}
 
-		err = meduzaServer.sd.Deploy(strings.NewReader(data))
+		// deployers that keep versions record who deployed them
+		if vd, ok := meduzaServer.sd.(schema.VersionedDeployer); ok {
+			_, err = vd.DeployAs(strings.NewReader(data), r.FormValue("author"))
+		} else {
+			err = meduzaServer.sd.Deploy(strings.NewReader(data))
+		}
 	}
 
 	if err == nil {
@@ -142,6 +316,72 @@ func HandleDeploySchema(w http.ResponseWriter, r *http.Request) {
 
 }
 
+// versionedDeployer returns the server's schema deployer if it keeps schema versions, or reports an error if it doesn't
+func versionedDeployer(w http.ResponseWriter) (schema.VersionedDeployer, bool) {
+	vd, ok := meduzaServer.sd.(schema.VersionedDeployer)
+	if !ok {
+		http.Error(w, "The schema deployer does not keep schema versions", http.StatusNotImplemented)
+	}
+	return vd, ok
+}
+
+// HandleSchemaHistory returns the deployed versions of a schema, and the changes of each of them, as YAML
+func HandleSchemaHistory(w http.ResponseWriter, r *http.Request) {
+	r.ParseForm()
+
+	vd, ok := versionedDeployer(w)
+	if !ok {
+		return
+	}
+
+	history, err := vd.History(r.FormValue("schema"))
+	if err != nil {
+		http.Error(w, "Error getting schema history: "+err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	b, err := yaml.Marshal(history)
+	if err != nil {
+		http.Error(w, "Error dumping schema history: "+err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "text/yaml")
+	w.Write(b)
+}
+
+// HandleSchemaRollback deploys the given version= of a schema again, as a new version, and returns the new version as YAML
+func HandleSchemaRollback(w http.ResponseWriter, r *http.Request) {
+	r.ParseForm()
+
+	vd, ok := versionedDeployer(w)
+	if !ok {
+		return
+	}
+
+	version, err := strconv.Atoi(r.FormValue("version"))
+	if err != nil {
+		http.Error(w, "Invalid version: "+r.FormValue("version"), http.StatusBadRequest)
+		return
+	}
+
+	ver, err := vd.Rollback(r.FormValue("schema"), version, r.FormValue("author"))
+	if err != nil {
+		logging.Error("Error rolling back schema: %s", err)
+		http.Error(w, "Error rolling back schema: "+err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	b, err := yaml.Marshal(ver)
+	if err != nil {
+		http.Error(w, "Error dumping schema version: "+err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "text/yaml")
+	w.Write(b)
+}
+
 func HandleStatus(w http.ResponseWriter, r *http.Request) {
 
 	var err error
@@ -52,6 +52,22 @@ func (BsonProtocol) readDelQuery(msg transport.Message) (ret query.DelQuery, err
 	err = read(msg, &ret)
 	return
 }
+func (BsonProtocol) readExplainQuery(msg transport.Message) (ret query.ExplainQuery, err error) {
+	err = read(msg, &ret)
+	return
+}
+func (BsonProtocol) readCountQuery(msg transport.Message) (ret query.CountQuery, err error) {
+	err = read(msg, &ret)
+	return
+}
+func (BsonProtocol) readMultiGetQuery(msg transport.Message) (ret query.MultiGetQuery, err error) {
+	err = read(msg, &ret)
+	return
+}
+func (BsonProtocol) readTxQuery(msg transport.Message) (ret query.TxQuery, err error) {
+	err = read(msg, &ret)
+	return
+}
 func (BsonProtocol) readGetResponse(msg transport.Message) (ret query.GetResponse, err error) {
 	err = read(msg, &ret)
 	return
@@ -70,6 +86,22 @@ func (BsonProtocol) readDelResponse(msg transport.Message) (ret query.DelRespons
 	err = read(msg, &ret)
 	return
 }
+func (BsonProtocol) readExplainResponse(msg transport.Message) (ret query.ExplainResponse, err error) {
+	err = read(msg, &ret)
+	return
+}
+func (BsonProtocol) readCountResponse(msg transport.Message) (ret query.CountResponse, err error) {
+	err = read(msg, &ret)
+	return
+}
+func (BsonProtocol) readMultiGetResponse(msg transport.Message) (ret query.MultiGetResponse, err error) {
+	err = read(msg, &ret)
+	return
+}
+func (BsonProtocol) readTxResponse(msg transport.Message) (ret query.TxResponse, err error) {
+	err = read(msg, &ret)
+	return
+}
 func (BsonProtocol) readPingResponse(msg transport.Message) (ret query.PingResponse, err error) {
 	err = read(msg, &ret)
 	return
@@ -88,6 +120,14 @@ func (p BsonProtocol) ReadMessage(msg transport.Message) (ret interface{}, err e
 		ret, err = p.readPutQuery(msg)
 	case transport.DelMessage:
 		ret, err = p.readDelQuery(msg)
+	case transport.ExplainMessage:
+		ret, err = p.readExplainQuery(msg)
+	case transport.CountMessage:
+		ret, err = p.readCountQuery(msg)
+	case transport.MultiGetMessage:
+		ret, err = p.readMultiGetQuery(msg)
+	case transport.TxMessage:
+		ret, err = p.readTxQuery(msg)
 	case transport.PingMessage:
 		ret, err = query.PingQuery{}, nil
 
@@ -99,6 +139,14 @@ func (p BsonProtocol) ReadMessage(msg transport.Message) (ret interface{}, err e
 		ret, err = p.readAddResponse(msg)
 	case transport.DelResponseMessage:
 		ret, err = p.readDelResponse(msg)
+	case transport.ExplainResponseMessage:
+		ret, err = p.readExplainResponse(msg)
+	case transport.CountResponseMessage:
+		ret, err = p.readCountResponse(msg)
+	case transport.MultiGetResponseMessage:
+		ret, err = p.readMultiGetResponse(msg)
+	case transport.TxResponseMessage:
+		ret, err = p.readTxResponse(msg)
 	case transport.PingResponseMessage:
 		ret, err = p.readPingResponse(msg)
 	default:
@@ -129,6 +177,14 @@ func (BsonProtocol) WriteMessage(v interface{}) (msg transport.Message, err erro
 		return newMessage(v, transport.UpdateMessage)
 	case query.DelQuery:
 		return newMessage(v, transport.DelMessage)
+	case query.ExplainQuery:
+		return newMessage(v, transport.ExplainMessage)
+	case query.CountQuery:
+		return newMessage(v, transport.CountMessage)
+	case query.MultiGetQuery:
+		return newMessage(v, transport.MultiGetMessage)
+	case query.TxQuery:
+		return newMessage(v, transport.TxMessage)
 	case query.PingQuery:
 		return newMessage(v, transport.PingMessage)
 	case query.PutResponse:
@@ -139,6 +195,14 @@ func (BsonProtocol) WriteMessage(v interface{}) (msg transport.Message, err erro
 		return newMessage(v, transport.UpdateResponseMessage)
 	case query.DelResponse:
 		return newMessage(v, transport.DelResponseMessage)
+	case query.ExplainResponse:
+		return newMessage(v, transport.ExplainResponseMessage)
+	case query.CountResponse:
+		return newMessage(v, transport.CountResponseMessage)
+	case query.MultiGetResponse:
+		return newMessage(v, transport.MultiGetResponseMessage)
+	case query.TxResponse:
+		return newMessage(v, transport.TxResponseMessage)
 	case query.PingResponse:
 		return newMessage(v, transport.PingResponseMessage)
 	}
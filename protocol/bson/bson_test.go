@@ -72,6 +72,16 @@ func TestBson(t *testing.T) {
 		{*query.NewUpdateResponse(nil, 0), transport.UpdateResponseMessage},
 		{*query.NewPutResponse(nil, "foo", "bar"), transport.PutResponseMessage},
 		{*query.NewDelResponse(nil, 10), transport.DelResponseMessage},
+		{*query.NewExplainQuery("Users").Filter("name", query.Eq, "User 0").OrderBy("name", query.DESC), transport.ExplainMessage},
+		{*query.NewExplainResponse(nil), transport.ExplainResponseMessage},
+		{*query.NewCountQuery("Users").Where("name", query.Prefix, "User"), transport.CountMessage},
+		{*query.NewCountResponse(nil, 3), transport.CountResponseMessage},
+		{*query.NewTxQuery().Put(query.NewPutQuery("foo").AddEntity(*schema.NewEntity("bar", schema.NewText("foo", "bar")))).
+			Del(query.NewDelQuery("foo").Where("name", query.Eq, "User 0")), transport.TxMessage},
+		{*query.NewTxResponse(nil), transport.TxResponseMessage},
+		{*query.NewMultiGetQuery(*query.NewGetQuery("Users").FilterEq("id", "foo")).
+			Add(query.NewGetQuery("Apps").FilterEq("id", "bar")), transport.MultiGetMessage},
+		{*query.NewMultiGetResponse(nil, 0), transport.MultiGetResponseMessage},
 	}
 
 	for _, x := range testables {
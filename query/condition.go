@@ -0,0 +1,34 @@
+package query
+
+import (
+	"github.com/EverythingMe/meduza/errors"
+	"github.com/EverythingMe/meduza/schema"
+)
+
+// Condition is a precondition on the current state of an entity, checked by the server atomically with a write.
+// If it does not hold, the write is rejected with errors.ConflictError.
+//
+// The condition holds if the entity's property equals Value. A nil Value means the property must not be set.
+// The schema.VersionKey property is the entity's version, which is 0 for entities that do not exist
+type Condition struct {
+	Property string      `bson:"property"`
+	Value    interface{} `bson:"value"`
+}
+
+// IfVersion returns a condition that holds only if the entity's current version is the given version
+func IfVersion(version int64) Condition {
+	return Condition{schema.VersionKey, schema.Int(version)}
+}
+
+// IfEquals returns a condition that holds only if the entity's property currently equals value
+func IfEquals(prop string, value interface{}) Condition {
+	return Condition{prop, internal(value)}
+}
+
+// Validate makes sure the condition has a property to check
+func (c Condition) Validate() error {
+	if c.Property == "" {
+		return errors.NewError("No property name for condition")
+	}
+	return nil
+}
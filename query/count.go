@@ -0,0 +1,69 @@
+package query
+
+import "github.com/EverythingMe/meduza/errors"
+
+// CountQuery asks the driver for the number of entities matching a selection, without loading them
+type CountQuery struct {
+	Table   string  `bson:"table"`
+	Filters Filters `bson:"filters"`
+	// Expression is an optional boolean filter expression, AND-ed with Filters
+	Expression Expression `bson:"expression"`
+}
+
+// NewCountQuery creates a new COUNT query for the given table
+func NewCountQuery(table string) *CountQuery {
+	return &CountQuery{
+		Table:   table,
+		Filters: make(Filters),
+	}
+}
+
+// Validate makes sure the query has a table and sane filters
+func (q CountQuery) Validate() error {
+	if q.Table == "" {
+		return errors.NewError("No table for COUNT query")
+	}
+
+	if len(q.Filters) == 0 && q.Expression.IsEmpty() {
+		return errors.NewError("No filters for COUNT query")
+	}
+
+	for _, f := range q.Filters {
+		if err := f.Validate(); err != nil {
+			return err
+		}
+	}
+
+	if !q.Expression.IsEmpty() {
+		if err := q.Expression.Validate(); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Where adds a selection filter to the query. Returns the query itself for builder-style syntax
+func (q *CountQuery) Where(prop string, operator string, values ...interface{}) *CountQuery {
+	q.Filters[prop] = NewFilter(prop, operator, values...)
+	return q
+}
+
+// WhereExpr adds a boolean filter expression to the selection, AND-ed with the other filters and expressions
+func (q *CountQuery) WhereExpr(expr Expression) *CountQuery {
+	q.Expression = q.Expression.and(expr)
+	return q
+}
+
+// CountResponse represents a response to a COUNT query, with the number of entities matching the selection
+type CountResponse struct {
+	*Response
+	Num int `bson:"num"`
+}
+
+// NewCountResponse creates a new response to a COUNT query with the given error and count
+func NewCountResponse(err error, num int) *CountResponse {
+	return &CountResponse{
+		NewResponse(err),
+		num,
+	}
+}
@@ -1,11 +1,20 @@
 package query
 
-import "github.com/EverythingMe/meduza/errors"
+import (
+	"github.com/EverythingMe/meduza/errors"
+	"github.com/EverythingMe/meduza/schema"
+)
 
 // DelQuery represents a DEL request handled by the appropriate driver
 type DelQuery struct {
 	Table   string  `bson:"table"`
 	Filters Filters `bson:"filters"`
+	// Expression is an optional boolean filter expression, AND-ed with Filters
+	Expression Expression `bson:"expression"`
+	// Returning asks for the deleted entities, as they were before being deleted, in the response
+	Returning bool `bson:"returning"`
+	// ReturnProperties limits the returned entities to these properties. If empty, all properties are returned
+	ReturnProperties []string `bson:"returnProperties"`
 }
 
 // NewDelQuery creates a new query object for a given table
@@ -27,6 +36,12 @@ func (q DelQuery) Validate() error {
 			return err
 		}
 	}
+
+	if !q.Expression.IsEmpty() {
+		if err := q.Expression.Validate(); err != nil {
+			return err
+		}
+	}
 	return nil
 }
 
@@ -37,18 +52,74 @@ func (q *DelQuery) Where(prop string, operator string, values ...interface{}) *D
 	return q
 }
 
+// WhereNe selects entities whose property is not equal to value
+func (q *DelQuery) WhereNe(prop string, value interface{}) *DelQuery {
+	q.Filters[prop] = NotEquals(prop, value)
+	return q
+}
+
+// WhereGt selects entities whose property is greater than value
+func (q *DelQuery) WhereGt(prop string, value interface{}) *DelQuery {
+	q.Filters[prop] = GreaterThan(prop, value)
+	return q
+}
+
+// WhereGte selects entities whose property is greater than or equal to value
+func (q *DelQuery) WhereGte(prop string, value interface{}) *DelQuery {
+	q.Filters[prop] = GreaterOrEqual(prop, value)
+	return q
+}
+
+// WhereLt selects entities whose property is less than value
+func (q *DelQuery) WhereLt(prop string, value interface{}) *DelQuery {
+	q.Filters[prop] = LessThan(prop, value)
+	return q
+}
+
+// WhereLte selects entities whose property is less than or equal to value
+func (q *DelQuery) WhereLte(prop string, value interface{}) *DelQuery {
+	q.Filters[prop] = LessOrEqual(prop, value)
+	return q
+}
+
+// WherePrefix selects entities whose text property starts with prefix
+func (q *DelQuery) WherePrefix(prop string, prefix string) *DelQuery {
+	q.Filters[prop] = StartsWith(prop, prefix)
+	return q
+}
+
+// WhereExpr adds a boolean filter expression to the selection, AND-ed with the other filters and expressions
+func (q *DelQuery) WhereExpr(expr Expression) *DelQuery {
+	q.Expression = q.Expression.and(expr)
+	return q
+}
+
+// Return asks for the deleted entities in the response, limited to the given properties if any are given
+func (q *DelQuery) Return(properties ...string) *DelQuery {
+	q.Returning = true
+	q.ReturnProperties = properties
+	return q
+}
+
 // DelResponse represents a response to a DEL query over the protocol, with the usual resonse
 // properties, and the number of objects deleted
 type DelResponse struct {
 	*Response
 	Num int `bson:"num"`
+	// Entities are the deleted entities, if the query asked for them
+	Entities []schema.Entity `bson:"entities"`
 }
 
 // NewDelResponse creates a new response to be returned by the protocol with the given error and
 // number of objects deleted
 func NewDelResponse(err error, num int) *DelResponse {
 	return &DelResponse{
-		NewResponse(err),
-		num,
+		Response: NewResponse(err),
+		Num:      num,
 	}
 }
+
+// MapEntities maps the returned entities into a pointer to a slice of model objects, or to a single model object
+func (r DelResponse) MapEntities(dst interface{}) error {
+	return mapEntities(r.Entities, dst)
+}
@@ -0,0 +1,116 @@
+package query
+
+import "github.com/EverythingMe/meduza/errors"
+
+// ExplainQuery asks the driver how it would select the entities matching a set of filters and an ordering,
+// without actually selecting them. It is used for debugging index selection
+type ExplainQuery struct {
+	Table   string   `bson:"table"`
+	Filters Filters  `bson:"filters"`
+	Order   Ordering `bson:"order"`
+}
+
+// NewExplainQuery creates a new EXPLAIN query for the given table
+func NewExplainQuery(table string) *ExplainQuery {
+	return &ExplainQuery{
+		Table:   table,
+		Filters: make(Filters),
+		Order:   Ordering{Ascending: true},
+	}
+}
+
+// Validate makes sure the query has a table and sane filters
+func (q ExplainQuery) Validate() error {
+	if q.Table == "" {
+		return errors.NewError("No table for EXPLAIN query")
+	}
+
+	if len(q.Filters) == 0 {
+		return errors.NewError("No filters for EXPLAIN query")
+	}
+
+	for _, f := range q.Filters {
+		if err := f.Validate(); err != nil {
+			return err
+		}
+	}
+
+	return q.Order.Validate()
+}
+
+// Filter adds a filter to the explained selection. Returns the query itself for builder-style syntax
+func (q *ExplainQuery) Filter(prop, op string, values ...interface{}) *ExplainQuery {
+	q.Filters[prop] = NewFilter(prop, op, values...)
+	return q
+}
+
+// OrderBy sets the ordering of the explained selection
+func (q *ExplainQuery) OrderBy(prop string, mode SortMode) *ExplainQuery {
+	q.Order = Ordering{
+		By:        prop,
+		Ascending: mode != DESC,
+	}
+	return q
+}
+
+// Strategies for answering a selection, as reported by EXPLAIN
+const (
+	// the selection is answered by the primary index
+	PlanPrimary = "PRIMARY"
+	// the selection is answered by a single secondary index
+	PlanIndex = "INDEX"
+	// the selection is answered by intersecting the results of several indexes
+	PlanIntersect = "INTERSECT"
+	// no index can answer the selection, and it will fail
+	PlanNone = "NONE"
+)
+
+// IndexCandidate describes how an index of the table matched the explained selection
+type IndexCandidate struct {
+	Index      string   `bson:"index"`
+	Type       string   `bson:"type"`
+	Properties []string `bson:"properties"`
+	// Matched is true if the index can answer all the filters and the ordering on its own
+	Matched bool    `bson:"matched"`
+	Score   float32 `bson:"score"`
+	// Cost is the estimated number of ids the index reads for the filters it covers, or -1 if it can't be estimated
+	Cost float64 `bson:"cost"`
+	// Covers are the filtered properties the index could answer as part of an intersection
+	Covers []string `bson:"covers"`
+	// Reason explains why the index did not match
+	Reason string `bson:"reason"`
+}
+
+// IndexScan describes a single redis command the driver will issue to read ids from an index.
+// Min and Max are the range bounds for ZRANGEBYLEX and ZRANGEBYSCORE scans, and empty otherwise
+type IndexScan struct {
+	Index   string `bson:"index"`
+	Command string `bson:"command"`
+	Key     string `bson:"key"`
+	Min     string `bson:"min"`
+	Max     string `bson:"max"`
+}
+
+// ExplainResponse describes the plan for a selection: the candidate indexes and their scores, the chosen index
+// (or indexes, when intersecting), the scans it will perform, and the estimated number of matching entities
+type ExplainResponse struct {
+	*Response
+	Plan       string           `bson:"plan"`
+	Candidates []IndexCandidate `bson:"candidates"`
+	// Chosen are the names of the indexes the selection will use
+	Chosen []string    `bson:"chosen"`
+	Scans  []IndexScan `bson:"scans"`
+	// Cardinality is the estimated number of matching entities, or -1 if the chosen indexes have no statistics yet
+	Cardinality int `bson:"cardinality"`
+}
+
+// NewExplainResponse creates a new, empty response for an EXPLAIN query
+func NewExplainResponse(err error) *ExplainResponse {
+	return &ExplainResponse{
+		Response:   NewResponse(err),
+		Plan:       PlanNone,
+		Candidates: make([]IndexCandidate, 0),
+		Chosen:     make([]string, 0),
+		Scans:      make([]IndexScan, 0),
+	}
+}
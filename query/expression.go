@@ -0,0 +1,152 @@
+package query
+
+import (
+	"fmt"
+	"strings"
+
+	"github.com/EverythingMe/meduza/errors"
+)
+
+// Expression node types
+const (
+	ExprAnd = "AND"
+	ExprOr  = "OR"
+	ExprNot = "NOT"
+)
+
+// Expression is a boolean filter expression tree. Inner nodes combine their children with AND, OR or NOT,
+// and leaves (nodes with no operator) hold a single filter.
+//
+// Expressions complement the Filters map of queries, which can hold just one filter per property, and are always
+// AND-ed. If a query has both filters and an expression, the entities selected must match both
+type Expression struct {
+	Op       string       `bson:"op"`
+	Filter   Filter       `bson:"filter"`
+	Children []Expression `bson:"children"`
+}
+
+// Cond creates a leaf expression from a single filter
+func Cond(f Filter) Expression {
+	return Expression{Filter: f}
+}
+
+// And creates an expression matching entities that match all the given expressions
+func And(exprs ...Expression) Expression {
+	return Expression{Op: ExprAnd, Children: exprs}
+}
+
+// Or creates an expression matching entities that match any of the given expressions
+func Or(exprs ...Expression) Expression {
+	return Expression{Op: ExprOr, Children: exprs}
+}
+
+// Not creates an expression matching entities that do not match the given expression
+func Not(expr Expression) Expression {
+	return Expression{Op: ExprNot, Children: []Expression{expr}}
+}
+
+// IsEmpty returns true if the expression is not set. Queries from older clients will have empty expressions
+func (e Expression) IsEmpty() bool {
+	return e.Op == "" && e.Filter.Property == "" && len(e.Children) == 0
+}
+
+// IsLeaf returns true if the expression is a single filter
+func (e Expression) IsLeaf() bool {
+	return e.Op == ""
+}
+
+// and combines the expression with another one, returning the other one if we are empty
+func (e Expression) and(other Expression) Expression {
+	if e.IsEmpty() {
+		return other
+	}
+	if e.Op == ExprAnd {
+		return And(append(e.Children[:len(e.Children):len(e.Children)], other)...)
+	}
+	return And(e, other)
+}
+
+// Filters returns the expression as a filters map if it is a single filter or an AND of filters on distinct
+// properties, so it can be answered by a single index. Otherwise it returns false. An empty expression is an empty
+// filters map
+func (e Expression) Filters() (Filters, bool) {
+
+	if e.IsEmpty() {
+		return Filters{}, true
+	}
+
+	if e.IsLeaf() {
+		return NewFilters(e.Filter), true
+	}
+
+	if e.Op != ExprAnd {
+		return nil, false
+	}
+
+	ret := make(Filters, len(e.Children))
+	for _, c := range e.Children {
+		if !c.IsLeaf() {
+			return nil, false
+		}
+		if _, found := ret[c.Filter.Property]; found {
+			return nil, false
+		}
+		ret[c.Filter.Property] = c.Filter
+	}
+	return ret, true
+}
+
+// Validate checks the expression tree and all its filters for validity
+func (e Expression) Validate() error {
+
+	switch e.Op {
+	case "":
+		if len(e.Children) > 0 {
+			return errors.NewError("Filter expressions cannot have children")
+		}
+		return e.Filter.Validate()
+	case ExprAnd, ExprOr:
+		if len(e.Children) == 0 {
+			return errors.NewError("%s expressions must have at least one child", e.Op)
+		}
+	case ExprNot:
+		if len(e.Children) != 1 {
+			return errors.NewError("NOT expressions must have exactly one child, %d given", len(e.Children))
+		}
+	default:
+		return errors.NewError("Unsupported expression operator: '%s'", e.Op)
+	}
+
+	for _, c := range e.Children {
+		if err := c.Validate(); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (e Expression) String() string {
+
+	if e.IsLeaf() {
+		return fmt.Sprintf("%s %s %v", e.Filter.Property, e.Filter.Operator, e.Filter.Values)
+	}
+
+	children := make([]string, len(e.Children))
+	for i, c := range e.Children {
+		children[i] = c.String()
+	}
+	return fmt.Sprintf("%s(%s)", e.Op, strings.Join(children, ", "))
+}
+
+// Selection returns a single expression for a filters map and an expression, that matches entities matching both
+func Selection(filters Filters, expr Expression) Expression {
+
+	ret := Expression{}
+	for _, f := range filters {
+		ret = ret.and(Cond(f))
+	}
+	if !expr.IsEmpty() {
+		ret = ret.and(expr)
+	}
+	return ret
+}
@@ -11,10 +11,21 @@ import (
 const (
 	In      = "IN"
 	Eq      = "="
+	Ne      = "!="
 	Gt      = ">"
+	Gte     = ">="
 	Lt      = "<"
+	Lte     = "<="
 	Between = "><"
+	Prefix  = "PREFIX"
 	All     = "ALL"
+
+	// Geo operators, used on geo indexes only. The filter's property is the latitude column of the index
+	Near      = "NEAR"
+	WithinBox = "WITHIN_BOX"
+
+	// Full text operator, used on full text indexes only. The filter's property is the first column of the index
+	Match = "MATCH"
 )
 
 type Filter struct {
@@ -63,6 +74,54 @@ func Within(property string, values ...interface{}) Filter {
 	return NewFilter(property, In, values...)
 }
 
+// NotEquals creates a filter selecting entities whose property is not equal to value
+func NotEquals(property string, value interface{}) Filter {
+	return NewFilter(property, Ne, value)
+}
+
+// GreaterThan creates a filter selecting entities whose property is greater than value
+func GreaterThan(property string, value interface{}) Filter {
+	return NewFilter(property, Gt, value)
+}
+
+// GreaterOrEqual creates a filter selecting entities whose property is greater than or equal to value
+func GreaterOrEqual(property string, value interface{}) Filter {
+	return NewFilter(property, Gte, value)
+}
+
+// LessThan creates a filter selecting entities whose property is less than value
+func LessThan(property string, value interface{}) Filter {
+	return NewFilter(property, Lt, value)
+}
+
+// LessOrEqual creates a filter selecting entities whose property is less than or equal to value
+func LessOrEqual(property string, value interface{}) Filter {
+	return NewFilter(property, Lte, value)
+}
+
+// StartsWith creates a filter selecting entities whose text property starts with prefix
+func StartsWith(property string, prefix string) Filter {
+	return NewFilter(property, Prefix, prefix)
+}
+
+// NearPoint creates a geo filter selecting entities within radius meters of the point (lat, lon).
+// property is the latitude column of a geo index. Results are ordered by distance from the point
+func NearPoint(property string, lat, lon, radius float64) Filter {
+	return NewFilter(property, Near, lat, lon, radius)
+}
+
+// InBox creates a geo filter selecting entities inside the bounding box defined by its south-west
+// (minLat, minLon) and north-east (maxLat, maxLon) corners. Results are ordered by distance from the box's center
+func InBox(property string, minLat, minLon, maxLat, maxLon float64) Filter {
+	return NewFilter(property, WithinBox, minLat, minLon, maxLat, maxLon)
+}
+
+// TextMatch creates a full text filter selecting entities containing all the terms in text.
+// property is the first column of a full text index. Results are ranked by term frequency
+func TextMatch(property, text string) Filter {
+	return NewFilter(property, Match, text)
+}
+
 // Fitlers is an abstraction over a map of filters for queries
 type Filters map[string]Filter
 
@@ -111,6 +170,19 @@ func (f Filter) Validate() error {
 		if len(f.Values) != 2 {
 			return errors.NewError("BETWEEN filters must have exactly 2 values, %d given", len(f.Values))
 		}
+	case Ne, Gt, Gte, Lt, Lte:
+		if len(f.Values) != 1 {
+			return errors.NewError("%s filters must have exactly one value, %d given", f.Operator, len(f.Values))
+		}
+	case Prefix:
+		if len(f.Values) != 1 {
+			return errors.NewError("PREFIX filters must have exactly one value, %d given", len(f.Values))
+		}
+		switch f.Values[0].(type) {
+		case schema.Text, string:
+		default:
+			return errors.NewError("PREFIX filters must have a text value")
+		}
 	case In:
 		if len(f.Values) < 1 {
 			return errors.NewError("IN filters must have at least one value")
@@ -119,6 +191,18 @@ func (f Filter) Validate() error {
 		if f.Property != schema.IdKey {
 			return errors.NewError("ALL is allowed only on primary keys")
 		}
+	case Near:
+		if len(f.Values) != 3 {
+			return errors.NewError("NEAR filters must have exactly 3 values (lat, lon, radius), %d given", len(f.Values))
+		}
+	case WithinBox:
+		if len(f.Values) != 4 {
+			return errors.NewError("WITHIN_BOX filters must have exactly 4 values (minLat, minLon, maxLat, maxLon), %d given", len(f.Values))
+		}
+	case Match:
+		if len(f.Values) < 1 {
+			return errors.NewError("MATCH filters must have at least one value")
+		}
 	default:
 		//TODO: Support more operators
 		return errors.NewError("Unsupported operator: '%s'", f.Operator)
@@ -18,8 +18,13 @@ type GetQuery struct {
 	Table      string   `bson:"table"`
 	Properties []string `bson:"properties"`
 	Filters    Filters  `bson:"filters"`
-	Order      Ordering `bson:"order"`
-	Paging     Paging   `bson:"paging"`
+	// Expression is an optional boolean filter expression, AND-ed with Filters
+	Expression Expression `bson:"expression"`
+	Order      Ordering   `bson:"order"`
+	Paging     Paging     `bson:"paging"`
+	// Cursor is an optional continuation token returned by a previous page of this query.
+	// If set, the query resumes right after the last result of that page, and Paging.Offset must be 0
+	Cursor string `bson:"cursor"`
 }
 
 // NewGetQuery creates a new GetQuery for the given table, with all the other prams.
@@ -50,7 +55,7 @@ func (q GetQuery) Validate() error {
 		return errors.NewError("No table for GET query")
 	}
 
-	if q.Filters == nil || len(q.Filters) == 0 {
+	if len(q.Filters) == 0 && q.Expression.IsEmpty() {
 		return errors.NewError("No filters for GET query")
 	}
 
@@ -60,10 +65,20 @@ func (q GetQuery) Validate() error {
 		}
 	}
 
+	if !q.Expression.IsEmpty() {
+		if err := q.Expression.Validate(); err != nil {
+			return err
+		}
+	}
+
 	if err := q.Paging.Validate(); err != nil {
 		return err
 	}
 
+	if q.Cursor != "" && q.Paging.Offset > 0 {
+		return errors.NewError("Cannot page by both offset and cursor")
+	}
+
 	if err := q.Order.Validate(); err != nil {
 		return err
 	}
@@ -94,6 +109,90 @@ func (q *GetQuery) FilterBetween(prop string, min, max interface{}) *GetQuery {
 	return q
 }
 
+// FilterNe adds a filter selecting entities whose property is not equal to value
+func (q *GetQuery) FilterNe(prop string, value interface{}) *GetQuery {
+
+	q.Filters[prop] = NotEquals(prop, value)
+
+	return q
+}
+
+// FilterGt adds a filter selecting entities whose property is greater than value
+func (q *GetQuery) FilterGt(prop string, value interface{}) *GetQuery {
+
+	q.Filters[prop] = GreaterThan(prop, value)
+
+	return q
+}
+
+// FilterGte adds a filter selecting entities whose property is greater than or equal to value
+func (q *GetQuery) FilterGte(prop string, value interface{}) *GetQuery {
+
+	q.Filters[prop] = GreaterOrEqual(prop, value)
+
+	return q
+}
+
+// FilterLt adds a filter selecting entities whose property is less than value
+func (q *GetQuery) FilterLt(prop string, value interface{}) *GetQuery {
+
+	q.Filters[prop] = LessThan(prop, value)
+
+	return q
+}
+
+// FilterLte adds a filter selecting entities whose property is less than or equal to value
+func (q *GetQuery) FilterLte(prop string, value interface{}) *GetQuery {
+
+	q.Filters[prop] = LessOrEqual(prop, value)
+
+	return q
+}
+
+// FilterPrefix adds a filter selecting entities whose text property starts with prefix
+func (q *GetQuery) FilterPrefix(prop string, prefix string) *GetQuery {
+
+	q.Filters[prop] = StartsWith(prop, prefix)
+
+	return q
+}
+
+// FilterNear adds a geo filter selecting entities within radius meters of (lat, lon), ordered by distance.
+// prop is the latitude column of a geo index
+func (q *GetQuery) FilterNear(prop string, lat, lon, radius float64) *GetQuery {
+
+	q.Filters[prop] = NearPoint(prop, lat, lon, radius)
+
+	return q
+}
+
+// FilterWithinBox adds a geo filter selecting entities inside a bounding box, ordered by distance from its center.
+// prop is the latitude column of a geo index
+func (q *GetQuery) FilterWithinBox(prop string, minLat, minLon, maxLat, maxLon float64) *GetQuery {
+
+	q.Filters[prop] = InBox(prop, minLat, minLon, maxLat, maxLon)
+
+	return q
+}
+
+// FilterMatch adds a full text filter selecting entities that contain all the terms in text, ranked by term frequency.
+// prop is the first column of a full text index
+func (q *GetQuery) FilterMatch(prop, text string) *GetQuery {
+
+	q.Filters[prop] = TextMatch(prop, text)
+
+	return q
+}
+
+// FilterExpr adds a boolean filter expression to the query, AND-ed with its other filters and expressions.
+// Use it for OR and NOT conditions, or for multiple conditions on the same property
+func (q *GetQuery) FilterExpr(expr Expression) *GetQuery {
+
+	q.Expression = q.Expression.and(expr)
+
+	return q
+}
+
 func (q *GetQuery) All() *GetQuery {
 
 	q.Filters[schema.IdKey] = NewFilter(schema.IdKey, All)
@@ -118,6 +217,16 @@ func (q *GetQuery) Page(offset, limit int) *GetQuery {
 	return q
 }
 
+// After makes the query resume right after the last result of a previous page, using the cursor returned with it.
+// The offset of the query is reset, as cursors replace it.
+// returns the query itself so it can be used in a building sequence.
+func (q *GetQuery) After(cursor string) *GetQuery {
+	q.Cursor = cursor
+	q.Paging.Offset = 0
+
+	return q
+}
+
 // Limit the GET query to a set of specific fields
 func (q *GetQuery) Fields(props ...string) *GetQuery {
 	q.Properties = props
@@ -197,6 +306,9 @@ type GetResponse struct {
 	Entities []schema.Entity `bson:"entities"`
 	// the total number of entities matching this response, regardless of how many entities we've retrived
 	Total int `bson:"total"`
+	// Cursor is an opaque token for getting the next page of results with GetQuery.After.
+	// It is empty if there are no more results
+	Cursor string `bson:"cursor"`
 }
 
 func NewGetResponseSize(err error, sizeHint int) *GetResponse {
@@ -215,8 +327,13 @@ func (r *GetResponse) AddEntity(e schema.Entity) {
 }
 
 func (r GetResponse) MapEntities(dst interface{}) error {
+	return mapEntities(r.Entities, dst)
+}
+
+// mapEntities maps entities into a pointer to a slice of model objects, or a pointer to a single model object
+func mapEntities(entities []schema.Entity, dst interface{}) error {
 
-	if len(r.Entities) == 0 {
+	if len(entities) == 0 {
 		return errors.EmptyResult
 	}
 	dv := reflect.ValueOf(dst)
@@ -231,22 +348,22 @@ func (r GetResponse) MapEntities(dst interface{}) error {
 
 		modelType = modelType.Elem()
 		dv = dv.Elem()
-		for _, ent := range r.Entities {
+		for _, ent := range entities {
 
 			obj := reflect.New(modelType).Interface()
 
 			if err := schema.DecodeEntity(ent, obj); err != nil {
-				return errors.NewError("Could not map entity %s: %s", ent, err)
+				return errors.NewError("Could not map entity %v: %s", ent, err)
 			}
 
 			dv.Set(reflect.Append(dv, reflect.ValueOf(obj).Elem()))
 
 		}
 	} else {
-		if len(r.Entities) != 1 {
+		if len(entities) != 1 {
 			return errors.NewError("Cannot load multiple entities into a single object, pass a slice please")
 		}
-		return schema.DecodeEntity(r.Entities[0], dst)
+		return schema.DecodeEntity(entities[0], dst)
 	}
 	return nil
 }
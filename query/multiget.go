@@ -0,0 +1,51 @@
+package query
+
+import "github.com/EverythingMe/meduza/errors"
+
+// MultiGetQuery carries several GET queries, possibly on different tables, to be executed in a single round trip
+type MultiGetQuery struct {
+	Queries []GetQuery `bson:"queries"`
+}
+
+// NewMultiGetQuery creates a new MULTIGET query with the given GET queries
+func NewMultiGetQuery(queries ...GetQuery) *MultiGetQuery {
+	return &MultiGetQuery{
+		Queries: queries,
+	}
+}
+
+// Add adds a GET query to the MULTIGET query. Returns the query itself for builder-style syntax
+func (q *MultiGetQuery) Add(g *GetQuery) *MultiGetQuery {
+	q.Queries = append(q.Queries, *g)
+	return q
+}
+
+// Validate makes sure the query has GET queries, and that they are all valid
+func (q MultiGetQuery) Validate() error {
+
+	if len(q.Queries) == 0 {
+		return errors.NewError("MULTIGET query has no queries")
+	}
+
+	for _, g := range q.Queries {
+		if err := g.Validate(); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// MultiGetResponse is the response to a MULTIGET query, with the responses to its GET queries matched to them
+// by position. The errors of the GET queries are in their own responses
+type MultiGetResponse struct {
+	*Response
+	Responses []GetResponse `bson:"responses"`
+}
+
+// NewMultiGetResponse creates a new response to a MULTIGET query with the given error, for num GET queries
+func NewMultiGetResponse(err error, num int) *MultiGetResponse {
+	return &MultiGetResponse{
+		Response:  NewResponse(err),
+		Responses: make([]GetResponse, num),
+	}
+}
@@ -5,9 +5,35 @@ import (
 	"github.com/EverythingMe/meduza/schema"
 )
 
+// PutMode decides how a PUT query treats entities that already exist
+type PutMode string
+
+const (
+	// Upsert inserts entities that do not exist and overwrites the ones that do. This is the default
+	Upsert PutMode = "UPSERT"
+	// InsertOnly rejects entities that already exist
+	InsertOnly PutMode = "INSERT"
+	// UpdateOnly rejects entities that do not exist
+	UpdateOnly PutMode = "UPDATE"
+)
+
+// PutOutcome is what happened to a single entity of a PUT query
+type PutOutcome string
+
+const (
+	OutcomeCreated  PutOutcome = "CREATED"
+	OutcomeUpdated  PutOutcome = "UPDATED"
+	OutcomeRejected PutOutcome = "REJECTED"
+)
+
 type PutQuery struct {
 	Table    string          `bson:"table"`
 	Entities []schema.Entity `bson:"entities"`
+	// Conditions are optional preconditions for writing each entity, matched to Entities by position.
+	// If any entity does not meet its conditions, none of the entities are written
+	Conditions [][]Condition `bson:"conditions"`
+	// Mode is the query's PutMode. Empty means Upsert
+	Mode PutMode `bson:"mode"`
 }
 
 func NewPutQuerySize(table string, capacity int) *PutQuery {
@@ -36,6 +62,23 @@ func (q PutQuery) Validate() error {
 		}
 	}
 
+	switch q.Mode {
+	case "", Upsert, InsertOnly, UpdateOnly:
+	default:
+		return errors.NewError("Invalid PUT mode %s", q.Mode)
+	}
+
+	if len(q.Conditions) > len(q.Entities) {
+		return errors.NewError("PUT query has more conditions than entities")
+	}
+	for _, conds := range q.Conditions {
+		for _, c := range conds {
+			if err := c.Validate(); err != nil {
+				return err
+			}
+		}
+	}
+
 	return nil
 }
 
@@ -44,14 +87,40 @@ func (q *PutQuery) AddEntity(e schema.Entity) *PutQuery {
 	return q
 }
 
+// WithMode sets the query's PutMode. Returns the query itself for builder-style syntax
+func (q *PutQuery) WithMode(mode PutMode) *PutQuery {
+	q.Mode = mode
+	return q
+}
+
+// AddEntityIf adds an entity that will be written only if it meets the given conditions
+func (q *PutQuery) AddEntityIf(e schema.Entity, conditions ...Condition) *PutQuery {
+	for len(q.Conditions) < len(q.Entities) {
+		q.Conditions = append(q.Conditions, nil)
+	}
+	q.Entities = append(q.Entities, e)
+	q.Conditions = append(q.Conditions, conditions)
+	return q
+}
+
+// EntityConditions returns the conditions of the i-th entity of the query, if any
+func (q PutQuery) EntityConditions(i int) []Condition {
+	if i < len(q.Conditions) {
+		return q.Conditions[i]
+	}
+	return nil
+}
+
 type PutResponse struct {
 	*Response
 	Ids []schema.Key `bson:"ids"`
+	// Outcomes tell what happened to each entity, matched to Ids by position
+	Outcomes []PutOutcome `bson:"outcomes"`
 }
 
 func NewPutResponse(err error, ids ...schema.Key) *PutResponse {
 	return &PutResponse{
-		NewResponse(err),
-		ids,
+		Response: NewResponse(err),
+		Ids:      ids,
 	}
 }
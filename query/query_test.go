@@ -75,3 +75,65 @@ func TestResponseMappingSingle(t *testing.T) {
 		t.Error("Mapping many entities to a single object should have failed")
 	}
 }
+
+func TestExpressions(t *testing.T) {
+
+	// a conjunction of filters on distinct properties is a filters map
+	e := And(Cond(Equals("name", "foo")), Cond(GreaterThan("score", 3)))
+	if err := e.Validate(); err != nil {
+		t.Error(err)
+	}
+	if filters, ok := e.Filters(); !ok || len(filters) != 2 {
+		t.Errorf("Expression %s should have been converted to filters", e)
+	}
+
+	// but two filters on the same property are not
+	e = And(Cond(GreaterThan("score", 3)), Cond(LessThan("score", 10)))
+	if _, ok := e.Filters(); ok {
+		t.Errorf("Expression %s should not have been converted to filters", e)
+	}
+
+	e = Or(Cond(Equals("name", "foo")), Not(Cond(Equals("name", "bar"))))
+	if err := e.Validate(); err != nil {
+		t.Error(err)
+	}
+	if _, ok := e.Filters(); ok {
+		t.Errorf("Expression %s should not have been converted to filters", e)
+	}
+
+	// invalid expressions
+	for _, bad := range []Expression{
+		Or(),
+		{Op: ExprNot, Children: []Expression{Cond(Equals("a", 1)), Cond(Equals("b", 2))}},
+		{Op: "XOR", Children: []Expression{Cond(Equals("a", 1))}},
+		And(Cond(Filter{Property: "a", Operator: Eq})),
+	} {
+		if err := bad.Validate(); err == nil {
+			t.Errorf("Expression %s should not have validated", bad)
+		}
+	}
+
+	// selections combine the filters and the expression of queries
+	q := NewGetQuery("users").FilterEq("name", "foo").FilterExpr(e)
+	if err := q.Validate(); err != nil {
+		t.Error(err)
+	}
+	sel := Selection(q.Filters, q.Expression)
+	if sel.Op != ExprAnd || len(sel.Children) != 2 {
+		t.Errorf("Unexpected selection %s", sel)
+	}
+
+	// queries from older clients have no expressions
+	sel = Selection(NewFilters(Equals("name", "foo")), Expression{})
+	if filters, ok := sel.Filters(); !ok || len(filters) != 1 {
+		t.Errorf("Unexpected selection %s", sel)
+	}
+
+	// a query with just an expression is valid
+	if err := NewDelQuery("users").WhereExpr(e).Validate(); err != nil {
+		t.Error(err)
+	}
+	if err := NewGetQuery("users").Validate(); err == nil {
+		t.Error("Query with no filters should not have validated")
+	}
+}
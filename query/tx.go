@@ -0,0 +1,139 @@
+package query
+
+import (
+	"strings"
+
+	"github.com/EverythingMe/meduza/errors"
+	"github.com/EverythingMe/meduza/schema"
+)
+
+// TxStatement is a single write of a transaction. Exactly one of its queries is set
+type TxStatement struct {
+	Put    *PutQuery    `bson:"put,omitempty"`
+	Update *UpdateQuery `bson:"update,omitempty"`
+	Del    *DelQuery    `bson:"del,omitempty"`
+}
+
+// Table returns the table the statement writes to
+func (s TxStatement) Table() string {
+	switch {
+	case s.Put != nil:
+		return s.Put.Table
+	case s.Update != nil:
+		return s.Update.Table
+	case s.Del != nil:
+		return s.Del.Table
+	}
+	return ""
+}
+
+// Validate makes sure the statement has exactly one valid query
+func (s TxStatement) Validate() error {
+
+	num := 0
+	var err error
+	if s.Put != nil {
+		num++
+		err = s.Put.Validate()
+	}
+	if s.Update != nil {
+		num++
+		if err = s.Update.Validate(); err == nil && s.Update.Returning {
+			err = errors.NewError("UPDATE statements in a transaction cannot return entities")
+		}
+	}
+	if s.Del != nil {
+		num++
+		if err = s.Del.Validate(); err == nil && s.Del.Returning {
+			err = errors.NewError("DEL statements in a transaction cannot return entities")
+		}
+	}
+
+	if num != 1 {
+		return errors.NewError("A transaction statement must have exactly one query, got %d", num)
+	}
+	return err
+}
+
+// TxQuery is a multi statement transaction - a list of PUT, UPDATE and DEL queries on tables of the same schema,
+// that are applied atomically. Either all of the statements are applied, or none of them are
+type TxQuery struct {
+	Statements []TxStatement `bson:"statements"`
+}
+
+// NewTxQuery creates a new empty transaction
+func NewTxQuery() *TxQuery {
+	return &TxQuery{
+		Statements: make([]TxStatement, 0),
+	}
+}
+
+// Put adds a PUT query to the transaction. Returns the query itself for builder-style syntax
+func (q *TxQuery) Put(p *PutQuery) *TxQuery {
+	q.Statements = append(q.Statements, TxStatement{Put: p})
+	return q
+}
+
+// Update adds an UPDATE query to the transaction. Returns the query itself for builder-style syntax
+func (q *TxQuery) Update(u *UpdateQuery) *TxQuery {
+	q.Statements = append(q.Statements, TxStatement{Update: u})
+	return q
+}
+
+// Del adds a DEL query to the transaction. Returns the query itself for builder-style syntax
+func (q *TxQuery) Del(d *DelQuery) *TxQuery {
+	q.Statements = append(q.Statements, TxStatement{Del: d})
+	return q
+}
+
+// Validate makes sure the transaction has statements, that they are all valid, and that all their tables belong
+// to the same schema
+func (q TxQuery) Validate() error {
+
+	if len(q.Statements) == 0 {
+		return errors.NewError("TX query has no statements")
+	}
+
+	schemaName := ""
+	for i, s := range q.Statements {
+		if err := s.Validate(); err != nil {
+			return err
+		}
+
+		// tables are qualified by their schema's name
+		name := s.Table()
+		if n := strings.Index(name, "."); n > 0 {
+			name = name[:n]
+		}
+		if i == 0 {
+			schemaName = name
+		} else if name != schemaName {
+			return errors.NewError("All the tables of a transaction must be in the same schema, got %s and %s",
+				schemaName, name)
+		}
+	}
+
+	return nil
+}
+
+// TxResult is the result of a single transaction statement
+type TxResult struct {
+	// Ids and Outcomes are the ids and outcomes of PUT statements' entities
+	Ids      []schema.Key `bson:"ids"`
+	Outcomes []PutOutcome `bson:"outcomes"`
+	// Num is the number of entities selected by UPDATE and DEL statements
+	Num int `bson:"num"`
+}
+
+// TxResponse is the response to a TX query, with the results of its statements matched to them by position
+type TxResponse struct {
+	*Response
+	Results []TxResult `bson:"results"`
+}
+
+// NewTxResponse creates a new response to a TX query with the given error
+func NewTxResponse(err error) *TxResponse {
+	return &TxResponse{
+		Response: NewResponse(err),
+	}
+}
@@ -21,6 +21,13 @@ const (
 	OpSetDel    ChangeOp = "SDEL"
 	OpMapSet    ChangeOp = "MSET"
 	OpMapDel    ChangeOp = "MDEL"
+	// List ops - append and prepend elements, remove all occurrences of values, trim to a number of elements,
+	// and set the element at an index
+	OpListAppend  ChangeOp = "LAPPEND"
+	OpListPrepend ChangeOp = "LPREPEND"
+	OpListRemove  ChangeOp = "LREM"
+	OpListTrim    ChangeOp = "LTRIM"
+	OpListSetAt   ChangeOp = "LSET"
 	// Delete a single property of an entity
 	OpPropDel ChangeOp = "PDEL"
 	// noop is a special internal OP that is used for reindexing entities.
@@ -44,6 +51,10 @@ func (c Change) Validate() error {
 
 	switch c.Op {
 	case OpSet, OpDel, OpIncrement, OpExpire, OpPropDel:
+	case OpSetAdd, OpSetDel, OpMapSet, OpMapDel, OpListAppend, OpListPrepend, OpListRemove, OpListTrim, OpListSetAt:
+		if c.Value == nil {
+			return errors.NewError("No value for %s change of %s", c.Op, c.Property)
+		}
 	default:
 		return errors.NewError("Change Op %s still not supported", c.Op)
 	}
@@ -75,11 +86,70 @@ func Expire(ttl time.Duration) Change {
 	return Change{"", ttl, OpExpire}
 }
 
+// SetAdd returns a new SADD change, adding elements to a Set property
+func SetAdd(prop string, elements ...interface{}) Change {
+	return Change{prop, schema.NewList(elements...), OpSetAdd}
+}
+
+// SetDel returns a new SDEL change, removing elements from a Set property
+func SetDel(prop string, elements ...interface{}) Change {
+	return Change{prop, schema.NewList(elements...), OpSetDel}
+}
+
+// MapSet returns a new MSET change, setting a single key of a Map property
+func MapSet(prop string, key string, value interface{}) Change {
+	return Change{prop, schema.NewMap().Set(key, value), OpMapSet}
+}
+
+// MapDel returns a new MDEL change, deleting keys from a Map property
+func MapDel(prop string, keys ...string) Change {
+	lst := make([]interface{}, len(keys))
+	for i := range keys {
+		lst[i] = keys[i]
+	}
+	return Change{prop, schema.NewList(lst...), OpMapDel}
+}
+
+// ListAppend returns a new LAPPEND change, appending elements to the end of a List property
+func ListAppend(prop string, elements ...interface{}) Change {
+	return Change{prop, schema.NewList(elements...), OpListAppend}
+}
+
+// ListPrepend returns a new LPREPEND change, inserting elements at the beginning of a List property, in the given order
+func ListPrepend(prop string, elements ...interface{}) Change {
+	return Change{prop, schema.NewList(elements...), OpListPrepend}
+}
+
+// ListRemove returns a new LREM change, removing all the occurrences of values from a List property
+func ListRemove(prop string, values ...interface{}) Change {
+	return Change{prop, schema.NewList(values...), OpListRemove}
+}
+
+// ListTrim returns a new LTRIM change, keeping only the first n elements of a List property, or the last -n
+// elements if n is negative
+func ListTrim(prop string, n int) Change {
+	return Change{prop, internal(n), OpListTrim}
+}
+
+// ListSetAt returns a new LSET change, replacing the element at an index of a List property. Negative indexes
+// count from the end of the list
+func ListSetAt(prop string, index int, value interface{}) Change {
+	return Change{prop, schema.NewList(index, value), OpListSetAt}
+}
+
 // UpdateQuery represents an UPDATE request sent to the server and processed by the relevant driver
 type UpdateQuery struct {
-	Table   string   `bson:"table"`
-	Filters Filters  `bson:"filters"`
-	Changes []Change `bson:"changes"`
+	Table   string  `bson:"table"`
+	Filters Filters `bson:"filters"`
+	// Expression is an optional boolean filter expression, AND-ed with Filters
+	Expression Expression `bson:"expression"`
+	Changes    []Change   `bson:"changes"`
+	// Conditions are optional preconditions that every selected entity must meet for the update to be applied
+	Conditions []Condition `bson:"conditions"`
+	// Returning asks for the updated entities, with their values after the update, in the response
+	Returning bool `bson:"returning"`
+	// ReturnProperties limits the returned entities to these properties. If empty, all properties are returned
+	ReturnProperties []string `bson:"returnProperties"`
 }
 
 // UpdateResponse is used to send a response back to clients to an update query.
@@ -87,6 +157,8 @@ type UpdateQuery struct {
 type UpdateResponse struct {
 	*Response
 	Num int `bson:"num"`
+	// Entities are the updated entities, if the query asked for them
+	Entities []schema.Entity `bson:"entities"`
 }
 
 // NewUpdateQuery initializes an update query for a given table
@@ -102,17 +174,64 @@ func NewUpdateQuery(table string) *UpdateQuery {
 // with a given error and the number of entities updated
 func NewUpdateResponse(err error, num int) *UpdateResponse {
 	return &UpdateResponse{
-		NewResponse(err),
-		num,
+		Response: NewResponse(err),
+		Num:      num,
 	}
 }
 
+// MapEntities maps the returned entities into a pointer to a slice of model objects, or to a single model object
+func (r UpdateResponse) MapEntities(dst interface{}) error {
+	return mapEntities(r.Entities, dst)
+}
+
 // Where adds a selection filter indicating what entities will be updated
 func (q *UpdateQuery) Where(prop string, operator string, values ...interface{}) *UpdateQuery {
 	q.Filters[prop] = NewFilter(prop, operator, values...)
 	return q
 }
 
+// WhereNe selects entities whose property is not equal to value
+func (q *UpdateQuery) WhereNe(prop string, value interface{}) *UpdateQuery {
+	q.Filters[prop] = NotEquals(prop, value)
+	return q
+}
+
+// WhereGt selects entities whose property is greater than value
+func (q *UpdateQuery) WhereGt(prop string, value interface{}) *UpdateQuery {
+	q.Filters[prop] = GreaterThan(prop, value)
+	return q
+}
+
+// WhereGte selects entities whose property is greater than or equal to value
+func (q *UpdateQuery) WhereGte(prop string, value interface{}) *UpdateQuery {
+	q.Filters[prop] = GreaterOrEqual(prop, value)
+	return q
+}
+
+// WhereLt selects entities whose property is less than value
+func (q *UpdateQuery) WhereLt(prop string, value interface{}) *UpdateQuery {
+	q.Filters[prop] = LessThan(prop, value)
+	return q
+}
+
+// WhereLte selects entities whose property is less than or equal to value
+func (q *UpdateQuery) WhereLte(prop string, value interface{}) *UpdateQuery {
+	q.Filters[prop] = LessOrEqual(prop, value)
+	return q
+}
+
+// WherePrefix selects entities whose text property starts with prefix
+func (q *UpdateQuery) WherePrefix(prop string, prefix string) *UpdateQuery {
+	q.Filters[prop] = StartsWith(prop, prefix)
+	return q
+}
+
+// WhereExpr adds a boolean filter expression to the selection, AND-ed with the other filters and expressions
+func (q *UpdateQuery) WhereExpr(expr Expression) *UpdateQuery {
+	q.Expression = q.Expression.and(expr)
+	return q
+}
+
 // WhereId creates a selection filter by primary ids
 func (q *UpdateQuery) WhereId(ids ...interface{}) *UpdateQuery {
 	return q.Where(schema.IdKey, In, ids...)
@@ -145,13 +264,82 @@ func (q *UpdateQuery) Expire(ttl time.Duration) *UpdateQuery {
 	return q
 }
 
+// SetAdd adds an SADD op change to the query's change set, adding elements to a Set property
+func (q *UpdateQuery) SetAdd(prop string, elements ...interface{}) *UpdateQuery {
+	q.Changes = append(q.Changes, SetAdd(prop, elements...))
+	return q
+}
+
+// SetDel adds an SDEL op change to the query's change set, removing elements from a Set property
+func (q *UpdateQuery) SetDel(prop string, elements ...interface{}) *UpdateQuery {
+	q.Changes = append(q.Changes, SetDel(prop, elements...))
+	return q
+}
+
+// MapSet adds an MSET op change to the query's change set, setting a single key of a Map property
+func (q *UpdateQuery) MapSet(prop string, key string, value interface{}) *UpdateQuery {
+	q.Changes = append(q.Changes, MapSet(prop, key, value))
+	return q
+}
+
+// MapDel adds an MDEL op change to the query's change set, deleting keys from a Map property
+func (q *UpdateQuery) MapDel(prop string, keys ...string) *UpdateQuery {
+	q.Changes = append(q.Changes, MapDel(prop, keys...))
+	return q
+}
+
+// ListAppend adds an LAPPEND op change to the query's change set, appending elements to a List property
+func (q *UpdateQuery) ListAppend(prop string, elements ...interface{}) *UpdateQuery {
+	q.Changes = append(q.Changes, ListAppend(prop, elements...))
+	return q
+}
+
+// ListPrepend adds an LPREPEND op change to the query's change set, inserting elements at the beginning of a List property
+func (q *UpdateQuery) ListPrepend(prop string, elements ...interface{}) *UpdateQuery {
+	q.Changes = append(q.Changes, ListPrepend(prop, elements...))
+	return q
+}
+
+// ListRemove adds an LREM op change to the query's change set, removing all the occurrences of values from a List property
+func (q *UpdateQuery) ListRemove(prop string, values ...interface{}) *UpdateQuery {
+	q.Changes = append(q.Changes, ListRemove(prop, values...))
+	return q
+}
+
+// ListTrim adds an LTRIM op change to the query's change set, keeping the first n elements of a List property,
+// or the last -n if n is negative
+func (q *UpdateQuery) ListTrim(prop string, n int) *UpdateQuery {
+	q.Changes = append(q.Changes, ListTrim(prop, n))
+	return q
+}
+
+// ListSetAt adds an LSET op change to the query's change set, replacing the element at an index of a List property
+func (q *UpdateQuery) ListSetAt(prop string, index int, value interface{}) *UpdateQuery {
+	q.Changes = append(q.Changes, ListSetAt(prop, index, value))
+	return q
+}
+
+// Return asks for the updated entities in the response, limited to the given properties if any are given
+func (q *UpdateQuery) Return(properties ...string) *UpdateQuery {
+	q.Returning = true
+	q.ReturnProperties = properties
+	return q
+}
+
+// If adds preconditions to the query. If any of the selected entities does not meet them, nothing is updated
+// and the query fails with errors.ConflictError
+func (q *UpdateQuery) If(conditions ...Condition) *UpdateQuery {
+	q.Conditions = append(q.Conditions, conditions...)
+	return q
+}
+
 // Validate tests the query's parameter for validity (not against a schema - just that they are sane).
 // If any problem is found it returns an error
 func (q *UpdateQuery) Validate() (err error) {
 	if q.Table == "" {
 		return errors.NewError("No table for PUT query")
 	}
-	if len(q.Filters) == 0 {
+	if len(q.Filters) == 0 && q.Expression.IsEmpty() {
 		return errors.NewError("No selection filters for Update query")
 	}
 	if len(q.Changes) == 0 {
@@ -164,11 +352,81 @@ func (q *UpdateQuery) Validate() (err error) {
 		}
 	}
 
+	if !q.Expression.IsEmpty() {
+		if err = q.Expression.Validate(); err != nil {
+			return
+		}
+	}
+
 	for _, c := range q.Changes {
 		if err = c.Validate(); err != nil {
 			return
 		}
 	}
 
+	for _, c := range q.Conditions {
+		if err = c.Validate(); err != nil {
+			return
+		}
+	}
+
 	return
 }
+
+// CheckSchema validates the changes of the query against the columns of a strict table: changed properties must be
+// columns of the table, SET values must be valid values of their columns (see schema.Table.CheckValue), increments
+// and collection changes must match the column's type, and required properties cannot be deleted.
+//
+// The returned error lists every violating property. Tables that are not strict accept any change
+func (q UpdateQuery) CheckSchema(t *schema.Table) error {
+
+	if !t.Strict {
+		return nil
+	}
+
+	vs := schema.Violations{}
+	for _, ch := range q.Changes {
+
+		switch ch.Op {
+		case OpDel, OpExpire, Noop:
+			continue
+		case OpSet:
+			t.CheckValue(ch.Property, ch.Value, &vs)
+			continue
+		}
+
+		col, found := t.Columns[ch.Property]
+		if !found {
+			vs.Add(ch.Property, "unknown property")
+			continue
+		}
+
+		var expected []schema.ColumnType
+		switch ch.Op {
+		case OpPropDel:
+			if col.Required() {
+				vs.Add(ch.Property, "required property cannot be deleted")
+			}
+		case OpIncrement:
+			expected = []schema.ColumnType{schema.IntType, schema.FloatType}
+		case OpSetAdd, OpSetDel:
+			expected = []schema.ColumnType{schema.SetType}
+		case OpMapSet, OpMapDel:
+			expected = []schema.ColumnType{schema.MapType}
+		case OpListAppend, OpListPrepend, OpListRemove, OpListTrim, OpListSetAt:
+			expected = []schema.ColumnType{schema.ListType}
+		}
+
+		if expected != nil {
+			matches := false
+			for _, tp := range expected {
+				matches = matches || col.Type == tp
+			}
+			if !matches {
+				vs.Add(ch.Property, "cannot perform %s on a %s column", ch.Op, col.Type)
+			}
+		}
+	}
+
+	return vs.Err(t.Name)
+}
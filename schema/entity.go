@@ -42,6 +42,8 @@ type Entity struct {
 	Id         Key           `bson:"id"`
 	Properties PropertyMap   `bson:"properties"`
 	TTL        time.Duration `bson:"ttl"`
+	// Version is the entity's version when it was loaded. It is ignored when writing entities
+	Version int64 `bson:"version"`
 }
 
 func (e Entity) Validate() error {
@@ -50,6 +52,9 @@ func (e Entity) Validate() error {
 		if k == "" {
 			return errors.NewError("Empty properties not allowed in entities")
 		}
+		if k == VersionKey {
+			return errors.NewError("Property %s is reserved for entity versions", VersionKey)
+		}
 
 		if v == nil {
 			continue
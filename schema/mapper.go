@@ -20,6 +20,7 @@ type structSpec struct {
 	fields      map[string]*fieldSpec
 	fieldsIndex []*fieldSpec
 	primary     *fieldSpec
+	version     *fieldSpec
 }
 
 var specs = map[reflect.Type]structSpec{}
@@ -29,6 +30,7 @@ type tag struct {
 	name         string
 	defaultValue string
 	primary      bool
+	version      bool
 }
 
 const (
@@ -56,6 +58,8 @@ func readTag(field reflect.StructField) tag {
 			switch s {
 			case "primary":
 				ret.primary = true
+			case "version":
+				ret.version = true
 			default:
 				logging.Warning("unknown field flag '" + s + "' in mapper")
 			}
@@ -108,6 +112,9 @@ func compileStructSpec(t reflect.Type) structSpec {
 				}
 
 				spec.primary = fspec
+			} else if tag.version {
+				// the version field is loaded from the entity's version and never written as a property
+				spec.version = fspec
 			} else {
 				spec.fieldsIndex[i] = fspec
 				spec.fields[tag.name] = fspec
@@ -155,6 +162,9 @@ func DecodeEntity(e Entity, dst interface{}) error {
 
 	primaryField := v.FieldByIndex(spec.primary.index)
 	primaryField.SetString(string(e.Id))
+	if spec.version != nil {
+		v.FieldByIndex(spec.version.index).SetInt(e.Version)
+	}
 	for k, p := range e.Properties {
 
 		if fspec, found := spec.fields[k]; found {
@@ -204,6 +214,25 @@ func SetPrimary(id Key, dst interface{}) error {
 	return nil
 }
 
+// SetVersion puts an entity version into a model object's version field, if it has one. dst must be a non nil
+// pointer to a struct for this to work
+func SetVersion(version int64, dst interface{}) error {
+	v := reflect.ValueOf(dst)
+	if v.Kind() != reflect.Ptr || v.IsNil() {
+		return errors.NewError("Cannot map a nil or non pointer type")
+	}
+	v = v.Elem()
+	t := v.Type()
+	if t.Kind() != reflect.Struct {
+		return errors.NewError("Mapping can only be done on structs")
+	}
+
+	if spec := spec(t); spec.version != nil {
+		v.FieldByIndex(spec.version.index).SetInt(version)
+	}
+	return nil
+}
+
 // EncodeStruct takes a model struct and encodes it into an entity.
 // The struct must have a primary field, and cannot be nil
 func EncodeStruct(src interface{}) (*Entity, error) {
@@ -238,7 +267,7 @@ func EncodeStruct(src interface{}) (*Entity, error) {
 
 		fspec := sp.fieldsIndex[i]
 
-		// skip ignored/primary field
+		// skip ignored/primary/version field
 		if fspec == nil {
 			continue
 		}
@@ -153,3 +153,35 @@ func TestDecoding(t *testing.T) {
 	}
 
 }
+
+type versionedModel struct {
+	Id      Key   `db:",primary"`
+	Version int64 `db:",version"`
+	Txt     Text  `db:"text"`
+}
+
+func TestVersionMapping(t *testing.T) {
+
+	ent := NewEntity("foo").Set("text", Text("bar"))
+	ent.Version = 3
+
+	m := &versionedModel{}
+	if err := DecodeEntity(*ent, m); err != nil {
+		t.Fatal("Could not decode entity: ", err)
+	}
+	if m.Version != 3 {
+		t.Errorf("Version not decoded, got %d", m.Version)
+	}
+
+	encoded, err := EncodeStruct(m)
+	if err != nil {
+		t.Fatal("Could not encode entity: ", err)
+	}
+	if len(encoded.Properties) != 1 {
+		t.Errorf("Version should not be encoded as a property, got %v", encoded.Properties)
+	}
+
+	if err := SetVersion(4, m); err != nil || m.Version != 4 {
+		t.Errorf("Could not set version: %v, %d", err, m.Version)
+	}
+}
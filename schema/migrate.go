@@ -0,0 +1,193 @@
+package schema
+
+import (
+	"math"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+	"unicode/utf8"
+
+	"github.com/EverythingMe/meduza/errors"
+)
+
+// When a column's type is changed or a column is renamed, the entities already stored keep their old values. Migrating
+// a table brings the stored properties of its entities in line with its columns - values of renamed columns are moved
+// to their new names, and values are converted to their column's type
+
+// ConvertValue converts a value to a column type. Numbers, booleans, texts and timestamps are converted to each other
+// where it makes sense, and sets and lists to each other. Floats are converted to integers only if they are whole
+// numbers, so no data is lost silently, and unsigned integers and floats only if they fit in a signed integer.
+// Texts are parsed when converted to numbers, booleans or timestamps
+func ConvertValue(v interface{}, tp ColumnType) (interface{}, error) {
+
+	v, err := InternalType(v)
+	if err != nil {
+		return nil, err
+	}
+	if v == nil || TypeOf(v) == tp {
+		return v, nil
+	}
+
+	switch tp {
+	case IntType:
+		switch val := v.(type) {
+		case Uint:
+			if val <= math.MaxInt64 {
+				return Int(val), nil
+			}
+		case Float:
+			if f := float64(val); f == math.Trunc(f) && f >= math.MinInt64 && f < math.MaxInt64 {
+				return Int(f), nil
+			}
+		case Bool:
+			if val {
+				return Int(1), nil
+			}
+			return Int(0), nil
+		case Timestamp:
+			return Int(time.Time(val).Unix()), nil
+		case Text:
+			if i, err := strconv.ParseInt(strings.TrimSpace(string(val)), 10, 64); err == nil {
+				return Int(i), nil
+			}
+		}
+
+	case FloatType:
+		switch val := v.(type) {
+		case Int:
+			return Float(val), nil
+		case Uint:
+			return Float(val), nil
+		case Text:
+			if f, err := strconv.ParseFloat(strings.TrimSpace(string(val)), 64); err == nil {
+				return Float(f), nil
+			}
+		}
+
+	case TextType:
+		switch val := v.(type) {
+		case Int:
+			return Text(strconv.FormatInt(int64(val), 10)), nil
+		case Uint:
+			return Text(strconv.FormatUint(uint64(val), 10)), nil
+		case Float:
+			return Text(strconv.FormatFloat(float64(val), 'f', -1, 64)), nil
+		case Bool:
+			return Text(strconv.FormatBool(bool(val))), nil
+		case Timestamp:
+			return Text(time.Time(val).UTC().Format(time.RFC3339)), nil
+		case Binary:
+			if utf8.Valid(val) {
+				return Text(val), nil
+			}
+		case Key:
+			return Text(val), nil
+		}
+
+	case BoolType:
+		switch val := v.(type) {
+		case Int:
+			return Bool(val != 0), nil
+		case Uint:
+			return Bool(val != 0), nil
+		case Text:
+			if b, err := strconv.ParseBool(strings.TrimSpace(string(val))); err == nil {
+				return Bool(b), nil
+			}
+		}
+
+	case TimestampType:
+		switch val := v.(type) {
+		case Int:
+			return Timestamp(time.Unix(int64(val), 0)), nil
+		case Uint:
+			if val <= math.MaxInt64 {
+				return Timestamp(time.Unix(int64(val), 0)), nil
+			}
+		case Text:
+			s := strings.TrimSpace(string(val))
+			if t, err := time.Parse(time.RFC3339, s); err == nil {
+				return Timestamp(t), nil
+			}
+			if i, err := strconv.ParseInt(s, 10, 64); err == nil {
+				return Timestamp(time.Unix(i, 0)), nil
+			}
+		}
+
+	case BinaryType:
+		switch val := v.(type) {
+		case Text:
+			return Binary(val), nil
+		}
+
+	case SetType:
+		switch val := v.(type) {
+		case List:
+			return NewSet(val...), nil
+		}
+
+	case ListType:
+		switch val := v.(type) {
+		case Set:
+			ret := make(List, 0, len(val))
+			for e := range val {
+				ret = append(ret, e)
+			}
+			return ret, nil
+		}
+	}
+
+	return nil, errors.NewError("Cannot convert %s %v to %s", typeName(v), v, tp)
+}
+
+// MigrateProperties returns the changes that bring the stored properties of an entity in line with the table's
+// columns: the properties to set, and the properties of renamed columns to delete. If an entity has values of both
+// the old and the new name of a column, the value of the new name is kept.
+//
+// Values that cannot be converted are left as they are, and their violations are added to vs
+func (t *Table) MigrateProperties(props PropertyMap, vs *Violations) (set PropertyMap, del []string) {
+
+	set = make(PropertyMap)
+	del = make([]string, 0)
+
+	columns := make([]string, 0, len(t.Columns))
+	for name := range t.Columns {
+		columns = append(columns, name)
+	}
+	sort.Strings(columns)
+
+	for _, name := range columns {
+		col := t.Columns[name]
+
+		v, found := props[name]
+		changed := false
+		if col.RenamedFrom != "" {
+			if old, oldFound := props[col.RenamedFrom]; oldFound {
+				if !found {
+					v, found, changed = old, true, true
+				}
+				del = append(del, col.RenamedFrom)
+			}
+		}
+
+		if !found || v == nil {
+			continue
+		}
+
+		if TypeOf(v) != col.Type {
+			converted, err := ConvertValue(v, col.Type)
+			if err != nil {
+				vs.Add(name, "%s", err)
+			} else {
+				v, changed = converted, true
+			}
+		}
+
+		if changed {
+			set[name] = v
+		}
+	}
+
+	return set, del
+}
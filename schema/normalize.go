@@ -3,6 +3,7 @@ package schema
 import (
 	"github.com/dvirsky/go-pylog/logging"
 
+	"strings"
 	"unicode"
 
 	"github.com/EverythingMe/meduza/errors"
@@ -126,8 +127,55 @@ func (d *DefaultTextNormalizer) NormalizeString(input string) (string, error) {
 	return d.Normalize([]byte(input))
 }
 
+// Tokenizer breaks text into a sequence of tokens (terms) for full text indexing
 type Tokenizer interface {
 	Tokenize(string) error
-	HasNext()
+	HasNext() bool
 	NextToken() string
 }
+
+// DefaultTokenizer normalizes text with a TextNormalizer, and splits it into tokens on every
+// rune that is not a letter or a digit
+type DefaultTokenizer struct {
+	normalizer TextNormalizer
+	tokens     []string
+	pos        int
+}
+
+// NewTokenizer creates a new tokenizer that normalizes text with the given normalizer before splitting it
+func NewTokenizer(normalizer TextNormalizer) *DefaultTokenizer {
+	return &DefaultTokenizer{
+		normalizer: normalizer,
+	}
+}
+
+func isTokenSeparator(r rune) bool {
+	return !unicode.IsLetter(r) && !unicode.IsDigit(r)
+}
+
+// Tokenize normalizes and splits the input, resetting the tokenizer to its first token
+func (t *DefaultTokenizer) Tokenize(input string) error {
+
+	normalized, err := t.normalizer.NormalizeString(input)
+	if err != nil {
+		return err
+	}
+
+	t.tokens = strings.FieldsFunc(normalized, isTokenSeparator)
+	t.pos = 0
+	return nil
+}
+
+// HasNext returns true if there are more tokens to read
+func (t *DefaultTokenizer) HasNext() bool {
+	return t.pos < len(t.tokens)
+}
+
+// NextToken returns the next token, or an empty string if we are out of tokens
+func (t *DefaultTokenizer) NextToken() string {
+	if !t.HasNext() {
+		return ""
+	}
+	t.pos++
+	return t.tokens[t.pos-1]
+}
@@ -8,6 +8,7 @@ import (
 	"path"
 	"path/filepath"
 	"strings"
+	"time"
 
 	"github.com/dvirsky/go-pylog/logging"
 	"github.com/EverythingMe/meduza/errors"
@@ -28,6 +29,30 @@ type Deployer interface {
 	DeployUri(uri string) error
 }
 
+// SchemaVersion describes a deployed version of a schema
+type SchemaVersion struct {
+	Schema  string    `yaml:"schema"`
+	Version int       `yaml:"version"`
+	Author  string    `yaml:"author,omitempty"`
+	Time    time.Time `yaml:"time"`
+	// The version this version rolled back to, if it was deployed by a rollback
+	RollbackOf int `yaml:"rollback_of,omitempty"`
+	// The changes from the previous version, as computed by Diff
+	Changes []string `yaml:"changes"`
+}
+
+// VersionedDeployer is a deployer that keeps every deployed version of a schema, and can roll a schema back to
+// any of them
+type VersionedDeployer interface {
+	Deployer
+	// DeployAs deploys a schema like Deploy, recording who deployed it, and returns the new version
+	DeployAs(r io.Reader, author string) (*SchemaVersion, error)
+	// History returns the versions of a schema, oldest first
+	History(name string) ([]SchemaVersion, error)
+	// Rollback deploys an old version of a schema again, as a new version
+	Rollback(name string, version int, author string) (*SchemaVersion, error)
+}
+
 // FilesProvider is a simple schema provider that reads static files in a directory, and monitors this directory
 // for changes in files. If it finds a changed file, it re-reads it and issues an update
 type FilesProvider struct {
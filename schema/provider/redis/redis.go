@@ -3,11 +3,13 @@ package redis
 
 import (
 	"bytes"
+	"fmt"
 	"io"
 	"io/ioutil"
 	"net/url"
 	"os"
 	"path"
+	"strconv"
 	"strings"
 	"time"
 
@@ -20,6 +22,24 @@ import (
 const redisKey = "__mdz_schemas__"
 const pubsubKey = "__mdz_updates__"
 
+// Every deployed version of a schema is kept in a hash of its own, numbered by a counter per schema. The current
+// version is also kept in the schemas HASH, which is what providers read
+const versionKeyPrefix = "__mdz_schema_version__"
+const historyKeyPrefix = "__mdz_schema_history__"
+
+// the number of times we retry deploying a schema that is concurrently deployed
+const maxDeployRetries = 10
+
+// versionKey returns the key of the counter of a schema's versions
+func versionKey(name string) string {
+	return fmt.Sprintf("%s:%s", versionKeyPrefix, name)
+}
+
+// historyKey returns the key of the hash a version of a schema is kept in
+func historyKey(name string, version int) string {
+	return fmt.Sprintf("%s:%s:%d", historyKeyPrefix, name, version)
+}
+
 // Provider implements a schema provider with updates, based on a redis HASH storing all schemas, and
 // a redis PUBSUB channel for updates
 type Provider struct {
@@ -187,31 +207,189 @@ func NewDeployer(net, addr string) Deployer {
 // Deploy deploys the data in reader r under the name name - if it is a valid schema.
 // If it succeeds, it publishes a message to the provider's pubsub channel
 func (d Deployer) Deploy(r io.Reader) error {
+	_, err := d.DeployAs(r, "")
+	return err
+}
+
+// DeployAs deploys a schema like Deploy, and records it as a new version of the schema by the given author
+func (d Deployer) DeployAs(r io.Reader, author string) (*schema.SchemaVersion, error) {
+
+	// read all the contents
+	b, err := ioutil.ReadAll(r)
+	if err != nil {
+		return nil, errors.NewError("Could not read schema: %s", err)
+	}
+
+	return d.deploy(b, author, 0)
+}
+
+// Rollback deploys the data of an old version of a schema again, as a new version
+func (d Deployer) Rollback(name string, version int, author string) (*schema.SchemaVersion, error) {
+
+	conn, err := redis.Dial(d.net, d.addr)
+	if err != nil {
+		return nil, errors.NewError("Could not connect to schema redis: %s", err)
+	}
+	defer conn.Close()
+
+	b, err := redis.Bytes(conn.Do("HGET", historyKey(name, version), "data"))
+	if err == redis.ErrNil {
+		return nil, errors.NewError("Schema %s has no version %d", name, version)
+	} else if err != nil {
+		return nil, errors.NewError("Could not load version %d of schema %s: %s", version, name, err)
+	}
+
+	logging.Info("Rolling schema %s back to version %d", name, version)
+	return d.deploy(b, author, version)
+}
+
+// deploy validates and saves a schema as its new version, and publishes the update.
+//
+// The changes of the version are computed against the current schema, which is watched so concurrent deploys of the
+// same schema are retried. A current schema deployed before versions were kept is recorded as the first version
+func (d Deployer) deploy(b []byte, author string, rollbackOf int) (*schema.SchemaVersion, error) {
+
+	// make sure the schema is fine before loading it
+	sc, err := schema.Load(bytes.NewReader(b))
+	if err != nil {
+		return nil, errors.NewError("Could not deploy schema - parsing error: %s", err)
+	}
 
 	// connect to redis
 	conn, err := redis.Dial(d.net, d.addr)
 	if err != nil {
-		return errors.NewError("Could not connect to schema redis: %s", err)
+		return nil, errors.NewError("Could not connect to schema redis: %s", err)
 	}
 	defer conn.Close()
 
-	// read all the contents
-	b, err := ioutil.ReadAll(r)
+	for retry := 0; retry < maxDeployRetries; retry++ {
+
+		if _, err := conn.Do("WATCH", redisKey, versionKey(sc.Name)); err != nil {
+			return nil, errors.NewError("Could not watch schema %s: %s", sc.Name, err)
+		}
+
+		last, err := redis.Int(conn.Do("GET", versionKey(sc.Name)))
+		if err != nil && err != redis.ErrNil {
+			return nil, errors.NewError("Could not get the version of schema %s: %s", sc.Name, err)
+		}
+
+		current, err := redis.Bytes(conn.Do("HGET", redisKey, sc.Name))
+		if err != nil && err != redis.ErrNil {
+			return nil, errors.NewError("Could not load schema %s from redis: %s", sc.Name, err)
+		}
+
+		prev := schema.NewSchema(sc.Name)
+		if current != nil {
+			if prev, err = schema.Load(bytes.NewReader(current)); err != nil {
+				logging.Warning("Could not parse the current version of schema %s, diffing against nothing: %s", sc.Name, err)
+				prev = schema.NewSchema(sc.Name)
+			}
+		}
+
+		// versions are kept with second precision
+		now := time.Unix(time.Now().Unix(), 0)
+
+		conn.Send("MULTI")
+
+		// the current schema was deployed before we kept versions
+		if last == 0 && current != nil {
+			last++
+			imported := &schema.SchemaVersion{Schema: sc.Name, Version: last, Time: now}
+			if err := sendVersion(conn, imported, schema.NewSchema(sc.Name), prev, current); err != nil {
+				return nil, err
+			}
+		}
+
+		ver := &schema.SchemaVersion{
+			Schema:     sc.Name,
+			Version:    last + 1,
+			Author:     author,
+			Time:       now,
+			RollbackOf: rollbackOf,
+		}
+		if err := sendVersion(conn, ver, prev, sc, b); err != nil {
+			return nil, err
+		}
+		conn.Send("SET", versionKey(sc.Name), ver.Version)
+		conn.Send("HSET", redisKey, sc.Name, b)
+
+		reply, err := conn.Do("EXEC")
+		if err != nil {
+			return nil, errors.NewError("Could not save schema in redis: %s", err)
+		} else if reply == nil {
+			logging.Info("Schema %s deployed concurrently, retrying", sc.Name)
+			continue
+		}
+
+		if _, err = conn.Do("PUBLISH", pubsubKey, sc.Name); err != nil {
+			return nil, errors.NewError("Could not publish schema update: %s", err)
+		}
+
+		logging.Info("Deployed version %d of schema %s: %s", ver.Version, sc.Name, ver.Changes)
+		return ver, nil
+	}
+
+	return nil, errors.NewError("Could not deploy schema %s, it is being deployed concurrently", sc.Name)
+}
+
+// sendVersion sends the command saving a version of a schema with its data in a transaction, computing its changes
+// from the previous version first
+func sendVersion(conn redis.Conn, ver *schema.SchemaVersion, prev, sc *schema.Schema, data []byte) error {
+
+	changes, err := prev.Diff(sc)
 	if err != nil {
-		return errors.NewError("Could not read schema: %s", err)
+		return errors.NewError("Could not compare schema %s to its previous version: %s", sc.Name, err)
 	}
-	var sc *schema.Schema
-	// make sure the schema is fine before loading it
-	if sc, err = schema.Load(bytes.NewReader(b)); err != nil {
-		return errors.NewError("Could not deploy schema - parsing error: %s", err)
+
+	ver.Changes = make([]string, len(changes))
+	for i, ch := range changes {
+		ver.Changes[i] = fmt.Sprint(ch)
 	}
 
-	if _, err = conn.Do("HSET", redisKey, sc.Name, b); err != nil {
-		return errors.NewError("Could not save schema in redis: %s", err)
+	return conn.Send("HMSET", historyKey(ver.Schema, ver.Version), "author", ver.Author, "time", ver.Time.Unix(),
+		"rollback_of", ver.RollbackOf, "changes", strings.Join(ver.Changes, "\n"), "data", data)
+}
+
+// History returns all the recorded versions of a schema, oldest first
+func (d Deployer) History(name string) ([]schema.SchemaVersion, error) {
+
+	conn, err := redis.Dial(d.net, d.addr)
+	if err != nil {
+		return nil, errors.NewError("Could not connect to schema redis: %s", err)
 	}
+	defer conn.Close()
 
-	_, err = conn.Do("PUBLISH", pubsubKey, sc.Name)
-	return err
+	last, err := redis.Int(conn.Do("GET", versionKey(name)))
+	if err != nil && err != redis.ErrNil {
+		return nil, errors.NewError("Could not get the version of schema %s: %s", name, err)
+	}
+
+	for v := 1; v <= last; v++ {
+		conn.Send("HMGET", historyKey(name, v), "author", "time", "rollback_of", "changes")
+	}
+	if err := conn.Flush(); err != nil {
+		return nil, errors.NewError("Could not load the history of schema %s: %s", name, err)
+	}
+
+	ret := make([]schema.SchemaVersion, 0, last)
+	for v := 1; v <= last; v++ {
+		vals, err := redis.Strings(conn.Receive())
+		if err != nil {
+			return nil, errors.NewError("Could not load version %d of schema %s: %s", v, name, err)
+		}
+
+		ver := schema.SchemaVersion{Schema: name, Version: v, Author: vals[0], Changes: []string{}}
+		if ts, err := strconv.ParseInt(vals[1], 10, 64); err == nil {
+			ver.Time = time.Unix(ts, 0)
+		}
+		ver.RollbackOf, _ = strconv.Atoi(vals[2])
+		if vals[3] != "" {
+			ver.Changes = strings.Split(vals[3], "\n")
+		}
+		ret = append(ret, ver)
+	}
+
+	return ret, nil
 }
 
 // DeployUri wraps Deploy with a URI of a schema file, reads it and loads it.
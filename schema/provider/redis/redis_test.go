@@ -0,0 +1,90 @@
+package redis
+
+import (
+	"fmt"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/EverythingMe/disposable-redis"
+	"github.com/garyburd/redigo/redis"
+	"github.com/stretchr/testify/assert"
+)
+
+const historySchema = `
+schema: history
+tables:
+    Users:
+        engines: 
+            - redis
+        columns:
+            name: 
+                type: Text
+            score:
+                type: %s
+        indexes:
+            -   type: simple
+                columns: [name]
+`
+
+func TestHistory(t *testing.T) {
+
+	srv, err := disposable_redis.NewServerRandomPort()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer srv.Stop()
+	if err := srv.WaitReady(200 * time.Millisecond); err != nil {
+		t.Fatal(err)
+	}
+
+	conn, err := redis.Dial("tcp", srv.Addr())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+
+	// a schema deployed before versions were kept
+	if _, err := conn.Do("HSET", redisKey, "history", fmt.Sprintf(historySchema, "Int")); err != nil {
+		t.Fatal(err)
+	}
+
+	d := NewDeployer("tcp", srv.Addr())
+	ver, err := d.DeployAs(strings.NewReader(fmt.Sprintf(historySchema, "Float")), "alice")
+	if err != nil {
+		t.Fatal(err)
+	}
+	assert.Equal(t, 2, ver.Version)
+	assert.Equal(t, "alice", ver.Author)
+	assert.Equal(t, []string{"column history.Users.score altered (Int => Float)"}, ver.Changes)
+
+	history, err := d.History("history")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if assert.Len(t, history, 2) {
+		assert.Equal(t, []string{"table history.Users added"}, history[0].Changes)
+		assert.Equal(t, "", history[0].Author)
+		assert.Equal(t, *ver, history[1])
+	}
+
+	// rolling back deploys the old version again as a new one
+	ver, err = d.Rollback("history", 1, "bob")
+	if err != nil {
+		t.Fatal(err)
+	}
+	assert.Equal(t, 3, ver.Version)
+	assert.Equal(t, 1, ver.RollbackOf)
+	assert.Equal(t, []string{"column history.Users.score altered (Float => Int)"}, ver.Changes)
+
+	current, err := redis.String(conn.Do("HGET", redisKey, "history"))
+	assert.NoError(t, err)
+	assert.Equal(t, fmt.Sprintf(historySchema, "Int"), current)
+
+	history, err = d.History("history")
+	assert.NoError(t, err)
+	assert.Len(t, history, 3)
+
+	_, err = d.Rollback("history", 10, "bob")
+	assert.Error(t, err)
+}
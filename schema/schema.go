@@ -28,6 +28,8 @@ func (k Key) IsNull() bool {
 
 const (
 	IdKey = "id"
+	// VersionKey is the reserved property holding an entity's version, incremented on every write
+	VersionKey = "_version"
 
 	// Index type specds
 	SimpleIndex   IndexType = "simple"
@@ -64,8 +66,25 @@ const (
 	IndexReady   IndexState = 1
 	IndexPending IndexState = 2
 	IndexGarbage IndexState = 3
+	// unique indexes whose backfill found entities with the same values
+	IndexFailed IndexState = 4
 )
 
+// String returns the name of the index state
+func (s IndexState) String() string {
+	switch s {
+	case IndexReady:
+		return "ready"
+	case IndexPending:
+		return "pending"
+	case IndexGarbage:
+		return "garbage"
+	case IndexFailed:
+		return "failed"
+	}
+	return "unknown"
+}
+
 // Column describes a column in a table, if we are talking about a strict schema
 type Column struct {
 	Name       string                 `yaml:"name"`
@@ -74,6 +93,9 @@ type Column struct {
 	Default    interface{}            `yaml:"default,omitempty"`
 	Comment    string                 `yaml:"comment,omitempty"`
 	Options    map[string]interface{} `yaml:"options,omitempty"`
+	// The previous name of a renamed column. Stored entities have their values of the old name moved to the new one
+	// when the table is migrated
+	RenamedFrom string `yaml:"renamedFrom,omitempty"`
 	// Admin Options
 	AdminOptions struct {
 		// If true - we do not show this column in forms
@@ -231,6 +253,15 @@ func (t *Table) Validate() error {
 
 	}
 
+	for _, col := range t.Columns {
+		if col.RenamedFrom == "" {
+			continue
+		}
+		if _, found := t.Columns[col.RenamedFrom]; found {
+			return errors.NewError("Column %s of table %s is renamed from %s, which is still a column", col.Name, t.Name, col.RenamedFrom)
+		}
+	}
+
 	// validate all indexes
 	for _, idx := range t.Indexes {
 		if err := idx.Validate(t); err != nil {
@@ -359,8 +390,16 @@ const (
 	OptSubType  = "subtype"
 	OptRequired = "required"
 	OptMaxLen   = "max_len"
+	OptUnique   = "unique"
 )
 
+// Unique tells us whether no two entities may have the same values of the index's columns.
+// Only simple and compound indexes can be unique
+func (i Index) Unique() bool {
+	b, _ := i.ExtraParams[OptUnique].(bool)
+	return b
+}
+
 func (i Index) Equals(other *Index) bool {
 	return i.Name == other.Name && other.Type == i.Type
 }
@@ -397,6 +436,10 @@ func (i *Index) Validate(t *Table) error {
 		}
 	}
 
+	if i.Unique() && i.Type != SimpleIndex && i.Type != CompoundIndex {
+		return errors.NewError("Index %s cannot be unique, only simple and compound indexes can", i.Name)
+	}
+
 	return nil
 
 }
@@ -463,9 +506,12 @@ type ColumnAddedChange struct {
 	Column *Column
 }
 
+// ColumnAlterChange is a change of a column's definition, or a rename of a column to a column with a renamedFrom
+// of its name. Column is the new definition and From is the previous one
 type ColumnAlterChange struct {
 	SchemaChange
 	Column *Column
+	From   *Column
 }
 
 type ColumnDeletedChange struct {
@@ -483,6 +529,40 @@ type IndexRemovedChange struct {
 	Index *Index
 }
 
+func (c TableAddedChange) String() string {
+	return fmt.Sprintf("table %s added", c.Table.Name)
+}
+
+func (c TableDeletedChange) String() string {
+	return fmt.Sprintf("table %s deleted", c.Table.Name)
+}
+
+func (c ColumnAddedChange) String() string {
+	return fmt.Sprintf("column %s.%s added (%s)", c.Table.Name, c.Column.Name, c.Column.Type)
+}
+
+func (c ColumnAlterChange) String() string {
+	if c.From != nil && c.From.Name != c.Column.Name {
+		return fmt.Sprintf("column %s.%s renamed to %s (%s => %s)", c.Table.Name, c.From.Name, c.Column.Name,
+			c.From.Type, c.Column.Type)
+	} else if c.From != nil {
+		return fmt.Sprintf("column %s.%s altered (%s => %s)", c.Table.Name, c.Column.Name, c.From.Type, c.Column.Type)
+	}
+	return fmt.Sprintf("column %s.%s altered", c.Table.Name, c.Column.Name)
+}
+
+func (c ColumnDeletedChange) String() string {
+	return fmt.Sprintf("column %s.%s deleted", c.Table.Name, c.Column.Name)
+}
+
+func (c IndexAddedChange) String() string {
+	return fmt.Sprintf("index %s added", c.Index.Name)
+}
+
+func (c IndexRemovedChange) String() string {
+	return fmt.Sprintf("index %s removed", c.Index.Name)
+}
+
 func (sc *Schema) Diff(other *Schema) ([]interface{}, error) {
 
 	ret := make([]interface{}, 0)
@@ -506,9 +586,26 @@ func (sc *Schema) Diff(other *Schema) ([]interface{}, error) {
 			continue
 		} else {
 
+			// columns of the other table renamed from columns of this table, by their old names
+			renamed := make(map[string]*Column)
+			for _, otherCol := range otherTbl.Columns {
+				if otherCol.RenamedFrom == "" {
+					continue
+				}
+				if _, found := tbl.Columns[otherCol.RenamedFrom]; found {
+					renamed[otherCol.RenamedFrom] = otherCol
+				}
+			}
+
 			// if found - check for column changes
 			for name, col := range tbl.Columns {
 
+				if otherCol, found := renamed[name]; found {
+					logging.Info("Column %s.%s renamed to %s", tbl.Name, name, otherCol.Name)
+					ret = append(ret, ColumnAlterChange{SchemaChange{tbl}, otherCol, col})
+					continue
+				}
+
 				// check for missing columns in other
 				if otherCol, found := otherTbl.Columns[name]; !found {
 					logging.Info("Column %s not in other table %s", name, otherTbl.Name)
@@ -519,7 +616,7 @@ func (sc *Schema) Diff(other *Schema) ([]interface{}, error) {
 					// check for column definition change
 					if !col.Equals(otherCol) {
 						logging.Info("Change in defintion of column %s.%s", tbl.Name, col.Name)
-						ret = append(ret, ColumnAlterChange{SchemaChange{tbl}, otherCol})
+						ret = append(ret, ColumnAlterChange{SchemaChange{tbl}, otherCol, col})
 
 					}
 				}
@@ -528,7 +625,7 @@ func (sc *Schema) Diff(other *Schema) ([]interface{}, error) {
 
 			// Check back for missing columns in the current table
 			for name, col := range otherTbl.Columns {
-				if _, found := tbl.Columns[name]; !found {
+				if _, found := tbl.Columns[name]; !found && renamed[col.RenamedFrom] != col {
 					logging.Info("Column %s.%s does not exist in original table", tbl.Name, col.Name)
 					ret = append(ret, ColumnAddedChange{SchemaChange{tbl}, col})
 				}
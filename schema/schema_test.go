@@ -2,6 +2,7 @@ package schema
 
 import (
 	"fmt"
+	"math"
 	"reflect"
 	"strings"
 	"testing"
@@ -195,6 +196,33 @@ func TestNormalization(t *testing.T) {
 
 }
 
+func TestTokenizer(t *testing.T) {
+	tokenizer := NewTokenizer(NewNormalizer(language.Und, true, true))
+
+	if err := tokenizer.Tokenize("Hello, Café - WORLD!... hello"); err != nil {
+		t.Fatal(err)
+	}
+
+	expected := []string{"hello", "cafe", "world", "hello"}
+	tokens := []string{}
+	for tokenizer.HasNext() {
+		tokens = append(tokens, tokenizer.NextToken())
+	}
+
+	if len(tokens) != len(expected) {
+		t.Fatalf("Wrong tokens: %v", tokens)
+	}
+	for i := range expected {
+		if tokens[i] != expected[i] {
+			t.Errorf("Wrong token at %d: %s", i, tokens[i])
+		}
+	}
+
+	if tokenizer.NextToken() != "" {
+		t.Error("Exhausted tokenizer returned a token")
+	}
+}
+
 func TestSet(t *testing.T) {
 	s := NewSet("foo", "bar", "baz")
 
@@ -322,3 +350,239 @@ func TestMap(t *testing.T) {
 	}
 
 }
+
+var strictSchema = `
+schema: strict
+tables:
+    accounts:
+        engines: 
+            - redis
+        strict: true
+        columns:
+            email: 
+                type: Text
+                options: 
+                    required: true
+                    max_len: 10
+            score:
+                type: Float
+                default: 0
+            plan:
+                type: Text
+                default: free
+            created:
+                type: Timestamp
+                default: $now
+`
+
+func TestStrictTable(t *testing.T) {
+
+	sc, err := Load(strings.NewReader(strictSchema))
+	if err != nil {
+		t.Fatal(err)
+	}
+	tbl := sc.Tables["accounts"]
+	if !tbl.Strict {
+		t.Fatal("Table should be strict")
+	}
+
+	// inserts get the defaults
+	ent := NewEntity("", NewText("email", "a@b.c"))
+	if err := tbl.ValidateEntity(ent, true); err != nil {
+		t.Fatal(err)
+	}
+	if ent.Properties["score"] != Float(0) || ent.Properties["plan"] != Text("free") {
+		t.Errorf("Defaults not set: %v", ent.Properties)
+	}
+	if _, ok := ent.Properties["created"].(Timestamp); !ok {
+		t.Errorf("$now default not set: %v", ent.Properties["created"])
+	}
+
+	// updates don't
+	ent = NewEntity("foo", NewText("email", "a@b.c"))
+	if err := tbl.ValidateEntity(ent, false); err != nil {
+		t.Fatal(err)
+	}
+	if len(ent.Properties) != 1 {
+		t.Errorf("Defaults set on update: %v", ent.Properties)
+	}
+
+	// all the violations are listed
+	ent = NewEntity("", NewText("email", "way.too.long@b.c"), NewInt("score", 3), NewText("foo", "bar"))
+	err = tbl.ValidateEntity(ent, true)
+	if err == nil {
+		t.Fatal("Invalid entity accepted")
+	}
+	for _, prop := range []string{"email: length", "score: expected Float, got Int", "foo: unknown property"} {
+		if !strings.Contains(err.Error(), prop) {
+			t.Errorf("Violation %s not in %s", prop, err)
+		}
+	}
+
+	ent = NewEntity("foo", NewText("plan", "pro"))
+	if err := tbl.ValidateEntity(ent, false); err == nil || !strings.Contains(err.Error(), "email: required") {
+		t.Errorf("Missing required property accepted: %v", err)
+	}
+
+	// setting a required column to nil violates it too, but only once
+	ent = NewEntity("foo").Set("email", nil)
+	if err := tbl.ValidateEntity(ent, false); err == nil || strings.Count(err.Error(), "email: required") != 1 {
+		t.Errorf("Nil required property accepted: %v", err)
+	}
+	vs := Violations{}
+	tbl.CheckValue("email", nil, &vs)
+	if vs.Err(tbl.Name) == nil {
+		t.Error("Nil value of a required column accepted")
+	}
+
+	// tables that are not strict accept anything
+	ent = NewEntity("", NewText("foo", "bar"))
+	if err := NewTable("strict.other", false).ValidateEntity(ent, true); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestUniqueIndex(t *testing.T) {
+
+	tbl := NewTable("unique.users", false)
+	tbl.AddColumn("email", TextType, nil, "")
+	tbl.AddColumn("score", IntType, nil, "")
+
+	idx := &Index{Columns: []string{"email"}, Type: SimpleIndex, ExtraParams: map[string]interface{}{OptUnique: true}}
+	if !idx.Unique() {
+		t.Error("Index should be unique")
+	}
+	if err := idx.Validate(tbl); err != nil {
+		t.Error(err)
+	}
+
+	idx = &Index{Columns: []string{"score"}, Type: SortedIndex, ExtraParams: map[string]interface{}{OptUnique: true}}
+	if err := idx.Validate(tbl); err == nil {
+		t.Error("Sorted indexes cannot be unique")
+	}
+
+	idx = &Index{Columns: []string{"score"}, Type: SimpleIndex}
+	if idx.Unique() {
+		t.Error("Index should not be unique")
+	}
+}
+
+var migrationSchema = `
+schema: migration
+tables:
+    users:
+        engines: 
+            - redis
+        columns:
+            name: 
+                type: Text
+            score:
+                type: Int
+`
+
+var migrationSchema2 = `
+schema: migration
+tables:
+    users:
+        engines: 
+            - redis
+        columns:
+            fullName: 
+                type: Text
+                renamedFrom: name
+            score:
+                type: Float
+`
+
+func TestMigration(t *testing.T) {
+
+	sc, err := Load(strings.NewReader(migrationSchema))
+	if err != nil {
+		t.Fatal(err)
+	}
+	sc2, err := Load(strings.NewReader(migrationSchema2))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// renames are alter changes, not a deletion and an addition
+	diff, err := sc.Diff(sc2)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(diff) != 2 {
+		t.Fatalf("Expected 2 changes, got %v", diff)
+	}
+	for _, change := range diff {
+		ch, ok := change.(ColumnAlterChange)
+		if !ok {
+			t.Fatal("Wrong change: ", reflect.TypeOf(change))
+		}
+		switch ch.Column.Name {
+		case "fullName":
+			if ch.From.Name != "name" {
+				t.Error("Wrong rename: ", ch.From.Name)
+			}
+		case "score":
+			if ch.From.Type != IntType || ch.Column.Type != FloatType {
+				t.Error("Wrong alter: ", ch.From.Type, ch.Column.Type)
+			}
+		default:
+			t.Error("Wrong column altered: ", ch.Column.Name)
+		}
+	}
+
+	tbl := sc2.Tables["users"]
+
+	vs := Violations{}
+	set, del := tbl.MigrateProperties(PropertyMap{"name": Text("foo"), "score": Int(3)}, &vs)
+	if len(vs) != 0 {
+		t.Error(vs)
+	}
+	if !reflect.DeepEqual(set, PropertyMap{"fullName": Text("foo"), "score": Float(3)}) || !reflect.DeepEqual(del, []string{"name"}) {
+		t.Errorf("Wrong migration: %v %v", set, del)
+	}
+
+	// migrated entities need no more changes
+	set, del = tbl.MigrateProperties(PropertyMap{"fullName": Text("foo"), "score": Float(3)}, &vs)
+	if len(set) != 0 || len(del) != 0 {
+		t.Errorf("Migrated entity migrated again: %v %v", set, del)
+	}
+
+	// values that cannot be converted are left as they are
+	set, _ = tbl.MigrateProperties(PropertyMap{"score": Text("lots")}, &vs)
+	if len(set) != 0 || len(vs) != 1 || !strings.HasPrefix(vs[0], "score: Cannot convert") {
+		t.Errorf("Unconvertible value migrated: %v %v", set, vs)
+	}
+
+	for _, c := range []struct {
+		v        interface{}
+		tp       ColumnType
+		expected interface{}
+	}{
+		{Int(3), FloatType, Float(3)},
+		{Float(3), IntType, Int(3)},
+		{Float(3.5), IntType, nil},
+		{Uint(math.MaxInt64), IntType, Int(math.MaxInt64)},
+		{Uint(math.MaxInt64 + 1), IntType, nil},
+		{Float(1e19), IntType, nil},
+		{Int(42), TextType, Text("42")},
+		{Float(1.5), TextType, Text("1.5")},
+		{Text(" 17 "), IntType, Int(17)},
+		{Text("true"), BoolType, Bool(true)},
+		{Int(0), BoolType, Bool(false)},
+		{Int(1000), TimestampType, Timestamp(time.Unix(1000, 0))},
+		{Timestamp(time.Unix(1000, 0)), IntType, Int(1000)},
+		{NewList(Text("a")), SetType, NewSet(Text("a"))},
+		{Bool(true), SetType, nil},
+	} {
+		v, err := ConvertValue(c.v, c.tp)
+		if c.expected == nil {
+			if err == nil {
+				t.Errorf("%v converted to %s: %v", c.v, c.tp, v)
+			}
+		} else if err != nil || !reflect.DeepEqual(v, c.expected) {
+			t.Errorf("Wrong conversion of %v to %s: %v, %v", c.v, c.tp, v, err)
+		}
+	}
+}
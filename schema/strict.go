@@ -0,0 +1,166 @@
+package schema
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+	"time"
+	"unicode/utf8"
+
+	"github.com/EverythingMe/meduza/errors"
+)
+
+// Strict tables have the entities written to them validated by the server against their columns, so clients in
+// different languages don't have to validate them identically. Tables that are not strict accept any entity
+
+// Violations lists the properties of a write that violate the schema of a strict table, and why
+type Violations []string
+
+// Add adds a violation of a property to the list
+func (v *Violations) Add(prop string, format string, args ...interface{}) {
+	*v = append(*v, fmt.Sprintf("%s: %s", prop, fmt.Sprintf(format, args...)))
+}
+
+// Err returns an error listing all the violations, or nil if there are none
+func (v Violations) Err(table string) error {
+	if len(v) == 0 {
+		return nil
+	}
+	return errors.NewError("Schema violation in strict table %s: %s", table, strings.Join(v, "; "))
+}
+
+// Required tells us whether the column must be set in every entity written to a strict table
+func (c Column) Required() bool {
+	b, _ := c.BoolOption(OptRequired)
+	return b
+}
+
+// DefaultValue returns the column's default value converted to the column's type. The default "$now" of
+// Timestamp columns is the current time
+func (c Column) DefaultValue() (interface{}, error) {
+
+	if s, ok := c.Default.(string); ok && s == "$now" && c.Type == TimestampType {
+		return Timestamp(time.Now()), nil
+	}
+
+	v, err := InternalType(c.Default)
+	if err != nil {
+		return nil, errors.NewError("Invalid default for column %s: %s", c.Name, err)
+	}
+
+	// YAML has no way to tell floats from round numbers, or sets from lists
+	switch val := v.(type) {
+	case Int:
+		if c.Type == FloatType {
+			v = Float(val)
+		}
+	case List:
+		if c.Type == SetType {
+			v = NewSet(val...)
+		}
+	}
+
+	if TypeOf(v) != c.Type {
+		return nil, errors.NewError("Default %v of column %s is not a %s", c.Default, c.Name, c.Type)
+	}
+	return v, nil
+}
+
+// CheckValue checks a value written to a property of a strict table, adding any violation to vs: the property must
+// be a column of the table, the value must be of the column's type, and texts must not exceed the column's max_len.
+// A nil value is valid unless the column is required
+func (t *Table) CheckValue(prop string, value interface{}, vs *Violations) {
+
+	col, found := t.Columns[prop]
+	if !found {
+		vs.Add(prop, "unknown property")
+		return
+	}
+
+	if value == nil {
+		if col.Required() {
+			vs.Add(prop, "required")
+		}
+		return
+	}
+
+	v, err := InternalType(value)
+	if err != nil {
+		vs.Add(prop, "%s", err)
+		return
+	}
+
+	if tp := TypeOf(v); tp != col.Type {
+		vs.Add(prop, "expected %s, got %s", col.Type, typeName(v))
+		return
+	}
+
+	if max, found := col.IntOption(OptMaxLen); found && col.Type == TextType {
+		if n := utf8.RuneCountInString(string(v.(Text))); n > max {
+			vs.Add(prop, "length %d exceeds max_len %d", n, max)
+		}
+	}
+}
+
+// ValidateEntity validates an entity written to a strict table: all its properties must be valid values of the
+// table's columns (see CheckValue), and all the required columns must be set. When the entity is inserted, the
+// defaults of the columns missing from it are set first.
+//
+// The returned error lists every violating property. Entities of tables that are not strict are always valid
+func (t *Table) ValidateEntity(e *Entity, insert bool) error {
+
+	if !t.Strict {
+		return nil
+	}
+
+	if e.Properties == nil {
+		e.Properties = make(PropertyMap)
+	}
+
+	columns := make([]string, 0, len(t.Columns))
+	for name := range t.Columns {
+		columns = append(columns, name)
+	}
+	sort.Strings(columns)
+
+	if insert {
+		for _, name := range columns {
+			col := t.Columns[name]
+			if _, found := e.Properties[name]; !found && col.HasDefault() {
+				v, err := col.DefaultValue()
+				if err != nil {
+					return err
+				}
+				e.Properties[name] = v
+			}
+		}
+	}
+
+	props := make([]string, 0, len(e.Properties))
+	for name := range e.Properties {
+		props = append(props, name)
+	}
+	sort.Strings(props)
+
+	vs := Violations{}
+	for _, name := range props {
+		t.CheckValue(name, e.Properties[name], &vs)
+	}
+
+	// required columns set to nil are reported by CheckValue
+	for _, name := range columns {
+		if _, found := e.Properties[name]; t.Columns[name].Required() && !found {
+			vs.Add(name, "required")
+		}
+	}
+
+	return vs.Err(t.Name)
+}
+
+// typeName returns the ColumnType of an internal value for violation messages, or its Go type if it has none
+func typeName(v interface{}) string {
+	if tp := TypeOf(v); tp != UnknownType {
+		return string(tp)
+	}
+	return fmt.Sprintf("%T", v)
+}
@@ -97,3 +97,66 @@ func TestClientServer(t *testing.T) {
 
 	fmt.Println(res)
 }
+
+func TestMultiGet(t *testing.T) {
+
+	srv := NewServer(mock.MockDriver{}, bson.BsonProtocol{})
+
+	q := query.NewMultiGetQuery().
+		Add(query.NewGetQuery("Users").FilterEq("id", "foo")).
+		Add(query.NewGetQuery("Apps").FilterEq("id", "bar")).
+		Add(query.NewGetQuery("Places").FilterEq("id", "baz"))
+
+	res, ok := srv.handleQuery(*q).(*query.MultiGetResponse)
+	if !ok {
+		t.Fatalf("Wrong response type: %s", reflect.TypeOf(res))
+	}
+	if res.Err() != nil {
+		t.Fatal(res.Err())
+	}
+	if len(res.Responses) != 3 {
+		t.Fatalf("Expected 3 responses, got %d", len(res.Responses))
+	}
+	for i, r := range res.Responses {
+		if r.Response == nil || r.Err() != nil || len(r.Entities) != 1 {
+			t.Errorf("Invalid response %d: %v", i, r)
+		}
+	}
+
+	if res, ok := srv.handleQuery(*query.NewMultiGetQuery()).(*query.MultiGetResponse); !ok || res.Err() == nil {
+		t.Error("Expected an error for an empty MULTIGET")
+	}
+
+	// a panic in one GET fails only that GET, even with more queries than workers
+	srv = NewServer(panicDriver{}, bson.BsonProtocol{})
+	q = query.NewMultiGetQuery()
+	for i := 0; i < 3*multiGetWorkers; i++ {
+		table := "Users"
+		if i == multiGetWorkers {
+			table = "Panic"
+		}
+		q.Add(query.NewGetQuery(table).FilterEq("id", "foo"))
+	}
+
+	res = srv.handleQuery(*q).(*query.MultiGetResponse)
+	if res.Err() != nil {
+		t.Fatal(res.Err())
+	}
+	for i, r := range res.Responses {
+		if failed := r.Err() != nil; failed != (i == multiGetWorkers) {
+			t.Errorf("Unexpected response %d: %v", i, r)
+		}
+	}
+}
+
+// panicDriver is a mock driver that panics on GET queries of the Panic table
+type panicDriver struct {
+	mock.MockDriver
+}
+
+func (d panicDriver) Get(q query.GetQuery) *query.GetResponse {
+	if q.Table == "Panic" {
+		panic("GET from the Panic table")
+	}
+	return d.MockDriver.Get(q)
+}
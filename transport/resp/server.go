@@ -6,6 +6,7 @@ import (
 	"net"
 	"reflect"
 	"runtime/debug"
+	"sync"
 
 	"github.com/dvirsky/go-pylog/logging"
 	"gitlab.doit9.com/backend/instrument"
@@ -156,7 +157,81 @@ func (r *Server) handleQuery(qu interface{}) query.QueryResult {
 			return query.NewDelResponse(err, 0)
 		}
 		return r.driver.Delete(q)
+	case query.ExplainQuery:
+		if err := q.Validate(); err != nil {
+			logging.Error("Error validating EXPLAIN query: %s", err)
+			return query.NewExplainResponse(err)
+		}
+		return r.driver.Explain(q)
+	case query.CountQuery:
+		if err := q.Validate(); err != nil {
+			logging.Error("Error validating COUNT query: %s", err)
+			return query.NewCountResponse(err, 0)
+		}
+		return r.driver.Count(q)
+	case query.MultiGetQuery:
+		if err := q.Validate(); err != nil {
+			logging.Error("Error validating MULTIGET query: %s", err)
+			return query.NewMultiGetResponse(err, 0)
+		}
+		return r.multiGet(q)
+	case query.TxQuery:
+		if err := q.Validate(); err != nil {
+			logging.Error("Error validating TX query: %s", err)
+			return query.NewTxResponse(err)
+		}
+		return r.driver.Transaction(q)
 	default:
 		return query.NewResponse(errors.NewError("Invalid query type object %s", reflect.TypeOf(q)))
 	}
 }
+
+// multiGetWorkers is the maximal number of GET queries of a single MULTIGET query executed concurrently
+const multiGetWorkers = 8
+
+// multiGet runs the GET queries of a MULTIGET query concurrently against the driver, and collects their responses
+func (r *Server) multiGet(q query.MultiGetQuery) *query.MultiGetResponse {
+
+	ret := query.NewMultiGetResponse(nil, len(q.Queries))
+	defer ret.Done()
+
+	workers := multiGetWorkers
+	if len(q.Queries) < workers {
+		workers = len(q.Queries)
+	}
+
+	next := make(chan int)
+	var wg sync.WaitGroup
+	for w := 0; w < workers; w++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for i := range next {
+				ret.Responses[i] = *r.get(q.Queries[i])
+			}
+		}()
+	}
+
+	for i := range q.Queries {
+		next <- i
+	}
+	close(next)
+	wg.Wait()
+
+	return ret
+}
+
+// get runs a single GET query of a MULTIGET query. If the driver panics, the panic is returned as the error of this
+// query alone, as it does not run on the connection's goroutine
+func (r *Server) get(q query.GetQuery) (res *query.GetResponse) {
+
+	defer func() {
+		if err := recover(); err != nil {
+			logging.Error("PANIC handling GET query %s: %s. Stack: %s", q, err, string(debug.Stack()))
+			instrument.Increment("handler_panic", 1)
+			res = query.NewGetResponse(errors.NewError("Error handling GET query: %v", err))
+		}
+	}()
+
+	return r.driver.Get(q)
+}
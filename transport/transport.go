@@ -11,12 +11,24 @@ const (
 	GetMessage         MessageType = "GET"
 	GetResponseMessage MessageType = "RGET"
 
+	MultiGetMessage         MessageType = "MULTIGET"
+	MultiGetResponseMessage MessageType = "RMULTIGET"
+
 	PutMessage         MessageType = "PUT"
 	PutResponseMessage MessageType = "RPUT"
 
 	DelMessage         MessageType = "DEL"
 	DelResponseMessage MessageType = "RDEL"
 
+	ExplainMessage         MessageType = "EXPLAIN"
+	ExplainResponseMessage MessageType = "REXPLAIN"
+
+	CountMessage         MessageType = "COUNT"
+	CountResponseMessage MessageType = "RCOUNT"
+
+	TxMessage         MessageType = "TX"
+	TxResponseMessage MessageType = "RTX"
+
 	PingMessage         MessageType = "PING"
 	PingResponseMessage MessageType = "PONG"
 )